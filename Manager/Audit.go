@@ -0,0 +1,249 @@
+package Manager
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	AuditMissing          = "missing"
+	AuditSizeMismatch     = "size-mismatch"
+	AuditChecksumMismatch = "checksum-mismatch"
+	AuditPartial          = "partial"
+	AuditOrphaned         = "orphaned"
+	AuditUnrestorable     = "unrestorable"
+)
+
+type AuditProblem struct {
+	Kind   string `json:"kind"`
+	Key    string `json:"key"`
+	Detail string `json:"detail"`
+}
+
+// AuditReport is the result of comparing the local backups with one destination
+type AuditReport struct {
+	Destination string         `json:"destination"`
+	Objects     int            `json:"objects"`
+	Backups     int            `json:"backups"`
+	Chains      int            `json:"chains"`
+	Problems    []AuditProblem `json:"problems"`
+}
+
+func (r *AuditReport) add(kind string, key string, detail string) {
+	r.Problems = append(r.Problems, AuditProblem{Kind: kind, Key: key, Detail: detail})
+}
+
+// LocalBackups returns the backup directories below the target directory in chain order, full/ first
+func LocalBackups(targetDirectory string) []string {
+	backups := make([]string, 0)
+
+	if _, err := os.Stat(filepath.Join(targetDirectory, "full")); err == nil {
+		backups = append(backups, filepath.Join(targetDirectory, "full"))
+	}
+
+	incrementals, _ := filepath.Glob(filepath.Join(targetDirectory, "incr", "*"))
+
+	sort.Slice(incrementals, func(i, j int) bool {
+		a, _ := strconv.Atoi(filepath.Base(incrementals[i]))
+		b, _ := strconv.Atoi(filepath.Base(incrementals[j]))
+		return a < b
+	})
+
+	return append(backups, incrementals...)
+}
+
+// Audit compares the local backups below targetDirectory with what the destination holds. It
+// reports local files that are missing remotely or differ in size, and with checksums also the
+// files whose SHA-256 differs from the one recorded at upload time. Remotely it reports partial
+// backups, objects that belong to no backup and backups or local chains that cannot be restored
+// from the destination alone.
+func Audit(destination Destination, targetDirectory string, checksums bool) (*AuditReport, error) {
+	report := &AuditReport{Destination: destination.Name(), Problems: make([]AuditProblem, 0)}
+
+	objects, err := destination.List(GenerateHostPrefix())
+
+	if err != nil {
+		return nil, err
+	}
+
+	backups, err := ReadCatalog(destination)
+
+	if err != nil {
+		return nil, err
+	}
+
+	report.Objects = len(objects)
+	report.Backups = len(backups)
+
+	byPrefix := make(map[string]*RemoteBackup)
+	byId := make(map[string]*RemoteBackup)
+
+	for _, backup := range backups {
+		byPrefix[backup.Prefix] = backup
+		byId[backup.Id] = backup
+
+		if !backup.Complete() {
+			missing := make([]string, 0)
+
+			for _, file := range requiredBackupFiles {
+				if _, ok := backup.Objects[file]; !ok {
+					missing = append(missing, file)
+				}
+			}
+
+			report.add(AuditPartial, backup.Prefix, "backup "+backup.Id+" is missing "+strings.Join(missing, ", "))
+		}
+	}
+
+	known := make(map[string]bool)
+	for _, file := range backupFiles {
+		known[file] = true
+	}
+
+	//objects of backups that could not be read, most likely an upload that never finished
+	unreadable := make(map[string][]string)
+
+	for _, object := range objects {
+		prefix := path.Dir(object.Key)
+
+		if isBinlogArchiveKey(object.Key) {
+			continue
+		}
+
+		if !known[path.Base(object.Key)] {
+			report.add(AuditOrphaned, object.Key, "not a backup file")
+		} else if _, ok := byPrefix[prefix]; !ok {
+			unreadable[prefix] = append(unreadable[prefix], path.Base(object.Key))
+		}
+	}
+
+	for prefix, files := range unreadable {
+		sort.Strings(files)
+		report.add(AuditPartial, prefix, "backup without readable backup.gz.enc and metadata, only "+strings.Join(files, ", ")+" exist")
+	}
+
+	chains := BuildChains(backups)
+	report.Chains = len(chains)
+	chained := make(map[string]bool)
+
+	for _, chain := range chains {
+		for _, backup := range chain {
+			chained[backup.Id] = true
+		}
+	}
+
+	for _, backup := range backups {
+		if backup.Complete() && !chained[backup.Id] {
+			report.add(AuditUnrestorable, backup.Prefix, fmt.Sprintf("incremental %v from LSN %v does not continue any chain", backup.Id, backup.FromLSN))
+		}
+	}
+
+	localChain := make([]string, 0)
+
+	for _, directory := range LocalBackups(targetDirectory) {
+		manifest, err := LoadManifest(directory)
+
+		if err != nil {
+			continue
+		}
+
+		localChain = append(localChain, manifest.Id)
+		auditLocalBackup(report, destination, directory, manifest.Id, byId[manifest.Id], checksums)
+	}
+
+	if len(localChain) > 0 && !remoteChainMatches(chains, localChain) {
+		report.add(AuditUnrestorable, targetDirectory, fmt.Sprintf("local chain %v cannot be restored from %v alone", strings.Join(localChain, ", "), destination.Name()))
+	}
+
+	return report, nil
+}
+
+func auditLocalBackup(report *AuditReport, destination Destination, directory string, id string, remote *RemoteBackup, checksums bool) {
+	replicated := ""
+
+	if status, err := LoadReplicationStatus(directory); err == nil {
+		for _, s := range status.Destinations {
+			if s.Name == destination.Name() && s.Succeeded {
+				replicated = ", although " + ReplicationFile + " reports it as replicated"
+			}
+		}
+	}
+
+	if remote == nil {
+		report.add(AuditMissing, directory, "backup "+id+" does not exist remotely"+replicated)
+		return
+	}
+
+	for _, file := range backupFiles {
+		local := filepath.Join(directory, file)
+		stat, err := os.Stat(local)
+
+		if err != nil {
+			continue
+		}
+
+		object, ok := remote.Objects[file]
+
+		if !ok {
+			report.add(AuditMissing, local, "not found in "+remote.Prefix+replicated)
+			continue
+		}
+
+		if object.Size != stat.Size() {
+			report.add(AuditSizeMismatch, object.Key, fmt.Sprintf("%d bytes remotely, %d bytes locally", object.Size, stat.Size()))
+			continue
+		}
+
+		reader, ok := destination.(MetadataReader)
+
+		if !checksums || !ok {
+			continue
+		}
+
+		metadata, err := reader.Metadata(object.Key)
+
+		if err != nil || len(metadata[Sha256MetadataKey]) == 0 {
+			report.add(AuditChecksumMismatch, object.Key, "no "+Sha256MetadataKey+" recorded at upload time")
+			continue
+		}
+
+		checksum, err := FileSha256(local)
+
+		if err != nil {
+			continue
+		}
+
+		if checksum != metadata[Sha256MetadataKey] {
+			report.add(AuditChecksumMismatch, object.Key, fmt.Sprintf("SHA-256 %v remotely, %v locally", metadata[Sha256MetadataKey], checksum))
+		}
+	}
+}
+
+// remoteChainMatches reports whether a remote chain starts with exactly the local chain members
+func remoteChainMatches(chains []RemoteChain, ids []string) bool {
+	for _, chain := range chains {
+		if len(chain) < len(ids) {
+			continue
+		}
+
+		matches := true
+
+		for i, id := range ids {
+			if chain[i].Id != id {
+				matches = false
+				break
+			}
+		}
+
+		if matches {
+			return true
+		}
+	}
+
+	return false
+}
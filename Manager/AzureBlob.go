@@ -0,0 +1,447 @@
+package Manager
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	AzureDestinationType = "azure"
+	AzureApiVersion      = "2020-10-02"
+	AzureMaxAttempts     = 3
+)
+
+// AzureBlobOptions configure the storage account and container used by AzureBlobManager
+type AzureBlobOptions struct {
+	Account    string `json:"account"`
+	AccountKey string `json:"account_key"`
+	SasToken   string `json:"sas_token"`
+	Container  string `json:"container"`
+	AccessTier string `json:"access_tier"`
+}
+
+type AzureBlobManager struct {
+	name          string
+	options       AzureBlobOptions
+	endpoint      *url.URL
+	key           []byte
+	sas           url.Values
+	client        *http.Client
+	retentionDays int
+}
+
+// azureError is the error document returned by the Blob service
+type azureError struct {
+	Status  int    `xml:"-"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *azureError) Error() string {
+	return fmt.Sprintf("%d %v: %v", e.Status, e.Code, strings.TrimSpace(e.Message))
+}
+
+type azureBlobList struct {
+	Blobs []struct {
+		Name       string `xml:"Name"`
+		Properties struct {
+			LastModified  string `xml:"Last-Modified"`
+			Etag          string `xml:"Etag"`
+			ContentLength int64  `xml:"Content-Length"`
+			AccessTier    string `xml:"AccessTier"`
+		} `xml:"Properties"`
+	} `xml:"Blobs>Blob"`
+	NextMarker string `xml:"NextMarker"`
+}
+
+// CreateAzureBlobManager connects to the account's blob endpoint unless Endpoint is set, use
+// http://127.0.0.1:10000/devstoreaccount1 for the Azurite emulator
+func CreateAzureBlobManager(Endpoint string, Options AzureBlobOptions, RetentionDays int) (*AzureBlobManager, error) {
+	if len(Options.Account) == 0 || len(Options.Container) == 0 {
+		return nil, errors.New("azure requires account and container")
+	}
+
+	if len(Options.AccountKey) > 0 == (len(Options.SasToken) > 0) {
+		return nil, errors.New("azure requires exactly one of account_key or sas_token")
+	}
+
+	switch Options.AccessTier {
+	case "", "Hot", "Cool":
+		break
+	default:
+		return nil, errors.New("invalid access tier, only ´Hot´ or ´Cool´ are supported, got: " + Options.AccessTier)
+	}
+
+	if len(Endpoint) == 0 {
+		Endpoint = "https://" + Options.Account + ".blob.core.windows.net"
+	}
+
+	endpoint, err := url.Parse(Endpoint)
+
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid azure endpoint %v, %v", Endpoint, err))
+	}
+
+	manager := &AzureBlobManager{
+		name:          "azure://" + Options.Account + "/" + Options.Container,
+		options:       Options,
+		endpoint:      endpoint,
+		client:        &http.Client{Transport: &throttledTransport{base: http.DefaultTransport}},
+		retentionDays: RetentionDays,
+	}
+
+	if len(Options.AccountKey) > 0 {
+		manager.key, err = base64.StdEncoding.DecodeString(Options.AccountKey)
+
+		if err != nil {
+			return nil, errors.New("invalid azure account_key, it must be base64 encoded")
+		}
+	} else {
+		manager.sas, err = url.ParseQuery(strings.TrimPrefix(Options.SasToken, "?"))
+
+		if err != nil {
+			return nil, errors.New("invalid azure sas_token")
+		}
+	}
+
+	return manager, nil
+}
+
+func (a *AzureBlobManager) Name() string {
+	return a.name
+}
+
+func (a *AzureBlobManager) setName(name string) {
+	a.name = name
+}
+
+func (a *AzureBlobManager) UploadFile(file string, key string, metadata map[string]string) error {
+	err := a.upload(file, key, metadata, file+".upload-state")
+
+	if err != nil {
+		return errors.New(fmt.Sprintf("[AzureBlobManager Upload()]> Failed to upload %v, %v", file, err))
+	}
+
+	return nil
+}
+
+// DownloadFile downloads into a temporary file that only replaces the target once its size and
+// SHA-256 match the blob
+func (a *AzureBlobManager) DownloadFile(key string, file string) error {
+	fh, err := os.OpenFile(file+".part", os.O_CREATE|os.O_RDWR, 0640)
+
+	if err != nil {
+		return err
+	}
+
+	properties, err := a.download(key, fh, file+".download-state")
+
+	if err != nil {
+		fh.Close()
+		return errors.New(fmt.Sprintf("[AzureBlobManager Download()]> Failed to download %v, %v", key, err))
+	}
+
+	err = a.verify(properties, fh)
+	fh.Close()
+
+	if err != nil {
+		os.Remove(file + ".part")
+		return errors.New(fmt.Sprintf("[AzureBlobManager Download()]> Verification of %v failed, %v", key, err))
+	}
+
+	return os.Rename(file+".part", file)
+}
+
+// Metadata returns the blob metadata, names are lower case with underscores instead of dashes
+func (a *AzureBlobManager) Metadata(key string) (map[string]string, error) {
+	resp, err := a.do(http.MethodHead, key, nil, nil, nil, 0)
+
+	if err != nil {
+		return nil, err
+	}
+
+	resp.Body.Close()
+
+	metadata := make(map[string]string)
+
+	for name := range resp.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-ms-meta-") {
+			metadata[strings.TrimPrefix(lower, "x-ms-meta-")] = resp.Header.Get(name)
+		}
+	}
+
+	return metadata, nil
+}
+
+func (a *AzureBlobManager) Open(key string) (io.ReadCloser, error) {
+	resp, err := a.do(http.MethodGet, key, nil, nil, nil, 0)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+// OpenRange reads part of the blob, pinned to its ETag when it is known
+func (a *AzureBlobManager) OpenRange(object RemoteObject, offset int64, length int64) (io.ReadCloser, error) {
+	headers := map[string]string{"x-ms-range": fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)}
+
+	if len(object.ETag) > 0 {
+		headers["If-Match"] = object.ETag
+	}
+
+	resp, err := a.do(http.MethodGet, object.Key, nil, headers, nil, 0)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+func (a *AzureBlobManager) List(prefix string) ([]RemoteObject, error) {
+	results := make([]RemoteObject, 0)
+	marker := ""
+
+	for {
+		query := url.Values{}
+		query.Set("restype", "container")
+		query.Set("comp", "list")
+		query.Set("prefix", prefix)
+
+		if len(marker) > 0 {
+			query.Set("marker", marker)
+		}
+
+		resp, err := a.do(http.MethodGet, "", query, nil, nil, 0)
+
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("[AzureBlobManager List()]> Failed to list %v, %v", prefix, err))
+		}
+
+		list := &azureBlobList{}
+		err = xml.NewDecoder(resp.Body).Decode(list)
+		resp.Body.Close()
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, blob := range list.Blobs {
+			modified, _ := time.Parse(http.TimeFormat, blob.Properties.LastModified)
+
+			results = append(results, RemoteObject{
+				Key:          blob.Name,
+				Size:         blob.Properties.ContentLength,
+				LastModified: modified,
+				ETag:         blob.Properties.Etag,
+				StorageClass: blob.Properties.AccessTier,
+			})
+		}
+
+		if len(list.NextMarker) == 0 {
+			return results, nil
+		}
+
+		marker = list.NextMarker
+	}
+}
+
+func (a *AzureBlobManager) Delete(object RemoteObject) (bool, error) {
+	resp, err := a.do(http.MethodDelete, object.Key, nil, nil, nil, 0)
+
+	if err != nil {
+		return false, errors.New(fmt.Sprintf("[AzureBlobManager Delete()]> Failed to delete %v, %v", object.Key, err))
+	}
+
+	resp.Body.Close()
+	log.Printf("Deleted %v from %v", object.Key, a.name)
+
+	return true, nil
+}
+
+func (a *AzureBlobManager) Prune() error {
+	return PruneBackups(a, a.retentionDays)
+}
+
+// do sends a signed request for the blob, an empty key addresses the container. Failed requests
+// are retried when the error is transient, body is called again for every attempt.
+func (a *AzureBlobManager) do(method string, key string, query url.Values, headers map[string]string, body func() io.Reader, length int64) (*http.Response, error) {
+	var lastErr error
+
+	for attempt := 0; attempt < AzureMaxAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(1<<uint(attempt)) * time.Second)
+		}
+
+		req, err := a.newRequest(method, key, query, headers, body, length)
+
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := a.client.Do(req)
+
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if resp.StatusCode < 300 {
+			return resp, nil
+		}
+
+		lastErr = readAzureError(resp)
+
+		if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500 {
+			return nil, lastErr
+		}
+	}
+
+	return nil, lastErr
+}
+
+func (a *AzureBlobManager) newRequest(method string, key string, query url.Values, headers map[string]string, body func() io.Reader, length int64) (*http.Request, error) {
+	u := *a.endpoint
+	u.Path = path.Join("/", u.Path, a.options.Container, key)
+
+	values := url.Values{}
+	for k, v := range query {
+		values[k] = v
+	}
+
+	for k, v := range a.sas {
+		values[k] = v
+	}
+
+	u.RawQuery = values.Encode()
+
+	var reader io.Reader
+	if body != nil {
+		reader = body()
+	}
+
+	req, err := http.NewRequest(method, u.String(), reader)
+
+	if err != nil {
+		return nil, err
+	}
+
+	req.ContentLength = length
+
+	//an empty body would otherwise be sent chunked, which the service rejects
+	if body != nil && length == 0 {
+		req.Body = http.NoBody
+	}
+
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("x-ms-version", AzureApiVersion)
+
+	if len(a.key) > 0 {
+		req.Header.Set("Authorization", "SharedKey "+a.options.Account+":"+a.sign(req))
+	}
+
+	return req, nil
+}
+
+// sign computes the shared key signature of the request
+func (a *AzureBlobManager) sign(req *http.Request) string {
+	names := make([]string, 0)
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-ms-") {
+			names = append(names, lower)
+		}
+	}
+	sort.Strings(names)
+
+	canonicalized := ""
+	for _, name := range names {
+		canonicalized += name + ":" + strings.TrimSpace(req.Header.Get(name)) + "\n"
+	}
+
+	canonicalized += "/" + a.options.Account + req.URL.EscapedPath()
+
+	query := req.URL.Query()
+	parameters := make([]string, 0, len(query))
+	for name := range query {
+		parameters = append(parameters, name)
+	}
+	sort.Strings(parameters)
+
+	for _, name := range parameters {
+		values := query[name]
+		sort.Strings(values)
+		canonicalized += "\n" + strings.ToLower(name) + ":" + strings.Join(values, ",")
+	}
+
+	length := ""
+	if req.ContentLength > 0 {
+		length = strconv.FormatInt(req.ContentLength, 10)
+	}
+
+	stringToSign := strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		length,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		"", //Date, x-ms-date is used instead
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+		canonicalized,
+	}, "\n")
+
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(stringToSign))
+
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func readAzureError(resp *http.Response) error {
+	defer resp.Body.Close()
+
+	data, _ := ioutil.ReadAll(resp.Body)
+	azureErr := &azureError{Status: resp.StatusCode}
+
+	if xml.Unmarshal(data, azureErr) != nil || len(azureErr.Code) == 0 {
+		azureErr.Code = resp.Header.Get("x-ms-error-code")
+		azureErr.Message = resp.Status
+	}
+
+	return azureErr
+}
+
+func isAzureNotFound(err error) bool {
+	var azureErr *azureError
+
+	return errors.As(err, &azureErr) && azureErr.Status == http.StatusNotFound
+}
+
+// azureMetadataName converts a metadata key into a valid blob metadata name, which may not contain dashes
+func azureMetadataName(key string) string {
+	return strings.Replace(key, "-", "_", -1)
+}
@@ -0,0 +1,383 @@
+package Manager
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// azuriteKey is the well-known key of the devstoreaccount1 account of the Azurite emulator
+const azuriteKey = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+
+func TestAzureSharedKeySignature(t *testing.T) {
+	manager, err := CreateAzureBlobManager("http://127.0.0.1:10000/devstoreaccount1", AzureBlobOptions{
+		Account:    "devstoreaccount1",
+		AccountKey: azuriteKey,
+		Container:  "backups",
+	}, 0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		method    string
+		key       string
+		query     url.Values
+		headers   map[string]string
+		length    int64
+		signature func(date string) string
+	}{
+		{
+			name:   "block upload",
+			method: http.MethodPut,
+			key:    "host/2026-10-01/backup.gz.enc",
+			query:  url.Values{"comp": {"block"}, "blockid": {azureBlockId(1)}},
+			length: 10,
+			signature: func(date string) string {
+				return "PUT\n\n\n10\n\n\n\n\n\n\n\n\n" +
+					"x-ms-date:" + date + "\nx-ms-version:" + AzureApiVersion + "\n" +
+					"/devstoreaccount1/devstoreaccount1/backups/host/2026-10-01/backup.gz.enc\n" +
+					"blockid:" + azureBlockId(1) + "\ncomp:block"
+			},
+		},
+		{
+			name:    "ranged download with metadata headers in any case",
+			method:  http.MethodGet,
+			key:     "host/a b.gz",
+			headers: map[string]string{"If-Match": "\"etag\"", "X-Ms-Range": "bytes=0-9", "x-ms-meta-sha256": " abc "},
+			signature: func(date string) string {
+				//an empty body has no Content-Length in the signature, headers are trimmed and sorted
+				return "GET\n\n\n\n\n\n\n\n\"etag\"\n\n\n\n" +
+					"x-ms-date:" + date + "\nx-ms-meta-sha256:abc\nx-ms-range:bytes=0-9\nx-ms-version:" + AzureApiVersion + "\n" +
+					"/devstoreaccount1/devstoreaccount1/backups/host/a%20b.gz"
+			},
+		},
+		{
+			name:   "container listing",
+			method: http.MethodGet,
+			query:  url.Values{"restype": {"container"}, "comp": {"list"}, "prefix": {"Host/"}},
+			signature: func(date string) string {
+				return "GET\n\n\n\n\n\n\n\n\n\n\n\n" +
+					"x-ms-date:" + date + "\nx-ms-version:" + AzureApiVersion + "\n" +
+					"/devstoreaccount1/devstoreaccount1/backups\n" +
+					"comp:list\nprefix:Host/\nrestype:container"
+			},
+		},
+	}
+
+	key, _ := base64.StdEncoding.DecodeString(azuriteKey)
+
+	for _, test := range tests {
+		var body func() io.Reader
+
+		if test.length > 0 {
+			body = func() io.Reader { return bytes.NewReader(make([]byte, test.length)) }
+		}
+
+		req, err := manager.newRequest(test.method, test.key, test.query, test.headers, body, test.length)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(test.signature(req.Header.Get("x-ms-date"))))
+		want := "SharedKey devstoreaccount1:" + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+		if got := req.Header.Get("Authorization"); got != want {
+			t.Errorf("%v: got %v, want %v", test.name, got, want)
+		}
+	}
+}
+
+func TestAzureSasToken(t *testing.T) {
+	manager, err := CreateAzureBlobManager("", AzureBlobOptions{
+		Account:   "account",
+		SasToken:  "?sv=2020-10-02&sp=rwdl&sig=abc%2Bdef",
+		Container: "backups",
+	}, 0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := manager.newRequest(http.MethodGet, "host/backup.gz.enc", url.Values{"comp": {"blocklist"}}, nil, nil, 0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(req.Header.Get("Authorization")) > 0 {
+		t.Error("a request with a SAS token is signed with a shared key")
+	}
+
+	if req.URL.Host != "account.blob.core.windows.net" || req.URL.Path != "/backups/host/backup.gz.enc" {
+		t.Errorf("got URL %v", req.URL)
+	}
+
+	query := req.URL.Query()
+
+	for name, want := range map[string]string{"sv": "2020-10-02", "sp": "rwdl", "sig": "abc+def", "comp": "blocklist"} {
+		if got := query.Get(name); got != want {
+			t.Errorf("query %v: got %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestAzureBlockId(t *testing.T) {
+	seen := make(map[string]int64)
+	length := len(azureBlockId(1))
+
+	for _, number := range []int64{1, 2, 9, 10, 99, 100, 9999, MultipartMaxParts, 99999999} {
+		id := azureBlockId(number)
+
+		//a resumed upload must find the blocks of the interrupted one under the same ids
+		if azureBlockId(number) != id {
+			t.Errorf("block %d: the id is not stable", number)
+		}
+
+		if len(id) != length {
+			t.Errorf("block %d: id %v has length %d, want %d", number, id, len(id), length)
+		}
+
+		if other, ok := seen[id]; ok {
+			t.Errorf("blocks %d and %d share the id %v", other, number, id)
+		}
+
+		seen[id] = number
+	}
+}
+
+// createAzuriteManager returns a manager for a new container of Azurite, AZURITE_ENDPOINT
+// overrides the default endpoint. The test is skipped when the emulator is not running.
+func createAzuriteManager(t *testing.T) *AzureBlobManager {
+	endpoint := os.Getenv("AZURITE_ENDPOINT")
+
+	if len(endpoint) == 0 {
+		endpoint = "http://127.0.0.1:10000/devstoreaccount1"
+	}
+
+	u, err := url.Parse(endpoint)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.DialTimeout("tcp", u.Host, time.Second)
+
+	if err != nil {
+		t.Skip("Azurite is not reachable on", u.Host)
+	}
+
+	conn.Close()
+
+	manager, err := CreateAzureBlobManager(endpoint, AzureBlobOptions{
+		Account:    "devstoreaccount1",
+		AccountKey: azuriteKey,
+		Container:  "test" + time.Now().UTC().Format("20060102150405999999999"),
+	}, 0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := manager.do(http.MethodPut, "", url.Values{"restype": {"container"}}, nil, func() io.Reader { return http.NoBody }, 0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp.Body.Close()
+
+	return manager
+}
+
+func deleteAzuriteContainer(manager *AzureBlobManager) {
+	resp, err := manager.do(http.MethodDelete, "", url.Values{"restype": {"container"}}, nil, nil, 0)
+
+	if err == nil {
+		resp.Body.Close()
+	}
+}
+
+func TestAzuriteUploadListDownloadDelete(t *testing.T) {
+	manager := createAzuriteManager(t)
+	defer deleteAzuriteContainer(manager)
+
+	dir, err := ioutil.TempDir("", "azure")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "backup.gz.enc")
+	content := writeTestFile(t, file, 300000)
+	checksum, err := FileSha256(file)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := "host/2026-10-01/20261001T000000Z/backup.gz.enc"
+	err = manager.UploadFile(file, key, map[string]string{Sha256MetadataKey: checksum, "backup-id": "20261001T000000Z"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	objects, err := manager.List("host/")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(objects) != 1 || objects[0].Key != key || objects[0].Size != int64(len(content)) {
+		t.Fatalf("got objects %+v, want only %v with %d bytes", objects, key, len(content))
+	}
+
+	metadata, err := manager.Metadata(key)
+
+	if err != nil || metadata[Sha256MetadataKey] != checksum || metadata["backup_id"] != "20261001T000000Z" {
+		t.Errorf("got metadata %v, %v", metadata, err)
+	}
+
+	downloaded := filepath.Join(dir, "downloaded")
+	err = manager.DownloadFile(key, downloaded)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(downloaded)
+
+	if err != nil || !bytes.Equal(data, content) {
+		t.Fatalf("the download differs from the upload, %v", err)
+	}
+
+	deleted, err := manager.Delete(objects[0])
+
+	if err != nil || !deleted {
+		t.Fatalf("delete returned %v, %v", deleted, err)
+	}
+
+	objects, err = manager.List("host/")
+
+	if err != nil || len(objects) != 0 {
+		t.Errorf("got objects %+v, %v after delete", objects, err)
+	}
+}
+
+// TestAzuriteUploadResume continues a block upload that was interrupted before the block list
+// was committed: blocks the service holds are not sent again, a block recorded as done but
+// missing on the service is
+func TestAzuriteUploadResume(t *testing.T) {
+	manager := createAzuriteManager(t)
+	defer deleteAzuriteContainer(manager)
+
+	dir, err := ioutil.TempDir("", "azure")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "backup.gz.enc")
+	content := writeTestFile(t, file, 10000)
+	stat, err := os.Stat(file)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := "host/backup.gz.enc"
+	stateFile := file + ".upload-state"
+	state := &TransferState{
+		Bucket:   manager.options.Container,
+		Key:      key,
+		Size:     stat.Size(),
+		ModTime:  stat.ModTime().UnixNano(),
+		PartSize: 3000,
+		Parts:    []TransferPart{{Number: 1}, {Number: 2}, {Number: 3}},
+	}
+
+	//the interrupted run sent blocks 1 and 2, block 1 with a marker the resume must not overwrite
+	for _, number := range []int64{1, 2} {
+		offset, length := state.PartRange(number)
+		block := append([]byte{}, content[offset:offset+length]...)
+
+		if number == 1 {
+			block[0] = 'R'
+		}
+
+		resp, err := manager.do(http.MethodPut, key, url.Values{"comp": {"block"}, "blockid": {azureBlockId(number)}}, nil, func() io.Reader {
+			return bytes.NewReader(block)
+		}, length)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp.Body.Close()
+	}
+
+	err = state.Save(stateFile)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fh, err := os.Open(file)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer fh.Close()
+
+	sent := int64(0)
+	err = manager.uploadBlocks(fh, key, stat.Size(), stat.ModTime().UnixNano(), map[string]string{"x-ms-blob-type": "BlockBlob"}, stateFile, &sent)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sent != stat.Size() {
+		t.Errorf("counted %d bytes sent, want %d", sent, stat.Size())
+	}
+
+	if _, err := os.Stat(stateFile); !os.IsNotExist(err) {
+		t.Error("the upload state was not removed")
+	}
+
+	body, err := manager.Open(key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadAll(body)
+	body.Close()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(data) != len(content) || data[0] != 'R' || !bytes.Equal(data[1:], content[1:]) {
+		t.Error("the resumed upload did not keep the uploaded blocks or missed the others")
+	}
+}
@@ -0,0 +1,374 @@
+package Manager
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+type azureBlockList struct {
+	XMLName xml.Name `xml:"BlockList"`
+	Latest  []string `xml:"Latest"`
+}
+
+type azureUncommittedBlocks struct {
+	Blocks []struct {
+		Name string `xml:"Name"`
+		Size int64  `xml:"Size"`
+	} `xml:"UncommittedBlocks>Block"`
+}
+
+// azureBlobProperties are the properties of a blob needed to download and verify it
+type azureBlobProperties struct {
+	Key    string
+	Size   int64
+	ETag   string
+	Sha256 string
+}
+
+// azureBlockId returns the id of the 1-based block number, every id of a blob must have the same length
+func azureBlockId(number int64) string {
+	return base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%08d", number)))
+}
+
+// upload sends files up to a single part with one request and larger files as blocks that are
+// committed at the end. Finished blocks are kept in stateFile, running it again only sends the
+// blocks that the service does not hold yet.
+func (a *AzureBlobManager) upload(file string, key string, metadata map[string]string, stateFile string) error {
+	fh, err := os.Open(file)
+
+	if err != nil {
+		return err
+	}
+
+	defer fh.Close()
+
+	stat, err := fh.Stat()
+
+	if err != nil {
+		return err
+	}
+
+	headers := map[string]string{"x-ms-blob-type": "BlockBlob"}
+
+	for k, v := range metadata {
+		headers["x-ms-meta-"+azureMetadataName(k)] = v
+	}
+
+	if len(a.options.AccessTier) > 0 {
+		headers["x-ms-access-tier"] = a.options.AccessTier
+	}
+
+	size := stat.Size()
+	sent := int64(0)
+
+	log.Printf("Uploading %v to %v", key, a.name)
+
+	task := Progress.Start("upload", key, size, func() int64 { return atomic.LoadInt64(&sent) })
+
+	if size <= MultipartPartSize {
+		var resp *http.Response
+		resp, err = a.do(http.MethodPut, key, nil, headers, func() io.Reader {
+			atomic.StoreInt64(&sent, 0)
+			return &sharedCountingReader{reader: io.NewSectionReader(fh, 0, size), bytes: &sent}
+		}, size)
+
+		if err == nil {
+			resp.Body.Close()
+		}
+	} else {
+		err = a.uploadBlocks(fh, key, size, stat.ModTime().UnixNano(), headers, stateFile, &sent)
+	}
+
+	task.Finish(err)
+
+	return err
+}
+
+func (a *AzureBlobManager) uploadBlocks(fh *os.File, key string, size int64, modTime int64, headers map[string]string, stateFile string, sent *int64) error {
+	state, err := LoadTransferState(stateFile)
+
+	if err == nil && state.Bucket == a.options.Container && state.Key == key && state.Size == size && state.ModTime == modTime {
+		//uncommitted blocks are discarded by the service after a week
+		uncommitted, err := a.uncommittedBlocks(key)
+
+		if err != nil {
+			return err
+		}
+
+		parts := make([]TransferPart, 0, len(state.Parts))
+
+		for _, part := range state.Parts {
+			_, length := state.PartRange(part.Number)
+
+			if uncommitted[azureBlockId(part.Number)] == length {
+				parts = append(parts, part)
+				atomic.AddInt64(sent, length)
+			}
+		}
+
+		state.Parts = parts
+		log.Printf("Resuming upload of %v, %d of %d blocks already uploaded", key, len(state.Parts), state.PartCount())
+	} else {
+		state = &TransferState{
+			Bucket:   a.options.Container,
+			Key:      key,
+			Size:     size,
+			ModTime:  modTime,
+			PartSize: partSize(size),
+			Parts:    make([]TransferPart, 0),
+		}
+	}
+
+	err = state.Save(stateFile)
+
+	if err != nil {
+		return err
+	}
+
+	blocks := make(chan int64)
+	mutex := &sync.Mutex{}
+	wg := &sync.WaitGroup{}
+	var uploadErr error
+
+	for i := 0; i < AwsConcurrencyLevel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for number := range blocks {
+				offset, length := state.PartRange(number)
+				query := url.Values{"comp": {"block"}, "blockid": {azureBlockId(number)}}
+
+				resp, err := a.do(http.MethodPut, key, query, nil, func() io.Reader {
+					return io.NewSectionReader(fh, offset, length)
+				}, length)
+
+				mutex.Lock()
+				if err == nil {
+					resp.Body.Close()
+					atomic.AddInt64(sent, length)
+					state.Parts = append(state.Parts, TransferPart{Number: number})
+					err = state.Save(stateFile)
+				}
+				if err != nil && uploadErr == nil {
+					uploadErr = err
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+
+	for number := int64(1); number <= state.PartCount(); number++ {
+		mutex.Lock()
+		failed := uploadErr != nil
+		done := state.Done(number)
+		mutex.Unlock()
+
+		if failed {
+			break
+		}
+
+		if !done {
+			blocks <- number
+		}
+	}
+
+	close(blocks)
+	wg.Wait()
+
+	if uploadErr != nil {
+		return uploadErr
+	}
+
+	list := azureBlockList{}
+	for number := int64(1); number <= state.PartCount(); number++ {
+		list.Latest = append(list.Latest, azureBlockId(number))
+	}
+
+	payload, err := xml.Marshal(list)
+
+	if err != nil {
+		return err
+	}
+
+	payload = append([]byte(xml.Header), payload...)
+
+	commitHeaders := map[string]string{"Content-Type": "application/xml"}
+	for k, v := range headers {
+		if k != "x-ms-blob-type" {
+			commitHeaders[k] = v
+		}
+	}
+
+	resp, err := a.do(http.MethodPut, key, url.Values{"comp": {"blocklist"}}, commitHeaders, func() io.Reader {
+		return bytes.NewReader(payload)
+	}, int64(len(payload)))
+
+	if err != nil {
+		return err
+	}
+
+	resp.Body.Close()
+
+	return os.Remove(stateFile)
+}
+
+// uncommittedBlocks returns the size of every uploaded block that is not committed yet
+func (a *AzureBlobManager) uncommittedBlocks(key string) (map[string]int64, error) {
+	blocks := make(map[string]int64)
+
+	resp, err := a.do(http.MethodGet, key, url.Values{"comp": {"blocklist"}, "blocklisttype": {"uncommitted"}}, nil, nil, 0)
+
+	if isAzureNotFound(err) {
+		return blocks, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	list := &azureUncommittedBlocks{}
+	err = xml.NewDecoder(resp.Body).Decode(list)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, block := range list.Blocks {
+		blocks[block.Name] = block.Size
+	}
+
+	return blocks, nil
+}
+
+func (a *AzureBlobManager) properties(key string) (*azureBlobProperties, error) {
+	resp, err := a.do(http.MethodHead, key, nil, nil, nil, 0)
+
+	if err != nil {
+		return nil, err
+	}
+
+	resp.Body.Close()
+
+	size, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid Content-Length of %v", key))
+	}
+
+	return &azureBlobProperties{
+		Key:    key,
+		Size:   size,
+		ETag:   resp.Header.Get("ETag"),
+		Sha256: resp.Header.Get("x-ms-meta-" + Sha256MetadataKey),
+	}, nil
+}
+
+// download fetches the blob with parallel range requests, finished ranges are recorded in
+// stateFile so running it again only fetches what is missing
+func (a *AzureBlobManager) download(key string, file *os.File, stateFile string) (*azureBlobProperties, error) {
+	properties, err := a.properties(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	received := int64(0)
+	state, err := LoadTransferState(stateFile)
+
+	if err == nil && state.Bucket == a.options.Container && state.Key == key && state.ETag == properties.ETag && state.Size == properties.Size {
+		log.Printf("Resuming download of %v, %d of %d parts already downloaded", key, len(state.Parts), state.PartCount())
+
+		for _, part := range state.Parts {
+			_, length := state.PartRange(part.Number)
+			received += length
+		}
+	} else {
+		state = &TransferState{
+			Bucket:   a.options.Container,
+			Key:      key,
+			ETag:     properties.ETag,
+			Size:     properties.Size,
+			PartSize: partSize(properties.Size),
+			Parts:    make([]TransferPart, 0),
+		}
+
+		err = file.Truncate(0)
+
+		if err == nil {
+			err = state.Save(stateFile)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	log.Printf("Downloading %v from %v", key, a.name)
+
+	task := Progress.Start("download", key, properties.Size, func() int64 { return atomic.LoadInt64(&received) })
+
+	err = downloadRanges(state, stateFile, file, &received, func(offset int64, length int64) (io.ReadCloser, error) {
+		resp, err := a.do(http.MethodGet, key, nil, map[string]string{
+			"x-ms-range": fmt.Sprintf("bytes=%d-%d", offset, offset+length-1),
+			"If-Match":   state.ETag,
+		}, nil, 0)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return resp.Body, nil
+	})
+
+	task.Finish(err)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return properties, os.Remove(stateFile)
+}
+
+// verify compares the downloaded file with the size of the blob and the SHA-256 stored in its metadata at upload time
+func (a *AzureBlobManager) verify(properties *azureBlobProperties, file *os.File) error {
+	stat, err := file.Stat()
+
+	if err != nil {
+		return err
+	}
+
+	if stat.Size() != properties.Size {
+		return errors.New(fmt.Sprintf("size mismatch, expected %d bytes, got %d", properties.Size, stat.Size()))
+	}
+
+	if len(properties.Sha256) == 0 {
+		log.Printf("Skipping SHA-256 check of %v, the blob has no %v metadata", properties.Key, Sha256MetadataKey)
+		return nil
+	}
+
+	_, checksum, err := checksumFile(file, properties.Size, false)
+
+	if err != nil {
+		return err
+	}
+
+	if checksum != properties.Sha256 {
+		return errors.New(fmt.Sprintf("SHA-256 mismatch, expected %v, got %v", properties.Sha256, checksum))
+	}
+
+	return nil
+}
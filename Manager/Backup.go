@@ -6,16 +6,19 @@ import (
 	gzip "github.com/klauspost/pgzip"
 	"io"
 	"io/ioutil"
+	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strconv"
+	"time"
 )
 
 const (
 	FullBackupMode        = "full"
 	IncrementalBackupMode = "incremental"
 	AwsConcurrencyLevel   = 16
+	//assumed compressed size of the stream until a backup with recorded sizes exists
+	DefaultCompressionRatio = 0.5
 )
 
 type BackupManager struct {
@@ -31,6 +34,10 @@ type BackupManager struct {
 	gzBlockSize        int
 	gzThreads          int
 	parallelThreads    int
+	throttleIOPS       int
+	backupPath         string
+	dataSize           int64
+	streamSize         int64
 }
 
 func CreateBackupManager(
@@ -46,6 +53,7 @@ func CreateBackupManager(
 	CompressionBlockSize int,
 	CompressionThreads int,
 	ParallelThreads int,
+	ThrottleIOPS int,
 ) (*BackupManager, error) {
 
 	switch Mode {
@@ -68,6 +76,7 @@ func CreateBackupManager(
 		gzThreads:          CompressionThreads,
 		gzBlockSize:        CompressionBlockSize,
 		parallelThreads:    ParallelThreads,
+		throttleIOPS:       ThrottleIOPS,
 	}, nil
 
 }
@@ -77,6 +86,7 @@ func (b *BackupManager) Backup() error {
 	backupPath := ""
 	backupPos := 0
 	incrementalBaseDir := ""
+	startedAt := time.Now()
 
 	if b.mode == FullBackupMode {
 		err := os.RemoveAll(b.targetDirectory)
@@ -116,33 +126,78 @@ func (b *BackupManager) Backup() error {
 		}
 	}
 
-	command := exec.Command("stdbuf", "--output=4M", b.mariaBackupBinary,
-		"--host="+b.host,
-		"--port="+strconv.Itoa(b.port),
-		"--user="+b.username,
-		"--password="+b.password,
+	args := []string{
+		"--output=4M",
+		b.mariaBackupBinary,
+		"--host=" + b.host,
+		"--port=" + strconv.Itoa(b.port),
+		"--user=" + b.username,
+		"--password=" + b.password,
 		"--backup",
-		"--datadir="+b.dataDirectory,
-		"--target_dir="+backupPath,
-		"--extra-lsndir="+backupPath,
-		"--parallel="+strconv.Itoa(b.parallelThreads),
+		"--datadir=" + b.dataDirectory,
+		"--target_dir=" + backupPath,
+		"--extra-lsndir=" + backupPath,
+		"--parallel=" + strconv.Itoa(b.parallelThreads),
 		"--stream=xbstream",
-	)
+	}
 
 	if len(incrementalBaseDir) > 0 {
-		command.Args = append(command.Args, "--incremental-basedir="+incrementalBaseDir)
+		args = append(args, "--incremental-basedir="+incrementalBaseDir)
+	}
+
+	if b.throttleIOPS > 0 {
+		args = append(args, "--throttle="+strconv.Itoa(b.throttleIOPS))
 	}
 
-	err := b.executeCommandAndSaveOutput(backupPath, command)
+	//stdbuf gives mariabackup a larger output buffer, killing the process group stops both
+	err := b.executeCommandAndSaveOutput(backupPath, NewProcess("backup", "stdbuf", args...))
 
 	if err != nil {
 		return err
 	}
 
+	//taken right after the backup, when the tables are closest to the backed up state
+	stats, err := collectServerTableStats(b.host, b.port, b.username, b.password)
+
+	if err == nil {
+		err = stats.Save(backupPath)
+	}
+
+	//the backup is usable without them, only the restore test can not compare the tables
+	if err != nil {
+		log.Println("Failed to record the table statistics of the backup:", err)
+	}
+
+	manifest, err := CreateBackupManifest(b.mode, backupPos, startedAt, backupPath)
+
+	if err != nil {
+		return errors.New(fmt.Sprintf("[BackupManager Backup()]> Failed to create backup manifest, %v", err))
+	}
+
+	manifest.DataSize = b.dataSize
+	manifest.StreamSize = b.streamSize
+
+	if stat, err := os.Stat(filepath.Join(backupPath, "backup.gz")); err == nil {
+		manifest.CompressedSize = stat.Size()
+	}
+
+	err = manifest.Save(backupPath)
+
+	if err != nil {
+		return errors.New(fmt.Sprintf("[BackupManager Backup()]> Failed to save backup manifest, %v", err))
+	}
+
+	b.backupPath = backupPath
+
 	return b.saveBackupPosition(backupPos)
 }
 
-func (b *BackupManager) executeCommandAndSaveOutput(backupPath string, command *exec.Cmd) error {
+// BackupPath returns the directory of the last backup taken by Backup()
+func (b *BackupManager) BackupPath() string {
+	return b.backupPath
+}
+
+func (b *BackupManager) executeCommandAndSaveOutput(backupPath string, process *Process) error {
 
 	file, err := os.Create(filepath.Join(backupPath, "backup.gz"))
 
@@ -152,7 +207,8 @@ func (b *BackupManager) executeCommandAndSaveOutput(backupPath string, command *
 
 	defer file.Close()
 
-	gzw, err := gzip.NewWriterLevel(file, gzip.BestSpeed)
+	compressed := &ProgressCounter{}
+	gzw, err := gzip.NewWriterLevel(compressed.Writer(&throttledWriter{writer: file, limiter: BackupWriteLimiter}), gzip.BestSpeed)
 
 	if err != nil {
 		return errors.New("Failed to create gzip writer:" + err.Error())
@@ -165,38 +221,93 @@ func (b *BackupManager) executeCommandAndSaveOutput(backupPath string, command *
 
 	defer gzw.Close()
 
-	out, err := command.StdoutPipe()
-	command.Stderr = os.Stderr
+	out, err := process.StdoutPipe()
 	if err != nil {
 		return err
 	}
 
-	err = command.Start()
+	defer out.Close()
+
+	err = process.Start()
 
 	if err != nil {
-		return errors.New(fmt.Sprintf("[BackupManager Backup()]> Failed executing command: %v", err))
+		return err
+	}
+
+	//the datadir size is only an estimate of the stream size
+	if b.dataSize == 0 {
+		b.dataSize, _ = directorySize(b.dataDirectory)
 	}
 
-	_, err = io.Copy(gzw, out)
+	stream := &ProgressCounter{}
+	streamTask := Progress.Start("backup", b.dataDirectory, b.dataSize, stream.Bytes)
+	compressTask := Progress.Start("compress", file.Name(), 0, compressed.Bytes)
+
+	_, err = io.Copy(gzw, stream.Reader(out))
+	b.streamSize = stream.Bytes()
+
+	streamTask.Finish(err)
+	compressTask.Finish(err)
 
 	if err != nil {
+		//closing the pipe makes mariabackup fail instead of blocking on a full pipe
+		out.Close()
+		process.Wait()
 		return err
 	}
 
-	err = command.Wait()
+	return process.Wait()
+}
+
+// EstimateDisk estimates the compressed size of the next backup from the size of the data
+// directory and the compression ratio of the last backup, an incremental from the size of the
+// last incremental. A full backup replaces the backups in the target directory, their space
+// counts as available.
+func (b *BackupManager) EstimateDisk() (DiskEstimate, error) {
+	var err error
+	b.dataSize, err = directorySize(b.dataDirectory)
 
 	if err != nil {
-		return err
+		return nil, errors.New(fmt.Sprintf("[BackupManager EstimateDisk()]> Failed to read the size of %v, %v", b.dataDirectory, err))
 	}
 
-	//check if the exit code was 0
-	exitCode := command.ProcessState.ExitCode()
+	ratio := DefaultCompressionRatio
+	var lastIncremental int64
+
+	for _, directory := range LocalBackups(b.targetDirectory) {
+		manifest, err := LoadManifest(directory)
+
+		if err != nil || manifest.StreamSize == 0 || manifest.CompressedSize == 0 {
+			continue
+		}
+
+		ratio = float64(manifest.CompressedSize) / float64(manifest.StreamSize)
 
-	if exitCode != 0 {
-		return errors.New("Backup failed, exit code:" + strconv.Itoa(exitCode))
+		if manifest.Mode == IncrementalBackupMode {
+			lastIncremental = manifest.CompressedSize
+		}
 	}
 
-	return nil
+	needed := uint64(float64(b.dataSize) * ratio)
+
+	if b.mode == IncrementalBackupMode && lastIncremental > 0 {
+		needed = uint64(lastIncremental)
+	}
+
+	estimate := DiskEstimate{}
+
+	err = estimate.Require(existingParent(b.targetDirectory), needed)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if b.mode == FullBackupMode {
+		replaced, _ := directorySize(b.targetDirectory)
+		estimate[0].Available += uint64(replaced)
+	}
+
+	return estimate, nil
 }
 
 func (b *BackupManager) saveBackupPosition(position int) error {
@@ -220,3 +331,25 @@ func (b *BackupManager) saveBackupPosition(position int) error {
 
 	return nil
 }
+
+// BackupSubDirectory returns the directory of the chain member, full/ for position 0 and incr/N after that
+func BackupSubDirectory(position int) string {
+	if position == 0 {
+		return "full"
+	}
+
+	return filepath.Join("incr", strconv.Itoa(position))
+}
+
+func directorySize(directory string) (int64, error) {
+	size := int64(0)
+
+	err := filepath.Walk(directory, func(name string, f os.FileInfo, err error) error {
+		if err == nil && f.Mode().IsRegular() {
+			size += f.Size()
+		}
+		return err
+	})
+
+	return size, err
+}
@@ -0,0 +1,578 @@
+package Manager
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	gzip "github.com/klauspost/pgzip"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	BinlogInfoFile       = "xtrabackup_binlog_info"
+	BinlogArchivePrefix  = "binlogs"
+	StopDatetimeFormat   = "2006-01-02 15:04:05"
+	BinlogServerWaitTime = 5 * time.Minute
+)
+
+var binlogPosPattern = regexp.MustCompile(`binlog_pos = filename '([^']+)', position '(\d+)'(?:, GTID of the last change '([^']*)')?`)
+var gtidPattern = regexp.MustCompile(`^\d+-\d+-\d+(,\d+-\d+-\d+)*$`)
+
+// BinlogPosition is the binary log coordinate a backup is consistent with
+type BinlogPosition struct {
+	File     string
+	Position int64
+	GTID     string
+}
+
+func (p *BinlogPosition) String() string {
+	if len(p.GTID) > 0 {
+		return fmt.Sprintf("%v:%d (GTID %v)", p.File, p.Position, p.GTID)
+	}
+
+	return fmt.Sprintf("%v:%d", p.File, p.Position)
+}
+
+// ReadBinlogInfo reads the binlog position of a prepared or downloaded backup from
+// xtrabackup_binlog_info, falling back to the binlog_pos line of xtrabackup_info
+func ReadBinlogInfo(directory string) (*BinlogPosition, error) {
+	data, err := ioutil.ReadFile(filepath.Join(directory, BinlogInfoFile))
+
+	if err == nil {
+		fields := strings.Fields(string(data))
+
+		if len(fields) < 2 {
+			return nil, errors.New(fmt.Sprintf("[Binlog]> Invalid %v in %v", BinlogInfoFile, directory))
+		}
+
+		position, err := strconv.ParseInt(fields[1], 10, 64)
+
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("[Binlog]> Invalid position in %v, %v", BinlogInfoFile, err))
+		}
+
+		binlog := &BinlogPosition{File: fields[0], Position: position}
+
+		if len(fields) > 2 {
+			binlog.GTID = fields[2]
+		}
+
+		return binlog, nil
+	}
+
+	data, err = ioutil.ReadFile(filepath.Join(directory, "xtrabackup_info"))
+
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("[Binlog]> Backup in %v has no binlog position, %v", directory, err))
+	}
+
+	return parseBinlogPos(string(data))
+}
+
+// BackupBinlogPosition reads the binlog position from the xtrabackup_info of a remote backup
+// without downloading the backup itself
+func BackupBinlogPosition(destination Destination, backup *RemoteBackup) (*BinlogPosition, error) {
+	object, ok := backup.Objects["xtrabackup_info"]
+
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("[Binlog]> Backup %v has no xtrabackup_info", backup.Id))
+	}
+
+	data, err := readSmallObject(destination, object.Key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return parseBinlogPos(data)
+}
+
+func parseBinlogPos(info string) (*BinlogPosition, error) {
+	match := binlogPosPattern.FindStringSubmatch(info)
+
+	if match == nil {
+		return nil, errors.New("[Binlog]> xtrabackup_info has no binlog position, was binary logging enabled?")
+	}
+
+	position, _ := strconv.ParseInt(match[2], 10, 64)
+
+	return &BinlogPosition{File: match[1], Position: position, GTID: match[3]}, nil
+}
+
+// RecoveryTarget is where the replay of the binary logs stops: a time, a binlog file and
+// position or a GTID
+type RecoveryTarget struct {
+	Time     string
+	File     string
+	Position int64
+	GTID     string
+}
+
+// ParseRecoveryTarget accepts the time as ´YYYY-MM-DD HH:MM:SS´ in the server time zone and the
+// position as either ´<binlog file>:<position>´ or a GTID list
+func ParseRecoveryTarget(stopDatetime string, stopPosition string) (*RecoveryTarget, error) {
+	if len(stopDatetime) > 0 && len(stopPosition) > 0 {
+		return nil, errors.New("only one of -stop-datetime or -stop-position can be used")
+	}
+
+	if len(stopDatetime) > 0 {
+		if _, err := time.ParseInLocation(StopDatetimeFormat, stopDatetime, time.Local); err != nil {
+			return nil, errors.New("invalid stop datetime, expected ´YYYY-MM-DD HH:MM:SS´, got: " + stopDatetime)
+		}
+
+		return &RecoveryTarget{Time: stopDatetime}, nil
+	}
+
+	if gtidPattern.MatchString(stopPosition) {
+		return &RecoveryTarget{GTID: stopPosition}, nil
+	}
+
+	separator := strings.LastIndex(stopPosition, ":")
+
+	if separator <= 0 {
+		return nil, errors.New("invalid stop position, expected ´<binlog file>:<position>´ or a GTID, got: " + stopPosition)
+	}
+
+	position, err := strconv.ParseInt(stopPosition[separator+1:], 10, 64)
+
+	if err != nil {
+		return nil, errors.New("invalid stop position, expected ´<binlog file>:<position>´ or a GTID, got: " + stopPosition)
+	}
+
+	return &RecoveryTarget{File: stopPosition[:separator], Position: position}, nil
+}
+
+// StopTime returns the stop datetime, zero unless the target is a time
+func (t *RecoveryTarget) StopTime() time.Time {
+	stop, _ := time.ParseInLocation(StopDatetimeFormat, t.Time, time.Local)
+
+	return stop
+}
+
+func (t *RecoveryTarget) String() string {
+	switch {
+	case len(t.Time) > 0:
+		return t.Time
+	case len(t.GTID) > 0:
+		return "GTID " + t.GTID
+	default:
+		return fmt.Sprintf("%v:%d", t.File, t.Position)
+	}
+}
+
+// args are the mysqlbinlog options stopping at the target, --stop-position only applies to
+// the last file given
+func (t *RecoveryTarget) args() []string {
+	switch {
+	case len(t.Time) > 0:
+		return []string{"--stop-datetime=" + t.Time}
+	case len(t.GTID) > 0:
+		return []string{"--stop-position=" + t.GTID}
+	default:
+		return []string{"--stop-position=" + strconv.FormatInt(t.Position, 10)}
+	}
+}
+
+// BinlogArchive holds copies of the binary logs, either below <prefix>binlogs/ of a
+// destination, where the prefix is the one the host's backups are stored in or as plain files in a local directory such as a copy of the server's log-bin
+// directory. Files archived by archive-binlogs are stored compressed as <name>.gz, or
+// <name>.gz.enc when they are also encrypted.
+type BinlogArchive struct {
+	destination   Destination
+	directory     string
+	prefix        string
+	encryptionKey string
+	keys          map[string]string
+}
+
+// CreateBinlogArchive returns the archive of the host whose backups are stored below Prefix,
+// an empty prefix is this host
+func CreateBinlogArchive(Destination Destination, Directory string, Prefix string, EncryptionKey string) (*BinlogArchive, error) {
+	if Destination == nil && len(Directory) == 0 {
+		return nil, errors.New("binlog archive requires a destination or a directory")
+	}
+
+	return &BinlogArchive{
+		destination:   Destination,
+		directory:     Directory,
+		prefix:        Prefix,
+		encryptionKey: EncryptionKey,
+		keys:          make(map[string]string),
+	}, nil
+}
+
+func (a *BinlogArchive) Name() string {
+	if len(a.directory) > 0 {
+		return a.directory
+	}
+
+	return a.destination.Name()
+}
+
+// BinlogArchiveKey is the key of an archived binlog file below the backup prefix of a host,
+// an empty prefix is this host
+func BinlogArchiveKey(prefix string, name string) string {
+	if len(prefix) == 0 {
+		prefix = GenerateHostPrefix()
+	}
+
+	return strings.TrimSuffix(prefix, "/") + "/" + BinlogArchivePrefix + "/" + name
+}
+
+// isBinlogArchiveKey reports whether the key belongs to the binlog archive of any host rather than a backup
+func isBinlogArchiveKey(key string) bool {
+	parts := strings.SplitN(key, "/", 3)
+
+	return len(parts) == 3 && parts[1] == BinlogArchivePrefix
+}
+
+// List returns the names of the archived binlog files in sequence order
+func (a *BinlogArchive) List() ([]string, error) {
+	names := make([]string, 0)
+
+	if len(a.directory) > 0 {
+		files, err := ioutil.ReadDir(a.directory)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, f := range files {
+			if f.Mode().IsRegular() && binlogSequence(f.Name()) >= 0 {
+				names = append(names, f.Name())
+			}
+		}
+	} else {
+		objects, err := a.destination.List(BinlogArchiveKey(a.prefix, ""))
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, object := range objects {
+			name := archivedBinlogName(object.Key)
+
+			if binlogSequence(name) >= 0 {
+				names = append(names, name)
+				a.keys[name] = object.Key
+			}
+		}
+	}
+
+	sortBinlogs(names)
+
+	return names, nil
+}
+
+// Fetch copies an archived binlog file to target
+func (a *BinlogArchive) Fetch(name string, target string) error {
+	if len(a.directory) > 0 {
+		err := copyFile(filepath.Join(a.directory, name), target+".part", "download", DownloadLimiter)
+
+		if err != nil {
+			return err
+		}
+
+		return os.Rename(target+".part", target)
+	}
+
+	key, ok := a.keys[name]
+
+	if !ok {
+		key = BinlogArchiveKey(a.prefix, name)
+	}
+
+	if !strings.HasSuffix(key, ".gz") && !strings.HasSuffix(key, ".gz.enc") {
+		return a.destination.DownloadFile(key, target)
+	}
+
+	packed := target + path.Ext(key)
+	err := a.destination.DownloadFile(key, packed)
+
+	if err != nil {
+		return err
+	}
+
+	err = unpackBinlog(packed, target, a.encryptionKey, strings.HasSuffix(key, ".enc"))
+
+	if err != nil {
+		return errors.New(fmt.Sprintf("[Binlog]> Failed to unpack %v, %v", key, err))
+	}
+
+	return os.Remove(packed)
+}
+
+// archivedBinlogName returns the binlog file name of an archived object
+func archivedBinlogName(key string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(path.Base(key), ".enc"), ".gz")
+}
+
+// binlogSequence returns the number of a binlog file name like mysql-bin.000042, -1 for other files
+func binlogSequence(name string) int64 {
+	extension := filepath.Ext(name)
+
+	if len(extension) < 2 {
+		return -1
+	}
+
+	sequence, err := strconv.ParseInt(extension[1:], 10, 64)
+
+	if err != nil {
+		return -1
+	}
+
+	return sequence
+}
+
+func sortBinlogs(names []string) {
+	sort.Slice(names, func(i, j int) bool {
+		return binlogSequence(names[i]) < binlogSequence(names[j])
+	})
+}
+
+// binlogsToReplay returns the files from the one of the backup position up to the one of the
+// target. Every file in between has to be archived, a gap would silently skip transactions.
+func binlogsToReplay(available []string, start *BinlogPosition, target *RecoveryTarget) ([]string, error) {
+	first := binlogSequence(start.File)
+	last := int64(-1)
+
+	if len(target.File) > 0 {
+		last = binlogSequence(target.File)
+
+		if last < first || (last == first && target.Position < start.Position) {
+			return nil, errors.New(fmt.Sprintf("[Binlog]> Stop position %v is before the backup position %v", target, start))
+		}
+	}
+
+	files := make([]string, 0)
+
+	for _, name := range available {
+		sequence := binlogSequence(name)
+
+		if sequence < first || (last >= 0 && sequence > last) {
+			continue
+		}
+
+		if len(files) > 0 && sequence != binlogSequence(files[len(files)-1])+1 {
+			return nil, errors.New(fmt.Sprintf("[Binlog]> The archive is missing binlog files between %v and %v", files[len(files)-1], name))
+		}
+
+		files = append(files, name)
+	}
+
+	if len(files) == 0 || files[0] != start.File {
+		return nil, errors.New(fmt.Sprintf("[Binlog]> The archive does not contain %v, the binlog file of the backup", start.File))
+	}
+
+	if last >= 0 && binlogSequence(files[len(files)-1]) != last {
+		return nil, errors.New(fmt.Sprintf("[Binlog]> The archive does not contain %v", target.File))
+	}
+
+	return files, nil
+}
+
+// fetchBinlogs downloads the binlog files needed to go from start to target into directory
+func fetchBinlogs(archive *BinlogArchive, start *BinlogPosition, target *RecoveryTarget, directory string) ([]string, error) {
+	available, err := archive.List()
+
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("[Binlog]> Failed to list binlogs in %v, %v", archive.Name(), err))
+	}
+
+	names, err := binlogsToReplay(available, start, target)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(directory, 0750)
+
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]string, 0, len(names))
+
+	for _, name := range names {
+		file := filepath.Join(directory, name)
+
+		if _, err := os.Stat(file); err != nil {
+			log.Println("Fetching", name, "from", archive.Name())
+			err = archive.Fetch(name, file)
+
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		files = append(files, file)
+	}
+
+	return files, nil
+}
+
+// packBinlog compresses the binlog file into target and encrypts it when a key is given, the
+// layout is the one of backup.gz.enc with the IV appended at the end
+func packBinlog(source string, target string, keyFile string, blockSize int, threads int) error {
+	in, err := os.Open(source)
+
+	if err != nil {
+		return err
+	}
+
+	defer in.Close()
+
+	out, err := os.OpenFile(target+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+
+	if err != nil {
+		return err
+	}
+
+	defer out.Close()
+
+	var writer io.Writer = out
+	var iv []byte
+
+	if len(keyFile) > 0 {
+		k, err := ioutil.ReadFile(keyFile)
+
+		if err != nil {
+			return err
+		}
+
+		block, err := aes.NewCipher(k)
+
+		if err != nil {
+			return err
+		}
+
+		iv = make([]byte, block.BlockSize())
+
+		if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+			return err
+		}
+
+		writer = &cipher.StreamWriter{S: cipher.NewCTR(block, iv), W: out}
+	}
+
+	gzw, err := gzip.NewWriterLevel(writer, gzip.BestSpeed)
+
+	if err != nil {
+		return err
+	}
+
+	err = gzw.SetConcurrency(blockSize, threads)
+
+	if err != nil {
+		return errors.New("gzip.SetConcurrency() - " + err.Error())
+	}
+
+	_, err = io.Copy(gzw, in)
+
+	if err == nil {
+		err = gzw.Close()
+	}
+
+	if err == nil && iv != nil {
+		_, err = out.Write(iv)
+	}
+
+	if err == nil {
+		err = out.Sync()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(target+".tmp", target)
+}
+
+// unpackBinlog reverses packBinlog
+func unpackBinlog(source string, target string, keyFile string, encrypted bool) error {
+	in, err := os.Open(source)
+
+	if err != nil {
+		return err
+	}
+
+	defer in.Close()
+
+	var reader io.Reader = in
+
+	if encrypted {
+		if len(keyFile) == 0 {
+			return errors.New("the binlog is encrypted, an encryption key is required")
+		}
+
+		k, err := ioutil.ReadFile(keyFile)
+
+		if err != nil {
+			return err
+		}
+
+		block, err := aes.NewCipher(k)
+
+		if err != nil {
+			return err
+		}
+
+		stat, err := in.Stat()
+
+		if err != nil {
+			return err
+		}
+
+		msgLen := stat.Size() - int64(block.BlockSize())
+
+		if msgLen < 0 {
+			return errors.New("the file is too short to be encrypted")
+		}
+
+		iv := make([]byte, block.BlockSize())
+
+		if _, err := in.ReadAt(iv, msgLen); err != nil {
+			return err
+		}
+
+		reader = &cipher.StreamReader{S: cipher.NewCTR(block, iv), R: io.NewSectionReader(in, 0, msgLen)}
+	}
+
+	gzr, err := gzip.NewReader(reader)
+
+	if err != nil {
+		return err
+	}
+
+	defer gzr.Close()
+
+	out, err := os.OpenFile(target+".part", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, gzr)
+
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(target+".part", target)
+}
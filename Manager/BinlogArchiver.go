@@ -0,0 +1,439 @@
+package Manager
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	BinlogArchiveStateFile = "archive-binlogs.json"
+	BinlogPollInterval     = 10 * time.Second
+	BinlogRestartDelay     = 30 * time.Second
+)
+
+// BinlogArchiveState is kept in the staging directory so a restarted archiver continues after
+// the last file that reached every destination
+type BinlogArchiveState struct {
+	LastArchived string    `json:"last_archived"`
+	ArchivedAt   time.Time `json:"archived_at"`
+}
+
+func LoadBinlogArchiveState(file string) (*BinlogArchiveState, error) {
+	data, err := ioutil.ReadFile(file)
+
+	if os.IsNotExist(err) {
+		return &BinlogArchiveState{}, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	state := &BinlogArchiveState{}
+
+	return state, json.Unmarshal(data, state)
+}
+
+func (s *BinlogArchiveState) Save(file string) error {
+	payload, err := json.MarshalIndent(s, "", "\t")
+
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(file+".tmp", payload, 0640)
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(file+".tmp", file)
+}
+
+// BinlogArchiver copies the binary logs of the server with mysqlbinlog into a staging directory
+// and uploads every file the server has rotated away from to the destinations
+type BinlogArchiver struct {
+	destinations      []Destination
+	mysqlBinlogBinary string
+	mysqlBinary       string
+	host              string
+	port              int
+	username          string
+	password          string
+	stagingDirectory  string
+	prefix            string
+	encryptionKey     string
+	gzBlockSize       int
+	gzThreads         int
+	stateFile         string
+}
+
+func CreateBinlogArchiver(
+	Destinations []Destination,
+	MysqlBinlogBinary string,
+	MysqlBinary string,
+	Host string,
+	Port int,
+	Username string,
+	Password string,
+	StagingDirectory string,
+	Prefix string,
+	EncryptionKey string,
+	CompressionBlockSize int,
+	CompressionThreads int,
+) (*BinlogArchiver, error) {
+
+	if len(Destinations) == 0 {
+		return nil, errors.New("binlog archiving requires at least one destination")
+	}
+
+	err := os.MkdirAll(StagingDirectory, 0750)
+
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("[BinlogArchiver]> Unable to create staging directory, %v", err))
+	}
+
+	return &BinlogArchiver{
+		destinations:      Destinations,
+		mysqlBinlogBinary: MysqlBinlogBinary,
+		mysqlBinary:       MysqlBinary,
+		host:              Host,
+		port:              Port,
+		username:          Username,
+		password:          Password,
+		stagingDirectory:  StagingDirectory,
+		prefix:            Prefix,
+		encryptionKey:     EncryptionKey,
+		gzBlockSize:       CompressionBlockSize,
+		gzThreads:         CompressionThreads,
+		stateFile:         filepath.Join(StagingDirectory, BinlogArchiveStateFile),
+	}, nil
+}
+
+// Run keeps mysqlbinlog connected to the server and archives completed files until SIGINT or
+// SIGTERM, mysqlbinlog is restarted when the connection breaks
+func (a *BinlogArchiver) Run(startFile string) error {
+	state, err := LoadBinlogArchiveState(a.stateFile)
+
+	if err != nil {
+		return errors.New(fmt.Sprintf("[BinlogArchiver]> Failed to read %v, %v", a.stateFile, err))
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	for {
+		start, err := a.startFile(state, startFile)
+
+		if err != nil {
+			return err
+		}
+
+		log.Println("Streaming binlogs from", a.host, "starting with", start)
+
+		process := a.mysqlBinlog(start)
+		err = process.Start()
+
+		if err != nil {
+			return err
+		}
+
+		stopping := false
+		poll := time.NewTicker(BinlogPollInterval)
+
+		for running := true; running; {
+			select {
+			case <-signals:
+				log.Println("Stopping binlog archiving")
+				process.Signal(syscall.SIGTERM)
+				<-process.Exited()
+				stopping = true
+				running = false
+			case <-process.Exited():
+				log.Println("mysqlbinlog exited, restarting in", BinlogRestartDelay, process.Wait())
+				running = false
+			case <-poll.C:
+				a.archiveCompleted(state)
+			}
+		}
+
+		poll.Stop()
+
+		a.archiveCompleted(state)
+
+		if stopping {
+			return nil
+		}
+
+		select {
+		case <-signals:
+			return nil
+		case <-time.After(BinlogRestartDelay):
+		}
+	}
+}
+
+// mysqlBinlog copies the binlogs byte for byte into the staging directory, the password is
+// passed in the environment so it does not show up in the process list
+func (a *BinlogArchiver) mysqlBinlog(start string) *Process {
+	process := NewProcess("mysqlbinlog", a.mysqlBinlogBinary,
+		"--read-from-remote-server",
+		"--raw",
+		"--stop-never",
+		"--host="+a.host,
+		"--port="+strconv.Itoa(a.port),
+		"--user="+a.username,
+		"--result-file="+a.stagingDirectory+string(filepath.Separator),
+		start,
+	)
+
+	process.Env("MYSQL_PWD=" + a.password)
+	process.SetStdout(os.Stdout)
+
+	return process
+}
+
+// startFile continues with the newest file in the staging directory, which mysqlbinlog was
+// writing when it stopped, or with the file following the last archived one. The first run
+// starts with the given file or the oldest binlog the server still has.
+func (a *BinlogArchiver) startFile(state *BinlogArchiveState, startFile string) (string, error) {
+	staged, err := a.stagedFiles()
+
+	if err != nil {
+		return "", err
+	}
+
+	if len(staged) > 0 && binlogSequence(staged[len(staged)-1]) > binlogSequence(state.LastArchived) {
+		return staged[len(staged)-1], nil
+	}
+
+	if len(state.LastArchived) > 0 {
+		return nextBinlog(state.LastArchived), nil
+	}
+
+	if len(startFile) > 0 {
+		return startFile, nil
+	}
+
+	query := NewProcess("mysql", a.mysqlBinary,
+		"--host="+a.host,
+		"--port="+strconv.Itoa(a.port),
+		"--user="+a.username,
+		"--batch",
+		"--skip-column-names",
+		"-e", "SHOW BINARY LOGS",
+	)
+	query.Env("MYSQL_PWD=" + a.password)
+
+	output := &bytes.Buffer{}
+	query.SetStdout(output)
+
+	err = query.Run()
+
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("[BinlogArchiver]> Failed to list the binary logs of the server, %v", err))
+	}
+
+	fields := strings.Fields(output.String())
+
+	if len(fields) == 0 {
+		return "", errors.New("[BinlogArchiver]> The server has no binary logs, is log_bin enabled?")
+	}
+
+	return fields[0], nil
+}
+
+// nextBinlog returns the name of the file following name, keeping the width of the number
+func nextBinlog(name string) string {
+	extension := filepath.Ext(name)
+
+	return fmt.Sprintf("%v.%0*d", strings.TrimSuffix(name, extension), len(extension)-1, binlogSequence(name)+1)
+}
+
+func (a *BinlogArchiver) stagedFiles() ([]string, error) {
+	files, err := ioutil.ReadDir(a.stagingDirectory)
+
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0)
+
+	for _, f := range files {
+		if f.Mode().IsRegular() && binlogSequence(f.Name()) >= 0 {
+			names = append(names, f.Name())
+		}
+	}
+
+	sortBinlogs(names)
+
+	return names, nil
+}
+
+// archiveCompleted uploads the staged files that mysqlbinlog has finished, which are all but the
+// newest one. A file that fails is retried on the next call, the following files wait for it so
+// the archive never has gaps.
+func (a *BinlogArchiver) archiveCompleted(state *BinlogArchiveState) {
+	staged, err := a.stagedFiles()
+
+	if err != nil {
+		log.Println("Failed to list staged binlogs:", err)
+		return
+	}
+
+	if len(staged) > 0 {
+		staged = staged[:len(staged)-1]
+	}
+
+	archived := false
+
+	for _, name := range staged {
+		//e.g. left behind by a crash between saving the state and removing the file, or the state
+		//file was restored from a later copy
+		if len(state.LastArchived) > 0 && binlogSequence(name) <= binlogSequence(state.LastArchived) {
+			log.Println("Discarding staged", name+", the state file records", state.LastArchived, "as archived last")
+			os.Remove(filepath.Join(a.stagingDirectory, name))
+			continue
+		}
+
+		err := a.archive(name)
+
+		if err != nil {
+			log.Println("Archiving", name, "has failed, retrying later:", err)
+			break
+		}
+
+		state.LastArchived = name
+		state.ArchivedAt = time.Now()
+
+		err = state.Save(a.stateFile)
+
+		if err != nil {
+			log.Println("Failed to save", a.stateFile, err)
+			break
+		}
+
+		os.Remove(filepath.Join(a.stagingDirectory, name))
+		archived = true
+	}
+
+	if !archived {
+		return
+	}
+
+	for _, destination := range a.destinations {
+		err := PruneBinlogs(destination, a.prefix)
+
+		if err != nil {
+			log.Println("Pruning binlogs in", destination.Name(), "has failed:", err)
+		}
+	}
+}
+
+// archive compresses and encrypts the file and uploads it to every destination
+func (a *BinlogArchiver) archive(name string) error {
+	source := filepath.Join(a.stagingDirectory, name)
+	packed := source + ".gz"
+
+	if len(a.encryptionKey) > 0 {
+		packed += ".enc"
+	}
+
+	err := packBinlog(source, packed, a.encryptionKey, a.gzBlockSize, a.gzThreads)
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(packed)
+
+	checksum, err := FileSha256(packed)
+
+	if err != nil {
+		return err
+	}
+
+	metadata := map[string]string{Sha256MetadataKey: checksum, "binlog-file": name}
+	key := BinlogArchiveKey(a.prefix, filepath.Base(packed))
+
+	for _, destination := range a.destinations {
+		err = destination.UploadFile(packed, key, metadata)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Println("Archived", name, "to", key)
+
+	return nil
+}
+
+// PruneBinlogs deletes the archived binlogs that are older than the binlog position of the
+// oldest full backup still kept, nothing before it can be restored anyway. Without a backup
+// with a known position nothing is deleted. The backups and binlogs are the ones below prefix,
+// an empty prefix is this host.
+func PruneBinlogs(destination Destination, prefix string) error {
+	if len(prefix) == 0 {
+		prefix = GenerateHostPrefix()
+	}
+
+	backups, err := ReadCatalogPrefix(destination, strings.TrimSuffix(prefix, "/")+"/")
+
+	if err != nil {
+		return err
+	}
+
+	var oldest *RemoteBackup
+
+	for _, chain := range BuildChains(backups) {
+		if oldest == nil || chain[0].Time.Before(oldest.Time) {
+			oldest = chain[0]
+		}
+	}
+
+	if oldest == nil {
+		return nil
+	}
+
+	position, err := BackupBinlogPosition(destination, oldest)
+
+	if err != nil {
+		log.Println("Not pruning binlogs in", destination.Name(), "-", err)
+		return nil
+	}
+
+	objects, err := destination.List(BinlogArchiveKey(prefix, ""))
+
+	if err != nil {
+		return err
+	}
+
+	for _, object := range objects {
+		sequence := binlogSequence(archivedBinlogName(object.Key))
+
+		if sequence < 0 || sequence >= binlogSequence(position.File) {
+			continue
+		}
+
+		_, err := destination.Delete(object)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
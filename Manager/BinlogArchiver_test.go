@@ -0,0 +1,240 @@
+package Manager
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNextBinlog(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "mysql-bin.000001", want: "mysql-bin.000002"},
+		{name: "mysql-bin.000009", want: "mysql-bin.000010"},
+		{name: "mysql-bin.000999", want: "mysql-bin.001000"},
+		{name: "mysql-bin.999999", want: "mysql-bin.1000000"},
+		{name: "mysql-bin.1000000", want: "mysql-bin.1000001"},
+		{name: "db.log.bin.41", want: "db.log.bin.42"},
+	}
+
+	for _, test := range tests {
+		if got := nextBinlog(test.name); got != test.want {
+			t.Errorf("%v: got %v, want %v", test.name, got, test.want)
+		}
+
+		if binlogSequence(nextBinlog(test.name)) != binlogSequence(test.name)+1 {
+			t.Errorf("%v: the sequence of %v does not follow", test.name, nextBinlog(test.name))
+		}
+	}
+}
+
+func TestBinlogArchiverStartFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archiver")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	//SHOW BINARY LOGS of the server, oldest first
+	mysql := filepath.Join(dir, "mysql")
+	err = ioutil.WriteFile(mysql, []byte("#!/bin/sh\nprintf 'mysql-bin.000003\\t1024\\nmysql-bin.000004\\t512\\n'\n"), 0750)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		staged       []string
+		lastArchived string
+		startFile    string
+		want         string
+	}{
+		{name: "first run asks the server", want: "mysql-bin.000003"},
+		{name: "first run with a start file", startFile: "mysql-bin.000004", want: "mysql-bin.000004"},
+		{name: "continues the file being written", staged: []string{"mysql-bin.000007", "mysql-bin.000008"}, lastArchived: "mysql-bin.000006", startFile: "mysql-bin.000001", want: "mysql-bin.000008"},
+		{name: "follows the last archived file", lastArchived: "mysql-bin.000006", startFile: "mysql-bin.000001", want: "mysql-bin.000007"},
+		{name: "staged files already archived", staged: []string{"mysql-bin.000005", "mysql-bin.000006", "mysql-bin.000006.gz"}, lastArchived: "mysql-bin.000006", want: "mysql-bin.000007"},
+		{name: "rollover of the last archived file", lastArchived: "mysql-bin.999999", want: "mysql-bin.1000000"},
+		{name: "staged across the rollover", staged: []string{"mysql-bin.999999", "mysql-bin.1000000"}, lastArchived: "mysql-bin.999998", want: "mysql-bin.1000000"},
+	}
+
+	for _, test := range tests {
+		staging := filepath.Join(dir, "staging")
+		os.RemoveAll(staging)
+		err = os.MkdirAll(staging, 0750)
+
+		for _, name := range test.staged {
+			if err == nil {
+				err = ioutil.WriteFile(filepath.Join(staging, name), []byte("binlog"), 0640)
+			}
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		archiver := &BinlogArchiver{mysqlBinary: mysql, stagingDirectory: staging}
+		start, err := archiver.startFile(&BinlogArchiveState{LastArchived: test.lastArchived}, test.startFile)
+
+		if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+			continue
+		}
+
+		if start != test.want {
+			t.Errorf("%v: got %v, want %v", test.name, start, test.want)
+		}
+	}
+}
+
+// testRemoteBackup stores the files of a backup below host/ of the destination root, without
+// an xtrabackup_info when the binlog file is empty
+func testRemoteBackup(t *testing.T, root string, id string, mode string, fromLSN string, toLSN string, finished time.Time, binlog string) {
+	prefix := filepath.Join(root, "host", finished.Format("2006-01-02"), id)
+	manifest, _ := json.Marshal(BackupManifest{Id: id, Mode: mode, FromLSN: fromLSN, ToLSN: toLSN, FinishedAt: finished})
+
+	files := map[string]string{
+		"backup.gz.enc":   "backup",
+		"checksum":        "checksum",
+		CheckpointsFile:   "backup_type = full-backuped\nfrom_lsn = " + fromLSN + "\nto_lsn = " + toLSN + "\n",
+		ManifestFile:      string(manifest),
+		"xtrabackup_info": "binlog_pos = filename '" + binlog + "', position '4'\n",
+	}
+
+	if len(binlog) == 0 {
+		delete(files, "xtrabackup_info")
+	}
+
+	for file, content := range files {
+		writeTestFile(t, filepath.Join(prefix, file), 0)
+
+		err := ioutil.WriteFile(filepath.Join(prefix, file), []byte(content), 0640)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPruneBinlogs(t *testing.T) {
+	finished := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		backups  func(root string)
+		archived []string
+		kept     string
+	}{
+		{
+			name:     "no backups",
+			backups:  func(root string) {},
+			archived: []string{"mysql-bin.000001.gz", "mysql-bin.000002.gz"},
+			kept:     "mysql-bin.000001,mysql-bin.000002",
+		},
+		{
+			name: "everything from the position of the oldest full backup",
+			backups: func(root string) {
+				testRemoteBackup(t, root, "full-1", FullBackupMode, "0", "100", finished, "mysql-bin.000003")
+				testRemoteBackup(t, root, "incr-1", IncrementalBackupMode, "100", "200", finished.Add(time.Hour), "mysql-bin.000004")
+				testRemoteBackup(t, root, "full-2", FullBackupMode, "0", "300", finished.Add(2*time.Hour), "mysql-bin.000005")
+			},
+			archived: []string{"mysql-bin.000001.gz.enc", "mysql-bin.000002.gz.enc", "mysql-bin.000003.gz.enc", "mysql-bin.000004.gz.enc", "mysql-bin.000006.gz.enc"},
+			kept:     "mysql-bin.000003,mysql-bin.000004,mysql-bin.000006",
+		},
+		{
+			name: "oldest full backup without a binlog position",
+			backups: func(root string) {
+				testRemoteBackup(t, root, "full-1", FullBackupMode, "0", "100", finished, "")
+				testRemoteBackup(t, root, "full-2", FullBackupMode, "0", "300", finished.Add(time.Hour), "mysql-bin.000005")
+			},
+			archived: []string{"mysql-bin.000001.gz", "mysql-bin.000005.gz"},
+			kept:     "mysql-bin.000001,mysql-bin.000005",
+		},
+		{
+			name: "rollover",
+			backups: func(root string) {
+				testRemoteBackup(t, root, "full-1", FullBackupMode, "0", "100", finished, "mysql-bin.1000000")
+			},
+			archived: []string{"mysql-bin.999998.gz", "mysql-bin.999999.gz", "mysql-bin.1000000.gz", "mysql-bin.1000001.gz"},
+			kept:     "mysql-bin.1000000,mysql-bin.1000001",
+		},
+	}
+
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "prune")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer os.RemoveAll(dir)
+
+		destination, err := CreateLocalDestination(dir, 0)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		test.backups(dir)
+
+		for _, name := range test.archived {
+			writeTestFile(t, filepath.Join(dir, "host", BinlogArchivePrefix, name), 10)
+			//binlogs of other hosts are left alone
+			writeTestFile(t, filepath.Join(dir, "other", BinlogArchivePrefix, name), 10)
+		}
+
+		err = PruneBinlogs(destination, "host/")
+
+		if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+			continue
+		}
+
+		for _, host := range []string{"host", "other"} {
+			objects, err := destination.List(BinlogArchiveKey(host, ""))
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			names := make([]string, 0)
+
+			for _, object := range objects {
+				names = append(names, archivedBinlogName(object.Key))
+			}
+
+			sortBinlogs(names)
+			want := test.kept
+
+			if host == "other" {
+				want = strings.Join(archivedNames(test.archived), ",")
+			}
+
+			if strings.Join(names, ",") != want {
+				t.Errorf("%v: %v keeps %v, want %v", test.name, host, strings.Join(names, ","), want)
+			}
+		}
+	}
+}
+
+// archivedNames returns the binlog names of the archived keys, oldest first
+func archivedNames(keys []string) []string {
+	names := make([]string, 0, len(keys))
+
+	for _, key := range keys {
+		names = append(names, archivedBinlogName(key))
+	}
+
+	sortBinlogs(names)
+
+	return names
+}
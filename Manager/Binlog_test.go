@@ -0,0 +1,236 @@
+package Manager
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseRecoveryTarget(t *testing.T) {
+	tests := []struct {
+		datetime string
+		position string
+		want     RecoveryTarget
+		err      bool
+	}{
+		{datetime: "2026-10-17 14:00:00", want: RecoveryTarget{Time: "2026-10-17 14:00:00"}},
+		{datetime: "2026-10-17T14:00:00Z", err: true},
+		{position: "mysql-bin.000042:1234", want: RecoveryTarget{File: "mysql-bin.000042", Position: 1234}},
+		{position: "/var/log/mysql/mysql-bin.000042:4", want: RecoveryTarget{File: "/var/log/mysql/mysql-bin.000042", Position: 4}},
+		{position: "0-1-100", want: RecoveryTarget{GTID: "0-1-100"}},
+		{position: "0-1-100,1-2-7", want: RecoveryTarget{GTID: "0-1-100,1-2-7"}},
+		{position: "mysql-bin.000042", err: true},
+		{position: ":1234", err: true},
+		{position: "mysql-bin.000042:end", err: true},
+		{datetime: "2026-10-17 14:00:00", position: "0-1-100", err: true},
+	}
+
+	for _, test := range tests {
+		target, err := ParseRecoveryTarget(test.datetime, test.position)
+
+		if test.err {
+			if err == nil {
+				t.Errorf("%q %q: expected an error, got %+v", test.datetime, test.position, target)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%q %q: %v", test.datetime, test.position, err)
+			continue
+		}
+
+		if *target != test.want {
+			t.Errorf("%q %q: got %+v, want %+v", test.datetime, test.position, *target, test.want)
+		}
+	}
+}
+
+func TestBinlogsToReplay(t *testing.T) {
+	archived := []string{"mysql-bin.000001", "mysql-bin.000002", "mysql-bin.000003", "mysql-bin.000004", "mysql-bin.000006", "mysql-bin.000007"}
+
+	tests := []struct {
+		name   string
+		start  BinlogPosition
+		target RecoveryTarget
+		files  string
+		err    string
+	}{
+		{
+			name:   "up to a time replays everything from the backup",
+			start:  BinlogPosition{File: "mysql-bin.000002", Position: 400},
+			target: RecoveryTarget{Time: "2026-10-17 14:00:00"},
+			err:    "missing binlog files between mysql-bin.000004 and mysql-bin.000006",
+		},
+		{
+			name:   "up to a file before the gap",
+			start:  BinlogPosition{File: "mysql-bin.000002", Position: 400},
+			target: RecoveryTarget{File: "mysql-bin.000004", Position: 10},
+			files:  "mysql-bin.000002,mysql-bin.000003,mysql-bin.000004",
+		},
+		{
+			name:   "within the file of the backup",
+			start:  BinlogPosition{File: "mysql-bin.000003", Position: 400},
+			target: RecoveryTarget{File: "mysql-bin.000003", Position: 900},
+			files:  "mysql-bin.000003",
+		},
+		{
+			name:   "after the gap",
+			start:  BinlogPosition{File: "mysql-bin.000006", Position: 4},
+			target: RecoveryTarget{GTID: "0-1-100"},
+			files:  "mysql-bin.000006,mysql-bin.000007",
+		},
+		{
+			name:   "stop position before the backup",
+			start:  BinlogPosition{File: "mysql-bin.000003", Position: 400},
+			target: RecoveryTarget{File: "mysql-bin.000003", Position: 100},
+			err:    "is before the backup position",
+		},
+		{
+			name:   "binlog of the backup not archived",
+			start:  BinlogPosition{File: "mysql-bin.000005", Position: 4},
+			target: RecoveryTarget{File: "mysql-bin.000007", Position: 4},
+			err:    "does not contain mysql-bin.000005",
+		},
+		{
+			name:   "stop file not archived yet",
+			start:  BinlogPosition{File: "mysql-bin.000006", Position: 4},
+			target: RecoveryTarget{File: "mysql-bin.000008", Position: 4},
+			err:    "does not contain mysql-bin.000008",
+		},
+	}
+
+	for _, test := range tests {
+		files, err := binlogsToReplay(archived, &test.start, &test.target)
+
+		if len(test.err) > 0 {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%v: got %v, %v, want an error containing %q", test.name, files, err, test.err)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+			continue
+		}
+
+		if strings.Join(files, ",") != test.files {
+			t.Errorf("%v: got %v, want %v", test.name, strings.Join(files, ","), test.files)
+		}
+	}
+}
+
+func TestPackBinlogRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "binlog")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	key := filepath.Join(dir, "key")
+	otherKey := filepath.Join(dir, "other-key")
+	source := filepath.Join(dir, "mysql-bin.000001")
+	content := bytes.Repeat([]byte("binlog event "), 100000)
+
+	err = ioutil.WriteFile(key, []byte("0123456789abcdef0123456789abcdef"), 0600)
+
+	if err == nil {
+		err = ioutil.WriteFile(otherKey, []byte("fedcba9876543210fedcba9876543210"), 0600)
+	}
+
+	if err == nil {
+		err = ioutil.WriteFile(source, content, 0640)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		packKey   string
+		unpackKey string
+		encrypted bool
+		err       bool
+	}{
+		{name: "compressed", encrypted: false},
+		{name: "encrypted", packKey: key, unpackKey: key, encrypted: true},
+		{name: "missing key", packKey: key, encrypted: true, err: true},
+		{name: "wrong key", packKey: key, unpackKey: otherKey, encrypted: true, err: true},
+	}
+
+	for _, test := range tests {
+		packed := filepath.Join(dir, "packed")
+		unpacked := filepath.Join(dir, "unpacked")
+		os.Remove(unpacked)
+
+		err = packBinlog(source, packed, test.packKey, 1<<20, 2)
+
+		if err != nil {
+			t.Errorf("%v: pack failed, %v", test.name, err)
+			continue
+		}
+
+		data, err := ioutil.ReadFile(packed)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if bytes.Contains(data, []byte("binlog event")) {
+			t.Errorf("%v: the packed file contains the plain binlog", test.name)
+		}
+
+		err = unpackBinlog(packed, unpacked, test.unpackKey, test.encrypted)
+
+		if test.err {
+			if err == nil {
+				t.Errorf("%v: expected unpacking to fail", test.name)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%v: unpack failed, %v", test.name, err)
+			continue
+		}
+
+		data, err = ioutil.ReadFile(unpacked)
+
+		if err != nil || !bytes.Equal(data, content) {
+			t.Errorf("%v: the unpacked binlog differs from the original, %v", test.name, err)
+		}
+	}
+}
+
+func TestBinlogArchiveKey(t *testing.T) {
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{prefix: "", want: GenerateHostPrefix() + "binlogs/mysql-bin.000001.gz"},
+		{prefix: "db2.example.com/", want: "db2.example.com/binlogs/mysql-bin.000001.gz"},
+		{prefix: "db2.example.com", want: "db2.example.com/binlogs/mysql-bin.000001.gz"},
+	}
+
+	for _, test := range tests {
+		key := BinlogArchiveKey(test.prefix, "mysql-bin.000001.gz")
+
+		if key != test.want {
+			t.Errorf("%q: got %v, want %v", test.prefix, key, test.want)
+		}
+
+		if !isBinlogArchiveKey(key) {
+			t.Errorf("%q: %v is not recognised as an archived binlog", test.prefix, key)
+		}
+	}
+}
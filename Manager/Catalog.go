@@ -0,0 +1,224 @@
+package Manager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// files that have to be present in remote storage for a backup to be restorable
+var requiredBackupFiles = []string{"backup.gz.enc", "xtrabackup_checkpoints", "checksum"}
+
+// RemoteBackup is a single backup (one chain member) found in remote storage
+type RemoteBackup struct {
+	Prefix  string
+	Id      string
+	Mode    string
+	Time    time.Time
+	FromLSN string
+	ToLSN   string
+	Objects map[string]RemoteObject
+	//size of the extracted xbstream from the manifest, 0 when unknown
+	StreamSize int64
+}
+
+// RemoteChain is a full backup followed by the incrementals taken on top of it
+type RemoteChain []*RemoteBackup
+
+func (r *RemoteBackup) Complete() bool {
+	for _, file := range requiredBackupFiles {
+		if _, ok := r.Objects[file]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (r *RemoteBackup) Size() int64 {
+	size := int64(0)
+
+	for _, object := range r.Objects {
+		size += object.Size
+	}
+
+	return size
+}
+
+func (r *RemoteBackup) String() string {
+	return fmt.Sprintf("%v %-11v %v LSN %v-%v (%v)", r.Id, r.Mode, r.Time.Format(time.RFC3339), r.FromLSN, r.ToLSN, r.Prefix)
+}
+
+// ReadCatalog groups this host's remote objects into backups and reads their metadata
+func ReadCatalog(destination Destination) ([]*RemoteBackup, error) {
+	return ReadCatalogPrefix(destination, GenerateHostPrefix())
+}
+
+// ReadCatalogPrefix reads the backups below another prefix, e.g. the one of the host whose
+// backups are restored on a fresh host
+func ReadCatalogPrefix(destination Destination, prefix string) ([]*RemoteBackup, error) {
+	objects, err := destination.List(prefix)
+
+	if err != nil {
+		return nil, err
+	}
+
+	byPrefix := make(map[string]*RemoteBackup)
+
+	for _, object := range objects {
+		prefix := path.Dir(object.Key)
+
+		if isBinlogArchiveKey(object.Key) {
+			continue
+		}
+
+		if _, ok := byPrefix[prefix]; !ok {
+			byPrefix[prefix] = &RemoteBackup{
+				Prefix:  prefix,
+				Objects: make(map[string]RemoteObject),
+			}
+		}
+
+		byPrefix[prefix].Objects[path.Base(object.Key)] = object
+	}
+
+	backups := make([]*RemoteBackup, 0, len(byPrefix))
+
+	for _, backup := range byPrefix {
+		if _, ok := backup.Objects["backup.gz.enc"]; !ok {
+			continue
+		}
+
+		err = readBackupMetadata(destination, backup)
+
+		if err != nil {
+			log.Printf("Skipping %v, unable to read backup metadata: %v", backup.Prefix, err)
+			continue
+		}
+
+		backups = append(backups, backup)
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].Time.Before(backups[j].Time)
+	})
+
+	return backups, nil
+}
+
+// readBackupMetadata uses the uploaded manifest and falls back to xtrabackup_checkpoints
+// for backups taken before manifests were introduced
+func readBackupMetadata(destination Destination, backup *RemoteBackup) error {
+	backup.Time = backup.Objects["backup.gz.enc"].LastModified
+
+	if object, ok := backup.Objects[ManifestFile]; ok {
+		reader, err := destination.Open(object.Key)
+
+		if err != nil {
+			return err
+		}
+
+		manifest := &BackupManifest{}
+		err = json.NewDecoder(reader).Decode(manifest)
+		reader.Close()
+
+		if err != nil {
+			return err
+		}
+
+		backup.Id = manifest.Id
+		backup.Mode = manifest.Mode
+		backup.FromLSN = manifest.FromLSN
+		backup.ToLSN = manifest.ToLSN
+		backup.Time = manifest.FinishedAt
+		backup.StreamSize = manifest.StreamSize
+
+		return nil
+	}
+
+	object, ok := backup.Objects[CheckpointsFile]
+
+	if !ok {
+		return errors.New("missing " + CheckpointsFile)
+	}
+
+	reader, err := destination.Open(object.Key)
+
+	if err != nil {
+		return err
+	}
+
+	checkpoints, err := ParseCheckpoints(reader)
+	reader.Close()
+
+	if err != nil {
+		return err
+	}
+
+	backup.Id = backup.Time.UTC().Format(BackupIdFormat)
+	backup.FromLSN = checkpoints["from_lsn"]
+	backup.ToLSN = checkpoints["to_lsn"]
+	backup.Mode = IncrementalBackupMode
+
+	if strings.HasPrefix(checkpoints["backup_type"], "full") || backup.FromLSN == "0" {
+		backup.Mode = FullBackupMode
+	}
+
+	return nil
+}
+
+// BuildChains links complete backups into chains, an incremental continues a chain when its
+// from_lsn matches the to_lsn of the chain's last member
+func BuildChains(backups []*RemoteBackup) []RemoteChain {
+	chains := make([]RemoteChain, 0)
+
+	for _, backup := range backups {
+		if !backup.Complete() {
+			continue
+		}
+
+		if backup.Mode == FullBackupMode {
+			chains = append(chains, RemoteChain{backup})
+			continue
+		}
+
+		for i := len(chains) - 1; i >= 0; i-- {
+			last := chains[i][len(chains[i])-1]
+
+			if last.ToLSN == backup.FromLSN {
+				chains[i] = append(chains[i], backup)
+				break
+			}
+		}
+	}
+
+	return chains
+}
+
+// FindChain returns the chain prefix ending with the newest backup taken at or before the given time
+func FindChain(chains []RemoteChain, at time.Time) (RemoteChain, error) {
+	var found RemoteChain
+
+	for _, chain := range chains {
+		for i, backup := range chain {
+			if backup.Time.After(at) {
+				break
+			}
+
+			if found == nil || backup.Time.After(found[len(found)-1].Time) {
+				found = chain[:i+1]
+			}
+		}
+	}
+
+	if found == nil {
+		return nil, errors.New(fmt.Sprintf("no complete backup chain found ending at or before %v", at.Format(time.RFC3339)))
+	}
+
+	return found, nil
+}
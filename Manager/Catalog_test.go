@@ -0,0 +1,150 @@
+package Manager
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+var catalogStart = time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+
+// testBackup returns a complete backup taken hours after catalogStart
+func testBackup(id string, mode string, fromLSN string, toLSN string, hours int) *RemoteBackup {
+	backup := &RemoteBackup{
+		Prefix:  "host/2026-10-01/" + id,
+		Id:      id,
+		Mode:    mode,
+		Time:    catalogStart.Add(time.Duration(hours) * time.Hour),
+		FromLSN: fromLSN,
+		ToLSN:   toLSN,
+		Objects: make(map[string]RemoteObject),
+	}
+
+	for _, file := range requiredBackupFiles {
+		backup.Objects[file] = RemoteObject{Key: backup.Prefix + "/" + file}
+	}
+
+	return backup
+}
+
+func chainIds(chain RemoteChain) string {
+	ids := make([]string, len(chain))
+
+	for i, backup := range chain {
+		ids[i] = backup.Id
+	}
+
+	return strings.Join(ids, ",")
+}
+
+func TestBuildChains(t *testing.T) {
+	incomplete := testBackup("i3", IncrementalBackupMode, "300", "400", 4)
+	delete(incomplete.Objects, "checksum")
+
+	tests := []struct {
+		name    string
+		backups []*RemoteBackup
+		chains  []string
+	}{
+		{
+			name:    "empty",
+			backups: nil,
+			chains:  []string{},
+		},
+		{
+			name: "one chain",
+			backups: []*RemoteBackup{
+				testBackup("f1", FullBackupMode, "0", "100", 0),
+				testBackup("i1", IncrementalBackupMode, "100", "200", 1),
+				testBackup("i2", IncrementalBackupMode, "200", "300", 2),
+			},
+			chains: []string{"f1,i1,i2"},
+		},
+		{
+			name: "incomplete backups are skipped and break the chain",
+			backups: []*RemoteBackup{
+				testBackup("f1", FullBackupMode, "0", "300", 0),
+				incomplete,
+				testBackup("i4", IncrementalBackupMode, "400", "500", 5),
+			},
+			chains: []string{"f1"},
+		},
+		{
+			name: "incrementals continue the chain with the matching LSN",
+			backups: []*RemoteBackup{
+				testBackup("f1", FullBackupMode, "0", "100", 0),
+				testBackup("i1", IncrementalBackupMode, "100", "200", 1),
+				testBackup("f2", FullBackupMode, "0", "250", 2),
+				testBackup("i2", IncrementalBackupMode, "250", "300", 3),
+				testBackup("i3", IncrementalBackupMode, "200", "260", 4),
+			},
+			chains: []string{"f1,i1,i3", "f2,i2"},
+		},
+		{
+			name: "incremental without a base",
+			backups: []*RemoteBackup{
+				testBackup("i1", IncrementalBackupMode, "100", "200", 0),
+				testBackup("f1", FullBackupMode, "0", "300", 1),
+			},
+			chains: []string{"f1"},
+		},
+	}
+
+	for _, test := range tests {
+		chains := BuildChains(test.backups)
+		got := make([]string, len(chains))
+
+		for i, chain := range chains {
+			got[i] = chainIds(chain)
+		}
+
+		if strings.Join(got, " ") != strings.Join(test.chains, " ") {
+			t.Errorf("%v: got chains %v, want %v", test.name, got, test.chains)
+		}
+	}
+}
+
+func TestFindChain(t *testing.T) {
+	chains := BuildChains([]*RemoteBackup{
+		testBackup("f1", FullBackupMode, "0", "100", 0),
+		testBackup("i1", IncrementalBackupMode, "100", "200", 1),
+		testBackup("i2", IncrementalBackupMode, "200", "300", 2),
+		testBackup("f2", FullBackupMode, "0", "400", 24),
+		testBackup("i3", IncrementalBackupMode, "400", "500", 25),
+	})
+
+	tests := []struct {
+		name  string
+		hours float64
+		chain string
+		err   bool
+	}{
+		{name: "before the first backup", hours: -1, err: true},
+		{name: "at the full backup", hours: 0, chain: "f1"},
+		{name: "between incrementals", hours: 1.5, chain: "f1,i1"},
+		{name: "before the next full backup", hours: 23, chain: "f1,i1,i2"},
+		{name: "at the next full backup", hours: 24, chain: "f2"},
+		{name: "latest", hours: 1000, chain: "f2,i3"},
+	}
+
+	for _, test := range tests {
+		chain, err := FindChain(chains, catalogStart.Add(time.Duration(test.hours*float64(time.Hour))))
+
+		if test.err {
+			if err == nil {
+				t.Errorf("%v: expected an error, got %v", test.name, chainIds(chain))
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+			continue
+		}
+
+		if chainIds(chain) != test.chain {
+			t.Errorf("%v: got %v, want %v", test.name, chainIds(chain), test.chain)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package Manager
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DiscoverLocalChain rebuilds the chain of a source directory from its full/ and incr/N
+// directories, described the same way ReadCatalog describes remote backups with Prefix being
+// the backup directory. The chain ends before the first incremental that is missing or does
+// not continue at the LSN where the previous member ended.
+func DiscoverLocalChain(sourceDirectory string) (RemoteChain, error) {
+	chain := make(RemoteChain, 0)
+
+	for i, directory := range LocalBackups(sourceDirectory) {
+		if directory != filepath.Join(sourceDirectory, BackupSubDirectory(i)) {
+			if len(chain) > 0 {
+				log.Printf("Chain in %v ends at %v, %v is missing", sourceDirectory, chain[len(chain)-1].Prefix, BackupSubDirectory(i))
+			}
+			break
+		}
+
+		backup, err := readLocalBackup(directory)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if i == 0 && backup.Mode != FullBackupMode {
+			return nil, errors.New(fmt.Sprintf("[Chain]> %v is not a full backup", directory))
+		}
+
+		if i > 0 && backup.FromLSN != chain[i-1].ToLSN {
+			log.Printf("Chain in %v ends at %v, %v starts at LSN %v instead of %v", sourceDirectory, chain[i-1].Prefix, directory, backup.FromLSN, chain[i-1].ToLSN)
+			break
+		}
+
+		chain = append(chain, backup)
+	}
+
+	if len(chain) == 0 {
+		return nil, errors.New(fmt.Sprintf("[Chain]> No full backup found in %v", sourceDirectory))
+	}
+
+	return chain, nil
+}
+
+// readLocalBackup uses the manifest and falls back to xtrabackup_checkpoints for backups taken
+// before manifests were introduced
+func readLocalBackup(directory string) (*RemoteBackup, error) {
+	backup := &RemoteBackup{Prefix: directory}
+
+	if manifest, err := LoadManifest(directory); err == nil {
+		backup.Id = manifest.Id
+		backup.Mode = manifest.Mode
+		backup.FromLSN = manifest.FromLSN
+		backup.ToLSN = manifest.ToLSN
+		backup.Time = manifest.FinishedAt
+		backup.StreamSize = manifest.StreamSize
+
+		return backup, nil
+	}
+
+	checkpoints, err := ReadCheckpoints(directory)
+
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("[Chain]> Unable to read backup in %v, %v", directory, err))
+	}
+
+	stat, err := os.Stat(filepath.Join(directory, CheckpointsFile))
+
+	if err != nil {
+		return nil, err
+	}
+
+	backup.Time = stat.ModTime()
+	backup.Id = backup.Time.UTC().Format(BackupIdFormat)
+	backup.FromLSN = checkpoints["from_lsn"]
+	backup.ToLSN = checkpoints["to_lsn"]
+	backup.Mode = IncrementalBackupMode
+
+	if strings.HasPrefix(checkpoints["backup_type"], "full") || backup.FromLSN == "0" {
+		backup.Mode = FullBackupMode
+	}
+
+	return backup, nil
+}
+
+// ChainUpTo returns the prefix of the chain ending with the member given by upto: its position
+// (0 is the full backup), its backup id or a time in RFC3339, which selects the newest member
+// finished at or before it. An empty upto returns the whole chain.
+func ChainUpTo(chain RemoteChain, upto string) (RemoteChain, error) {
+	if len(upto) == 0 {
+		return chain, nil
+	}
+
+	if position, err := strconv.Atoi(upto); err == nil {
+		if position < 0 || position >= len(chain) {
+			return nil, errors.New(fmt.Sprintf("invalid position %d, the chain has positions 0 to %d", position, len(chain)-1))
+		}
+
+		return chain[:position+1], nil
+	}
+
+	if at, err := time.Parse(time.RFC3339, upto); err == nil {
+		for i := len(chain) - 1; i >= 0; i-- {
+			if !chain[i].Time.After(at) {
+				return chain[:i+1], nil
+			}
+		}
+
+		return nil, errors.New(fmt.Sprintf("no backup of the chain finished at or before %v", upto))
+	}
+
+	for i, backup := range chain {
+		if backup.Id == upto {
+			return chain[:i+1], nil
+		}
+	}
+
+	return nil, errors.New("invalid -upto, expected a position, a backup id or a time in RFC3339, no backup of the chain matches: " + upto)
+}
+
+// ValidateChain checks that the chain starts with a full backup and that every incremental
+// continues at the LSN where the previous member ended
+func ValidateChain(chain RemoteChain) error {
+	if len(chain) == 0 {
+		return errors.New("[Chain]> The chain is empty")
+	}
+
+	if chain[0].Mode != FullBackupMode {
+		return errors.New(fmt.Sprintf("[Chain]> The chain starts with %v, which is not a full backup", chain[0].Prefix))
+	}
+
+	for i := 1; i < len(chain); i++ {
+		if chain[i].Mode != IncrementalBackupMode {
+			return errors.New(fmt.Sprintf("[Chain]> %v is not an incremental backup", chain[i].Prefix))
+		}
+
+		if chain[i].FromLSN != chain[i-1].ToLSN {
+			return errors.New(fmt.Sprintf("[Chain]> %v starts at LSN %v but %v ends at LSN %v, the chain is broken", chain[i].Prefix, chain[i].FromLSN, chain[i-1].Prefix, chain[i-1].ToLSN))
+		}
+	}
+
+	return nil
+}
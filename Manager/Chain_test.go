@@ -0,0 +1,93 @@
+package Manager
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestChainUpTo(t *testing.T) {
+	chain := RemoteChain{
+		testBackup("20261001T000000Z", FullBackupMode, "0", "100", 0),
+		testBackup("20261001T010000Z", IncrementalBackupMode, "100", "200", 1),
+		testBackup("20261001T020000Z", IncrementalBackupMode, "200", "300", 2),
+		testBackup("20261001T030000Z", IncrementalBackupMode, "300", "400", 3),
+	}
+
+	tests := []struct {
+		upto  string
+		count int
+		err   bool
+	}{
+		{upto: "", count: 4},
+		{upto: "0", count: 1},
+		{upto: "2", count: 3},
+		{upto: "3", count: 4},
+		{upto: "4", err: true},
+		{upto: "-1", err: true},
+		{upto: "20261001T010000Z", count: 2},
+		{upto: "20261002T000000Z", err: true},
+		{upto: "2026-10-01T02:30:00Z", count: 3},
+		{upto: "2026-10-01T03:00:00Z", count: 4},
+		{upto: "2026-10-01T05:00:00+02:00", count: 4},
+		{upto: "2026-10-01T01:59:59+00:00", count: 2},
+		{upto: "2026-09-30T23:00:00Z", err: true},
+	}
+
+	for _, test := range tests {
+		prefix, err := ChainUpTo(chain, test.upto)
+
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %v", test.upto, chainIds(prefix))
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%q: %v", test.upto, err)
+			continue
+		}
+
+		if len(prefix) != test.count || prefix[0] != chain[0] {
+			t.Errorf("%q: got %v, want the first %d backups", test.upto, chainIds(prefix), test.count)
+		}
+	}
+}
+
+func TestValidateChain(t *testing.T) {
+	full := testBackup("f1", FullBackupMode, "0", "100", 0)
+	first := testBackup("i1", IncrementalBackupMode, "100", "200", 1)
+	second := testBackup("i2", IncrementalBackupMode, "200", "300", 2)
+	gap := testBackup("i3", IncrementalBackupMode, "250", "300", 2)
+
+	tests := []struct {
+		name  string
+		chain RemoteChain
+		err   string
+	}{
+		{name: "full only", chain: RemoteChain{full}},
+		{name: "full and incrementals", chain: RemoteChain{full, first, second}},
+		{name: "empty", chain: RemoteChain{}, err: "empty"},
+		{name: "starts with an incremental", chain: RemoteChain{first, second}, err: "not a full backup"},
+		{name: "second full backup", chain: RemoteChain{full, full}, err: "not an incremental"},
+		{name: "LSN gap", chain: RemoteChain{full, first, gap}, err: "the chain is broken"},
+		{name: "incremental skipped", chain: RemoteChain{full, second}, err: "the chain is broken"},
+	}
+
+	for _, test := range tests {
+		err := ValidateChain(test.chain)
+
+		if len(test.err) == 0 {
+			if err != nil {
+				t.Errorf("%v: %v", test.name, err)
+			}
+
+			continue
+		}
+
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%v: got %v, want an error containing %q", test.name, err, test.err)
+		}
+	}
+}
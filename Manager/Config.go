@@ -2,26 +2,60 @@ package Manager
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
 type Config struct {
-	MariaBackupBinary string  `json:"maria_backup_binary"`
-	MbStreamBinary    string  `json:"mb_stream_binary"`
-	PositionFile      string  `json:"position_file"`
-	Backup            backup  `json:"backup"`
-	Restore           restore `json:"restore"`
-	S3                s3Conf  `json:"s3"`
-	ParallelThreads   int     `json:"parallel_threads"`
-	GzipThreads       int     `json:"compression_threads"`
-	GzipBlockSize     int     `json:"compression_block_size"`
+	MariaBackupBinary         string              `json:"maria_backup_binary"`
+	MbStreamBinary            string              `json:"mb_stream_binary"`
+	PositionFile              string              `json:"position_file"`
+	Backup                    backup              `json:"backup"`
+	Restore                   restore             `json:"restore"`
+	Binlog                    binlogConf          `json:"binlog"`
+	S3                        s3Conf              `json:"s3"`
+	Azure                     azureConf           `json:"azure"`
+	GCS                       gcsConf             `json:"gcs"`
+	SFTP                      sftpConf            `json:"sftp"`
+	Destinations              []DestinationConfig `json:"destinations"`
+	MinSuccessfulDestinations int                 `json:"min_successful_destinations"`
+	ParallelThreads           int                 `json:"parallel_threads"`
+	GzipThreads               int                 `json:"compression_threads"`
+	GzipBlockSize             int                 `json:"compression_block_size"`
+	Throttle                  ThrottleConfig      `json:"throttle"`
+	Progress                  ProgressConfig      `json:"progress"`
+	Process                   ProcessConfig       `json:"process"`
+	Disk                      DiskConfig          `json:"disk"`
+	RestoreTest               RestoreTestConfig   `json:"restore_test"`
 }
 
 type restore struct {
-	SourceDirectory string `json:"source_directory"`
-	TargetDirectory string `json:"target_directory"`
-	WorkDirectory   string `json:"work_directory"`
+	SourceDirectory   string `json:"source_directory"`
+	TargetDirectory   string `json:"target_directory"`
+	WorkDirectory     string `json:"work_directory"`
+	DownloadDirectory string `json:"download_directory"`
+	Stream            bool   `json:"stream"`
+	PipelineDepth     int    `json:"pipeline_depth"`
+	LowDisk           bool   `json:"low_disk"`
+	HistoryFile       string `json:"history_file"`
+	SetAsideDays      int    `json:"set_aside_days"`
+}
+
+// binlogConf locates the binlog archive used for point-in-time recovery, either a configured
+// destination or a local directory, and the binaries that replay it
+type binlogConf struct {
+	Destination       string   `json:"destination"`
+	Directory         string   `json:"directory"`
+	MysqlBinlogBinary string   `json:"mysqlbinlog_binary"`
+	MysqlBinary       string   `json:"mysql_binary"`
+	MariadbdBinary    string   `json:"mariadbd_binary"`
+	StagingDirectory  string   `json:"staging_directory"`
+	ServerOptions     []string `json:"server_options"`
+	ClientOptions     []string `json:"client_options"`
 }
 
 type s3Conf struct {
@@ -31,6 +65,28 @@ type s3Conf struct {
 	Bucket              string `json:"bucket"`
 	UploadDirectory     string `json:"upload_directory"`
 	AwsConcurrencyLevel int    `json:"aws_concurrency_level"`
+	S3ObjectOptions
+}
+
+type azureConf struct {
+	AzureBlobOptions
+	Endpoint      string `json:"endpoint"`
+	RetentionDays int    `json:"retention_days"`
+}
+
+type gcsConf struct {
+	Bucket   string `json:"bucket"`
+	Endpoint string `json:"endpoint"`
+	GCSOptions
+	StorageClass  string            `json:"storage_class"`
+	Metadata      map[string]string `json:"metadata"`
+	RetentionDays int               `json:"retention_days"`
+}
+
+type sftpConf struct {
+	SFTPOptions
+	Path          string `json:"path"`
+	RetentionDays int    `json:"retention_days"`
 }
 
 type backup struct {
@@ -46,9 +102,13 @@ type backup struct {
 func CreateNewConfig() *Config {
 
 	config := &Config{Restore: restore{
-		SourceDirectory: "/backup/mariabackup",
-		TargetDirectory: "/var/lib/mysql",
-		WorkDirectory:   "/backup/mariabackup/restore",
+		SourceDirectory:   "/backup/mariabackup",
+		TargetDirectory:   "/var/lib/mysql",
+		WorkDirectory:     "/backup/mariabackup/restore",
+		DownloadDirectory: "/backup/download",
+		PipelineDepth:     2,
+		HistoryFile:       "/backup/restore-history.json",
+		SetAsideDays:      7,
 	},
 		Backup: backup{
 			TargetDirectory: "/backup/mariabackup",
@@ -59,6 +119,24 @@ func CreateNewConfig() *Config {
 			Mode:            "full",
 			DataDirectory:   "/var/lib/mysql",
 		},
+		//outside of the backup target directory, a full backup removes everything in it
+		Binlog: binlogConf{
+			MysqlBinlogBinary: "/usr/bin/mysqlbinlog",
+			MysqlBinary:       "/usr/bin/mysql",
+			MariadbdBinary:    "/usr/sbin/mariadbd",
+			StagingDirectory:  "/backup/binlogs",
+		},
+		Process: ProcessConfig{
+			LogDirectory: "/var/log/mariabackup",
+		},
+		Disk: DiskConfig{
+			MinFreeMB:              1024,
+			MonitorIntervalSeconds: 30,
+		},
+		RestoreTest: RestoreTestConfig{
+			Directory:         "/backup/restore-test",
+			RowCountTolerance: 20,
+		},
 		MariaBackupBinary: "/usr/bin/mariabackup",
 		MbStreamBinary:    "/usr/bin/mbstream",
 		PositionFile:      "/backup/mariabackup/mariabackup.pos",
@@ -70,6 +148,39 @@ func CreateNewConfig() *Config {
 	return config
 }
 
+// CheckDirectories rejects directories that must survive a full backup but are inside
+// backup.target_directory, which a full backup removes
+func (c *Config) CheckDirectories() error {
+	directories := []struct {
+		name string
+		path string
+	}{
+		{"binlog.staging_directory", c.Binlog.StagingDirectory},
+		{"restore.download_directory", c.Restore.DownloadDirectory},
+		{"process.log_directory", c.Process.LogDirectory},
+		{"progress.output", c.Progress.Output},
+	}
+
+	for _, directory := range directories {
+		if len(directory.path) > 0 && isInside(directory.path, c.Backup.TargetDirectory) {
+			return errors.New(fmt.Sprintf("%v %v is inside backup.target_directory %v, which a full backup removes", directory.name, directory.path, c.Backup.TargetDirectory))
+		}
+	}
+
+	return nil
+}
+
+// isInside reports whether path is parent or below it
+func isInside(path string, parent string) bool {
+	if len(parent) == 0 {
+		return false
+	}
+
+	relative, err := filepath.Rel(filepath.Clean(parent), filepath.Clean(path))
+
+	return err == nil && relative != ".." && !strings.HasPrefix(relative, ".."+string(filepath.Separator))
+}
+
 func (c *Config) Load(file string) error {
 	data, err := ioutil.ReadFile(file)
 
@@ -80,6 +191,65 @@ func (c *Config) Load(file string) error {
 	return json.Unmarshal(data, &c)
 }
 
+// DestinationConfigs returns the configured destinations, configs without a destinations
+// section replicate to the s3, azure, gcs and sftp sections that are set
+func (c *Config) DestinationConfigs() []DestinationConfig {
+	if len(c.Destinations) > 0 {
+		return c.Destinations
+	}
+
+	destinations := make([]DestinationConfig, 0)
+
+	if len(c.S3.Bucket) > 0 {
+		destinations = append(destinations, DestinationConfig{
+			Name:            "s3",
+			Type:            S3DestinationType,
+			Region:          c.S3.Region,
+			AccessKey:       c.S3.AccessKey,
+			Secret:          c.S3.Secret,
+			Bucket:          c.S3.Bucket,
+			S3ObjectOptions: c.S3.S3ObjectOptions,
+		})
+	}
+
+	if len(c.Azure.Container) > 0 {
+		destinations = append(destinations, DestinationConfig{
+			Name:             "azure",
+			Type:             AzureDestinationType,
+			Endpoint:         c.Azure.Endpoint,
+			S3ObjectOptions:  S3ObjectOptions{RetentionDays: c.Azure.RetentionDays},
+			AzureBlobOptions: c.Azure.AzureBlobOptions,
+		})
+	}
+
+	if len(c.GCS.Bucket) > 0 {
+		destinations = append(destinations, DestinationConfig{
+			Name:     "gcs",
+			Type:     GCSDestinationType,
+			Bucket:   c.GCS.Bucket,
+			Endpoint: c.GCS.Endpoint,
+			S3ObjectOptions: S3ObjectOptions{
+				StorageClass:  c.GCS.StorageClass,
+				Metadata:      c.GCS.Metadata,
+				RetentionDays: c.GCS.RetentionDays,
+			},
+			GCSOptions: c.GCS.GCSOptions,
+		})
+	}
+
+	if len(c.SFTP.Host) > 0 {
+		destinations = append(destinations, DestinationConfig{
+			Name:            "sftp",
+			Type:            SFTPDestinationType,
+			Path:            c.SFTP.Path,
+			S3ObjectOptions: S3ObjectOptions{RetentionDays: c.SFTP.RetentionDays},
+			SFTPOptions:     c.SFTP.SFTPOptions,
+		})
+	}
+
+	return destinations
+}
+
 func (c *Config) CheckIfExists(file string) error {
 	_, err := os.Stat(file)
 	return err
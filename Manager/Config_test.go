@@ -0,0 +1,35 @@
+package Manager
+
+import "testing"
+
+func TestCheckDirectories(t *testing.T) {
+	tests := []struct {
+		name    string
+		staging string
+		err     bool
+	}{
+		{name: "default", staging: "/backup/binlogs"},
+		{name: "not set", staging: ""},
+		{name: "sibling with the same prefix", staging: "/backup/mariabackup-binlogs"},
+		{name: "inside", staging: "/backup/mariabackup/binlogs", err: true},
+		{name: "the target itself", staging: "/backup/mariabackup/", err: true},
+		{name: "inside after cleaning", staging: "/backup/other/../mariabackup/binlogs", err: true},
+	}
+
+	for _, test := range tests {
+		config := CreateNewConfig()
+		config.Binlog.StagingDirectory = test.staging
+
+		err := config.CheckDirectories()
+
+		if test.err != (err != nil) {
+			t.Errorf("%v: got %v", test.name, err)
+		}
+	}
+
+	config := CreateNewConfig()
+
+	if err := config.CheckDirectories(); err != nil {
+		t.Errorf("the defaults are rejected, %v", err)
+	}
+}
@@ -0,0 +1,333 @@
+package Manager
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	S3DestinationType    = "s3"
+	LocalDestinationType = "local"
+)
+
+// files of a backup directory that are sent to remote storage
+var backupFiles = []string{"backup.gz.enc", "xtrabackup_info", "xtrabackup_checkpoints", "checksum", ManifestFile, TableStatsFile}
+
+// Destination is remote storage that backups are replicated to. Every destination uses the
+// same <hostname>/<YYYY-MM-DD>/<backup-id>/<file> layout.
+type Destination interface {
+	Name() string
+	// UploadFile stores the local file under the key together with the metadata
+	UploadFile(file string, key string, metadata map[string]string) error
+	// DownloadFile fetches and verifies the object, the file is only replaced once it is complete
+	DownloadFile(key string, file string) error
+	Open(key string) (io.ReadCloser, error)
+	List(prefix string) ([]RemoteObject, error)
+	// Delete skips objects that are still locked and returns false for them
+	Delete(object RemoteObject) (bool, error)
+	Prune() error
+}
+
+// MetadataReader is implemented by destinations that return the metadata stored with an object
+type MetadataReader interface {
+	Metadata(key string) (map[string]string, error)
+}
+
+// LockInspector is implemented by destinations that support locking objects against deletion
+type LockInspector interface {
+	LockStatus(object *RemoteObject) error
+}
+
+// DestinationConfig holds the settings of every destination type, the endpoint is shared by
+// the azure and gcs types and the path by the local and sftp types
+type DestinationConfig struct {
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	Path      string `json:"path"`
+	Region    string `json:"region"`
+	AccessKey string `json:"access_key"`
+	Secret    string `json:"secret"`
+	Bucket    string `json:"bucket"`
+	Endpoint  string `json:"endpoint"`
+	S3ObjectOptions
+	AzureBlobOptions
+	GCSOptions
+	SFTPOptions
+}
+
+// namedDestination is implemented by every destination type, the name defaults to one derived
+// from its location and is replaced by the name of the configuration
+type namedDestination interface {
+	Destination
+	setName(name string)
+}
+
+func CreateDestination(config DestinationConfig) (Destination, error) {
+	var destination namedDestination
+	var err error
+
+	switch config.Type {
+	case S3DestinationType, "":
+		destination, err = CreateS3Manager(
+			config.AccessKey,
+			config.Region,
+			config.Bucket,
+			config.Secret,
+			config.S3ObjectOptions,
+		)
+	case LocalDestinationType:
+		destination, err = CreateLocalDestination(config.Path, config.RetentionDays)
+	case AzureDestinationType:
+		destination, err = CreateAzureBlobManager(config.Endpoint, config.AzureBlobOptions, config.RetentionDays)
+	case GCSDestinationType:
+		destination, err = CreateGCSManager(config.Bucket, config.Endpoint, config.GCSOptions, config.StorageClass, config.Metadata, config.RetentionDays)
+	case SFTPDestinationType:
+		destination, err = CreateSFTPManager(config.Path, config.SFTPOptions, config.RetentionDays)
+	default:
+		return nil, errors.New("invalid destination type, only ´s3´, ´azure´, ´gcs´, ´sftp´ or ´local´ are supported, got: " + config.Type)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(config.Name) > 0 {
+		destination.setName(config.Name)
+	}
+
+	return destination, nil
+}
+
+func CreateDestinations(configs []DestinationConfig) ([]Destination, error) {
+	destinations := make([]Destination, 0, len(configs))
+
+	for _, config := range configs {
+		destination, err := CreateDestination(config)
+
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("[Destination]> Failed to initialize destination %v, %v", config.Name, err))
+		}
+
+		destinations = append(destinations, destination)
+	}
+
+	return destinations, nil
+}
+
+// UploadBackup sends the files of a backup directory to the destination
+func UploadBackup(destination Destination, backup string) error {
+	metadata := backupMetadata(backup)
+	backupId := metadata["backup-id"]
+
+	for _, file := range backupFiles {
+		local := filepath.Join(backup, file)
+
+		if _, err := os.Stat(local); os.IsNotExist(err) && (file == ManifestFile || file == TableStatsFile) {
+			//backups taken before manifests were introduced, or whose tables could not be read
+			continue
+		}
+
+		checksum, err := FileSha256(local)
+
+		if err != nil {
+			return err
+		}
+
+		fileMetadata := map[string]string{Sha256MetadataKey: checksum}
+		for k, v := range metadata {
+			fileMetadata[k] = v
+		}
+
+		err = destination.UploadFile(local, GenerateUploadPath(file, backupId), fileMetadata)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// backupMetadata describes the backup with its id, mode and LSNs
+func backupMetadata(backup string) map[string]string {
+	metadata := make(map[string]string)
+
+	if checkpoints, err := ReadCheckpoints(backup); err == nil {
+		for _, k := range []string{"backup_type", "from_lsn", "to_lsn", "last_lsn"} {
+			if v, ok := checkpoints[k]; ok {
+				metadata[strings.Replace(k, "_", "-", -1)] = v
+			}
+		}
+	}
+
+	if manifest, err := LoadManifest(backup); err == nil {
+		metadata["backup-id"] = manifest.Id
+		metadata["backup-mode"] = manifest.Mode
+		metadata["finished-at"] = manifest.FinishedAt.Format(time.RFC3339)
+	}
+
+	return metadata
+}
+
+// DownloadChain downloads every member of the chain into the full/ and incr/N layout used by
+// BackupManager and writes a matching position file. Downloading the same chain again resumes
+// the interrupted transfers, any other chain replaces the directory contents.
+func DownloadChain(destination Destination, chain RemoteChain, directory string, positionFile string) error {
+	prefixes := make([]string, 0, len(chain))
+	for _, backup := range chain {
+		prefixes = append(prefixes, backup.Prefix)
+	}
+
+	marker := filepath.Join(directory, ".chain")
+	previous, _ := ioutil.ReadFile(marker)
+
+	if string(previous) != strings.Join(prefixes, "\n") {
+		for _, sub := range []string{"full", "incr"} {
+			err := os.RemoveAll(filepath.Join(directory, sub))
+
+			if err != nil {
+				return errors.New(fmt.Sprintf("[Destination DownloadChain()]> Failed to clean download directory, %v", err))
+			}
+		}
+
+		err := os.MkdirAll(directory, 0755)
+
+		if err == nil {
+			err = ioutil.WriteFile(marker, []byte(strings.Join(prefixes, "\n")), 0640)
+		}
+
+		if err != nil {
+			return errors.New(fmt.Sprintf("[Destination DownloadChain()]> Failed to prepare download directory, %v", err))
+		}
+	}
+
+	for i, backup := range chain {
+		backupDirectory := filepath.Join(directory, BackupSubDirectory(i))
+
+		log.Println("Downloading", backup.Prefix, "from", destination.Name(), "to", backupDirectory)
+		err := DownloadBackup(destination, backup, backupDirectory)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return ioutil.WriteFile(positionFile, []byte(strconv.Itoa(len(chain)-1)), 0640)
+}
+
+func DownloadBackup(destination Destination, backup *RemoteBackup, directory string) error {
+	err := os.MkdirAll(directory, 0755)
+
+	if err != nil {
+		return errors.New(fmt.Sprintf("[Destination Download()]> Unable to create backups directory, %v", err))
+	}
+
+	for file, object := range backup.Objects {
+		err := destination.DownloadFile(object.Key, filepath.Join(directory, file))
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// PruneBackups deletes this host's backup chains whose newest member is older than the
+// retention, together with leftover objects that do not belong to any backup
+func PruneBackups(destination Destination, retentionDays int) error {
+	if retentionDays <= 0 {
+		log.Printf("retention_days is not configured for %v, not pruning backups", destination.Name())
+		return nil
+	}
+
+	cutoff := time.Now().AddDate(0, 0, -retentionDays)
+
+	backups, err := ReadCatalog(destination)
+
+	if err != nil {
+		return err
+	}
+
+	chained := make(map[string]bool)
+	expired := make(map[string]bool)
+
+	for _, chain := range BuildChains(backups) {
+		keep := chain[len(chain)-1].Time.After(cutoff)
+
+		for _, backup := range chain {
+			chained[backup.Prefix] = true
+			expired[backup.Prefix] = !keep
+		}
+	}
+
+	objects, err := destination.List(GenerateHostPrefix())
+
+	if err != nil {
+		return err
+	}
+
+	skipped := 0
+
+	for _, object := range objects {
+		prefix := path.Dir(object.Key)
+
+		if isBinlogArchiveKey(object.Key) {
+			continue
+		}
+
+		if chained[prefix] && !expired[prefix] {
+			continue
+		}
+
+		if !chained[prefix] && object.LastModified.After(cutoff) {
+			continue
+		}
+
+		deleted, err := destination.Delete(object)
+
+		if err != nil {
+			return err
+		}
+
+		if !deleted {
+			skipped++
+		}
+	}
+
+	if skipped > 0 {
+		log.Printf("%d expired objects were skipped because they are still locked", skipped)
+	}
+
+	return PruneBinlogs(destination, GenerateHostPrefix())
+}
+
+func GenerateUploadPath(file string, backupId string) string {
+
+	hostname, _ := os.Hostname()
+	currentTime := time.Now()
+
+	//keep the key stable when an interrupted upload is resumed on a later day
+	if id, err := time.Parse(BackupIdFormat, backupId); err == nil {
+		currentTime = id
+	}
+
+	date := currentTime.Format("2006-01-02")
+
+	return path.Join(hostname, date, backupId, file)
+}
+
+func GenerateHostPrefix() string {
+	hostname, _ := os.Hostname()
+
+	return hostname + "/"
+}
@@ -0,0 +1,201 @@
+package Manager
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// DiskConfig sets the free space that has to remain while a backup or restore runs and how
+// often it is checked
+type DiskConfig struct {
+	MinFreeMB              int `json:"min_free_mb"`
+	MonitorIntervalSeconds int `json:"monitor_interval_seconds"`
+}
+
+// DiskRequirement is the space a run needs on the file system of a directory
+type DiskRequirement struct {
+	Directory string
+	Needed    uint64
+	Available uint64
+	device    uint64
+}
+
+// DiskEstimate lists the space needed per file system, directories on the same file system
+// share one requirement
+type DiskEstimate []*DiskRequirement
+
+// Require adds needed bytes on the file system of directory
+func (d *DiskEstimate) Require(directory string, needed uint64) error {
+	stat := syscall.Stat_t{}
+
+	err := syscall.Stat(directory, &stat)
+
+	if err != nil {
+		return err
+	}
+
+	for _, requirement := range *d {
+		if requirement.device == uint64(stat.Dev) {
+			requirement.Needed += needed
+			return nil
+		}
+	}
+
+	available, err := FreeSpace(directory)
+
+	if err != nil {
+		return err
+	}
+
+	*d = append(*d, &DiskRequirement{Directory: directory, Needed: needed, Available: available, device: uint64(stat.Dev)})
+
+	return nil
+}
+
+// Fits reports whether every file system has the space needed
+func (d DiskEstimate) Fits() bool {
+	for _, requirement := range d {
+		if requirement.Needed > requirement.Available {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Directories returns the directories of the requirements, e.g. to monitor them
+func (d DiskEstimate) Directories() []string {
+	directories := make([]string, 0, len(d))
+
+	for _, requirement := range d {
+		directories = append(directories, requirement.Directory)
+	}
+
+	return directories
+}
+
+func (d DiskEstimate) String() string {
+	parts := make([]string, 0, len(d))
+
+	for _, requirement := range d {
+		parts = append(parts, fmt.Sprintf("%v needs %d MB, %d MB available", requirement.Directory, requirement.Needed>>20, requirement.Available>>20))
+	}
+
+	return strings.Join(parts, "; ")
+}
+
+// existingParent returns the directory or its closest existing parent, the work directory does
+// not exist before the first restore
+func existingParent(directory string) string {
+	for filepath.Dir(directory) != directory {
+		if _, err := os.Stat(directory); err == nil {
+			break
+		}
+
+		directory = filepath.Dir(directory)
+	}
+
+	return directory
+}
+
+func sameFileSystem(first string, second string) (bool, error) {
+	firstStat := syscall.Stat_t{}
+	secondStat := syscall.Stat_t{}
+
+	if err := syscall.Stat(first, &firstStat); err != nil {
+		return false, err
+	}
+
+	if err := syscall.Stat(second, &secondStat); err != nil {
+		return false, err
+	}
+
+	return firstStat.Dev == secondStat.Dev, nil
+}
+
+// FreeSpace returns the bytes available to unprivileged users on the file system of directory
+func FreeSpace(directory string) (uint64, error) {
+	stat := syscall.Statfs_t{}
+
+	err := syscall.Statfs(directory, &stat)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
+
+// DiskMonitor checks the free space of directories while a run is in progress. When it drops
+// below the minimum the child processes are aborted, the run fails instead of filling the disk,
+// unless the monitor only warns.
+type DiskMonitor struct {
+	directories []string
+	minFree     uint64
+	interval    time.Duration
+	warnOnly    bool
+	stop        chan struct{}
+}
+
+func WatchDiskSpace(directories []string, config DiskConfig, warnOnly bool) *DiskMonitor {
+	m := &DiskMonitor{
+		directories: directories,
+		minFree:     uint64(config.MinFreeMB) << 20,
+		interval:    time.Duration(config.MonitorIntervalSeconds) * time.Second,
+		warnOnly:    warnOnly,
+		stop:        make(chan struct{}),
+	}
+
+	if m.interval <= 0 || m.minFree == 0 {
+		return m
+	}
+
+	go m.run()
+
+	return m
+}
+
+func (m *DiskMonitor) run() {
+	warned := make(map[string]bool)
+
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-time.After(m.interval):
+		}
+
+		for _, directory := range m.directories {
+			free, err := FreeSpace(directory)
+
+			if err != nil || free >= m.minFree {
+				warned[directory] = false
+				continue
+			}
+
+			if m.warnOnly {
+				if !warned[directory] {
+					log.Printf("Warning: %v has only %d MB free, less than the minimum of %d MB", directory, free>>20, m.minFree>>20)
+					warned[directory] = true
+				}
+
+				continue
+			}
+
+			Processes.LogAbort(fmt.Sprintf("%v has only %d MB free, less than the minimum of %d MB", directory, free>>20, m.minFree>>20))
+			Processes.Abort()
+
+			return
+		}
+	}
+}
+
+// Stop ends the monitoring
+func (m *DiskMonitor) Stop() {
+	close(m.stop)
+}
@@ -1,26 +1,27 @@
 package Manager
 
 import (
+	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"io"
 	"log"
+	"os"
 	"sync/atomic"
 )
 
 type DownloadProgress struct {
-	writer io.WriterAt
-	bytes  int64
+	bytes int64
 }
 
-func (d *DownloadProgress) Download(sess *session.Session, key string, bucket string, writer io.WriterAt) (chan ProgressUpdate, error) {
+// Download fetches the object with parallel range requests. Finished parts are recorded in
+// stateFile, so running it again against the partially written file only fetches what is missing.
+func (d *DownloadProgress) Download(sess *session.Session, key string, bucket string, file *os.File, stateFile string) (chan ProgressUpdate, error) {
 	//Resets the value just in case
 	atomic.StoreInt64(&d.bytes, 0)
 
 	updates := make(chan ProgressUpdate, 32)
-	d.writer = writer
 
 	//Create s3 client and determine file size
 	s3Client := s3.New(sess)
@@ -34,37 +35,67 @@ func (d *DownloadProgress) Download(sess *session.Session, key string, bucket st
 	}
 
 	//determine total size of the file
-	fileSize := head.ContentLength
+	fileSize := aws.Int64Value(head.ContentLength)
+	etag := aws.StringValue(head.ETag)
 
-	//create download manager
-	dl := s3manager.NewDownloader(sess)
-	dl.Concurrency = AwsConcurrencyLevel
-	log.Printf("Downloading " + key + " from S3")
-	_, err = dl.Download(d, &s3.GetObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(key),
-	})
+	state, err := LoadTransferState(stateFile)
 
-	if err != nil {
-		select {
-		case updates <- ProgressUpdate{
-			Bytes:    *fileSize,
-			Total:    d.BytesWritten(),
-			Finished: false,
-			Error:    err,
-		}:
-		default:
-			log.Printf("Failed to download" + key + " from S3...")
+	if err == nil && state.Bucket == bucket && state.Key == key && state.ETag == etag && state.Size == fileSize {
+		log.Printf("Resuming download of %v, %d of %d parts already downloaded", key, len(state.Parts), state.PartCount())
+
+		for _, part := range state.Parts {
+			_, length := state.PartRange(part.Number)
+			atomic.AddInt64(&d.bytes, length)
+		}
+	} else {
+		state = &TransferState{
+			Bucket:   bucket,
+			Key:      key,
+			ETag:     etag,
+			Size:     fileSize,
+			PartSize: partSize(fileSize),
+			Parts:    make([]TransferPart, 0),
+		}
+
+		err = file.Truncate(0)
+
+		if err == nil {
+			err = state.Save(stateFile)
+		}
+
+		if err != nil {
+			return nil, err
 		}
 	}
 
-	return updates, nil
-}
+	log.Printf("Downloading " + key + " from S3")
+
+	task := Progress.Start("download", key, fileSize, d.BytesWritten)
+	task.Notify(updates)
+
+	err = downloadRanges(state, stateFile, file, &d.bytes, func(offset int64, length int64) (io.ReadCloser, error) {
+		out, err := s3Client.GetObject(&s3.GetObjectInput{
+			Bucket:  aws.String(bucket),
+			Key:     aws.String(key),
+			Range:   aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
+			IfMatch: aws.String(etag),
+		})
+
+		if err != nil {
+			return nil, err
+		}
 
-func (d *DownloadProgress) WriteAt(p []byte, off int64) (n int, err error) {
-	atomic.AddInt64(&d.bytes, int64(len(p))) //increment
+		return out.Body, nil
+	})
+
+	task.Finish(err)
+
+	if err != nil {
+		log.Printf("Failed to download " + key + " from S3...")
+		return updates, err
+	}
 
-	return d.writer.WriteAt(p, off)
+	return updates, os.Remove(stateFile)
 }
 
 func (d *DownloadProgress) BytesWritten() int64 {
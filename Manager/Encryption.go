@@ -55,7 +55,7 @@ func (e *Encrypt) Encrypt(inFile string, outFile string, key string, bufferSize
 		log.Fatal(err)
 	}
 
-	outfile, err := os.OpenFile(outFile, os.O_RDWR|os.O_CREATE, 0644)
+	outfile, err := os.OpenFile(outFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -65,10 +65,20 @@ func (e *Encrypt) Encrypt(inFile string, outFile string, key string, bufferSize
 
 	log.Printf("Encrypting backup...")
 
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	counter := &ProgressCounter{}
+	reader := counter.Reader(f)
+	task := Progress.Start("encrypt", inFile, fi.Size(), counter.Bytes)
+	defer task.Finish(nil)
+
 	buf := make([]byte, bufferSize)
 	stream := cipher.NewCTR(b, iv)
 	for {
-		n, err := f.Read(buf)
+		n, err := reader.Read(buf)
 		if n > 0 {
 			stream.XORKeyStream(buf, buf[:n])
 			// Write into file
@@ -140,7 +150,7 @@ func (d *Decrypt) Decrypt(inFile string, outFile string, key string, bufferSize
 		log.Fatal(err)
 	}
 
-	outfile, err := os.OpenFile(outFile, os.O_RDWR|os.O_CREATE, 0644)
+	outfile, err := os.OpenFile(outFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -148,11 +158,16 @@ func (d *Decrypt) Decrypt(inFile string, outFile string, key string, bufferSize
 
 	log.Printf("Decrypting backup...")
 
+	counter := &ProgressCounter{}
+	reader := counter.Reader(f)
+	task := Progress.Start("decrypt", inFile, fi.Size(), counter.Bytes)
+	defer task.Finish(nil)
+
 	// The buffer size must be multiple of 16 bytes
 	buf := make([]byte, bufferSize)
 	stream := cipher.NewCTR(b, iv)
 	for {
-		n, err := f.Read(buf)
+		n, err := reader.Read(buf)
 		if n > 0 {
 			// The last bytes are the IV, don't belong the original message
 			if n > int(msgLen) {
@@ -260,8 +275,6 @@ func ValidateChecksum(checksum string, checksumDir string, checksumFile string)
 
 	if strings.Contains(s, checksum) {
 		return true
-	} else {
-		return false
 	}
 
 	return false
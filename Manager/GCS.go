@@ -0,0 +1,383 @@
+package Manager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	GCSDestinationType = "gcs"
+	GCSDefaultEndpoint = "https://storage.googleapis.com"
+	GCSMaxAttempts     = 3
+)
+
+// GCSOptions configure authentication of GCSManager. Without a credentials file the application
+// default credentials are used, NoAuth sends no credentials at all for testing against a
+// fake-gcs-server.
+type GCSOptions struct {
+	CredentialsFile string `json:"credentials_file"`
+	NoAuth          bool   `json:"no_auth"`
+}
+
+type GCSManager struct {
+	name          string
+	bucket        string
+	endpoint      string
+	storageClass  string
+	metadata      map[string]string
+	tokens        *gcsTokenSource
+	client        *http.Client
+	retentionDays int
+}
+
+// gcsObject is the object resource of the JSON API, only the fields used here
+type gcsObject struct {
+	Name                    string            `json:"name"`
+	Size                    string            `json:"size"`
+	Generation              string            `json:"generation"`
+	Etag                    string            `json:"etag"`
+	Md5Hash                 string            `json:"md5Hash"`
+	StorageClass            string            `json:"storageClass"`
+	Updated                 time.Time         `json:"updated"`
+	Metadata                map[string]string `json:"metadata,omitempty"`
+	RetentionExpirationTime time.Time         `json:"retentionExpirationTime"`
+	TemporaryHold           bool              `json:"temporaryHold"`
+	EventBasedHold          bool              `json:"eventBasedHold"`
+}
+
+type gcsObjectList struct {
+	Items         []gcsObject `json:"items"`
+	NextPageToken string      `json:"nextPageToken"`
+}
+
+type gcsError struct {
+	Status  int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *gcsError) Error() string {
+	return fmt.Sprintf("%d: %v", e.Status, e.Message)
+}
+
+// CreateGCSManager connects to storage.googleapis.com unless Endpoint is set, e.g. to
+// http://127.0.0.1:4443 for a fake-gcs-server
+func CreateGCSManager(Bucket string, Endpoint string, Options GCSOptions, StorageClass string, Metadata map[string]string, RetentionDays int) (*GCSManager, error) {
+	if len(Bucket) == 0 {
+		return nil, errors.New("gcs requires a bucket")
+	}
+
+	switch StorageClass {
+	case "", "STANDARD", "NEARLINE", "COLDLINE", "ARCHIVE":
+		break
+	default:
+		return nil, errors.New("invalid storage class, only ´STANDARD´, ´NEARLINE´, ´COLDLINE´ or ´ARCHIVE´ are supported, got: " + StorageClass)
+	}
+
+	if len(Endpoint) == 0 {
+		Endpoint = GCSDefaultEndpoint
+	}
+
+	manager := &GCSManager{
+		name:          "gs://" + Bucket,
+		bucket:        Bucket,
+		endpoint:      strings.TrimSuffix(Endpoint, "/"),
+		storageClass:  StorageClass,
+		metadata:      Metadata,
+		client:        &http.Client{Transport: &throttledTransport{base: http.DefaultTransport}},
+		retentionDays: RetentionDays,
+	}
+
+	if !Options.NoAuth {
+		tokens, err := newGCSTokenSource(Options.CredentialsFile)
+
+		if err != nil {
+			return nil, err
+		}
+
+		manager.tokens = tokens
+	}
+
+	return manager, nil
+}
+
+func (g *GCSManager) Name() string {
+	return g.name
+}
+
+func (g *GCSManager) setName(name string) {
+	g.name = name
+}
+
+func (g *GCSManager) UploadFile(file string, key string, metadata map[string]string) error {
+	err := g.upload(file, key, metadata, file+".upload-state")
+
+	if err != nil {
+		return errors.New(fmt.Sprintf("[GCSManager Upload()]> Failed to upload %v, %v", file, err))
+	}
+
+	return nil
+}
+
+// DownloadFile downloads into a temporary file that only replaces the target once its size,
+// MD5 and SHA-256 match the object
+func (g *GCSManager) DownloadFile(key string, file string) error {
+	fh, err := os.OpenFile(file+".part", os.O_CREATE|os.O_RDWR, 0640)
+
+	if err != nil {
+		return err
+	}
+
+	object, err := g.download(key, fh, file+".download-state")
+
+	if err != nil {
+		fh.Close()
+		return errors.New(fmt.Sprintf("[GCSManager Download()]> Failed to download %v, %v", key, err))
+	}
+
+	err = g.verify(object, fh)
+	fh.Close()
+
+	if err != nil {
+		os.Remove(file + ".part")
+		return errors.New(fmt.Sprintf("[GCSManager Download()]> Verification of %v failed, %v", key, err))
+	}
+
+	return os.Rename(file+".part", file)
+}
+
+func (g *GCSManager) Metadata(key string) (map[string]string, error) {
+	object, err := g.object(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return object.Metadata, nil
+}
+
+func (g *GCSManager) Open(key string) (io.ReadCloser, error) {
+	resp, err := g.do(http.MethodGet, g.objectUri(key)+"?alt=media", nil, nil, 0)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+func (g *GCSManager) OpenRange(object RemoteObject, offset int64, length int64) (io.ReadCloser, error) {
+	resp, err := g.do(http.MethodGet, g.objectUri(object.Key)+"?alt=media", map[string]string{
+		"Range": fmt.Sprintf("bytes=%d-%d", offset, offset+length-1),
+	}, nil, 0)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+func (g *GCSManager) List(prefix string) ([]RemoteObject, error) {
+	results := make([]RemoteObject, 0)
+	pageToken := ""
+
+	for {
+		query := url.Values{"prefix": {prefix}}
+
+		if len(pageToken) > 0 {
+			query.Set("pageToken", pageToken)
+		}
+
+		resp, err := g.do(http.MethodGet, g.bucketUri()+"/o?"+query.Encode(), nil, nil, 0)
+
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("[GCSManager List()]> Failed to list %v, %v", prefix, err))
+		}
+
+		list := &gcsObjectList{}
+		err = json.NewDecoder(resp.Body).Decode(list)
+		resp.Body.Close()
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range list.Items {
+			results = append(results, item.remoteObject())
+		}
+
+		if len(list.NextPageToken) == 0 {
+			return results, nil
+		}
+
+		pageToken = list.NextPageToken
+	}
+}
+
+// Delete removes the object unless it is still protected by the bucket retention policy or a
+// hold, in which case it is skipped and false is returned
+func (g *GCSManager) Delete(object RemoteObject) (bool, error) {
+	if object.Locked() {
+		log.Printf("Skipping %v, object is locked (%v)", object.Key, object.LockStatus())
+		return false, nil
+	}
+
+	resp, err := g.do(http.MethodDelete, g.objectUri(object.Key), nil, nil, 0)
+
+	if err != nil {
+		return false, errors.New(fmt.Sprintf("[GCSManager Delete()]> Failed to delete %v, %v", object.Key, err))
+	}
+
+	resp.Body.Close()
+	log.Printf("Deleted %v from %v", object.Key, g.name)
+
+	return true, nil
+}
+
+func (g *GCSManager) Prune() error {
+	return PruneBackups(g, g.retentionDays)
+}
+
+func (o *gcsObject) remoteObject() RemoteObject {
+	size, _ := strconv.ParseInt(o.Size, 10, 64)
+
+	object := RemoteObject{
+		Key:          o.Name,
+		Size:         size,
+		LastModified: o.Updated,
+		ETag:         o.Etag,
+		StorageClass: o.StorageClass,
+		RetainUntil:  o.RetentionExpirationTime,
+		LegalHold:    o.TemporaryHold || o.EventBasedHold,
+	}
+
+	if !o.RetentionExpirationTime.IsZero() {
+		object.LockMode = "RETENTION"
+	}
+
+	return object
+}
+
+func (g *GCSManager) bucketUri() string {
+	return g.endpoint + "/storage/v1/b/" + url.PathEscape(g.bucket)
+}
+
+func (g *GCSManager) objectUri(key string) string {
+	return g.bucketUri() + "/o/" + url.PathEscape(key)
+}
+
+func (g *GCSManager) object(key string) (*gcsObject, error) {
+	resp, err := g.do(http.MethodGet, g.objectUri(key), nil, nil, 0)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	object := &gcsObject{}
+
+	return object, json.NewDecoder(resp.Body).Decode(object)
+}
+
+// do sends an authorized request, failed requests are retried when the error is transient and
+// body is called again for every attempt. Responses below 400 are returned to the caller,
+// which includes the 308 of an incomplete resumable upload.
+func (g *GCSManager) do(method string, uri string, headers map[string]string, body func() io.Reader, length int64) (*http.Response, error) {
+	var lastErr error
+
+	for attempt := 0; attempt < GCSMaxAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(1<<uint(attempt)) * time.Second)
+		}
+
+		var reader io.Reader = http.NoBody
+		if body != nil && length > 0 {
+			reader = body()
+		}
+
+		req, err := http.NewRequest(method, uri, reader)
+
+		if err != nil {
+			return nil, err
+		}
+
+		req.ContentLength = length
+
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+
+		if g.tokens != nil {
+			token, err := g.tokens.Token()
+
+			if err != nil {
+				return nil, err
+			}
+
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		resp, err := g.client.Do(req)
+
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if resp.StatusCode < 400 {
+			return resp, nil
+		}
+
+		lastErr = readGCSError(resp)
+
+		if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500 {
+			return nil, lastErr
+		}
+	}
+
+	return nil, lastErr
+}
+
+func readGCSError(resp *http.Response) error {
+	defer resp.Body.Close()
+
+	data, _ := ioutil.ReadAll(resp.Body)
+	document := &struct {
+		Error gcsError `json:"error"`
+	}{}
+
+	if json.Unmarshal(data, document) != nil || len(document.Error.Message) == 0 {
+		document.Error.Message = strings.TrimSpace(string(data))
+	}
+
+	document.Error.Status = resp.StatusCode
+
+	return &document.Error
+}
+
+func isGCSStatus(err error, statuses ...int) bool {
+	var gcsErr *gcsError
+
+	if !errors.As(err, &gcsErr) {
+		return false
+	}
+
+	for _, status := range statuses {
+		if gcsErr.Status == status {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,242 @@
+package Manager
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	GCSScope            = "https://www.googleapis.com/auth/devstorage.read_write"
+	GCSTokenUri         = "https://oauth2.googleapis.com/token"
+	GCSMetadataTokenUri = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+)
+
+// gcsCredentials is a service account key or the authorized user file written by
+// gcloud auth application-default login
+type gcsCredentials struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKey   string `json:"private_key"`
+	TokenUri     string `json:"token_uri"`
+	ClientId     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+type gcsToken struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// gcsTokenSource fetches OAuth2 access tokens and caches them until shortly before they expire.
+// Without credentials the token comes from the metadata server of the instance.
+type gcsTokenSource struct {
+	credentials *gcsCredentials
+	key         *rsa.PrivateKey
+	client      *http.Client
+	mutex       sync.Mutex
+	token       string
+	expiry      time.Time
+}
+
+// newGCSTokenSource reads the service account key file, without a file the application default
+// credentials are used: GOOGLE_APPLICATION_CREDENTIALS, the gcloud default credentials file
+// and finally the metadata server
+func newGCSTokenSource(credentialsFile string) (*gcsTokenSource, error) {
+	source := &gcsTokenSource{client: &http.Client{Timeout: 30 * time.Second}}
+
+	if len(credentialsFile) == 0 {
+		credentialsFile = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+
+	if len(credentialsFile) == 0 {
+		home, _ := os.UserHomeDir()
+		wellKnown := filepath.Join(home, ".config", "gcloud", "application_default_credentials.json")
+
+		if _, err := os.Stat(wellKnown); err == nil {
+			credentialsFile = wellKnown
+		}
+	}
+
+	if len(credentialsFile) == 0 {
+		return source, nil
+	}
+
+	data, err := ioutil.ReadFile(credentialsFile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	source.credentials = &gcsCredentials{}
+	err = json.Unmarshal(data, source.credentials)
+
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid credentials file %v, %v", credentialsFile, err))
+	}
+
+	switch source.credentials.Type {
+	case "service_account":
+		source.key, err = parseRsaPrivateKey(source.credentials.PrivateKey)
+
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid private key in %v, %v", credentialsFile, err))
+		}
+
+		if len(source.credentials.TokenUri) == 0 {
+			source.credentials.TokenUri = GCSTokenUri
+		}
+	case "authorized_user":
+		break
+	default:
+		return nil, errors.New("unsupported credentials type, only ´service_account´ or ´authorized_user´ are supported, got: " + source.credentials.Type)
+	}
+
+	return source, nil
+}
+
+func (t *gcsTokenSource) Token() (string, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if len(t.token) > 0 && time.Now().Add(time.Minute).Before(t.expiry) {
+		return t.token, nil
+	}
+
+	var req *http.Request
+	var err error
+
+	switch {
+	case t.credentials == nil:
+		req, err = http.NewRequest(http.MethodGet, GCSMetadataTokenUri, nil)
+
+		if err == nil {
+			req.Header.Set("Metadata-Flavor", "Google")
+		}
+	case t.credentials.Type == "service_account":
+		var assertion string
+		assertion, err = t.assertion()
+
+		if err == nil {
+			req, err = newFormRequest(t.credentials.TokenUri, url.Values{
+				"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+				"assertion":  {assertion},
+			})
+		}
+	default:
+		req, err = newFormRequest(GCSTokenUri, url.Values{
+			"grant_type":    {"refresh_token"},
+			"client_id":     {t.credentials.ClientId},
+			"client_secret": {t.credentials.ClientSecret},
+			"refresh_token": {t.credentials.RefreshToken},
+		})
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := t.client.Do(req)
+
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("[GCS]> Failed to fetch access token, %v", err))
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return "", errors.New(fmt.Sprintf("[GCS]> Failed to fetch access token, %v: %v", resp.Status, strings.TrimSpace(string(body))))
+	}
+
+	token := &gcsToken{}
+	err = json.NewDecoder(resp.Body).Decode(token)
+
+	if err != nil {
+		return "", err
+	}
+
+	t.token = token.AccessToken
+	t.expiry = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+
+	return t.token, nil
+}
+
+// assertion is the signed JWT exchanged for an access token of the service account
+func (t *gcsTokenSource) assertion() (string, error) {
+	now := time.Now()
+
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   t.credentials.ClientEmail,
+		"scope": GCSScope,
+		"aud":   t.credentials.TokenUri,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+
+	signature, err := rsa.SignPKCS1v15(rand.Reader, t.key, crypto.SHA256, digest[:])
+
+	if err != nil {
+		return "", err
+	}
+
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func parseRsaPrivateKey(data string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(data))
+
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := parsed.(*rsa.PrivateKey)
+
+	if !ok {
+		return nil, errors.New("private key is not an RSA key")
+	}
+
+	return key, nil
+}
+
+func newFormRequest(uri string, values url.Values) (*http.Request, error) {
+	req, err := http.NewRequest(http.MethodPost, uri, strings.NewReader(values.Encode()))
+
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	return req, nil
+}
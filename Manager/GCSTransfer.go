@@ -0,0 +1,318 @@
+package Manager
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// GCSChunkSize is the size of every request of a resumable upload, it must be a multiple of 256KiB
+const GCSChunkSize = 16 << 20
+
+// upload sends the file as a resumable upload. The session is kept in stateFile, running it
+// again asks the service how much it already holds and continues from there.
+func (g *GCSManager) upload(file string, key string, metadata map[string]string, stateFile string) error {
+	fh, err := os.Open(file)
+
+	if err != nil {
+		return err
+	}
+
+	defer fh.Close()
+
+	stat, err := fh.Stat()
+
+	if err != nil {
+		return err
+	}
+
+	size := stat.Size()
+	sent := int64(0)
+	offset := int64(-1)
+
+	state, err := LoadTransferState(stateFile)
+
+	if err == nil && state.Bucket == g.bucket && state.Key == key && state.Size == size && state.ModTime == stat.ModTime().UnixNano() {
+		offset, err = g.uploadOffset(state.UploadId, size)
+
+		if isGCSStatus(err, http.StatusNotFound, http.StatusGone) {
+			log.Printf("Upload session of %v expired, starting over", key)
+			offset = -1
+		} else if err != nil {
+			return err
+		} else {
+			log.Printf("Resuming upload of %v at %v of %v", key, formatBytes(offset), formatBytes(size))
+		}
+	}
+
+	if offset < 0 {
+		state = &TransferState{
+			Bucket:  g.bucket,
+			Key:     key,
+			Size:    size,
+			ModTime: stat.ModTime().UnixNano(),
+		}
+
+		state.UploadId, err = g.createUploadSession(key, size, metadata)
+
+		if err == nil {
+			err = state.Save(stateFile)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		offset = 0
+	}
+
+	log.Printf("Uploading %v to %v", key, g.name)
+
+	atomic.StoreInt64(&sent, offset)
+	task := Progress.Start("upload", key, size, func() int64 { return atomic.LoadInt64(&sent) })
+
+	for done := offset == size && size > 0; !done && err == nil; {
+		length := size - offset
+
+		if length > GCSChunkSize {
+			length = GCSChunkSize
+		}
+
+		done, offset, err = g.uploadChunk(state.UploadId, fh, offset, length, size)
+		atomic.StoreInt64(&sent, offset)
+	}
+
+	task.Finish(err)
+
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(stateFile)
+}
+
+func (g *GCSManager) createUploadSession(key string, size int64, metadata map[string]string) (string, error) {
+	object := gcsObject{
+		Name:         key,
+		StorageClass: g.storageClass,
+		Metadata:     make(map[string]string),
+	}
+
+	for k, v := range g.metadata {
+		object.Metadata[k] = v
+	}
+
+	for k, v := range metadata {
+		object.Metadata[k] = v
+	}
+
+	payload, err := json.Marshal(object)
+
+	if err != nil {
+		return "", err
+	}
+
+	uri := g.endpoint + "/upload/storage/v1/b/" + url.PathEscape(g.bucket) + "/o?" + url.Values{"uploadType": {"resumable"}, "name": {key}}.Encode()
+
+	resp, err := g.do(http.MethodPost, uri, map[string]string{
+		"Content-Type":            "application/json; charset=UTF-8",
+		"X-Upload-Content-Length": strconv.FormatInt(size, 10),
+	}, func() io.Reader {
+		return bytes.NewReader(payload)
+	}, int64(len(payload)))
+
+	if err != nil {
+		return "", err
+	}
+
+	resp.Body.Close()
+
+	session := resp.Header.Get("Location")
+
+	if len(session) == 0 {
+		return "", errors.New("no upload session returned for " + key)
+	}
+
+	return session, nil
+}
+
+// uploadChunk sends the range starting at offset and returns whether the upload is finished
+// together with the offset the service expects next
+func (g *GCSManager) uploadChunk(session string, body io.ReaderAt, offset int64, length int64, size int64) (bool, int64, error) {
+	contentRange := fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, size)
+
+	if size == 0 {
+		contentRange = "bytes */0"
+	}
+
+	resp, err := g.do(http.MethodPut, session, map[string]string{"Content-Range": contentRange}, func() io.Reader {
+		return io.NewSectionReader(body, offset, length)
+	}, length)
+
+	if err != nil {
+		return false, offset, err
+	}
+
+	return g.uploadProgress(resp, size)
+}
+
+// uploadOffset asks the service how many bytes of the upload it holds, finished uploads return the size
+func (g *GCSManager) uploadOffset(session string, size int64) (int64, error) {
+	resp, err := g.do(http.MethodPut, session, map[string]string{"Content-Range": fmt.Sprintf("bytes */%d", size)}, nil, 0)
+
+	if err != nil {
+		return 0, err
+	}
+
+	_, offset, err := g.uploadProgress(resp, size)
+
+	return offset, err
+}
+
+// uploadProgress reads the response of a resumable upload request, 308 means more data is
+// expected and the Range header holds what was persisted so far
+func (g *GCSManager) uploadProgress(resp *http.Response, size int64) (bool, int64, error) {
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusCreated {
+		return true, size, nil
+	}
+
+	if resp.StatusCode != http.StatusPermanentRedirect {
+		return false, 0, errors.New("unexpected response to upload: " + resp.Status)
+	}
+
+	persisted := resp.Header.Get("Range")
+
+	if len(persisted) == 0 {
+		return false, 0, nil
+	}
+
+	end, err := strconv.ParseInt(persisted[strings.LastIndex(persisted, "-")+1:], 10, 64)
+
+	if err != nil {
+		return false, 0, errors.New("invalid Range of upload: " + persisted)
+	}
+
+	return false, end + 1, nil
+}
+
+// download fetches the object with parallel range requests pinned to its generation, finished
+// ranges are recorded in stateFile so running it again only fetches what is missing
+func (g *GCSManager) download(key string, file *os.File, stateFile string) (*gcsObject, error) {
+	object, err := g.object(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := strconv.ParseInt(object.Size, 10, 64)
+
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid size of %v", key))
+	}
+
+	received := int64(0)
+	state, err := LoadTransferState(stateFile)
+
+	if err == nil && state.Bucket == g.bucket && state.Key == key && state.ETag == object.Generation && state.Size == size {
+		log.Printf("Resuming download of %v, %d of %d parts already downloaded", key, len(state.Parts), state.PartCount())
+
+		for _, part := range state.Parts {
+			_, length := state.PartRange(part.Number)
+			received += length
+		}
+	} else {
+		state = &TransferState{
+			Bucket:   g.bucket,
+			Key:      key,
+			ETag:     object.Generation,
+			Size:     size,
+			PartSize: partSize(size),
+			Parts:    make([]TransferPart, 0),
+		}
+
+		err = file.Truncate(0)
+
+		if err == nil {
+			err = state.Save(stateFile)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	log.Printf("Downloading %v from %v", key, g.name)
+
+	task := Progress.Start("download", key, size, func() int64 { return atomic.LoadInt64(&received) })
+
+	uri := g.objectUri(key) + "?" + url.Values{"alt": {"media"}, "generation": {object.Generation}}.Encode()
+
+	err = downloadRanges(state, stateFile, file, &received, func(offset int64, length int64) (io.ReadCloser, error) {
+		resp, err := g.do(http.MethodGet, uri, map[string]string{
+			"Range": fmt.Sprintf("bytes=%d-%d", offset, offset+length-1),
+		}, nil, 0)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return resp.Body, nil
+	})
+
+	task.Finish(err)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return object, os.Remove(stateFile)
+}
+
+// verify compares the downloaded file with the size and MD5 of the object and the SHA-256
+// stored in its metadata at upload time. Composite objects have no MD5.
+func (g *GCSManager) verify(object *gcsObject, file *os.File) error {
+	stat, err := file.Stat()
+
+	if err != nil {
+		return err
+	}
+
+	size, _ := strconv.ParseInt(object.Size, 10, 64)
+
+	if stat.Size() != size {
+		return errors.New(fmt.Sprintf("size mismatch, expected %d bytes, got %d", size, stat.Size()))
+	}
+
+	md5, checksum, err := checksumFile(file, size, false)
+
+	if err != nil {
+		return err
+	}
+
+	if len(object.Md5Hash) > 0 {
+		expected, err := base64.StdEncoding.DecodeString(object.Md5Hash)
+
+		if err != nil || hex.EncodeToString(expected) != md5 {
+			return errors.New(fmt.Sprintf("MD5 mismatch, expected %v, got %v", hex.EncodeToString(expected), md5))
+		}
+	}
+
+	if expected, ok := object.Metadata[Sha256MetadataKey]; ok && expected != checksum {
+		return errors.New(fmt.Sprintf("SHA-256 mismatch, expected %v, got %v", expected, checksum))
+	}
+
+	return nil
+}
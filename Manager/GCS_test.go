@@ -0,0 +1,315 @@
+package Manager
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGCSUploadProgress(t *testing.T) {
+	manager := &GCSManager{}
+	size := int64(1 << 20)
+
+	tests := []struct {
+		name   string
+		status int
+		header string
+		done   bool
+		offset int64
+		err    bool
+	}{
+		{name: "finished", status: http.StatusOK, done: true, offset: size},
+		{name: "created", status: http.StatusCreated, done: true, offset: size},
+		{name: "nothing persisted", status: http.StatusPermanentRedirect, offset: 0},
+		{name: "first chunk persisted", status: http.StatusPermanentRedirect, header: "bytes=0-262143", offset: 262144},
+		{name: "one byte persisted", status: http.StatusPermanentRedirect, header: "bytes=0-0", offset: 1},
+		{name: "invalid range", status: http.StatusPermanentRedirect, header: "bytes=0-", err: true},
+		{name: "unexpected status", status: http.StatusNoContent, err: true},
+	}
+
+	for _, test := range tests {
+		resp := &http.Response{
+			StatusCode: test.status,
+			Status:     strconv.Itoa(test.status),
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+		}
+
+		if len(test.header) > 0 {
+			resp.Header.Set("Range", test.header)
+		}
+
+		done, offset, err := manager.uploadProgress(resp, size)
+
+		if test.err {
+			if err == nil {
+				t.Errorf("%v: expected an error, got %v %d", test.name, done, offset)
+			}
+
+			continue
+		}
+
+		if err != nil || done != test.done || offset != test.offset {
+			t.Errorf("%v: got %v %d %v, want %v %d", test.name, done, offset, err, test.done, test.offset)
+		}
+	}
+}
+
+func TestGCSVerify(t *testing.T) {
+	file, err := ioutil.TempFile("", "gcs")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	content := bytes.Repeat([]byte("backup "), 1000)
+
+	_, err = file.Write(content)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	md5Sum := md5.Sum(content)
+	sha256Sum := sha256.Sum256(content)
+	md5Hash := base64.StdEncoding.EncodeToString(md5Sum[:])
+	checksum := hex.EncodeToString(sha256Sum[:])
+	size := strconv.Itoa(len(content))
+
+	tests := []struct {
+		name   string
+		object gcsObject
+		err    string
+	}{
+		{name: "matches", object: gcsObject{Size: size, Md5Hash: md5Hash, Metadata: map[string]string{Sha256MetadataKey: checksum}}},
+		{name: "composite object without MD5", object: gcsObject{Size: size, Metadata: map[string]string{Sha256MetadataKey: checksum}}},
+		{name: "uploaded without SHA-256", object: gcsObject{Size: size, Md5Hash: md5Hash}},
+		{name: "size", object: gcsObject{Size: "10", Md5Hash: md5Hash}, err: "size mismatch"},
+		{name: "MD5", object: gcsObject{Size: size, Md5Hash: base64.StdEncoding.EncodeToString(make([]byte, 16))}, err: "MD5 mismatch"},
+		{name: "invalid MD5", object: gcsObject{Size: size, Md5Hash: "not base64"}, err: "MD5 mismatch"},
+		{name: "SHA-256", object: gcsObject{Size: size, Md5Hash: md5Hash, Metadata: map[string]string{Sha256MetadataKey: strings.Repeat("0", 64)}}, err: "SHA-256 mismatch"},
+	}
+
+	manager := &GCSManager{}
+
+	for _, test := range tests {
+		err := manager.verify(&test.object, file)
+
+		if len(test.err) > 0 {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%v: got %v, want an error containing %q", test.name, err, test.err)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+		}
+	}
+}
+
+// createFakeGCSManager returns a manager for a new bucket of a fake-gcs-server started with
+// -scheme http, FAKE_GCS_ENDPOINT overrides the default endpoint. The test is skipped when the
+// server is not running.
+func createFakeGCSManager(t *testing.T) *GCSManager {
+	endpoint := os.Getenv("FAKE_GCS_ENDPOINT")
+
+	if len(endpoint) == 0 {
+		endpoint = "http://127.0.0.1:4443"
+	}
+
+	u, err := url.Parse(endpoint)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.DialTimeout("tcp", u.Host, time.Second)
+
+	if err != nil {
+		t.Skip("fake-gcs-server is not reachable on", u.Host)
+	}
+
+	conn.Close()
+
+	bucket := "test" + time.Now().UTC().Format("20060102150405999999999")
+	manager, err := CreateGCSManager(bucket, endpoint, GCSOptions{NoAuth: true}, "", nil, 0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload, _ := json.Marshal(map[string]string{"name": bucket})
+
+	resp, err := manager.do(http.MethodPost, manager.endpoint+"/storage/v1/b", map[string]string{"Content-Type": "application/json"}, func() io.Reader {
+		return bytes.NewReader(payload)
+	}, int64(len(payload)))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp.Body.Close()
+
+	return manager
+}
+
+func TestFakeGCSUploadListDownloadDelete(t *testing.T) {
+	manager := createFakeGCSManager(t)
+
+	dir, err := ioutil.TempDir("", "gcs")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "backup.gz.enc")
+	content := writeTestFile(t, file, 300000)
+	checksum, err := FileSha256(file)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := "host/2026-10-01/20261001T000000Z/backup.gz.enc"
+	err = manager.UploadFile(file, key, map[string]string{Sha256MetadataKey: checksum})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	objects, err := manager.List("host/")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(objects) != 1 || objects[0].Key != key || objects[0].Size != int64(len(content)) {
+		t.Fatalf("got objects %+v, want only %v with %d bytes", objects, key, len(content))
+	}
+
+	downloaded := filepath.Join(dir, "downloaded")
+	err = manager.DownloadFile(key, downloaded)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(downloaded)
+
+	if err != nil || !bytes.Equal(data, content) {
+		t.Fatalf("the download differs from the upload, %v", err)
+	}
+
+	deleted, err := manager.Delete(objects[0])
+
+	if err != nil || !deleted {
+		t.Fatalf("delete returned %v, %v", deleted, err)
+	}
+
+	objects, err = manager.List("host/")
+
+	if err != nil || len(objects) != 0 {
+		t.Errorf("got objects %+v, %v after delete", objects, err)
+	}
+}
+
+// TestFakeGCSUploadResume continues a resumable upload whose first chunk was sent by an
+// interrupted run, the service reports what it holds and only the rest is sent
+func TestFakeGCSUploadResume(t *testing.T) {
+	manager := createFakeGCSManager(t)
+
+	dir, err := ioutil.TempDir("", "gcs")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "backup.gz.enc")
+	content := writeTestFile(t, file, 600000)
+	stat, err := os.Stat(file)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := "host/backup.gz.enc"
+	session, err := manager.createUploadSession(key, stat.Size(), nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fh, err := os.Open(file)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//chunks other than the last one are multiples of 256KiB
+	done, offset, err := manager.uploadChunk(session, fh, 0, 256<<10, stat.Size())
+	fh.Close()
+
+	if err != nil || done || offset != 256<<10 {
+		t.Fatalf("the first chunk returned %v %d %v", done, offset, err)
+	}
+
+	stateFile := file + ".upload-state"
+	state := &TransferState{Bucket: manager.bucket, Key: key, Size: stat.Size(), ModTime: stat.ModTime().UnixNano(), UploadId: session}
+	err = state.Save(stateFile)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	offset, err = manager.uploadOffset(session, stat.Size())
+
+	if err != nil || offset != 256<<10 {
+		t.Fatalf("the service holds %d bytes, %v, want %d", offset, err, 256<<10)
+	}
+
+	err = manager.UploadFile(file, key, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(stateFile); !os.IsNotExist(err) {
+		t.Error("the upload state was not removed")
+	}
+
+	body, err := manager.Open(key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadAll(body)
+	body.Close()
+
+	if err != nil || !bytes.Equal(data, content) {
+		t.Errorf("the resumed upload differs from the file, %v", err)
+	}
+}
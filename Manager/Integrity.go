@@ -0,0 +1,151 @@
+package Manager
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	sha256 "github.com/minio/sha256-simd"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Sha256MetadataKey is the object metadata holding the SHA-256 of the uploaded file
+const Sha256MetadataKey = "sha256"
+
+func FileSha256(file string) (string, error) {
+	f, err := os.Open(file)
+
+	if err != nil {
+		return "", err
+	}
+
+	defer f.Close()
+
+	hash := sha256.New()
+
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// VerifyDownload compares the downloaded file with the object: the size, the ETag (plain or
+// multipart) and the SHA-256 stored in the object metadata at upload time
+func VerifyDownload(client *s3.S3, bucket string, key string, file *os.File) error {
+	head, err := client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+
+	if err != nil {
+		return err
+	}
+
+	stat, err := file.Stat()
+
+	if err != nil {
+		return err
+	}
+
+	size := aws.Int64Value(head.ContentLength)
+
+	if stat.Size() != size {
+		return errors.New(fmt.Sprintf("[Integrity]> Size mismatch for %v, expected %d bytes, got %d", key, size, stat.Size()))
+	}
+
+	etag := strings.Trim(aws.StringValue(head.ETag), `"`)
+	parts := int64(1)
+
+	if i := strings.LastIndex(etag, "-"); i >= 0 {
+		parts, err = strconv.ParseInt(etag[i+1:], 10, 64)
+
+		if err != nil {
+			return errors.New(fmt.Sprintf("[Integrity]> Unexpected ETag %v for %v", etag, key))
+		}
+	}
+
+	partSize := size
+
+	if parts > 1 {
+		part, err := client.HeadObject(&s3.HeadObjectInput{
+			Bucket:     aws.String(bucket),
+			Key:        aws.String(key),
+			PartNumber: aws.Int64(1),
+		})
+
+		if err != nil {
+			return err
+		}
+
+		partSize = aws.Int64Value(part.ContentLength)
+	}
+
+	computedETag, computedSha256, err := checksumFile(file, partSize, strings.Contains(etag, "-"))
+
+	if err != nil {
+		return err
+	}
+
+	//the ETag of objects encrypted with KMS or customer keys is not a digest of the content
+	if aws.StringValue(head.ServerSideEncryption) == s3.ServerSideEncryptionAwsKms || len(aws.StringValue(head.SSECustomerAlgorithm)) > 0 {
+		log.Printf("Skipping ETag check of %v, object is encrypted with %v", key, aws.StringValue(head.ServerSideEncryption))
+	} else if computedETag != etag {
+		return errors.New(fmt.Sprintf("[Integrity]> ETag mismatch for %v, expected %v, got %v", key, etag, computedETag))
+	}
+
+	for k, v := range head.Metadata {
+		if strings.ToLower(k) == Sha256MetadataKey && aws.StringValue(v) != computedSha256 {
+			return errors.New(fmt.Sprintf("[Integrity]> SHA-256 mismatch for %v, expected %v, got %v", key, aws.StringValue(v), computedSha256))
+		}
+	}
+
+	return nil
+}
+
+// checksumFile reads the file once and returns its S3 style ETag and its SHA-256
+func checksumFile(file *os.File, partSize int64, multipart bool) (string, string, error) {
+	_, err := file.Seek(0, io.SeekStart)
+
+	if err != nil {
+		return "", "", err
+	}
+
+	sha := sha256.New()
+	partDigests := make([]byte, 0)
+	parts := 0
+
+	for {
+		part := md5.New()
+		n, err := io.Copy(io.MultiWriter(part, sha), io.LimitReader(file, partSize))
+
+		if err != nil {
+			return "", "", err
+		}
+
+		if n == 0 && parts > 0 {
+			break
+		}
+
+		partDigests = append(partDigests, part.Sum(nil)...)
+		parts++
+
+		if n < partSize || partSize == 0 {
+			break
+		}
+	}
+
+	if !multipart {
+		return hex.EncodeToString(partDigests), hex.EncodeToString(sha.Sum(nil)), nil
+	}
+
+	combined := md5.Sum(partDigests)
+
+	return fmt.Sprintf("%v-%d", hex.EncodeToString(combined[:]), parts), hex.EncodeToString(sha.Sum(nil)), nil
+}
@@ -0,0 +1,95 @@
+package Manager
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// expectedETag computes the ETag S3 reports for content uploaded in parts of partSize
+func expectedETag(content []byte, partSize int, multipart bool) string {
+	if !multipart {
+		sum := md5.Sum(content)
+		return hex.EncodeToString(sum[:])
+	}
+
+	digests := make([]byte, 0)
+	parts := 0
+
+	for offset := 0; offset < len(content); offset += partSize {
+		end := offset + partSize
+
+		if end > len(content) {
+			end = len(content)
+		}
+
+		sum := md5.Sum(content[offset:end])
+		digests = append(digests, sum[:]...)
+		parts++
+	}
+
+	combined := md5.Sum(digests)
+
+	return fmt.Sprintf("%v-%d", hex.EncodeToString(combined[:]), parts)
+}
+
+func TestChecksumFile(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      int
+		partSize  int
+		multipart bool
+	}{
+		{name: "empty", size: 0, partSize: 0, multipart: false},
+		{name: "single upload", size: 1000, partSize: 1000, multipart: false},
+		{name: "one part", size: 1000, partSize: 1000, multipart: true},
+		{name: "last part short", size: 2503, partSize: 1000, multipart: true},
+		{name: "parts fill the file", size: 3000, partSize: 1000, multipart: true},
+	}
+
+	file, err := ioutil.TempFile("", "checksum")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	for _, test := range tests {
+		content := make([]byte, test.size)
+
+		for i := range content {
+			content[i] = byte(i * 7)
+		}
+
+		err = file.Truncate(0)
+
+		if err == nil {
+			_, err = file.WriteAt(content, 0)
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		etag, sha, err := checksumFile(file, int64(test.partSize), test.multipart)
+
+		if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+			continue
+		}
+
+		if want := expectedETag(content, test.partSize, test.multipart); etag != want {
+			t.Errorf("%v: got ETag %v, want %v", test.name, etag, want)
+		}
+
+		if want := sha256.Sum256(content); sha != hex.EncodeToString(want[:]) {
+			t.Errorf("%v: got SHA-256 %v, want %v", test.name, sha, hex.EncodeToString(want[:]))
+		}
+	}
+}
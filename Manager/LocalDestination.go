@@ -0,0 +1,256 @@
+package Manager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LocalDestination replicates backups to a local directory or an NFS mount, object metadata
+// is kept next to each file in a .meta file
+type LocalDestination struct {
+	name          string
+	root          string
+	retentionDays int
+}
+
+func CreateLocalDestination(Root string, RetentionDays int) (*LocalDestination, error) {
+	if len(Root) == 0 {
+		return nil, errors.New("local destination requires a path")
+	}
+
+	err := os.MkdirAll(Root, 0750)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &LocalDestination{
+		name:          "file://" + Root,
+		root:          Root,
+		retentionDays: RetentionDays,
+	}, nil
+}
+
+func (l *LocalDestination) Name() string {
+	return l.name
+}
+
+func (l *LocalDestination) setName(name string) {
+	l.name = name
+}
+
+func (l *LocalDestination) path(key string) string {
+	return filepath.Join(l.root, filepath.FromSlash(key))
+}
+
+func (l *LocalDestination) UploadFile(file string, key string, metadata map[string]string) error {
+	target := l.path(key)
+
+	err := os.MkdirAll(filepath.Dir(target), 0750)
+
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Copying %v to %v", file, target)
+
+	err = copyFile(file, target+".tmp", "upload", UploadLimiter)
+
+	if err == nil {
+		err = os.Rename(target+".tmp", target)
+	}
+
+	if err != nil {
+		os.Remove(target + ".tmp")
+		return errors.New(fmt.Sprintf("[LocalDestination Upload()]> Failed to copy %v, %v", file, err))
+	}
+
+	payload, err := json.Marshal(metadata)
+
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(target+".meta", payload, 0640)
+}
+
+func (l *LocalDestination) DownloadFile(key string, file string) error {
+	source := l.path(key)
+
+	err := copyFile(source, file+".part", "download", DownloadLimiter)
+
+	if err != nil {
+		os.Remove(file + ".part")
+		return errors.New(fmt.Sprintf("[LocalDestination Download()]> Failed to copy %v, %v", source, err))
+	}
+
+	err = l.verify(key, file+".part")
+
+	if err != nil {
+		os.Remove(file + ".part")
+		return errors.New(fmt.Sprintf("[LocalDestination Download()]> Verification of %v failed, %v", key, err))
+	}
+
+	return os.Rename(file+".part", file)
+}
+
+// verify compares the copy with the source size and the SHA-256 recorded at upload time
+func (l *LocalDestination) verify(key string, file string) error {
+	source, err := os.Stat(l.path(key))
+
+	if err != nil {
+		return err
+	}
+
+	copied, err := os.Stat(file)
+
+	if err != nil {
+		return err
+	}
+
+	if source.Size() != copied.Size() {
+		return errors.New(fmt.Sprintf("size mismatch, expected %d bytes, got %d", source.Size(), copied.Size()))
+	}
+
+	metadata, err := l.Metadata(key)
+
+	if err != nil || len(metadata[Sha256MetadataKey]) == 0 {
+		return nil
+	}
+
+	checksum, err := FileSha256(file)
+
+	if err != nil {
+		return err
+	}
+
+	if checksum != metadata[Sha256MetadataKey] {
+		return errors.New(fmt.Sprintf("SHA-256 mismatch, expected %v, got %v", metadata[Sha256MetadataKey], checksum))
+	}
+
+	return nil
+}
+
+func (l *LocalDestination) Metadata(key string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(l.path(key) + ".meta")
+
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := make(map[string]string)
+
+	return metadata, json.Unmarshal(data, &metadata)
+}
+
+func (l *LocalDestination) Open(key string) (io.ReadCloser, error) {
+	return os.Open(l.path(key))
+}
+
+func (l *LocalDestination) OpenRange(object RemoteObject, offset int64, length int64) (io.ReadCloser, error) {
+	f, err := os.Open(l.path(object.Key))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &throttledReadCloser{throttledReader{io.NewSectionReader(f, offset, length), DownloadLimiter}, f}, nil
+}
+
+func (l *LocalDestination) List(prefix string) ([]RemoteObject, error) {
+	results := make([]RemoteObject, 0)
+
+	err := filepath.Walk(l.root, func(name string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !f.Mode().IsRegular() || strings.HasSuffix(name, ".meta") || strings.HasSuffix(name, ".tmp") {
+			return nil
+		}
+
+		relative, err := filepath.Rel(l.root, name)
+
+		if err != nil {
+			return err
+		}
+
+		key := filepath.ToSlash(relative)
+
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		results = append(results, RemoteObject{
+			Key:          key,
+			Size:         f.Size(),
+			LastModified: f.ModTime(),
+		})
+
+		return nil
+	})
+
+	return results, err
+}
+
+func (l *LocalDestination) Delete(object RemoteObject) (bool, error) {
+	err := os.Remove(l.path(object.Key))
+
+	if err != nil {
+		return false, errors.New(fmt.Sprintf("[LocalDestination Delete()]> Failed to delete %v, %v", object.Key, err))
+	}
+
+	os.Remove(l.path(object.Key) + ".meta")
+	log.Printf("Deleted %v", l.path(object.Key))
+
+	return true, nil
+}
+
+func (l *LocalDestination) Prune() error {
+	return PruneBackups(l, l.retentionDays)
+}
+
+// copyFile copies with progress reporting and throttling, the copy is synced before returning
+func copyFile(source string, target string, phase string, limiter *RateLimiter) error {
+	in, err := os.Open(source)
+
+	if err != nil {
+		return err
+	}
+
+	defer in.Close()
+
+	stat, err := in.Stat()
+
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+
+	if err != nil {
+		return err
+	}
+
+	defer out.Close()
+
+	counter := &ProgressCounter{}
+	task := Progress.Start(phase, source, stat.Size(), counter.Bytes)
+
+	_, err = io.Copy(counter.Writer(out), &throttledReader{reader: in, limiter: limiter})
+
+	if err == nil {
+		err = out.Sync()
+	}
+
+	task.Finish(err)
+
+	return err
+}
@@ -0,0 +1,117 @@
+package Manager
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	ManifestFile    = "manifest.json"
+	CheckpointsFile = "xtrabackup_checkpoints"
+	BackupIdFormat  = "20060102T150405Z"
+)
+
+// BackupManifest describes a single backup in the chain. It is written next to
+// backup.gz when the backup finishes and travels with the backup to remote storage.
+type BackupManifest struct {
+	Id         string    `json:"id"`
+	Hostname   string    `json:"hostname"`
+	Mode       string    `json:"mode"`
+	Position   int       `json:"position"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	FromLSN    string    `json:"from_lsn"`
+	ToLSN      string    `json:"to_lsn"`
+	LastLSN    string    `json:"last_lsn"`
+	//sizes in bytes, 0 for backups taken before they were recorded
+	DataSize       int64 `json:"data_size,omitempty"`
+	StreamSize     int64 `json:"stream_size,omitempty"`
+	CompressedSize int64 `json:"compressed_size,omitempty"`
+}
+
+func CreateBackupManifest(mode string, position int, startedAt time.Time, backupPath string) (*BackupManifest, error) {
+	hostname, _ := os.Hostname()
+
+	checkpoints, err := ReadCheckpoints(backupPath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &BackupManifest{
+		Id:         startedAt.UTC().Format(BackupIdFormat),
+		Hostname:   hostname,
+		Mode:       mode,
+		Position:   position,
+		StartedAt:  startedAt.UTC(),
+		FinishedAt: time.Now().UTC(),
+		FromLSN:    checkpoints["from_lsn"],
+		ToLSN:      checkpoints["to_lsn"],
+		LastLSN:    checkpoints["last_lsn"],
+	}, nil
+}
+
+func LoadManifest(dir string) (*BackupManifest, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, ManifestFile))
+
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &BackupManifest{}
+	err = json.Unmarshal(data, manifest)
+
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("[Manifest]> Failed to parse %v, %v", filepath.Join(dir, ManifestFile), err))
+	}
+
+	return manifest, nil
+}
+
+func (m *BackupManifest) Save(dir string) error {
+	payload, err := json.MarshalIndent(m, "", "\t")
+
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(dir, ManifestFile), payload, 0640)
+}
+
+// ReadCheckpoints parses the key = value pairs of xtrabackup_checkpoints
+func ReadCheckpoints(dir string) (map[string]string, error) {
+	f, err := os.Open(filepath.Join(dir, CheckpointsFile))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	return ParseCheckpoints(f)
+}
+
+func ParseCheckpoints(r io.Reader) (map[string]string, error) {
+	checkpoints := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), "=", 2)
+
+		if len(parts) != 2 {
+			continue
+		}
+
+		checkpoints[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+
+	return checkpoints, scanner.Err()
+}
@@ -0,0 +1,219 @@
+package Manager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	MultipartPartSize = 64 << 20
+	MultipartMaxParts = 10000
+)
+
+// TransferPart is a finished part of a multipart upload or ranged download
+type TransferPart struct {
+	Number int64  `json:"number"`
+	ETag   string `json:"etag,omitempty"`
+}
+
+// TransferState is saved next to the local file while a transfer is in progress so that an
+// interrupted upload or download can continue with the parts that are still missing
+type TransferState struct {
+	Bucket   string         `json:"bucket"`
+	Key      string         `json:"key"`
+	UploadId string         `json:"upload_id,omitempty"`
+	ETag     string         `json:"etag,omitempty"`
+	Size     int64          `json:"size"`
+	ModTime  int64          `json:"mod_time,omitempty"`
+	PartSize int64          `json:"part_size"`
+	Parts    []TransferPart `json:"parts"`
+}
+
+func LoadTransferState(file string) (*TransferState, error) {
+	data, err := ioutil.ReadFile(file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	state := &TransferState{}
+	err = json.Unmarshal(data, state)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+// Save writes the state to a temporary file first so a crash never leaves a truncated state file
+func (t *TransferState) Save(file string) error {
+	payload, err := json.Marshal(t)
+
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(file+".tmp", payload, 0640)
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(file+".tmp", file)
+}
+
+func (t *TransferState) Done(number int64) bool {
+	for _, part := range t.Parts {
+		if part.Number == number {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (t *TransferState) PartCount() int64 {
+	return (t.Size + t.PartSize - 1) / t.PartSize
+}
+
+// PartRange returns the offset and length of the 1-based part number
+func (t *TransferState) PartRange(number int64) (int64, int64) {
+	offset := (number - 1) * t.PartSize
+	length := t.PartSize
+
+	if offset+length > t.Size {
+		length = t.Size - offset
+	}
+
+	return offset, length
+}
+
+func (t *TransferState) SortedParts() []TransferPart {
+	parts := append([]TransferPart{}, t.Parts...)
+
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].Number < parts[j].Number
+	})
+
+	return parts
+}
+
+// partSize keeps the number of parts below the S3 limit for very large files
+func partSize(size int64) int64 {
+	partSize := int64(MultipartPartSize)
+
+	for size/partSize >= MultipartMaxParts {
+		partSize *= 2
+	}
+
+	return partSize
+}
+
+// offsetWriter turns an io.WriterAt into a sequential writer starting at the given offset
+type offsetWriter struct {
+	writer io.WriterAt
+	offset int64
+}
+
+func (o *offsetWriter) Write(p []byte) (int, error) {
+	n, err := o.writer.WriteAt(p, o.offset)
+	o.offset += int64(n)
+
+	return n, err
+}
+
+// downloadRanges fetches the parts of the state that are not done yet in parallel and writes them
+// into file, every finished part is recorded in stateFile and added to received
+func downloadRanges(state *TransferState, stateFile string, file io.WriterAt, received *int64, fetch func(offset int64, length int64) (io.ReadCloser, error)) error {
+	parts := make(chan int64)
+	mutex := &sync.Mutex{}
+	wg := &sync.WaitGroup{}
+	var downloadErr error
+
+	for i := 0; i < AwsConcurrencyLevel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for number := range parts {
+				err := downloadRange(state, number, file, received, fetch)
+
+				mutex.Lock()
+				if err == nil {
+					state.Parts = append(state.Parts, TransferPart{Number: number})
+					err = state.Save(stateFile)
+				}
+				if err != nil && downloadErr == nil {
+					downloadErr = err
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+
+	for number := int64(1); number <= state.PartCount(); number++ {
+		mutex.Lock()
+		failed := downloadErr != nil
+		done := state.Done(number)
+		mutex.Unlock()
+
+		if failed {
+			break
+		}
+
+		if !done {
+			parts <- number
+		}
+	}
+
+	close(parts)
+	wg.Wait()
+
+	return downloadErr
+}
+
+func downloadRange(state *TransferState, number int64, file io.WriterAt, received *int64, fetch func(offset int64, length int64) (io.ReadCloser, error)) error {
+	offset, length := state.PartRange(number)
+
+	body, err := fetch(offset, length)
+
+	if err != nil {
+		return err
+	}
+
+	defer body.Close()
+
+	written, err := io.Copy(&offsetWriter{writer: file, offset: offset}, &sharedCountingReader{reader: body, bytes: received})
+
+	if err == nil && written != length {
+		err = errors.New(fmt.Sprintf("short read of part %d, got %d of %d bytes", number, written, length))
+	}
+
+	if err != nil {
+		//the part is fetched again, do not count it twice
+		atomic.AddInt64(received, -written)
+	}
+
+	return err
+}
+
+// sharedCountingReader adds the bytes read to a counter shared by parallel transfers
+type sharedCountingReader struct {
+	reader io.Reader
+	bytes  *int64
+}
+
+func (c *sharedCountingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	atomic.AddInt64(c.bytes, int64(n))
+
+	return n, err
+}
@@ -0,0 +1,252 @@
+package Manager
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+func TestPartRange(t *testing.T) {
+	tests := []struct {
+		size   int64
+		part   int64
+		count  int64
+		ranges [][2]int64
+	}{
+		{size: 0, part: 10, count: 0},
+		{size: 1, part: 10, count: 1, ranges: [][2]int64{{0, 1}}},
+		{size: 10, part: 10, count: 1, ranges: [][2]int64{{0, 10}}},
+		{size: 11, part: 10, count: 2, ranges: [][2]int64{{0, 10}, {10, 1}}},
+		{size: 25, part: 10, count: 3, ranges: [][2]int64{{0, 10}, {10, 10}, {20, 5}}},
+	}
+
+	for _, test := range tests {
+		state := &TransferState{Size: test.size, PartSize: test.part}
+
+		if state.PartCount() != test.count {
+			t.Errorf("size %d: got %d parts, want %d", test.size, state.PartCount(), test.count)
+			continue
+		}
+
+		for i, want := range test.ranges {
+			offset, length := state.PartRange(int64(i + 1))
+
+			if offset != want[0] || length != want[1] {
+				t.Errorf("size %d part %d: got offset %d length %d, want %d %d", test.size, i+1, offset, length, want[0], want[1])
+			}
+		}
+	}
+}
+
+func TestPartSize(t *testing.T) {
+	tests := []struct {
+		size int64
+		want int64
+	}{
+		{size: 0, want: MultipartPartSize},
+		{size: MultipartPartSize * (MultipartMaxParts - 1), want: MultipartPartSize},
+		{size: MultipartPartSize * MultipartMaxParts, want: MultipartPartSize * 2},
+		{size: MultipartPartSize * MultipartMaxParts * 3, want: MultipartPartSize * 4},
+	}
+
+	for _, test := range tests {
+		got := partSize(test.size)
+
+		if got != test.want {
+			t.Errorf("size %d: got part size %d, want %d", test.size, got, test.want)
+		}
+
+		if test.size/got >= MultipartMaxParts {
+			t.Errorf("size %d: part size %d exceeds %d parts", test.size, got, MultipartMaxParts)
+		}
+	}
+}
+
+// s3RangeServer serves HEAD and ranged GET requests for one object the way S3 does, the range
+// starting at failAt is refused and every served range is counted in fetched
+func s3RangeServer(content []byte, etag string, failAt *int64, fetched map[int64]int, mutex *sync.Mutex) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", etag)
+
+		if r.Method == http.MethodHead {
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			return
+		}
+
+		var start, end int64
+		_, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end)
+
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		if err != nil || r.Header.Get("If-Match") != etag || start == *failAt {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		fetched[start]++
+
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(content)))
+		w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(content[start : end+1])
+	}))
+}
+
+// TestDownloadRangesResume interrupts a ranged download and continues it from the saved state,
+// with the shared helper directly and through the S3 download
+func TestDownloadRangesResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "multipart")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	content := bytes.Repeat([]byte("0123456789abcdef"), 100)
+	etag := "\"d41d8cd98f00b204e9800998ecf8427e\""
+	mutex := &sync.Mutex{}
+	fetched := make(map[int64]int)
+	failAt := int64(500)
+
+	server := s3RangeServer(content, etag, &failAt, fetched, mutex)
+	defer server.Close()
+
+	sess, err := session.NewSession(&aws.Config{
+		Endpoint:         aws.String(server.URL),
+		Region:           aws.String("us-east-1"),
+		Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+		S3ForcePathStyle: aws.Bool(true),
+		MaxRetries:       aws.Int(0),
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fetch := func(offset int64, length int64) (io.ReadCloser, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		if offset == failAt {
+			return nil, errors.New("connection reset")
+		}
+
+		fetched[offset]++
+
+		return ioutil.NopCloser(bytes.NewReader(content[offset : offset+length])), nil
+	}
+
+	tests := []struct {
+		name     string
+		download func(stateFile string, file *os.File, received *int64) error
+	}{
+		{
+			name: "ranges",
+			download: func(stateFile string, file *os.File, received *int64) error {
+				state, err := LoadTransferState(stateFile)
+
+				if err != nil {
+					return err
+				}
+
+				return downloadRanges(state, stateFile, file, received, fetch)
+			},
+		},
+		{
+			name: "s3",
+			download: func(stateFile string, file *os.File, received *int64) error {
+				progress := &DownloadProgress{}
+				_, err := progress.Download(sess, "host/backup.gz.enc", "bucket", file, stateFile)
+				*received = progress.BytesWritten()
+
+				return err
+			},
+		},
+	}
+
+	for _, test := range tests {
+		for offset := range fetched {
+			delete(fetched, offset)
+		}
+
+		failAt = 500
+		stateFile := filepath.Join(dir, test.name+".state")
+		state := &TransferState{Bucket: "bucket", Key: "host/backup.gz.enc", ETag: etag, Size: int64(len(content)), PartSize: 100, Parts: make([]TransferPart, 0)}
+		err = state.Save(stateFile)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		file, err := os.Create(filepath.Join(dir, test.name))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer file.Close()
+
+		received := int64(0)
+		err = test.download(stateFile, file, &received)
+
+		if err == nil {
+			t.Fatalf("%v: expected the interrupted download to fail", test.name)
+		}
+
+		saved, err := LoadTransferState(stateFile)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if saved.Done(failAt/100 + 1) {
+			t.Errorf("%v: the failed part %d is recorded as done", test.name, failAt/100+1)
+		}
+
+		if received != int64(len(saved.Parts))*100 {
+			t.Errorf("%v: counted %d bytes for %d finished parts", test.name, received, len(saved.Parts))
+		}
+
+		failAt = -1
+		err = test.download(stateFile, file, &received)
+
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+
+		for offset, count := range fetched {
+			if count > 1 {
+				t.Errorf("%v: part at offset %d was fetched %d times", test.name, offset, count)
+			}
+		}
+
+		if received != int64(len(content)) {
+			t.Errorf("%v: received %d bytes, want %d", test.name, received, len(content))
+		}
+
+		data, err := ioutil.ReadFile(file.Name())
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(data, content) {
+			t.Errorf("%v: the resumed download differs from the content", test.name)
+		}
+	}
+}
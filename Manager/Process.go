@@ -0,0 +1,481 @@
+package Manager
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	ProcessKillGrace = 10 * time.Second
+	processTailLines = 5
+)
+
+// ProcessConfig sets where the stderr of child processes is logged and how long each kind of
+// process may run, timeouts are durations like "6h" keyed by the process name, e.g. prepare
+type ProcessConfig struct {
+	LogDirectory string            `json:"log_directory"`
+	Timeouts     map[string]string `json:"timeouts"`
+}
+
+// ProcessSupervisor starts every child process of a run, copies their stderr to the console and
+// to the log of the run and kills the process groups still running when the run is aborted
+type ProcessSupervisor struct {
+	mutex     sync.Mutex
+	timeouts  map[string]time.Duration
+	logFile   *os.File
+	running   map[*Process]bool
+	ctx       context.Context
+	cancel    context.CancelFunc
+	abortOnce sync.Once
+}
+
+// Processes supervises the child processes of the run
+var Processes = newProcessSupervisor()
+
+func newProcessSupervisor() *ProcessSupervisor {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &ProcessSupervisor{
+		timeouts: make(map[string]time.Duration),
+		running:  make(map[*Process]bool),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// Configure parses the timeouts and opens <log_directory>/<command>-<time>.log, without a log
+// directory stderr only goes to the console
+func (s *ProcessSupervisor) Configure(config ProcessConfig, command string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	timeouts := make(map[string]time.Duration)
+
+	for name, value := range config.Timeouts {
+		timeout, err := time.ParseDuration(value)
+
+		if err != nil || timeout <= 0 {
+			return errors.New(fmt.Sprintf("invalid timeout ´%v´ of %v, expected a duration like 6h or 30m", value, name))
+		}
+
+		timeouts[name] = timeout
+	}
+
+	s.timeouts = timeouts
+
+	if len(config.LogDirectory) == 0 {
+		return nil
+	}
+
+	err := os.MkdirAll(config.LogDirectory, 0750)
+
+	if err != nil {
+		return errors.New(fmt.Sprintf("[ProcessSupervisor]> Failed to create log directory, %v", err))
+	}
+
+	name := fmt.Sprintf("%v-%v.log", command, time.Now().UTC().Format(BackupIdFormat))
+	s.logFile, err = os.OpenFile(filepath.Join(config.LogDirectory, name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+
+	if err != nil {
+		return errors.New(fmt.Sprintf("[ProcessSupervisor]> Failed to open process log, %v", err))
+	}
+
+	return nil
+}
+
+// LogFile returns the path of the log of the run, empty when there is none
+func (s *ProcessSupervisor) LogFile() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.logFile == nil {
+		return ""
+	}
+
+	return s.logFile.Name()
+}
+
+func (s *ProcessSupervisor) log(name string, line string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.logFile != nil {
+		fmt.Fprintf(s.logFile, "%v [%v] %v\n", time.Now().Format("2006-01-02 15:04:05"), name, line)
+	}
+}
+
+// Abort terminates the process groups of all running processes, processes started afterwards
+// fail immediately. It returns once they have exited or were killed.
+func (s *ProcessSupervisor) Abort() {
+	s.abortOnce.Do(s.cancel)
+
+	s.mutex.Lock()
+	running := make([]*Process, 0, len(s.running))
+
+	for p := range s.running {
+		running = append(running, p)
+	}
+
+	s.mutex.Unlock()
+
+	for _, p := range running {
+		<-p.exited
+	}
+}
+
+// Aborted is closed once the run is aborted, for waits that are not a child process
+func (s *ProcessSupervisor) Aborted() <-chan struct{} {
+	return s.ctx.Done()
+}
+
+// Process is a child process started by the supervisor. It runs in its own process group, so
+// killing it also stops the processes it started, e.g. mariabackup behind stdbuf.
+type Process struct {
+	supervisor *ProcessSupervisor
+	ctx        context.Context
+	name       string
+	command    *exec.Cmd
+	quiet      bool
+	stderr     *processStderr
+	exited     chan struct{}
+	mutex      sync.Mutex
+	reason     string
+	err        error
+	pipeWriter *os.File
+}
+
+// NewProcess prepares the binary to run under the name used in logs and for the timeout, ctx
+// aborts the process like the supervisor does
+func (s *ProcessSupervisor) NewProcess(ctx context.Context, name string, binary string, args ...string) *Process {
+	command := exec.Command(binary, args...)
+	command.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	p := &Process{
+		supervisor: s,
+		ctx:        ctx,
+		name:       name,
+		command:    command,
+		exited:     make(chan struct{}),
+	}
+
+	p.stderr = &processStderr{process: p}
+	command.Stderr = p.stderr
+
+	return p
+}
+
+// NewProcess starts a process under the supervisor of the run
+func NewProcess(name string, binary string, args ...string) *Process {
+	return Processes.NewProcess(context.Background(), name, binary, args...)
+}
+
+// Quiet keeps the stderr of the process off the console, it still goes to the log of the run
+func (p *Process) Quiet() *Process {
+	p.quiet = true
+	return p
+}
+
+// Env sets additional environment variables
+func (p *Process) Env(variables ...string) *Process {
+	p.command.Env = append(os.Environ(), variables...)
+	return p
+}
+
+func (p *Process) SetStdin(reader io.Reader) {
+	p.command.Stdin = reader
+}
+
+func (p *Process) SetStdout(writer io.Writer) {
+	p.command.Stdout = writer
+}
+
+func (p *Process) StdinPipe() (io.WriteCloser, error) {
+	return p.command.StdinPipe()
+}
+
+// StdoutPipe returns the stdout of the process. Unlike the pipe of exec.Cmd it is not closed when
+// the process exits, the reader sees EOF once everything written was read and closes it.
+func (p *Process) StdoutPipe() (io.ReadCloser, error) {
+	reader, writer, err := os.Pipe()
+
+	if err != nil {
+		return nil, err
+	}
+
+	p.command.Stdout = writer
+	p.pipeWriter = writer
+
+	return reader, nil
+}
+
+// Args returns the arguments, passwords masked, for logging
+func (p *Process) Args() string {
+	return passwordPattern.ReplaceAllString(strings.Join(p.command.Args, " "), "$1***")
+}
+
+var passwordPattern = regexp.MustCompile(`(--password=)\S*`)
+
+// Start starts the process and the watchdog that kills its process group on timeout or abort
+func (p *Process) Start() error {
+	s := p.supervisor
+
+	select {
+	case <-s.ctx.Done():
+		return p.notStarted(errors.New(fmt.Sprintf("[Process %v]> Not started, the run was aborted", p.name)))
+	default:
+	}
+
+	s.log(p.name, "starting "+p.Args())
+
+	err := p.command.Start()
+
+	//the child holds its own copy of the write end
+	if p.pipeWriter != nil {
+		p.pipeWriter.Close()
+	}
+
+	if err != nil {
+		s.log(p.name, "failed to start: "+err.Error())
+		return p.notStarted(errors.New(fmt.Sprintf("[Process %v]> Failed executing %v: %v", p.name, p.command.Path, err)))
+	}
+
+	s.mutex.Lock()
+	s.running[p] = true
+	timeout := s.timeouts[p.name]
+	s.mutex.Unlock()
+
+	var timer *time.Timer
+	var expired <-chan time.Time
+
+	if timeout > 0 {
+		timer = time.NewTimer(timeout)
+		expired = timer.C
+	}
+
+	exited := make(chan error, 1)
+
+	go func() {
+		exited <- p.command.Wait()
+	}()
+
+	go func() {
+		if timer != nil {
+			defer timer.Stop()
+		}
+
+		var err error
+
+		select {
+		case err = <-exited:
+		case <-expired:
+			p.kill(fmt.Sprintf("timed out after %v", timeout), exited)
+			err = <-exited
+		case <-s.ctx.Done():
+			p.kill("aborted", exited)
+			err = <-exited
+		case <-p.ctx.Done():
+			p.kill("canceled", exited)
+			err = <-exited
+		}
+
+		p.finish(err)
+	}()
+
+	return nil
+}
+
+// notStarted records why the process did not start, so that Wait returns the error and
+// Exited does not block callers that select on it
+func (p *Process) notStarted(err error) error {
+	p.mutex.Lock()
+	p.err = err
+	p.mutex.Unlock()
+
+	close(p.exited)
+
+	return err
+}
+
+// kill sends SIGTERM to the process group and SIGKILL when it is still running after the grace period
+func (p *Process) kill(reason string, exited chan error) {
+	p.mutex.Lock()
+	p.reason = reason
+	p.mutex.Unlock()
+
+	p.supervisor.log(p.name, reason+", terminating process group")
+	syscall.Kill(-p.command.Process.Pid, syscall.SIGTERM)
+
+	select {
+	case err := <-exited:
+		exited <- err
+	case <-time.After(ProcessKillGrace):
+		syscall.Kill(-p.command.Process.Pid, syscall.SIGKILL)
+	}
+}
+
+func (p *Process) finish(err error) {
+	s := p.supervisor
+
+	p.mutex.Lock()
+	p.err = p.describe(err)
+	p.mutex.Unlock()
+
+	if p.err != nil {
+		s.log(p.name, p.err.Error())
+	} else {
+		s.log(p.name, "exited with status 0")
+	}
+
+	s.mutex.Lock()
+	delete(s.running, p)
+	s.mutex.Unlock()
+
+	close(p.exited)
+}
+
+// describe turns the result of Wait into an error naming the exit status or the signal, why
+// the process was killed and the last lines it wrote to stderr
+func (p *Process) describe(err error) error {
+	if err == nil && len(p.reason) == 0 {
+		return nil
+	}
+
+	status := "failed"
+
+	if err != nil {
+		status = err.Error()
+	}
+
+	if state := p.command.ProcessState; state != nil {
+		if waitStatus, ok := state.Sys().(syscall.WaitStatus); ok && waitStatus.Signaled() {
+			status = "killed by signal " + waitStatus.Signal().String()
+		} else if state.ExitCode() >= 0 {
+			status = fmt.Sprintf("exit status %d", state.ExitCode())
+		}
+	}
+
+	if len(p.reason) > 0 {
+		status = p.reason + ", " + status
+	}
+
+	if tail := p.stderr.tail(); len(tail) > 0 {
+		status += ": " + tail
+	}
+
+	return errors.New(fmt.Sprintf("[Process %v]> %v %v", p.name, filepath.Base(p.command.Path), status))
+}
+
+// Wait waits for the process to exit and returns an error describing how it failed
+func (p *Process) Wait() error {
+	<-p.exited
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.err
+}
+
+// Run starts the process and waits for it
+func (p *Process) Run() error {
+	err := p.Start()
+
+	if err != nil {
+		return err
+	}
+
+	return p.Wait()
+}
+
+// Exited is closed once the process has exited
+func (p *Process) Exited() <-chan struct{} {
+	return p.exited
+}
+
+// Signal sends a signal to the process only, e.g. SIGTERM to shut down a server cleanly
+func (p *Process) Signal(signal os.Signal) error {
+	return p.command.Process.Signal(signal)
+}
+
+// Kill terminates the process group right away
+func (p *Process) Kill() {
+	p.mutex.Lock()
+	p.reason = "killed"
+	p.mutex.Unlock()
+
+	syscall.Kill(-p.command.Process.Pid, syscall.SIGKILL)
+}
+
+// processStderr copies stderr to the console unless the process is quiet, writes it line by
+// line to the log of the run and keeps the last lines for the error message
+type processStderr struct {
+	process *Process
+	mutex   sync.Mutex
+	partial []byte
+	lines   []string
+}
+
+func (w *processStderr) Write(data []byte) (int, error) {
+	if !w.process.quiet {
+		os.Stderr.Write(data)
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.partial = append(w.partial, data...)
+
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+
+		if i < 0 {
+			break
+		}
+
+		line := strings.TrimRight(string(w.partial[:i]), "\r")
+		w.partial = w.partial[i+1:]
+
+		if len(strings.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		w.process.supervisor.log(w.process.name, line)
+		w.lines = append(w.lines, line)
+
+		if len(w.lines) > processTailLines {
+			w.lines = w.lines[1:]
+		}
+	}
+
+	return len(data), nil
+}
+
+func (w *processStderr) tail() string {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	lines := w.lines
+
+	if len(w.partial) > 0 {
+		lines = append(lines, string(w.partial))
+	}
+
+	return strings.Join(lines, " | ")
+}
+
+// LogAbort logs why the run was aborted next to the output of the processes
+func (s *ProcessSupervisor) LogAbort(reason string) {
+	log.Println("Aborting:", reason)
+	s.log("supervisor", "aborting: "+reason)
+}
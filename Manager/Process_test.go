@@ -0,0 +1,25 @@
+package Manager
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProcessStartFailure(t *testing.T) {
+	process := NewProcess("missing", "/nonexistent/binary")
+	err := process.Start()
+
+	if err == nil {
+		t.Fatal("a missing binary was started")
+	}
+
+	select {
+	case <-process.Exited():
+	case <-time.After(time.Second):
+		t.Fatal("Exited was not closed after the failed start")
+	}
+
+	if process.Wait() != err {
+		t.Errorf("Wait returned %v, want the start error %v", process.Wait(), err)
+	}
+}
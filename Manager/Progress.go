@@ -0,0 +1,423 @@
+package Manager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ProgressFormatBar  = "bar"
+	ProgressFormatLog  = "log"
+	ProgressFormatJson = "json"
+	ProgressFormatNone = "none"
+)
+
+type ProgressConfig struct {
+	Format          string `json:"format"`
+	IntervalSeconds int    `json:"interval_seconds"`
+	//file the events are appended to, stderr when empty. stdout is left to the reports of
+	//audit -json and restore-test -json.
+	Output string `json:"output"`
+}
+
+// ProgressEvent is emitted periodically for every running phase. Total is 0 and ETA -1 when
+// the size of the phase is not known up front.
+type ProgressEvent struct {
+	Time           time.Time `json:"time"`
+	Phase          string    `json:"phase"`
+	Name           string    `json:"name"`
+	Bytes          int64     `json:"bytes"`
+	Total          int64     `json:"total"`
+	BytesPerSecond float64   `json:"bytes_per_second"`
+	ETASeconds     float64   `json:"eta_seconds"`
+	ElapsedSeconds float64   `json:"elapsed_seconds"`
+	Finished       bool      `json:"finished"`
+	Error          string    `json:"error,omitempty"`
+}
+
+type ProgressReporter struct {
+	mutex    sync.Mutex
+	format   string
+	interval time.Duration
+	output   io.Writer
+	tasks    []*ProgressTask
+	running  bool
+}
+
+// ProgressTask is a single running phase, its byte count is read from counter
+type ProgressTask struct {
+	reporter  *ProgressReporter
+	phase     string
+	name      string
+	total     int64
+	counter   func() int64
+	started   time.Time
+	lastBytes int64
+	lastTime  time.Time
+	rate      float64
+	updates   chan ProgressUpdate
+}
+
+// Progress is the reporter used by every phase of the process
+var Progress = &ProgressReporter{format: ProgressFormatLog, interval: 30 * time.Second, output: os.Stderr}
+
+// Configure selects how and where events are rendered, an empty format picks a bar when stderr
+// is a terminal and log lines otherwise
+func (p *ProgressReporter) Configure(config ProgressConfig) error {
+	format := config.Format
+
+	if len(format) == 0 {
+		format = ProgressFormatLog
+
+		if stat, err := os.Stderr.Stat(); err == nil && stat.Mode()&os.ModeCharDevice != 0 && len(config.Output) == 0 {
+			format = ProgressFormatBar
+		}
+	}
+
+	interval := time.Duration(config.IntervalSeconds) * time.Second
+
+	switch format {
+	case ProgressFormatBar:
+		if interval <= 0 {
+			interval = time.Second
+		}
+	case ProgressFormatLog:
+		if interval <= 0 {
+			interval = 30 * time.Second
+		}
+	case ProgressFormatJson:
+		if interval <= 0 {
+			interval = 10 * time.Second
+		}
+	case ProgressFormatNone:
+	default:
+		return errors.New("invalid progress format, only ´bar´, ´log´, ´json´ or ´none´ are supported, got: " + format)
+	}
+
+	var output io.Writer = os.Stderr
+
+	if len(config.Output) > 0 {
+		file, err := os.OpenFile(config.Output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+
+		if err != nil {
+			return errors.New(fmt.Sprintf("[Progress]> Failed to open progress output %v, %v", config.Output, err))
+		}
+
+		output = file
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.format = format
+	p.interval = interval
+	p.output = output
+
+	return nil
+}
+
+// Start begins reporting a phase. Total may be 0 when unknown and counter may be nil for
+// phases without a byte count, like prepare.
+func (p *ProgressReporter) Start(phase string, name string, total int64, counter func() int64) *ProgressTask {
+	now := time.Now()
+
+	task := &ProgressTask{
+		reporter: p,
+		phase:    phase,
+		name:     name,
+		total:    total,
+		counter:  counter,
+		started:  now,
+		lastTime: now,
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.tasks = append(p.tasks, task)
+
+	if !p.running && p.format != ProgressFormatNone {
+		p.running = true
+		go p.run()
+	}
+
+	return task
+}
+
+// Notify forwards every event of the task to the channel without ever blocking the transfer
+func (t *ProgressTask) Notify(updates chan ProgressUpdate) {
+	t.reporter.mutex.Lock()
+	defer t.reporter.mutex.Unlock()
+
+	t.updates = updates
+}
+
+func (t *ProgressTask) Finish(err error) {
+	p := t.reporter
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for i := range p.tasks {
+		if p.tasks[i] == t {
+			p.tasks = append(p.tasks[:i], p.tasks[i+1:]...)
+			break
+		}
+	}
+
+	event := t.event(time.Now())
+	event.Finished = true
+	event.BytesPerSecond = float64(event.Bytes) / maxFloat(event.ElapsedSeconds, 0.001)
+	event.ETASeconds = 0
+
+	if err != nil {
+		event.Error = err.Error()
+	}
+
+	t.send(event)
+
+	if p.format != ProgressFormatNone {
+		p.render([]ProgressEvent{event})
+	}
+}
+
+func (p *ProgressReporter) run() {
+	for {
+		p.mutex.Lock()
+		interval := p.interval
+		p.mutex.Unlock()
+
+		time.Sleep(interval)
+
+		p.mutex.Lock()
+		events := make([]ProgressEvent, 0, len(p.tasks))
+		now := time.Now()
+
+		for _, task := range p.tasks {
+			event := task.event(now)
+			task.send(event)
+			events = append(events, event)
+		}
+
+		if len(events) > 0 && p.format != ProgressFormatNone {
+			p.render(events)
+		}
+		p.mutex.Unlock()
+	}
+}
+
+// event samples the counter, the rate is smoothed so short stalls do not make the ETA jump
+func (t *ProgressTask) event(now time.Time) ProgressEvent {
+	bytes := int64(0)
+
+	if t.counter != nil {
+		bytes = t.counter()
+	}
+
+	if elapsed := now.Sub(t.lastTime).Seconds(); elapsed > 0 {
+		current := float64(bytes-t.lastBytes) / elapsed
+
+		if t.rate == 0 {
+			t.rate = current
+		} else {
+			t.rate = 0.7*t.rate + 0.3*current
+		}
+
+		t.lastBytes = bytes
+		t.lastTime = now
+	}
+
+	eta := float64(-1)
+
+	if t.total > 0 && t.rate > 0 {
+		eta = float64(t.total-bytes) / t.rate
+	}
+
+	return ProgressEvent{
+		Time:           now.UTC(),
+		Phase:          t.phase,
+		Name:           t.name,
+		Bytes:          bytes,
+		Total:          t.total,
+		BytesPerSecond: t.rate,
+		ETASeconds:     eta,
+		ElapsedSeconds: now.Sub(t.started).Seconds(),
+	}
+}
+
+func (t *ProgressTask) send(event ProgressEvent) {
+	if t.updates == nil {
+		return
+	}
+
+	var err error
+	if len(event.Error) > 0 {
+		err = errors.New(event.Error)
+	}
+
+	select {
+	case t.updates <- ProgressUpdate{
+		Bytes:    event.Bytes,
+		Total:    event.Total,
+		Finished: event.Finished,
+		Error:    err,
+	}:
+	default:
+	}
+}
+
+func (p *ProgressReporter) render(events []ProgressEvent) {
+	switch p.format {
+	case ProgressFormatJson:
+		for _, event := range events {
+			payload, err := json.Marshal(event)
+
+			if err == nil {
+				fmt.Fprintln(p.output, string(payload))
+			}
+		}
+	case ProgressFormatLog:
+		for _, event := range events {
+			log.Println("[Progress]>", formatProgress(event))
+		}
+	case ProgressFormatBar:
+		lines := make([]string, 0, len(events))
+
+		for _, event := range events {
+			lines = append(lines, progressBar(event)+" "+formatProgress(event))
+		}
+
+		line := strings.Join(lines, " | ")
+
+		if events[0].Finished {
+			fmt.Fprintf(p.output, "\r\033[K%v\n", line)
+		} else {
+			fmt.Fprintf(p.output, "\r\033[K%v", line)
+		}
+	}
+}
+
+func formatProgress(event ProgressEvent) string {
+	text := event.Phase
+
+	if len(event.Name) > 0 {
+		text += " " + event.Name
+	}
+
+	if event.Total > 0 {
+		text += fmt.Sprintf(" %.1f%% %v/%v", 100*float64(event.Bytes)/float64(event.Total), formatBytes(event.Bytes), formatBytes(event.Total))
+	} else if event.Bytes > 0 {
+		text += " " + formatBytes(event.Bytes)
+	}
+
+	if event.BytesPerSecond > 0 {
+		text += " " + formatBytes(int64(event.BytesPerSecond)) + "/s"
+	}
+
+	if event.Finished {
+		text += " done in " + formatDuration(event.ElapsedSeconds)
+
+		if len(event.Error) > 0 {
+			text += " with error: " + event.Error
+		}
+	} else if event.ETASeconds >= 0 {
+		text += " ETA " + formatDuration(event.ETASeconds)
+	} else {
+		text += " elapsed " + formatDuration(event.ElapsedSeconds)
+	}
+
+	return text
+}
+
+func progressBar(event ProgressEvent) string {
+	const width = 20
+
+	if event.Total <= 0 {
+		return ""
+	}
+
+	filled := int(width * event.Bytes / event.Total)
+
+	if filled > width {
+		filled = width
+	}
+
+	return "[" + strings.Repeat("=", filled) + strings.Repeat(" ", width-filled) + "]"
+}
+
+func formatBytes(bytes int64) string {
+	const unit = 1024
+
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
+
+func formatDuration(seconds float64) string {
+	return (time.Duration(seconds) * time.Second).String()
+}
+
+func maxFloat(a float64, b float64) float64 {
+	if a > b {
+		return a
+	}
+
+	return b
+}
+
+// ProgressCounter counts the bytes passing through the readers and writers it wraps
+type ProgressCounter struct {
+	bytes int64
+}
+
+func (c *ProgressCounter) Bytes() int64 {
+	return atomic.LoadInt64(&c.bytes)
+}
+
+func (c *ProgressCounter) Reader(reader io.Reader) io.Reader {
+	return &countingReader{reader: reader, counter: c}
+}
+
+func (c *ProgressCounter) Writer(writer io.Writer) io.Writer {
+	return &countingWriter{writer: writer, counter: c}
+}
+
+type countingReader struct {
+	reader  io.Reader
+	counter *ProgressCounter
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	atomic.AddInt64(&c.counter.bytes, int64(n))
+
+	return n, err
+}
+
+type countingWriter struct {
+	writer  io.Writer
+	counter *ProgressCounter
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.writer.Write(p)
+	atomic.AddInt64(&c.counter.bytes, int64(n))
+
+	return n, err
+}
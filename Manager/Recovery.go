@@ -0,0 +1,176 @@
+package Manager
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// PointInTimeRecovery replays the archived binary logs on top of a restored backup, from the
+// binlog position of the backup up to a recovery target
+type PointInTimeRecovery struct {
+	archive           *BinlogArchive
+	mysqlBinlogBinary string
+	mysqlBinary       string
+	mariadbdBinary    string
+	serverOptions     []string
+	clientOptions     []string
+	workDirectory     string
+}
+
+func CreatePointInTimeRecovery(
+	Archive *BinlogArchive,
+	MysqlBinlogBinary string,
+	MysqlBinary string,
+	MariadbdBinary string,
+	ServerOptions []string,
+	ClientOptions []string,
+	WorkDirectory string,
+) (*PointInTimeRecovery, error) {
+
+	return &PointInTimeRecovery{
+		archive:           Archive,
+		mysqlBinlogBinary: MysqlBinlogBinary,
+		mysqlBinary:       MysqlBinary,
+		mariadbdBinary:    MariadbdBinary,
+		serverOptions:     ServerOptions,
+		clientOptions:     ClientOptions,
+		workDirectory:     WorkDirectory,
+	}, nil
+}
+
+// mysqlBinlog builds the mysqlbinlog command reading the files from the start position to the target
+func (p *PointInTimeRecovery) mysqlBinlog(start *BinlogPosition, target *RecoveryTarget, files []string, extra ...string) *Process {
+	args := append([]string{"--start-position=" + fmt.Sprint(start.Position)}, target.args()...)
+	args = append(args, extra...)
+	args = append(args, files...)
+
+	return NewProcess("mysqlbinlog", p.mysqlBinlogBinary, args...)
+}
+
+func (p *PointInTimeRecovery) fetch(start *BinlogPosition, target *RecoveryTarget) ([]string, error) {
+	log.Println("Replaying binlogs from", start, "to", target)
+
+	files, err := fetchBinlogs(p.archive, start, target, filepath.Join(p.workDirectory, BinlogArchivePrefix))
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		log.Println("  ", filepath.Base(file))
+	}
+
+	return files, nil
+}
+
+// DryRun prints the decoded events that Replay would apply without touching any server
+func (p *PointInTimeRecovery) DryRun(start *BinlogPosition, target *RecoveryTarget) error {
+	files, err := p.fetch(start, target)
+
+	if err != nil {
+		return err
+	}
+
+	process := p.mysqlBinlog(start, target, files, "--base64-output=decode-rows", "--verbose")
+	process.SetStdout(os.Stdout)
+
+	return process.Run()
+}
+
+// Replay starts a temporary server without networking on the restored data directory, pipes
+// mysqlbinlog into it and shuts it down again once every event up to the target was applied
+func (p *PointInTimeRecovery) Replay(dataDirectory string, start *BinlogPosition, target *RecoveryTarget) error {
+	files, err := p.fetch(start, target)
+
+	if err != nil {
+		return err
+	}
+
+	server, runDirectory, err := p.startServer(dataDirectory)
+
+	if err != nil {
+		return err
+	}
+
+	defer os.RemoveAll(runDirectory)
+
+	err = server.wait(func() error {
+		return p.client(server.socket, "-e", "SELECT 1").Quiet().Run()
+	})
+
+	if err == nil {
+		err = p.apply(server.socket, start, target, files)
+	}
+
+	shutdownErr := server.shutdown()
+
+	if err != nil {
+		return err
+	}
+
+	return shutdownErr
+}
+
+// startServer starts the temporary server with its socket and pid file in a pitr directory of
+// its own, the work directory is only accessible to root and the server runs as mysql
+func (p *PointInTimeRecovery) startServer(dataDirectory string) (*temporaryServer, string, error) {
+	runDirectory, err := createRunDirectory(p.workDirectory, "pitr")
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	server, err := startTemporaryServer(p.mariadbdBinary, p.serverOptions, dataDirectory, runDirectory, "pitr")
+
+	if err != nil {
+		os.RemoveAll(runDirectory)
+		return nil, "", err
+	}
+
+	return server, runDirectory, nil
+}
+
+func (p *PointInTimeRecovery) client(socket string, args ...string) *Process {
+	options := append(append([]string{}, p.clientOptions...), "--socket="+socket)
+
+	return NewProcess("mysql", p.mysqlBinary, append(options, args...)...)
+}
+
+func (p *PointInTimeRecovery) apply(socket string, start *BinlogPosition, target *RecoveryTarget, files []string) error {
+	binlog := p.mysqlBinlog(start, target, files)
+	mysql := p.client(socket, "--binary-mode")
+	mysql.SetStdout(os.Stdout)
+
+	pipe, err := binlog.StdoutPipe()
+
+	if err != nil {
+		return err
+	}
+
+	mysql.SetStdin(pipe)
+
+	err = mysql.Start()
+
+	//mysql holds its own copy of the read end
+	pipe.Close()
+
+	if err != nil {
+		return err
+	}
+
+	task := Progress.Start("replay", strings.Join([]string{filepath.Base(files[0]), filepath.Base(files[len(files)-1])}, ".."), 0, nil)
+
+	err = binlog.Run()
+	mysqlErr := mysql.Wait()
+
+	if err == nil {
+		err = mysqlErr
+	}
+
+	task.Finish(err)
+
+	return err
+}
@@ -0,0 +1,99 @@
+package Manager
+
+import (
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// TestRecoveryRunDirectory starts a fake mariadbd that records its arguments and checks that the
+// socket is created in a run directory of its own, owned by the user the server runs as
+func TestRecoveryRunDirectory(t *testing.T) {
+	account, err := user.Lookup("nobody")
+
+	if os.Geteuid() != 0 || err != nil {
+		t.Skip("changing the owner requires root and the nobody user")
+	}
+
+	defer func(name string) { temporaryServerUser = name }(temporaryServerUser)
+	temporaryServerUser = "nobody"
+
+	dir, err := ioutil.TempDir("", "recovery")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	work := filepath.Join(dir, "work")
+	args := filepath.Join(dir, "args")
+	binary := filepath.Join(dir, "mariadbd")
+
+	err = os.MkdirAll(work, 0750)
+
+	if err == nil {
+		err = ioutil.WriteFile(binary, []byte("#!/bin/sh\necho \"$@\" > "+args+"\n"), 0750)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recovery := &PointInTimeRecovery{mariadbdBinary: binary, workDirectory: work}
+	server, runDirectory, err := recovery.startServer(filepath.Join(dir, "data"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	<-server.process.Exited()
+
+	data, err := ioutil.ReadFile(args)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	socket := ""
+
+	for _, arg := range strings.Fields(string(data)) {
+		if strings.HasPrefix(arg, "--socket=") {
+			socket = strings.TrimPrefix(arg, "--socket=")
+		}
+	}
+
+	if filepath.Dir(socket) != runDirectory || filepath.Clean(runDirectory) == filepath.Clean(work) {
+		t.Errorf("socket %v is not in a run directory of its own below %v", socket, work)
+	}
+
+	uid, _ := strconv.Atoi(account.Uid)
+	gid, _ := strconv.Atoi(account.Gid)
+
+	for _, check := range []struct {
+		directory string
+		uid       int
+		gid       int
+	}{
+		{directory: runDirectory, uid: uid, gid: gid},
+		//root keeps the work directory, the server reaches the run directory through its group
+		{directory: work, uid: 0, gid: gid},
+	} {
+		stat, err := os.Stat(check.directory)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		owner := stat.Sys().(*syscall.Stat_t)
+
+		if int(owner.Uid) != check.uid || int(owner.Gid) != check.gid {
+			t.Errorf("%v is owned by %d:%d, want %d:%d", check.directory, owner.Uid, owner.Gid, check.uid, check.gid)
+		}
+	}
+}
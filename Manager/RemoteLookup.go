@@ -2,11 +2,46 @@ package Manager
 
 import (
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"log"
+	"time"
 )
 
+type RemoteObject struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+	ETag         string
+	StorageClass string
+	LockMode     string
+	RetainUntil  time.Time
+	LegalHold    bool
+}
+
+// Locked reports whether the object is protected by a retention period or a legal hold
+func (r *RemoteObject) Locked() bool {
+	return r.LegalHold || r.RetainUntil.After(time.Now())
+}
+
+func (r *RemoteObject) LockStatus() string {
+	status := "unlocked"
+
+	if r.RetainUntil.After(time.Now()) {
+		status = r.LockMode + " until " + r.RetainUntil.Format(time.RFC3339)
+	}
+
+	if r.LegalHold {
+		if status == "unlocked" {
+			return "legal hold"
+		}
+		status += ", legal hold"
+	}
+
+	return status
+}
+
 func RemoteLookup(sess *session.Session, prefix string, bucket string) ([]string, error) {
 
 	client := s3.New(sess)
@@ -28,3 +63,75 @@ func RemoteLookup(sess *session.Session, prefix string, bucket string) ([]string
 
 	return results, nil
 }
+
+// RemoteList returns every object under the prefix, following pagination
+func RemoteList(sess *session.Session, prefix string, bucket string) ([]RemoteObject, error) {
+
+	client := s3.New(sess)
+	results := make([]RemoteObject, 0)
+
+	err := client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	}, func(out *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, record := range out.Contents {
+			results = append(results, RemoteObject{
+				Key:          aws.StringValue(record.Key),
+				Size:         aws.Int64Value(record.Size),
+				LastModified: aws.TimeValue(record.LastModified),
+				ETag:         aws.StringValue(record.ETag),
+				StorageClass: aws.StringValue(record.StorageClass),
+			})
+		}
+		return true
+	})
+
+	if err != nil {
+		log.Println("[ERROR] Error during RemoteList() error:", err)
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// RemoteLockStatus fills in the Object Lock retention and legal hold of the object
+func RemoteLockStatus(sess *session.Session, object *RemoteObject, bucket string) error {
+
+	client := s3.New(sess)
+
+	retention, err := client.GetObjectRetention(&s3.GetObjectRetentionInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(object.Key),
+	})
+
+	if err == nil && retention.Retention != nil {
+		object.LockMode = aws.StringValue(retention.Retention.Mode)
+		object.RetainUntil = aws.TimeValue(retention.Retention.RetainUntilDate)
+	} else if err != nil && !isNoObjectLockError(err) {
+		return err
+	}
+
+	hold, err := client.GetObjectLegalHold(&s3.GetObjectLegalHoldInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(object.Key),
+	})
+
+	if err == nil && hold.LegalHold != nil {
+		object.LegalHold = aws.StringValue(hold.LegalHold.Status) == s3.ObjectLockLegalHoldStatusOn
+	} else if err != nil && !isNoObjectLockError(err) {
+		return err
+	}
+
+	return nil
+}
+
+func isNoObjectLockError(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case "NoSuchObjectLockConfiguration", "ObjectLockConfigurationNotFoundError", "InvalidRequest":
+			return true
+		}
+	}
+
+	return false
+}
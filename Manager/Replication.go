@@ -0,0 +1,212 @@
+package Manager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ReplicationFile records in every backup directory which destinations hold a copy of it
+const ReplicationFile = "replication.json"
+
+type DestinationStatus struct {
+	Name        string    `json:"name"`
+	Succeeded   bool      `json:"succeeded"`
+	Attempts    int       `json:"attempts"`
+	LastAttempt time.Time `json:"last_attempt"`
+	Error       string    `json:"error,omitempty"`
+}
+
+type ReplicationStatus struct {
+	Destinations []DestinationStatus `json:"destinations"`
+	Good         bool                `json:"good"`
+}
+
+// ReplicationManager sends every backup to all destinations, a backup counts as good once
+// minSuccessful of them hold a copy
+type ReplicationManager struct {
+	destinations  []Destination
+	minSuccessful int
+}
+
+// CreateReplicationManager requires MinSuccessful of the destinations to succeed, 0 means all of them
+func CreateReplicationManager(Destinations []Destination, MinSuccessful int) (*ReplicationManager, error) {
+	if len(Destinations) == 0 {
+		return nil, errors.New("no destinations are configured")
+	}
+
+	if MinSuccessful < 0 || MinSuccessful > len(Destinations) {
+		return nil, errors.New(fmt.Sprintf("min_successful_destinations must be between 0 and %d, got: %d", len(Destinations), MinSuccessful))
+	}
+
+	if MinSuccessful == 0 {
+		MinSuccessful = len(Destinations)
+	}
+
+	return &ReplicationManager{
+		destinations:  Destinations,
+		minSuccessful: MinSuccessful,
+	}, nil
+}
+
+func LoadReplicationStatus(backup string) (*ReplicationStatus, error) {
+	data, err := ioutil.ReadFile(filepath.Join(backup, ReplicationFile))
+
+	if err != nil {
+		return nil, err
+	}
+
+	status := &ReplicationStatus{}
+
+	return status, json.Unmarshal(data, status)
+}
+
+func (s *ReplicationStatus) Save(backup string) error {
+	payload, err := json.MarshalIndent(s, "", "\t")
+
+	if err != nil {
+		return err
+	}
+
+	file := filepath.Join(backup, ReplicationFile)
+
+	err = ioutil.WriteFile(file+".tmp", payload, 0640)
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(file+".tmp", file)
+}
+
+func (s *ReplicationStatus) destination(name string) *DestinationStatus {
+	for i := range s.Destinations {
+		if s.Destinations[i].Name == name {
+			return &s.Destinations[i]
+		}
+	}
+
+	s.Destinations = append(s.Destinations, DestinationStatus{Name: name})
+
+	return &s.Destinations[len(s.Destinations)-1]
+}
+
+// Replicate uploads the backup to every destination that does not hold a copy yet. Failed
+// destinations do not stop the others, the backup only fails when too few of them succeeded.
+func (r *ReplicationManager) Replicate(backup string) (*ReplicationStatus, error) {
+	status, err := LoadReplicationStatus(backup)
+
+	if err != nil {
+		status = &ReplicationStatus{}
+	}
+
+	succeeded := 0
+
+	for _, destination := range r.destinations {
+		current := status.destination(destination.Name())
+
+		if current.Succeeded {
+			succeeded++
+			continue
+		}
+
+		log.Println("Replicating", backup, "to", destination.Name())
+
+		err := UploadBackup(destination, backup)
+
+		current.Attempts++
+		current.LastAttempt = time.Now().UTC()
+		current.Succeeded = err == nil
+		current.Error = ""
+
+		if err != nil {
+			current.Error = err.Error()
+			log.Printf("Replication of %v to %v has failed, it will be retried on the next run: %v", backup, destination.Name(), err)
+		} else {
+			succeeded++
+		}
+
+		err = status.Save(backup)
+
+		if err != nil {
+			return status, errors.New(fmt.Sprintf("[ReplicationManager Replicate()]> Failed to save replication status, %v", err))
+		}
+	}
+
+	status.Good = succeeded >= r.minSuccessful
+
+	err = status.Save(backup)
+
+	if err != nil {
+		return status, errors.New(fmt.Sprintf("[ReplicationManager Replicate()]> Failed to save replication status, %v", err))
+	}
+
+	log.Printf("Backup %v replicated to %d of %d destinations, %d required", backup, succeeded, len(r.destinations), r.minSuccessful)
+
+	if !status.Good {
+		return status, errors.New(fmt.Sprintf("[ReplicationManager Replicate()]> Only %d of %d destinations succeeded, %d required", succeeded, len(r.destinations), r.minSuccessful))
+	}
+
+	return status, nil
+}
+
+// Pending returns the backups below the target directory that still miss a copy on one of the
+// destinations. An encrypted backup without a status file was not replicated anywhere yet, the
+// run that took it stopped before the first upload finished.
+func (r *ReplicationManager) Pending(targetDirectory string) []string {
+	pending := make([]string, 0)
+
+	for _, directory := range LocalBackups(targetDirectory) {
+		status, err := LoadReplicationStatus(directory)
+
+		if os.IsNotExist(err) {
+			if _, err := os.Stat(filepath.Join(directory, "backup.gz.enc")); err == nil {
+				pending = append(pending, directory)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			log.Printf("Replication status of %v is unreadable, replicating it again: %v", directory, err)
+			pending = append(pending, directory)
+			continue
+		}
+
+		for _, destination := range r.destinations {
+			if !status.destination(destination.Name()).Succeeded {
+				pending = append(pending, directory)
+				break
+			}
+		}
+	}
+
+	return pending
+}
+
+// RetryPending replicates the backups whose copies failed on an earlier run
+func (r *ReplicationManager) RetryPending(targetDirectory string) error {
+	failed := 0
+
+	for _, backup := range r.Pending(targetDirectory) {
+		log.Println("Retrying replication of", backup)
+
+		_, err := r.Replicate(backup)
+
+		if err != nil {
+			log.Println(err)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return errors.New(fmt.Sprintf("[ReplicationManager RetryPending()]> %d backups are still not replicated to enough destinations", failed))
+	}
+
+	return nil
+}
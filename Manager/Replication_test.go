@@ -0,0 +1,87 @@
+package Manager
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReplicationPending(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replication")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	destinations := make([]Destination, 0)
+
+	for _, name := range []string{"first", "second"} {
+		destination, err := CreateLocalDestination(filepath.Join(dir, name), 0)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		destination.setName(name)
+		destinations = append(destinations, destination)
+	}
+
+	replication, err := CreateReplicationManager(destinations, 1)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target := filepath.Join(dir, "target")
+
+	tests := []struct {
+		backup    string
+		encrypted bool
+		status    *ReplicationStatus
+		pending   bool
+	}{
+		//replicated everywhere
+		{backup: "full", encrypted: true, status: &ReplicationStatus{Destinations: []DestinationStatus{{Name: "first", Succeeded: true}, {Name: "second", Succeeded: true}}}, pending: false},
+		//one copy failed
+		{backup: "incr/1", encrypted: true, status: &ReplicationStatus{Destinations: []DestinationStatus{{Name: "first", Succeeded: true}, {Name: "second"}}}, pending: true},
+		//a destination added since
+		{backup: "incr/2", encrypted: true, status: &ReplicationStatus{Destinations: []DestinationStatus{{Name: "first", Succeeded: true}}}, pending: true},
+		//the run stopped before the status file was written
+		{backup: "incr/3", encrypted: true, pending: true},
+		//taken without replication
+		{backup: "incr/4", encrypted: false, pending: false},
+	}
+
+	want := make([]string, 0)
+
+	for _, test := range tests {
+		directory := filepath.Join(target, test.backup)
+		err = os.MkdirAll(directory, 0750)
+
+		if err == nil && test.encrypted {
+			err = ioutil.WriteFile(filepath.Join(directory, "backup.gz.enc"), []byte("backup"), 0640)
+		}
+
+		if err == nil && test.status != nil {
+			err = test.status.Save(directory)
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if test.pending {
+			want = append(want, directory)
+		}
+	}
+
+	pending := replication.Pending(target)
+
+	if strings.Join(pending, ",") != strings.Join(want, ",") {
+		t.Errorf("got pending %v, want %v", pending, want)
+	}
+}
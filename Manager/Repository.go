@@ -4,20 +4,49 @@ import (
 	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"io"
 	"log"
+	"net/http"
+	"net/url"
 	"os"
-	"path/filepath"
+	"strings"
 	"time"
 )
 
+const (
+	StorageClassGlacierIr      = "GLACIER_IR"
+	ArchiveRestorePollInterval = time.Minute
+)
+
 type S3Manager struct {
+	name       string
 	region     string
 	awsSession *session.Session
 	accessKey  string
 	secret     string
 	bucket     string
+	options    S3ObjectOptions
+}
+
+// S3ObjectOptions are applied to every object uploaded by S3Manager
+type S3ObjectOptions struct {
+	ServerSideEncryption string            `json:"server_side_encryption"`
+	SSEKMSKeyId          string            `json:"sse_kms_key_id"`
+	StorageClass         string            `json:"storage_class"`
+	Tags                 map[string]string `json:"tags"`
+	Metadata             map[string]string `json:"metadata"`
+	ArchiveRestoreDays   int               `json:"archive_restore_days"`
+	ArchiveRestoreTier   string            `json:"archive_restore_tier"`
+	ArchiveRestoreHours  int               `json:"archive_restore_wait_hours"`
+	RetentionDays        int               `json:"retention_days"`
+	ObjectLockMode       string            `json:"object_lock_mode"`
+	ObjectLockLegalHold  bool              `json:"object_lock_legal_hold"`
+	StaleUploadHours     int               `json:"stale_upload_hours"`
 }
 
 type ProgressUpdate struct {
@@ -32,72 +61,413 @@ func CreateS3Manager(
 	Region string,
 	Bucket string,
 	Secret string,
+	Options S3ObjectOptions,
 ) (*S3Manager, error) {
 
+	switch Options.ServerSideEncryption {
+	case "", s3.ServerSideEncryptionAes256, s3.ServerSideEncryptionAwsKms:
+		break
+	default:
+		return nil, errors.New("invalid server side encryption, only ´AES256´ or ´aws:kms´ are supported, got: " + Options.ServerSideEncryption)
+	}
+
+	if len(Options.SSEKMSKeyId) > 0 && Options.ServerSideEncryption != s3.ServerSideEncryptionAwsKms {
+		return nil, errors.New("sse_kms_key_id requires server_side_encryption ´aws:kms´")
+	}
+
+	if len(Options.StorageClass) > 0 && !isValidStorageClass(Options.StorageClass) {
+		return nil, errors.New("invalid storage class: " + Options.StorageClass)
+	}
+
+	switch Options.ObjectLockMode {
+	case "", s3.ObjectLockModeGovernance, s3.ObjectLockModeCompliance:
+		break
+	default:
+		return nil, errors.New("invalid object lock mode, only ´GOVERNANCE´ or ´COMPLIANCE´ are supported, got: " + Options.ObjectLockMode)
+	}
+
+	if len(Options.ObjectLockMode) > 0 && Options.RetentionDays <= 0 {
+		return nil, errors.New("object_lock_mode requires retention_days to be set")
+	}
+
+	if Options.StaleUploadHours <= 0 {
+		Options.StaleUploadHours = 24
+	}
+
+	if Options.ArchiveRestoreDays <= 0 {
+		Options.ArchiveRestoreDays = 1
+	}
+
+	if len(Options.ArchiveRestoreTier) == 0 {
+		Options.ArchiveRestoreTier = s3.TierStandard
+	}
+
+	//bulk restores from Deep Archive take up to 48 hours
+	if Options.ArchiveRestoreHours <= 0 {
+		Options.ArchiveRestoreHours = 48
+	}
+
 	sess, err := session.NewSession(&aws.Config{
 		Credentials: credentials.NewStaticCredentials(AccessKey, Secret, ""),
 		Region:      aws.String(Region),
+		HTTPClient:  &http.Client{Transport: &throttledTransport{base: http.DefaultTransport}},
 	})
 
 	if err != nil {
 		return nil, errors.New("session creation failed")
 	}
 	return &S3Manager{
+		name:       "s3://" + Bucket,
 		region:     Region,
 		accessKey:  AccessKey,
 		bucket:     Bucket,
 		secret:     Secret,
 		awsSession: sess,
+		options:    Options,
 	}, nil
 }
 
-func (s *S3Manager) Upload(backup string) {
+func (s *S3Manager) Name() string {
+	return s.name
+}
 
-	files := []string{"backup.gz.enc", "xtrabackup_info", "xtrabackup_checkpoints", "checksum"}
+func (s *S3Manager) setName(name string) {
+	s.name = name
+}
 
-	for i := range files {
-		ulp := &UploadProgress{}
-		fh, err := os.Open(filepath.Join(backup, files[i]))
-		if err != nil {
-			fmt.Println(err)
+func (s *S3Manager) UploadFile(file string, key string, metadata map[string]string) error {
+	fh, err := os.Open(file)
+
+	if err != nil {
+		return err
+	}
+
+	defer fh.Close()
+
+	stat, err := fh.Stat()
+
+	if err != nil {
+		return err
+	}
+
+	ulp := &UploadProgress{}
+	_, err = ulp.Upload(s.awsSession, s.createUploadInput(key, metadata), fh, stat.Size(), file+".upload-state")
+
+	if err != nil {
+		return errors.New(fmt.Sprintf("[S3Manager Upload()]> Failed to upload %v, %v", file, err))
+	}
+
+	return nil
+}
+
+func (s *S3Manager) createUploadInput(key string, metadata map[string]string) *s3manager.UploadInput {
+	input := &s3manager.UploadInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(key),
+		Metadata: make(map[string]*string),
+	}
+
+	for k, v := range s.options.Metadata {
+		input.Metadata[k] = aws.String(v)
+	}
+
+	for k, v := range metadata {
+		input.Metadata[k] = aws.String(v)
+	}
+
+	if len(s.options.ServerSideEncryption) > 0 {
+		input.ServerSideEncryption = aws.String(s.options.ServerSideEncryption)
+	}
+
+	if len(s.options.SSEKMSKeyId) > 0 {
+		input.SSEKMSKeyId = aws.String(s.options.SSEKMSKeyId)
+	}
+
+	if len(s.options.StorageClass) > 0 {
+		input.StorageClass = aws.String(s.options.StorageClass)
+	}
+
+	if len(s.options.ObjectLockMode) > 0 {
+		input.ObjectLockMode = aws.String(s.options.ObjectLockMode)
+		input.ObjectLockRetainUntilDate = aws.Time(time.Now().AddDate(0, 0, s.options.RetentionDays))
+	}
+
+	if s.options.ObjectLockLegalHold {
+		input.ObjectLockLegalHoldStatus = aws.String(s3.ObjectLockLegalHoldStatusOn)
+	}
+
+	if len(s.options.Tags) > 0 {
+		tags := url.Values{}
+		for k, v := range s.options.Tags {
+			tags.Set(k, v)
 		}
-		stat, err := fh.Stat()
+		input.Tagging = aws.String(tags.Encode())
+	}
+
+	return input
+}
+
+// DownloadFile downloads into a temporary file that only replaces the target once it is verified,
+// objects in archival storage classes are restored first
+func (s *S3Manager) DownloadFile(key string, file string) error {
+	err := s.waitForArchiveRestore(key)
+
+	if err != nil {
+		return err
+	}
+
+	fh, err := os.OpenFile(file+".part", os.O_CREATE|os.O_RDWR, 0640)
+
+	if err != nil {
+		return err
+	}
+
+	dlp := &DownloadProgress{}
+	_, err = dlp.Download(s.awsSession, key, s.bucket, fh, file+".download-state")
+
+	if err != nil {
+		fh.Close()
+		return errors.New(fmt.Sprintf("[S3Manager Download()]> Failed to download %v, %v", key, err))
+	}
+
+	err = VerifyDownload(s3.New(s.awsSession), s.bucket, key, fh)
+	fh.Close()
+
+	if err != nil {
+		//a corrupt copy must not be resumed on the next run
+		os.Remove(file + ".part")
+		return errors.New(fmt.Sprintf("[S3Manager Download()]> Verification of %v failed, %v", key, err))
+	}
+
+	return os.Rename(file+".part", file)
+}
+
+func (s *S3Manager) Open(key string) (io.ReadCloser, error) {
+	client := s3.New(s.awsSession)
+	out, err := client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return out.Body, nil
+}
+
+// OpenRange reads part of the object, pinned to its ETag when it is known
+func (s *S3Manager) OpenRange(object RemoteObject, offset int64, length int64) (io.ReadCloser, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(object.Key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
+	}
+
+	if len(object.ETag) > 0 {
+		input.IfMatch = aws.String(object.ETag)
+	}
+
+	out, err := s3.New(s.awsSession).GetObject(input)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return out.Body, nil
+}
+
+// waitForArchiveRestore issues a restore request for objects stored in an archival
+// storage class and blocks until the temporary copy is available for download, at most
+// archive_restore_wait_hours or until the run is aborted
+func (s *S3Manager) waitForArchiveRestore(key string) error {
+	client := s3.New(s.awsSession)
+	requested := false
+	wait := time.Duration(s.options.ArchiveRestoreHours) * time.Hour
+	deadline := time.Now().Add(wait)
+
+	for {
+		head, err := client.HeadObject(&s3.HeadObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(key),
+		})
+
 		if err != nil {
-			fmt.Println(err)
+			return errors.New(fmt.Sprintf("[S3Manager Download()]> Failed to head %v, %v", key, err))
 		}
-		_, err = ulp.Upload(s.awsSession, GenerateUploadS3Path(files[i]), s.bucket, fh, stat.Size())
-		if err != nil {
-			fmt.Println(err)
+
+		storageClass := aws.StringValue(head.StorageClass)
+		archiveStatus := aws.StringValue(head.ArchiveStatus)
+
+		if storageClass != s3.StorageClassGlacier && storageClass != s3.StorageClassDeepArchive && len(archiveStatus) == 0 {
+			return nil
+		}
+
+		restore := aws.StringValue(head.Restore)
+
+		if strings.Contains(restore, `ongoing-request="false"`) {
+			return nil
+		}
+
+		if len(restore) == 0 && !requested {
+			log.Printf("%v is stored in %v%v, requesting restore (tier %v)", key, storageClass, archiveStatus, s.options.ArchiveRestoreTier)
+
+			input := &s3.RestoreObjectInput{
+				Bucket:         aws.String(s.bucket),
+				Key:            aws.String(key),
+				RestoreRequest: &s3.RestoreRequest{},
+			}
+
+			//intelligent tiering archive access tiers do not accept the number of days
+			if len(archiveStatus) == 0 {
+				input.RestoreRequest.Days = aws.Int64(int64(s.options.ArchiveRestoreDays))
+				input.RestoreRequest.GlacierJobParameters = &s3.GlacierJobParameters{
+					Tier: aws.String(s.options.ArchiveRestoreTier),
+				}
+			}
+
+			_, err = client.RestoreObject(input)
+
+			if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "RestoreAlreadyInProgress" {
+				err = nil
+			}
+
+			if err != nil {
+				return errors.New(fmt.Sprintf("[S3Manager Download()]> Failed to request restore of %v, %v", key, err))
+			}
+		}
+
+		//also the case when a lifecycle rule expired the restored copy again
+		if requested && time.Now().After(deadline) {
+			return errors.New(fmt.Sprintf("[S3Manager Download()]> Archive restore of %v did not complete within %v", key, wait))
+		}
+
+		requested = true
+		log.Printf("Waiting for archive restore of %v to complete...", key)
+
+		select {
+		case <-Processes.Aborted():
+			return errors.New(fmt.Sprintf("[S3Manager Download()]> Waiting for the archive restore of %v was aborted", key))
+		case <-time.After(ArchiveRestorePollInterval):
 		}
 	}
 }
 
-func (s *S3Manager) Download(backup string, restoreDate string) {
-	//check if backup exists in S3
-	if s.IsPushed(GenerateDownloadS3Path("backup.gz.enc", restoreDate)) == false {
+func (s *S3Manager) List(prefix string) ([]RemoteObject, error) {
+	return RemoteList(s.awsSession, prefix, s.bucket)
+}
+
+// LockStatus fills in the Object Lock retention and legal hold of the object
+func (s *S3Manager) LockStatus(object *RemoteObject) error {
+	err := RemoteLockStatus(s.awsSession, object, s.bucket)
+
+	if err != nil {
+		return errors.New(fmt.Sprintf("[S3Manager LockStatus()]> Failed to read lock status of %v, %v", object.Key, err))
 	}
 
-	files := []string{"backup.gz.enc", "xtrabackup_info", "xtrabackup_checkpoints", "checksum"}
+	return nil
+}
 
-	if _, err := os.Stat(backup); os.IsNotExist(err) {
-		err := os.Mkdir(backup, 0755)
-		if err != nil {
-			log.Printf("Unable to create backups directory")
-		}
+// Delete removes the object unless it is still protected by Object Lock, in which case
+// it is skipped and false is returned
+func (s *S3Manager) Delete(object RemoteObject) (bool, error) {
+	err := s.LockStatus(&object)
+
+	if err != nil {
+		return false, err
 	}
 
-	for i := range files {
-		fh, err := os.OpenFile(filepath.Join(backup, files[i]), os.O_CREATE|os.O_WRONLY, 0640)
-		if err != nil {
-			fmt.Println(err)
-		}
+	if object.Locked() {
+		log.Printf("Skipping %v, object is locked (%v)", object.Key, object.LockStatus())
+		return false, nil
+	}
 
-		dlp := &DownloadProgress{}
-		_, err = dlp.Download(s.awsSession, GenerateDownloadS3Path(files[i], restoreDate), s.bucket, fh)
-		if err != nil {
-			fmt.Println(err)
+	client := s3.New(s.awsSession)
+	_, err = client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(object.Key),
+	})
+
+	if err != nil {
+		return false, errors.New(fmt.Sprintf("[S3Manager Delete()]> Failed to delete %v, %v", object.Key, err))
+	}
+
+	log.Printf("Deleted %v", object.Key)
+
+	return true, nil
+}
+
+// AbortStaleUploads lists this host's unfinished multipart uploads and aborts the ones
+// that were started longer than stale_upload_hours ago
+func (s *S3Manager) AbortStaleUploads() error {
+	client := s3.New(s.awsSession)
+	cutoff := time.Now().Add(-time.Duration(s.options.StaleUploadHours) * time.Hour)
+
+	err := client.ListMultipartUploadsPages(&s3.ListMultipartUploadsInput{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(GenerateHostPrefix()),
+	}, func(out *s3.ListMultipartUploadsOutput, lastPage bool) bool {
+		for _, upload := range out.Uploads {
+			initiated := aws.TimeValue(upload.Initiated)
+			log.Printf("Unfinished upload %v of %v started %v", aws.StringValue(upload.UploadId), aws.StringValue(upload.Key), initiated.Format(time.RFC3339))
+
+			if initiated.After(cutoff) {
+				continue
+			}
+
+			err := abortMultipartUpload(client, &TransferState{
+				Bucket:   s.bucket,
+				Key:      aws.StringValue(upload.Key),
+				UploadId: aws.StringValue(upload.UploadId),
+			})
+
+			if err != nil {
+				log.Printf("Failed to abort stale upload %v: %v", aws.StringValue(upload.UploadId), err)
+				continue
+			}
+
+			log.Printf("Aborted stale upload %v", aws.StringValue(upload.UploadId))
 		}
+		return true
+	})
+
+	if err != nil {
+		return errors.New(fmt.Sprintf("[S3Manager AbortStaleUploads()]> Failed to list multipart uploads, %v", err))
 	}
+
+	return nil
+}
+
+// Prune aborts stale multipart uploads and deletes expired backup chains
+func (s *S3Manager) Prune() error {
+	err := s.AbortStaleUploads()
+
+	if err != nil {
+		return err
+	}
+
+	return PruneBackups(s, s.options.RetentionDays)
+}
+
+// Metadata returns the user metadata of the object with lower case keys
+func (s *S3Manager) Metadata(key string) (map[string]string, error) {
+	client := s3.New(s.awsSession)
+	head, err := client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := make(map[string]string)
+
+	for k, v := range head.Metadata {
+		metadata[strings.ToLower(k)] = aws.StringValue(v)
+	}
+
+	return metadata, nil
 }
 
 func (s *S3Manager) IsPushed(backup string) bool {
@@ -115,21 +485,16 @@ func (s *S3Manager) IsPushed(backup string) bool {
 	return false
 }
 
-func GenerateUploadS3Path(file string) (s3Path string) {
-
-	hostname, _ := os.Hostname()
-	currentTime := time.Now()
-	date := currentTime.Format("2006-01-02")
-
-	s3Path = filepath.Join(hostname, date, file)
-
-	return s3Path
-}
-
-func GenerateDownloadS3Path(file string, restoreDate string) (s3Path string) {
+func isValidStorageClass(storageClass string) bool {
+	if storageClass == StorageClassGlacierIr {
+		return true
+	}
 
-	hostname, _ := os.Hostname()
-	s3Path = filepath.Join(hostname, restoreDate, file)
+	for _, v := range s3.StorageClass_Values() {
+		if v == storageClass {
+			return true
+		}
+	}
 
-	return s3Path
+	return false
 }
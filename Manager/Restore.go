@@ -8,12 +8,18 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
 	"os/user"
 	"path/filepath"
+	"sort"
 	"strconv"
+	"sync"
+	"time"
 )
 
+// ExtractedSizeFactor is the assumed ratio between the extracted and the compressed size of a
+// backup, used to estimate the disk space a restore needs
+const ExtractedSizeFactor = 4
+
 type RestoreManager struct {
 	sourceDirectory    string
 	targetDirectory    string
@@ -23,6 +29,19 @@ type RestoreManager struct {
 	mbStreamBinary     string
 	gzBlockSize        int
 	gzThreads          int
+	destination        Destination
+	chain              RemoteChain
+	encryptionKey      string
+	binlogPosition     *BinlogPosition
+	members            RemoteChain
+	include            func(path string) bool
+	pipelineDepth      int
+	lowDisk            bool
+	historyFile        string
+	replace            bool
+	setAside           string
+	extractTime        time.Duration
+	prepareTime        time.Duration
 }
 
 func CreateRestoreManager(
@@ -49,57 +68,340 @@ func CreateRestoreManager(
 
 }
 
+// StreamFrom restores the chain straight from the destination instead of the source directory,
+// every backup is decrypted and decompressed into mbstream while it is downloaded
+func (b *RestoreManager) StreamFrom(destination Destination, chain RemoteChain, EncryptionKey string) {
+	b.destination = destination
+	b.chain = chain
+	b.encryptionKey = EncryptionKey
+}
+
+// Filter extracts only the files of the backups that include accepts, given their path in the
+// xbstream relative to the data directory
+func (b *RestoreManager) Filter(include func(path string) bool) {
+	b.include = include
+}
+
+// Pipeline lets the extraction of up to depth following backups run while a backup is being
+// prepared, 0 extracts and prepares the backups strictly one after another
+func (b *RestoreManager) Pipeline(depth int) {
+	b.pipelineDepth = depth
+}
+
+// LowDisk extracts and applies one backup at a time, every incremental is deleted as soon as it
+// is merged into full/. Local source files are not moved into the work directory even on the
+// same file system: they hold the compressed xbstream, which has to be decompressed anyway, and
+// the source set stays intact for the next restore. Only the prepared full/ is moved back.
+func (b *RestoreManager) LowDisk() {
+	b.lowDisk = true
+	b.pipelineDepth = 0
+}
+
+// History appends the duration of every finished restore to file, the plan of later restores
+// estimates their duration from it
+func (b *RestoreManager) History(file string) {
+	b.historyFile = file
+}
+
+// Replace lets Restore move a target directory that is not empty aside to a timestamped sibling
+// instead of refusing it, once it is sure no server uses the directory
+func (b *RestoreManager) Replace() {
+	b.replace = true
+}
+
+// SetAsidePath returns where Restore moved the previous data directory, empty when it was empty
+func (b *RestoreManager) SetAsidePath() string {
+	return b.setAside
+}
+
+// Plan selects the backups Restore applies: the whole chain, or with upto only the prefix
+// ending with that position, backup id or time. The prefix has to be a continuous chain.
+func (b *RestoreManager) Plan(upto string) (RemoteChain, error) {
+	chain := b.chain
+
+	if b.destination == nil {
+		var err error
+		chain, err = DiscoverLocalChain(b.sourceDirectory)
+
+		if err != nil {
+			return nil, err
+		}
+
+		//the position file only is a hint, it may be missing on a fresh host or belong to another server
+		if backupPosition, err := b.getBackupPosition(); err == nil && backupPosition != len(chain)-1 {
+			log.Printf("Position file %v points to backup %d but the chain in %v ends at %d, restoring the discovered chain", b.backupPositionFile, backupPosition, b.sourceDirectory, len(chain)-1)
+		}
+	}
+
+	chain, err := ChainUpTo(chain, upto)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = ValidateChain(chain)
+
+	if err != nil {
+		return nil, err
+	}
+
+	b.members = chain
+
+	if b.destination != nil {
+		b.chain = chain
+	}
+
+	return chain, nil
+}
+
 func (b *RestoreManager) Restore() error {
 	f, err := os.Open(b.targetDirectory)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
 
 	_, err = f.Readdir(1)
+	f.Close()
+
+	empty := err == io.EOF
 
-	if err != io.EOF {
-		return errors.New(fmt.Sprintf("[Restore backup]> Target directory %v is not empty", b.targetDirectory))
+	if !empty && !b.replace {
+		return errors.New(fmt.Sprintf("[Restore backup]> Target directory %v is not empty, use -replace to move it aside", b.targetDirectory))
 	}
 
-	err = os.RemoveAll(b.workDirectory)
+	//fail before the chain is prepared, the check is repeated before the data is moved aside
+	if !empty {
+		err = CheckDataDirectoryUnused(b.targetDirectory)
+
+		if err != nil {
+			return errors.New(fmt.Sprintf("[Restore backup]> Target directory %v is in use, stop the server first: %v", b.targetDirectory, err))
+		}
+	}
+
+	err = b.PrepareChain()
+
 	if err != nil {
-		return errors.New(fmt.Sprintf("[Restore backup]> Failed to remove previous backup restore directory, %v", err))
+		return err
 	}
 
-	backupSubDirectory := ""
+	//read before move-back, the position of the last prepared incremental is kept in full/
+	b.binlogPosition, _ = ReadBinlogInfo(filepath.Join(b.workDirectory, "full"))
 
-	backupPosition, _ := b.getBackupPosition()
+	if !empty {
+		err = CheckDataDirectoryUnused(b.targetDirectory)
 
-	for i := 0; i <= backupPosition; i++ {
-		if i == 0 {
-			backupSubDirectory = "full"
-		} else {
-			backupSubDirectory = filepath.Join("incr", strconv.Itoa(i))
+		if err != nil {
+			return errors.New(fmt.Sprintf("[Restore backup]> Target directory %v is in use, stop the server first: %v", b.targetDirectory, err))
 		}
 
-		log.Println("Decompressing", filepath.Join(filepath.Join(b.sourceDirectory, backupSubDirectory), "backup.gz"), "to", filepath.Join(b.workDirectory, backupSubDirectory))
-		err := b.decompressBackup(backupSubDirectory)
+		b.setAside, err = SetAsideDataDirectory(b.targetDirectory)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	movingBack := time.Now()
+	err = b.moveBackupToTargetDirectory()
+
+	if err != nil {
+		if len(b.setAside) > 0 {
+			log.Println("The previous data directory is in", b.setAside+", rollback-restore puts it back")
+		}
+
+		return err
+	}
+
+	if len(b.historyFile) > 0 {
+		err = b.recordHistory(time.Since(movingBack))
+
+		//the data is restored, a lost record only makes the next estimate less accurate
+		if err != nil {
+			log.Println("Failed to record the restore duration:", err)
+		}
+	}
+
+	return nil
+}
+
+// PrepareChain extracts the planned backups into the work directory and prepares them, the
+// result is the prepared full/ directory. Backups are prepared strictly in order, the
+// extraction of the following ones runs ahead as far as the pipeline depth and the free space
+// of the work directory allow.
+func (b *RestoreManager) PrepareChain() error {
+	err := os.RemoveAll(b.workDirectory)
+	if err != nil {
+		return errors.New(fmt.Sprintf("[Restore backup]> Failed to remove previous backup restore directory, %v", err))
+	}
+
+	err = os.MkdirAll(b.workDirectory, 0750)
+
+	if err != nil {
+		return errors.New(fmt.Sprintf("[RestoreManager]> Making directories failed, %v", err))
+	}
+
+	if b.members == nil {
+		_, err = b.Plan("")
 
 		if err != nil {
 			return err
 		}
+	}
+
+	started := time.Now()
+	extracted := make([]chan extraction, len(b.members))
+
+	for i := range extracted {
+		extracted[i] = make(chan extraction, 1)
+	}
+
+	prepared := make(chan struct{}, len(b.members))
+	stop := make(chan struct{})
+	wg := &sync.WaitGroup{}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		b.extractAhead(extracted, prepared, stop)
+	}()
+
+	//the extraction still running has to finish before the work directory can be cleaned up
+	defer wg.Wait()
+	defer close(stop)
+
+	var extractTime, prepareTime time.Duration
+
+	for i := range b.members {
+		backupSubDirectory := BackupSubDirectory(i)
+
+		result := <-extracted[i]
+
+		if result.err != nil {
+			return result.err
+		}
+
+		extractTime += result.elapsed
 
 		log.Println("Preparing", filepath.Join(b.workDirectory, backupSubDirectory))
+
+		preparing := time.Now()
 		err = b.prepareBackup(backupSubDirectory)
+		prepareTime += time.Since(preparing)
 
 		if err != nil {
 			return err
 		}
+
+		//merged into full/, in low-disk mode the space is needed by the next extraction
+		if i > 0 && b.lowDisk {
+			os.RemoveAll(filepath.Join(b.workDirectory, backupSubDirectory))
+		}
+
+		prepared <- struct{}{}
 	}
 
-	err = b.moveBackupToTargetDirectory()
+	elapsed := time.Since(started)
+	b.extractTime = extractTime
+	b.prepareTime = prepareTime
+
+	log.Printf("Extracted in %v and prepared in %v, finished after %v, pipelining saved %v",
+		extractTime.Round(time.Second), prepareTime.Round(time.Second), elapsed.Round(time.Second),
+		(extractTime + prepareTime - elapsed).Round(time.Second))
+
+	return nil
+}
+
+type extraction struct {
+	err     error
+	elapsed time.Duration
+}
+
+// extractAhead extracts the backups in order. A backup is extracted once the one pipeline depth
+// positions before it is prepared, and ahead of the backup needed next only when the work
+// directory has room for it.
+func (b *RestoreManager) extractAhead(extracted []chan extraction, prepared chan struct{}, stop chan struct{}) {
+	done := 0
+
+	for i := range b.members {
+		for i-done > b.pipelineDepth || (i > done && !b.hasRoomFor(i)) {
+			select {
+			case <-prepared:
+				done++
+			case <-stop:
+				return
+			}
+		}
+
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		backupSubDirectory := BackupSubDirectory(i)
+		extracting := time.Now()
+
+		var err error
+
+		if b.destination != nil {
+			log.Println("Streaming", b.chain[i].Prefix, "from", b.destination.Name(), "to", filepath.Join(b.workDirectory, backupSubDirectory))
+			err = b.streamBackup(b.chain[i], backupSubDirectory)
+		} else {
+			log.Println("Decompressing", filepath.Join(filepath.Join(b.sourceDirectory, backupSubDirectory), "backup.gz"), "to", filepath.Join(b.workDirectory, backupSubDirectory))
+			err = b.decompressBackup(backupSubDirectory)
+		}
+
+		extracted[i] <- extraction{err: err, elapsed: time.Since(extracting)}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// compressedSize returns the size of the compressed backup of a chain member, encrypted for
+// streamed restores
+func (b *RestoreManager) compressedSize(i int) (int64, error) {
+	if b.destination != nil {
+		object, ok := b.chain[i].Objects[BackupStreamFile]
+
+		if !ok {
+			return 0, errors.New(fmt.Sprintf("[RestoreManager]> Backup %v has no %v", b.chain[i].Id, BackupStreamFile))
+		}
+
+		return object.Size, nil
+	}
+
+	stat, err := os.Stat(filepath.Join(b.sourceDirectory, BackupSubDirectory(i), "backup.gz"))
 
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	return nil
+	return stat.Size(), nil
+}
+
+// hasRoomFor estimates the extracted size of a backup from its compressed size, unknown sizes
+// are never extracted ahead
+func (b *RestoreManager) hasRoomFor(i int) bool {
+	compressed, err := b.compressedSize(i)
+
+	if err != nil {
+		return false
+	}
+
+	free, err := FreeSpace(b.workDirectory)
+
+	if err != nil {
+		return false
+	}
+
+	if free < uint64(compressed)*ExtractedSizeFactor {
+		log.Printf("Waiting to extract %v, %v has %d MB free", BackupSubDirectory(i), b.workDirectory, free>>20)
+		return false
+	}
+
+	return true
 }
 
 func (b *RestoreManager) decompressBackup(backupSubDirectory string) error {
@@ -119,96 +421,175 @@ func (b *RestoreManager) decompressBackup(backupSubDirectory string) error {
 
 	defer f.Close()
 
-	gzr, err := gzip.NewReaderN(f, b.gzBlockSize, b.gzThreads)
+	fi, err := f.Stat()
 
 	if err != nil {
 		return err
 	}
 
-	defer gzr.Close()
+	counter := &ProgressCounter{}
+	task := Progress.Start("decompress", f.Name(), fi.Size(), counter.Bytes)
 
-	command := exec.Command(b.mbStreamBinary, "-x", "-C", workDirectory)
+	err = b.extract(counter.Reader(f), workDirectory)
+	task.Finish(err)
+
+	return err
+}
+
+// streamBackup reads the encrypted backup from the destination and extracts it without writing
+// it to disk first. The checksums can only be compared once mbstream has written everything,
+// so the files are extracted into <backup>.unverified and only renamed to the directory that
+// is prepared after the backup passed verification. On a failure they are removed.
+func (b *RestoreManager) streamBackup(backup *RemoteBackup, backupSubDirectory string) error {
+	workDirectory := filepath.Join(b.workDirectory, backupSubDirectory)
+	unverified := workDirectory + ".unverified"
+
+	err := os.RemoveAll(unverified)
+
+	if err == nil {
+		err = os.MkdirAll(unverified, 0750)
+	}
 
-	out, err := command.StdinPipe()
-	command.Stderr = os.Stderr
 	if err != nil {
-		return err
+		return errors.New(fmt.Sprintf("[RestoreManager]> Making directories failed, %v", err))
 	}
 
-	err = command.Start()
+	stream, err := OpenBackupStream(b.destination, backup, b.encryptionKey)
 
 	if err != nil {
-		return errors.New(fmt.Sprintf("[RestoreManager Restore()]> Failed executing mbstream command: %v", err))
+		return err
+	}
+
+	defer stream.Close()
+
+	task := Progress.Start("stream", backup.Prefix, stream.Size(), stream.Bytes)
+
+	err = b.extract(stream, unverified)
+
+	if err == nil {
+		err = stream.Verify()
 	}
 
-	_, err = io.Copy(out, gzr)
+	task.Finish(err)
 
 	if err != nil {
+		if removeErr := os.RemoveAll(unverified); removeErr != nil {
+			log.Println("Failed to remove the unverified files of", backup.Prefix+":", removeErr)
+		}
+
 		return err
 	}
 
-	return nil
+	log.Println("Verified", backup.Prefix)
+
+	return os.Rename(unverified, workDirectory)
 }
 
-func (b *RestoreManager) prepareBackup(backupSubDirectory string) error {
-	command := exec.Command(b.mariaBackupBinary,
-		"--prepare",
-		"--target-dir="+filepath.Join(b.workDirectory, "full"),
-	)
+// extract decompresses the gzipped xbstream from reader into mbstream
+func (b *RestoreManager) extract(reader io.Reader, workDirectory string) error {
+	gzr, err := gzip.NewReaderN(reader, b.gzBlockSize, b.gzThreads)
 
-	if backupSubDirectory != "full" {
-		command.Args = append(command.Args, "--incremental-basedir="+filepath.Join(b.workDirectory, backupSubDirectory))
+	if err != nil {
+		return err
 	}
 
-	command.Stderr = os.Stderr
-	command.Stdout = os.Stdout
-	err := command.Start()
+	defer gzr.Close()
+
+	process := NewProcess("mbstream", b.mbStreamBinary, "-x", "-C", workDirectory)
 
+	out, err := process.StdinPipe()
 	if err != nil {
-		return errors.New(fmt.Sprintf("[RestoreManager Restore()]> Failed executing mariabackup --prepare command: %v", err))
+		return err
 	}
 
-	err = command.Wait()
+	err = process.Start()
 
 	if err != nil {
 		return err
 	}
 
-	//check if the exit code was 0
-	exitCode := command.ProcessState.ExitCode()
+	if b.include != nil {
+		err = filterXbstream(out, gzr, b.include)
+	} else {
+		_, err = io.Copy(out, gzr)
+	}
+
+	out.Close()
+
+	//mbstream has to finish writing before the backup can be verified or prepared, when it
+	//failed the write error only is a consequence
+	waitErr := process.Wait()
 
-	if exitCode != 0 {
-		return errors.New("Failed to prepare backup, exit code:" + strconv.Itoa(exitCode))
+	if waitErr != nil {
+		return waitErr
 	}
 
-	return nil
+	return err
 }
 
-func (b *RestoreManager) moveBackupToTargetDirectory() error {
-	command := exec.Command(b.mariaBackupBinary,
-		"--move-back",
-		"--target-dir="+filepath.Join(b.workDirectory, "full"),
-	)
+// mariaBackup runs mariabackup with its output on the console while the phase is reported
+func (b *RestoreManager) mariaBackup(phase string, name string, args ...string) error {
+	process := NewProcess(phase, b.mariaBackupBinary, args...)
+	process.SetStdout(os.Stdout)
 
-	command.Stderr = os.Stderr
-	command.Stdout = os.Stdout
-	err := command.Start()
+	err := process.Start()
 
 	if err != nil {
-		return errors.New(fmt.Sprintf("[RestoreManager Restore()]> Failed executing mariabackup --move-back command: %v", err))
+		return err
 	}
 
-	err = command.Wait()
+	task := Progress.Start(phase, name, 0, nil)
+	err = process.Wait()
+	task.Finish(err)
 
-	if err != nil {
-		return err
+	return err
+}
+
+func (b *RestoreManager) prepareBackup(backupSubDirectory string) error {
+	return b.mariaBackup("prepare", filepath.Join(b.workDirectory, backupSubDirectory), b.prepareArgs(backupSubDirectory)...)
+}
+
+// prepareArgs applies an incremental to full/, or prepares full/ itself
+func (b *RestoreManager) prepareArgs(backupSubDirectory string) []string {
+	args := []string{
+		"--prepare",
+		"--target-dir=" + filepath.Join(b.workDirectory, "full"),
+	}
+
+	if backupSubDirectory != "full" {
+		args = append(args, "--incremental-dir="+filepath.Join(b.workDirectory, backupSubDirectory))
 	}
 
-	//check if the exit code was 0
-	exitCode := command.ProcessState.ExitCode()
+	return args
+}
 
-	if exitCode != 0 {
-		return errors.New("Failed to move backup to target directory, exit code:" + strconv.Itoa(exitCode))
+// Export prepares the full/ directory again with --export, which writes a .cfg file for every
+// InnoDB table so the tables can be imported into another server
+func (b *RestoreManager) Export() error {
+	return b.mariaBackup("export", filepath.Join(b.workDirectory, "full"),
+		"--prepare",
+		"--export",
+		"--target-dir="+filepath.Join(b.workDirectory, "full"),
+	)
+}
+
+// ExportDirectory is the prepared full/ directory the exported tables are read from
+func (b *RestoreManager) ExportDirectory() string {
+	return filepath.Join(b.workDirectory, "full")
+}
+
+func (b *RestoreManager) moveBackArgs() []string {
+	return []string{
+		"--move-back",
+		"--target-dir=" + filepath.Join(b.workDirectory, "full"),
+	}
+}
+
+func (b *RestoreManager) moveBackupToTargetDirectory() error {
+	err := b.mariaBackup("move-back", b.targetDirectory, b.moveBackArgs()...)
+
+	if err != nil {
+		return err
 	}
 
 	group, err := user.Lookup("mysql")
@@ -230,6 +611,156 @@ func (b *RestoreManager) moveBackupToTargetDirectory() error {
 	return nil
 }
 
+// BinlogPosition returns the binlog position the restored data is consistent with. Before
+// Restore it is read from the xtrabackup_info of the last backup of the chain.
+func (b *RestoreManager) BinlogPosition() (*BinlogPosition, error) {
+	if b.binlogPosition != nil {
+		return b.binlogPosition, nil
+	}
+
+	if b.members == nil {
+		_, err := b.Plan("")
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if b.destination != nil {
+		return BackupBinlogPosition(b.destination, b.members[len(b.members)-1])
+	}
+
+	return ReadBinlogInfo(b.members[len(b.members)-1].Prefix)
+}
+
+// TableStats returns the tables recorded when the last backup of the chain was taken
+func (b *RestoreManager) TableStats() (*TableStats, error) {
+	if b.members == nil {
+		_, err := b.Plan("")
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	last := b.members[len(b.members)-1]
+
+	if b.destination == nil {
+		return LoadTableStats(last.Prefix)
+	}
+
+	object, ok := last.Objects[TableStatsFile]
+
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("[RestoreManager]> Backup %v has no %v", last.Id, TableStatsFile))
+	}
+
+	//too large for readSmallObject on servers with many tables
+	body, err := b.destination.Open(object.Key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer body.Close()
+
+	data, err := ioutil.ReadAll(body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return parseTableStats(data)
+}
+
+// Members returns the backups selected by Plan
+func (b *RestoreManager) Members() RemoteChain {
+	return b.members
+}
+
+// TargetDirectory is the data directory the chain is restored into
+func (b *RestoreManager) TargetDirectory() string {
+	return b.targetDirectory
+}
+
+// EstimateDisk calculates the peak disk usage of the planned restore. The work directory holds
+// the extracted full backup and, in low-disk mode, the one incremental being applied, otherwise
+// every incremental because they are kept until the next restore. --move-back renames the files
+// when the target directory is on the same file system and copies the full backup otherwise.
+func (b *RestoreManager) EstimateDisk() (DiskEstimate, error) {
+	if b.members == nil {
+		_, err := b.Plan("")
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sizes := make([]uint64, len(b.members))
+
+	for i := range b.members {
+		size, err := b.extractedSize(i)
+
+		if err != nil {
+			return nil, err
+		}
+
+		sizes[i] = size
+	}
+
+	full := sizes[0]
+	incrementals := sizes[1:]
+	sort.Slice(incrementals, func(i, j int) bool { return incrementals[i] > incrementals[j] })
+
+	concurrent := 1
+
+	if !b.lowDisk {
+		concurrent = len(incrementals)
+	}
+
+	work := full
+
+	for i := 0; i < concurrent && i < len(incrementals); i++ {
+		work += incrementals[i]
+	}
+
+	estimate := DiskEstimate{}
+
+	err := estimate.Require(existingParent(b.workDirectory), work)
+
+	if err != nil {
+		return nil, err
+	}
+
+	same, err := sameFileSystem(existingParent(b.workDirectory), existingParent(b.targetDirectory))
+
+	if err == nil && !same {
+		err = estimate.Require(existingParent(b.targetDirectory), full)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return estimate, nil
+}
+
+// extractedSize is the size of the xbstream recorded in the manifest, or estimated from the
+// compressed size for backups taken before it was recorded
+func (b *RestoreManager) extractedSize(i int) (uint64, error) {
+	if b.members[i].StreamSize > 0 {
+		return uint64(b.members[i].StreamSize), nil
+	}
+
+	compressed, err := b.compressedSize(i)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return uint64(compressed) * ExtractedSizeFactor, nil
+}
+
 func (b *RestoreManager) getBackupPosition() (int, error) {
 	data, err := ioutil.ReadFile(b.backupPositionFile)
 	if err != nil {
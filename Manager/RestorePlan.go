@@ -0,0 +1,398 @@
+package Manager
+
+import (
+	"crypto/aes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// RestoreHistoryLimit is the number of finished restores kept in the history file
+	RestoreHistoryLimit = 20
+	//W_OK of access(2)
+	accessWritable = 2
+)
+
+// RestoreRecord is the duration of a finished restore per phase, the bytes are the extracted
+// size of the chain
+type RestoreRecord struct {
+	FinishedAt      time.Time `json:"finished_at"`
+	Streamed        bool      `json:"streamed"`
+	Backups         int       `json:"backups"`
+	ExtractedBytes  int64     `json:"extracted_bytes"`
+	ExtractSeconds  float64   `json:"extract_seconds"`
+	PrepareSeconds  float64   `json:"prepare_seconds"`
+	MoveBackSeconds float64   `json:"move_back_seconds"`
+}
+
+// LoadRestoreHistory reads the restores recorded in file, oldest first, a missing file is an
+// empty history
+func LoadRestoreHistory(file string) ([]RestoreRecord, error) {
+	records := make([]RestoreRecord, 0)
+
+	data, err := ioutil.ReadFile(file)
+
+	if os.IsNotExist(err) {
+		return records, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, &records)
+
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("[RestoreHistory]> Failed to parse %v, %v", file, err))
+	}
+
+	return records, nil
+}
+
+func (b *RestoreManager) recordHistory(moveBack time.Duration) error {
+	records, err := LoadRestoreHistory(b.historyFile)
+
+	if err != nil {
+		return err
+	}
+
+	records = append(records, RestoreRecord{
+		FinishedAt:      time.Now().UTC(),
+		Streamed:        b.destination != nil,
+		Backups:         len(b.members),
+		ExtractedBytes:  int64(b.chainExtractedSize()),
+		ExtractSeconds:  b.extractTime.Seconds(),
+		PrepareSeconds:  b.prepareTime.Seconds(),
+		MoveBackSeconds: moveBack.Seconds(),
+	})
+
+	if len(records) > RestoreHistoryLimit {
+		records = records[len(records)-RestoreHistoryLimit:]
+	}
+
+	payload, err := json.MarshalIndent(records, "", "\t")
+
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(b.historyFile), 0750)
+
+	if err == nil {
+		err = ioutil.WriteFile(b.historyFile+".tmp", payload, 0640)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(b.historyFile+".tmp", b.historyFile)
+}
+
+// chainExtractedSize sums the extracted sizes of the planned backups, unknown sizes count as 0
+func (b *RestoreManager) chainExtractedSize() uint64 {
+	total := uint64(0)
+
+	for i := range b.members {
+		size, _ := b.extractedSize(i)
+		total += size
+	}
+
+	return total
+}
+
+// PlanCheck is a precondition of the restore, Err is nil when it holds
+type PlanCheck struct {
+	Name string
+	Err  error
+}
+
+// RestorePlan describes what Restore will do without doing any of it
+type RestorePlan struct {
+	Source   string
+	Members  RemoteChain
+	Steps    []string
+	Estimate DiskEstimate
+	//0 when no restore was recorded yet
+	Duration time.Duration
+	Checks   []PlanCheck
+}
+
+// Check adds the result of a precondition
+func (p *RestorePlan) Check(name string, err error) {
+	p.Checks = append(p.Checks, PlanCheck{Name: name, Err: err})
+}
+
+// Failed returns the number of preconditions that do not hold
+func (p *RestorePlan) Failed() int {
+	failed := 0
+
+	for _, check := range p.Checks {
+		if check.Err != nil {
+			failed++
+		}
+	}
+
+	return failed
+}
+
+// Step appends a step, e.g. the point-in-time recovery that follows the restore
+func (p *RestorePlan) Step(format string, args ...interface{}) {
+	p.Steps = append(p.Steps, fmt.Sprintf(format, args...))
+}
+
+// Print writes the plan in the order the restore runs it
+func (p *RestorePlan) Print(w io.Writer) {
+	fmt.Fprintf(w, "Source: %v\n", p.Source)
+	fmt.Fprintf(w, "Chain:\n")
+
+	for i, backup := range p.Members {
+		fmt.Fprintf(w, "  %d %v\n", i, backup)
+	}
+
+	fmt.Fprintf(w, "Steps:\n")
+
+	for i, step := range p.Steps {
+		fmt.Fprintf(w, "  %2d. %v\n", i+1, step)
+	}
+
+	fmt.Fprintf(w, "Disk space: %v\n", p.Estimate)
+
+	if p.Duration > 0 {
+		fmt.Fprintf(w, "Estimated time: %v, from the throughput of past restores\n", p.Duration.Round(time.Minute))
+	} else {
+		fmt.Fprintf(w, "Estimated time: unknown, no restore was recorded yet\n")
+	}
+
+	fmt.Fprintf(w, "Checks:\n")
+
+	for _, check := range p.Checks {
+		if check.Err != nil {
+			fmt.Fprintf(w, "  FAILED %v: %v\n", check.Name, check.Err)
+		} else {
+			fmt.Fprintf(w, "  ok     %v\n", check.Name)
+		}
+	}
+}
+
+// DescribePlan lists the steps of the planned restore and checks that the binaries, keys and
+// directories they need are in place. A remote chain that is downloaded before the restore is
+// described with the download directory, one that is streamed without it. Nothing is changed.
+func (b *RestoreManager) DescribePlan(downloadDirectory string, history []RestoreRecord) (*RestorePlan, error) {
+	if b.members == nil {
+		_, err := b.Plan("")
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	plan := &RestorePlan{Members: b.members}
+
+	switch {
+	case b.destination == nil:
+		plan.Source = "local directory " + b.sourceDirectory
+	case len(downloadDirectory) > 0:
+		plan.Source = fmt.Sprintf("%v, downloaded to %v", b.destination.Name(), downloadDirectory)
+	default:
+		plan.Source = fmt.Sprintf("%v, streamed", b.destination.Name())
+	}
+
+	compressedTotal := uint64(0)
+	sizes := make([]string, len(b.members))
+
+	for i, backup := range b.members {
+		compressed, err := b.compressedSize(i)
+		plan.Check(fmt.Sprintf("backup %v %v is readable", BackupSubDirectory(i), backup.Id), err)
+
+		extracted, _ := b.extractedSize(i)
+		compressedTotal += uint64(compressed)
+		sizes[i] = fmt.Sprintf("%v, about %v extracted", formatBytes(compressed), formatBytes(int64(extracted)))
+	}
+
+	//the whole chain is downloaded and decrypted before the restore starts
+	if b.destination != nil && len(downloadDirectory) > 0 {
+		for i, backup := range b.members {
+			downloaded := filepath.Join(downloadDirectory, BackupSubDirectory(i))
+			plan.Step("download %v%v from %v (%v) to %v", backup.Prefix, BackupStreamFile, b.destination.Name(), sizes[i], downloaded)
+		}
+
+		for i := range b.members {
+			downloaded := filepath.Join(downloadDirectory, BackupSubDirectory(i))
+			plan.Step("verify the checksum and decrypt %v with %v to %v",
+				filepath.Join(downloaded, BackupStreamFile), b.encryptionKey, filepath.Join(downloaded, "backup.gz"))
+		}
+	}
+
+	plan.Step("remove and recreate the work directory %v", b.workDirectory)
+
+	if b.pipelineDepth > 0 && len(b.members) > 1 {
+		plan.Step("while a backup is prepared, extract up to %d following backups ahead", b.pipelineDepth)
+	}
+
+	for i, backup := range b.members {
+		backupSubDirectory := BackupSubDirectory(i)
+		workDirectory := filepath.Join(b.workDirectory, backupSubDirectory)
+
+		switch {
+		case b.destination == nil:
+			plan.Step("decompress %v (%v) into %v -x -C %v",
+				filepath.Join(b.sourceDirectory, backupSubDirectory, "backup.gz"), sizes[i], b.mbStreamBinary, workDirectory)
+		case len(downloadDirectory) > 0:
+			plan.Step("decompress %v into %v -x -C %v",
+				filepath.Join(downloadDirectory, backupSubDirectory, "backup.gz"), b.mbStreamBinary, workDirectory)
+		default:
+			plan.Step("stream %v%v from %v (%v), decrypt with %v and decompress into %v -x -C %v.unverified, renamed to %v once the checksums match",
+				backup.Prefix, BackupStreamFile, b.destination.Name(), sizes[i], b.encryptionKey, b.mbStreamBinary, workDirectory, workDirectory)
+		}
+
+		plan.Step("%v %v", b.mariaBackupBinary, strings.Join(b.prepareArgs(backupSubDirectory), " "))
+
+		if i > 0 {
+			plan.Step("remove %v", workDirectory)
+		}
+	}
+
+	replacing := b.replace && checkEmptyDirectory(b.targetDirectory) != nil
+
+	if replacing {
+		plan.Step("move %v aside to %v%v<time>, when no server uses it", b.targetDirectory, filepath.Clean(b.targetDirectory), SetAsideSuffix)
+	}
+
+	plan.Step("%v %v into %v", b.mariaBackupBinary, strings.Join(b.moveBackArgs(), " "), b.targetDirectory)
+	plan.Step("change the owner of everything in %v to mysql:mysql", b.targetDirectory)
+
+	estimate, err := b.EstimateDisk()
+
+	//the download keeps the encrypted and the decrypted copy of every backup
+	if err == nil && len(downloadDirectory) > 0 {
+		err = estimate.Require(existingParent(downloadDirectory), compressedTotal*2)
+	}
+
+	if err == nil && !estimate.Fits() {
+		err = errors.New("not enough space, " + estimate.String())
+	}
+
+	plan.Check("disk space", err)
+
+	plan.Estimate = estimate
+	plan.Duration = estimateRestoreDuration(history, b.destination != nil && len(downloadDirectory) == 0, b.chainExtractedSize())
+
+	plan.Check("mariabackup binary "+b.mariaBackupBinary, CheckBinary(b.mariaBackupBinary))
+	plan.Check("mbstream binary "+b.mbStreamBinary, CheckBinary(b.mbStreamBinary))
+
+	if b.destination != nil {
+		plan.Check("encryption key "+b.encryptionKey, checkEncryptionKey(b.encryptionKey))
+	}
+
+	if len(downloadDirectory) > 0 {
+		plan.Check("download directory "+downloadDirectory+" is writable", checkWritable(downloadDirectory))
+	}
+
+	plan.Check("work directory "+b.workDirectory+" is writable", checkWritable(b.workDirectory))
+	if replacing {
+		plan.Check("target directory "+b.targetDirectory+" is not used by a server", CheckDataDirectoryUnused(b.targetDirectory))
+	} else {
+		plan.Check("target directory "+b.targetDirectory+" exists and is empty", checkEmptyDirectory(b.targetDirectory))
+	}
+
+	_, err = user.Lookup("mysql")
+	plan.Check("user mysql exists", err)
+
+	return plan, nil
+}
+
+// estimateRestoreDuration divides the size of the chain by the throughput of each phase in the
+// past restores, preferring those restored the same way. Pipelining usually finishes earlier.
+func estimateRestoreDuration(history []RestoreRecord, streamed bool, size uint64) time.Duration {
+	records := make([]RestoreRecord, 0, len(history))
+
+	for _, record := range history {
+		if record.Streamed == streamed && record.ExtractedBytes > 0 {
+			records = append(records, record)
+		}
+	}
+
+	if len(records) == 0 {
+		for _, record := range history {
+			if record.ExtractedBytes > 0 {
+				records = append(records, record)
+			}
+		}
+	}
+
+	if len(records) == 0 {
+		return 0
+	}
+
+	var bytes, seconds float64
+
+	for _, record := range records {
+		bytes += float64(record.ExtractedBytes)
+		seconds += record.ExtractSeconds + record.PrepareSeconds + record.MoveBackSeconds
+	}
+
+	return time.Duration(float64(size) / bytes * seconds * float64(time.Second))
+}
+
+// CheckBinary fails when path is not an executable file
+func CheckBinary(path string) error {
+	_, err := exec.LookPath(path)
+	return err
+}
+
+func checkEncryptionKey(file string) error {
+	if len(file) == 0 {
+		return errors.New("no -encryption-key given")
+	}
+
+	key, err := ioutil.ReadFile(file)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = aes.NewCipher(key)
+
+	return err
+}
+
+// checkWritable checks the directory or, before it is created, its closest existing parent
+func checkWritable(directory string) error {
+	parent := existingParent(directory)
+	err := syscall.Access(parent, accessWritable)
+
+	if err != nil {
+		return errors.New(fmt.Sprintf("%v is not writable, %v", parent, err))
+	}
+
+	return nil
+}
+
+func checkEmptyDirectory(directory string) error {
+	f, err := os.Open(directory)
+
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	_, err = f.Readdir(1)
+
+	if err != io.EOF {
+		return errors.New("the directory is not empty")
+	}
+
+	return nil
+}
@@ -0,0 +1,371 @@
+package Manager
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+const (
+	RestoreTestCheckFailed     = "check-failed"
+	RestoreTestMissingTable    = "missing-table"
+	RestoreTestUnexpectedTable = "unexpected-table"
+	RestoreTestSchemaMismatch  = "schema-mismatch"
+	RestoreTestRowCount        = "row-count"
+	//row count differences below this are never reported, the estimates of small InnoDB tables are rough
+	RestoreTestRowSlack = 1000
+)
+
+// RestoreTestConfig sets where the sandbox restore is made and how the restored tables are checked
+type RestoreTestConfig struct {
+	Directory string `json:"directory"`
+	//number of tables checked and counted per run, 0 checks all of them
+	Sample int `json:"sample"`
+	//allowed difference to the row count estimated at backup time, in percent
+	RowCountTolerance float64  `json:"row_count_tolerance"`
+	ServerOptions     []string `json:"server_options"`
+	AfterBackup       bool     `json:"after_backup"`
+}
+
+type RestoreTestProblem struct {
+	Kind   string `json:"kind"`
+	Table  string `json:"table"`
+	Detail string `json:"detail"`
+}
+
+// RestoreTestReport is the result of a restore test, Compared is false for backups taken
+// before table statistics were recorded
+type RestoreTestReport struct {
+	Backup   string               `json:"backup"`
+	Backups  int                  `json:"backups"`
+	Tables   int                  `json:"tables"`
+	Checked  int                  `json:"checked"`
+	Rows     int64                `json:"rows"`
+	Compared bool                 `json:"compared"`
+	Seconds  float64              `json:"seconds"`
+	Problems []RestoreTestProblem `json:"problems"`
+}
+
+func (r *RestoreTestReport) add(kind string, table string, detail string) {
+	r.Problems = append(r.Problems, RestoreTestProblem{Kind: kind, Table: table, Detail: detail})
+}
+
+// RestoreTest restores a chain into a sandbox directory, starts a temporary mariadbd on it and
+// checks the tables against the statistics recorded at backup time
+type RestoreTest struct {
+	restore        *RestoreManager
+	config         RestoreTestConfig
+	mariadbdBinary string
+	keep           bool
+}
+
+// CreateRestoreTest expects a restore manager whose target and work directory are the data/
+// and work/ directories of the sandbox, see RestoreTestDirectories
+func CreateRestoreTest(Restore *RestoreManager, Config RestoreTestConfig, MariadbdBinary string, Keep bool) (*RestoreTest, error) {
+	if len(Config.Directory) == 0 {
+		return nil, errors.New("restore_test.directory is required")
+	}
+
+	if Config.Sample < 0 || Config.RowCountTolerance < 0 {
+		return nil, errors.New("restore_test.sample and restore_test.row_count_tolerance can not be negative")
+	}
+
+	return &RestoreTest{
+		restore:        Restore,
+		config:         Config,
+		mariadbdBinary: MariadbdBinary,
+		keep:           Keep,
+	}, nil
+}
+
+// RestoreTestDirectories returns the data and the work directory inside the sandbox
+func RestoreTestDirectories(directory string) (string, string) {
+	return filepath.Join(directory, "data"), filepath.Join(directory, "work")
+}
+
+// Run restores the chain and checks it. The error is set when the test could not be run, the
+// problems found in the restored data are in the report. The sandbox is removed afterwards
+// unless it is kept for inspection.
+func (t *RestoreTest) Run() (*RestoreTestReport, error) {
+	started := time.Now()
+
+	if !t.keep {
+		defer os.RemoveAll(t.config.Directory)
+	}
+
+	err := t.createSandbox()
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.restore.Restore()
+
+	if err != nil {
+		return nil, err
+	}
+
+	members := t.restore.Members()
+
+	report := &RestoreTestReport{
+		Backup:   members[len(members)-1].Id,
+		Backups:  len(members),
+		Problems: make([]RestoreTestProblem, 0),
+	}
+
+	expected, err := t.restore.TableStats()
+
+	if err != nil {
+		log.Println("No table statistics recorded for the backup, only checking the tables:", err)
+		expected = nil
+	}
+
+	server, err := startTemporaryServer(t.mariadbdBinary, t.config.ServerOptions, t.restore.TargetDirectory(), t.config.Directory, "restore-test",
+		//the restored grants are not needed, nobody else can reach the server without networking
+		"--skip-grant-tables",
+		"--event-scheduler=DISABLED",
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.check(server, expected, report)
+	shutdownErr := server.shutdown()
+
+	if err == nil {
+		err = shutdownErr
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	report.Seconds = time.Since(started).Seconds()
+
+	return report, nil
+}
+
+// createSandbox empties the sandbox, the temporary server running as mysql creates its socket there
+func (t *RestoreTest) createSandbox() error {
+	dataDirectory, _ := RestoreTestDirectories(t.config.Directory)
+
+	err := os.RemoveAll(t.config.Directory)
+
+	if err == nil {
+		err = os.MkdirAll(dataDirectory, 0750)
+	}
+
+	if err != nil {
+		return errors.New(fmt.Sprintf("[RestoreTest]> Failed to create the sandbox %v, %v", t.config.Directory, err))
+	}
+
+	group, err := user.Lookup("mysql")
+
+	if err != nil {
+		return err
+	}
+
+	uid, _ := strconv.Atoi(group.Uid)
+	gid, _ := strconv.Atoi(group.Gid)
+
+	return os.Chown(t.config.Directory, uid, gid)
+}
+
+func (t *RestoreTest) check(server *temporaryServer, expected *TableStats, report *RestoreTestReport) error {
+	config := mysql.NewConfig()
+	config.User = "root"
+	config.Net = "unix"
+	config.Addr = server.socket
+
+	db, err := sql.Open("mysql", config.FormatDSN())
+
+	if err != nil {
+		return err
+	}
+
+	defer db.Close()
+
+	err = server.wait(db.Ping)
+
+	if err != nil {
+		return err
+	}
+
+	restored, err := CollectTableStats(db)
+
+	if err != nil {
+		return err
+	}
+
+	report.Tables = len(restored.Tables)
+
+	//row counts estimated at backup time, by table
+	estimates := make(map[string]int64)
+
+	if expected != nil {
+		report.Compared = true
+		compareTables(expected, restored, report)
+
+		for _, table := range expected.Tables {
+			estimates[table.String()] = table.Rows
+		}
+	}
+
+	tables := t.sample(restored.Tables)
+	checked := int64(0)
+	task := Progress.Start("check", fmt.Sprintf("%d tables", len(tables)), int64(len(tables)), func() int64 {
+		return atomic.LoadInt64(&checked)
+	})
+
+	for _, table := range tables {
+		err = t.checkTable(db, table, estimates, report)
+
+		if err != nil {
+			task.Finish(err)
+			return err
+		}
+
+		atomic.AddInt64(&checked, 1)
+		report.Checked++
+	}
+
+	task.Finish(nil)
+
+	return nil
+}
+
+// sample picks the tables checked in this run at random, over several runs all are covered
+func (t *RestoreTest) sample(tables []TableStat) []TableStat {
+	if t.config.Sample == 0 || t.config.Sample >= len(tables) {
+		return tables
+	}
+
+	sampled := append([]TableStat{}, tables...)
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	random.Shuffle(len(sampled), func(i, j int) { sampled[i], sampled[j] = sampled[j], sampled[i] })
+
+	return sampled[:t.config.Sample]
+}
+
+// compareTables reports tables that are missing or were not in the backup and changed engines or
+// column counts, the statistics of both sides come from information_schema
+func compareTables(expected *TableStats, restored *TableStats, report *RestoreTestReport) {
+	byName := make(map[string]TableStat)
+
+	for _, table := range restored.Tables {
+		byName[table.String()] = table
+	}
+
+	for _, table := range expected.Tables {
+		found, ok := byName[table.String()]
+
+		if !ok {
+			report.add(RestoreTestMissingTable, table.String(), "recorded at backup time but missing after the restore")
+			continue
+		}
+
+		delete(byName, table.String())
+
+		if found.Engine != table.Engine || found.Columns != table.Columns {
+			report.add(RestoreTestSchemaMismatch, table.String(), fmt.Sprintf("%v with %d columns at backup time, %v with %d columns restored",
+				table.Engine, table.Columns, found.Engine, found.Columns))
+		}
+	}
+
+	unexpected := make([]string, 0, len(byName))
+
+	for name := range byName {
+		unexpected = append(unexpected, name)
+	}
+
+	sort.Strings(unexpected)
+
+	for _, name := range unexpected {
+		report.add(RestoreTestUnexpectedTable, name, "restored but not recorded at backup time")
+	}
+}
+
+// checkTable runs CHECK TABLE and counts the rows, the count is compared with the estimate of
+// the backup within the tolerance
+func (t *RestoreTest) checkTable(db *sql.DB, table TableStat, estimates map[string]int64, report *RestoreTestReport) error {
+	rows, err := db.Query("CHECK TABLE " + table.quoted())
+
+	//e.g. a tablespace that can not be opened
+	if err != nil {
+		report.add(RestoreTestCheckFailed, table.String(), err.Error())
+		return nil
+	}
+
+	//engines without CHECK TABLE only return a note, warnings do not fail the check either
+	messages := make([]string, 0)
+
+	for rows.Next() {
+		var name, op, msgType, msgText string
+
+		err = rows.Scan(&name, &op, &msgType, &msgText)
+
+		if err != nil {
+			rows.Close()
+			return errors.New(fmt.Sprintf("[RestoreTest]> Failed to check %v, %v", table, err))
+		}
+
+		if strings.EqualFold(msgType, "error") || (strings.EqualFold(msgType, "status") && msgText != "OK" && msgText != "Table is already up to date") {
+			messages = append(messages, msgType+": "+msgText)
+		}
+	}
+
+	rows.Close()
+
+	if len(messages) > 0 {
+		report.add(RestoreTestCheckFailed, table.String(), strings.Join(messages, " | "))
+		return nil
+	}
+
+	var count int64
+
+	err = db.QueryRow("SELECT COUNT(*) FROM " + table.quoted()).Scan(&count)
+
+	if err != nil {
+		report.add(RestoreTestCheckFailed, table.String(), "counting the rows failed, "+err.Error())
+		return nil
+	}
+
+	report.Rows += count
+
+	estimate, ok := estimates[table.String()]
+
+	if !ok {
+		return nil
+	}
+
+	difference := count - estimate
+
+	if difference < 0 {
+		difference = -difference
+	}
+
+	larger := count
+
+	if estimate > larger {
+		larger = estimate
+	}
+
+	if difference > RestoreTestRowSlack && float64(difference) > float64(larger)*t.config.RowCountTolerance/100 {
+		report.add(RestoreTestRowCount, table.String(), fmt.Sprintf("about %d rows at backup time, %d restored", estimate, count))
+	}
+
+	return nil
+}
@@ -0,0 +1,154 @@
+package Manager
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testLocalBackup writes a compressed backup into directory the way Backup leaves it behind
+func testLocalBackup(t *testing.T, directory string, mode string, fromLSN string, toLSN string) {
+	err := os.MkdirAll(directory, 0750)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, _ := json.Marshal(BackupManifest{Id: filepath.Base(directory), Mode: mode, FromLSN: fromLSN, ToLSN: toLSN, FinishedAt: time.Now()})
+	err = ioutil.WriteFile(filepath.Join(directory, ManifestFile), manifest, 0640)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Create(filepath.Join(directory, "backup.gz"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gzw := gzip.NewWriter(f)
+	_, err = gzw.Write([]byte("xbstream of " + directory))
+
+	if err == nil {
+		err = gzw.Close()
+	}
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readTree returns the content of every file below directory by its relative path
+func readTree(t *testing.T, directory string) map[string]string {
+	files := make(map[string]string)
+
+	err := filepath.Walk(directory, func(name string, f os.FileInfo, err error) error {
+		if err != nil || f.IsDir() {
+			return err
+		}
+
+		data, err := ioutil.ReadFile(name)
+		relative, _ := filepath.Rel(directory, name)
+		files[relative] = string(data)
+
+		return err
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return files
+}
+
+func TestLowDiskLocalRestoreKeepsSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "restore")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "source")
+	work := filepath.Join(dir, "work")
+	testLocalBackup(t, filepath.Join(source, BackupSubDirectory(0)), FullBackupMode, "0", "100")
+	testLocalBackup(t, filepath.Join(source, BackupSubDirectory(1)), IncrementalBackupMode, "100", "200")
+	testLocalBackup(t, filepath.Join(source, BackupSubDirectory(2)), IncrementalBackupMode, "200", "300")
+
+	//mbstream -x -C <directory> and mariabackup recording how it was run
+	mbstream := filepath.Join(dir, "mbstream")
+	mariabackup := filepath.Join(dir, "mariabackup")
+	prepared := filepath.Join(dir, "prepared")
+
+	err = ioutil.WriteFile(mbstream, []byte("#!/bin/sh\ncat > \"$3/xbstream\"\n"), 0750)
+
+	if err == nil {
+		err = ioutil.WriteFile(mariabackup, []byte("#!/bin/sh\necho \"$@\" >> "+prepared+"\n"), 0750)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := readTree(t, source)
+
+	restore, _ := CreateRestoreManager(source, filepath.Join(dir, "target"), work, mariabackup, filepath.Join(dir, "position"), mbstream, 1<<20, 1)
+	restore.LowDisk()
+
+	err = restore.PrepareChain()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	after := readTree(t, source)
+
+	if len(after) != len(before) {
+		t.Errorf("Source holds %d files after the restore, want %d", len(after), len(before))
+	}
+
+	for name, content := range before {
+		if after[name] != content {
+			t.Errorf("%v changed by the restore", name)
+		}
+	}
+
+	extracted, err := ioutil.ReadFile(filepath.Join(work, "full", "xbstream"))
+
+	if err != nil || string(extracted) != "xbstream of "+filepath.Join(source, "full") {
+		t.Errorf("full/ holds %q, %v", extracted, err)
+	}
+
+	for i := 1; i <= 2; i++ {
+		if _, err := os.Stat(filepath.Join(work, BackupSubDirectory(i))); !os.IsNotExist(err) {
+			t.Errorf("%v is not removed after it was applied: %v", BackupSubDirectory(i), err)
+		}
+	}
+
+	runs, err := ioutil.ReadFile(prepared)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"--prepare --target-dir=" + filepath.Join(work, "full"),
+		"--prepare --target-dir=" + filepath.Join(work, "full") + " --incremental-dir=" + filepath.Join(work, "incr", "1"),
+		"--prepare --target-dir=" + filepath.Join(work, "full") + " --incremental-dir=" + filepath.Join(work, "incr", "2"),
+	}
+
+	if got := strings.TrimSpace(string(runs)); got != strings.Join(want, "\n") {
+		t.Errorf("mariabackup ran\n%v\nwant\n%v", got, strings.Join(want, "\n"))
+	}
+}
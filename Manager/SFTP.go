@@ -0,0 +1,582 @@
+package Manager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const SFTPDestinationType = "sftp"
+
+// SFTPOptions configure the SSH connection of SFTPManager, the host key must be listed in
+// the known hosts file
+type SFTPOptions struct {
+	Host                 string `json:"host"`
+	Port                 int    `json:"port"`
+	User                 string `json:"user"`
+	PrivateKeyFile       string `json:"private_key_file"`
+	PrivateKeyPassphrase string `json:"private_key_passphrase"`
+	KnownHostsFile       string `json:"known_hosts_file"`
+}
+
+// SFTPManager stores backups below a directory of an SSH server. Files are written under a
+// .part name and renamed once complete, object metadata is kept next to each file in a .meta file.
+type SFTPManager struct {
+	name          string
+	root          string
+	config        *ssh.ClientConfig
+	address       string
+	ssh           *ssh.Client
+	client        *sftp.Client
+	mutex         sync.Mutex
+	retentionDays int
+}
+
+func CreateSFTPManager(Root string, Options SFTPOptions, RetentionDays int) (*SFTPManager, error) {
+	if len(Options.Host) == 0 || len(Options.User) == 0 || len(Root) == 0 {
+		return nil, errors.New("sftp requires host, user and path")
+	}
+
+	if len(Options.PrivateKeyFile) == 0 {
+		return nil, errors.New("sftp requires private_key_file")
+	}
+
+	if Options.Port == 0 {
+		Options.Port = 22
+	}
+
+	if len(Options.KnownHostsFile) == 0 {
+		home, _ := os.UserHomeDir()
+		Options.KnownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+
+	key, err := ioutil.ReadFile(Options.PrivateKeyFile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var signer ssh.Signer
+
+	if len(Options.PrivateKeyPassphrase) > 0 {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(Options.PrivateKeyPassphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey(key)
+	}
+
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid private key %v, %v", Options.PrivateKeyFile, err))
+	}
+
+	hostKeyCallback, err := knownhosts.New(Options.KnownHostsFile)
+
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to read known hosts %v, %v", Options.KnownHostsFile, err))
+	}
+
+	address := net.JoinHostPort(Options.Host, strconv.Itoa(Options.Port))
+
+	return &SFTPManager{
+		name: "sftp://" + Options.User + "@" + address + Root,
+		root: Root,
+		config: &ssh.ClientConfig{
+			User:            Options.User,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         30 * time.Second,
+		},
+		address:       address,
+		retentionDays: RetentionDays,
+	}, nil
+}
+
+func (s *SFTPManager) Name() string {
+	return s.name
+}
+
+func (s *SFTPManager) setName(name string) {
+	s.name = name
+}
+
+// connect opens the connection on first use, it is reused until an operation fails
+func (s *SFTPManager) connect() (*sftp.Client, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.client != nil {
+		return s.client, nil
+	}
+
+	conn, err := ssh.Dial("tcp", s.address, s.config)
+
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("[SFTPManager]> Failed to connect to %v, %v", s.address, err))
+	}
+
+	client, err := sftp.NewClient(conn, sftp.UseConcurrentWrites(true))
+
+	if err != nil {
+		conn.Close()
+		return nil, errors.New(fmt.Sprintf("[SFTPManager]> Failed to start sftp on %v, %v", s.address, err))
+	}
+
+	s.ssh = conn
+	s.client = client
+
+	return client, nil
+}
+
+// reset drops the connection after a failed operation so the next one reconnects
+func (s *SFTPManager) reset(err error) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err != nil && s.client != nil {
+		s.client.Close()
+		s.ssh.Close()
+		s.client = nil
+		s.ssh = nil
+	}
+
+	return err
+}
+
+func (s *SFTPManager) path(key string) string {
+	return path.Join(s.root, key)
+}
+
+// UploadFile writes to <key>.part and renames it once complete. An interrupted upload of the
+// same local file continues at the size of the .part file.
+func (s *SFTPManager) UploadFile(file string, key string, metadata map[string]string) error {
+	err := s.reset(s.upload(file, key, metadata, file+".upload-state"))
+
+	if err != nil {
+		return errors.New(fmt.Sprintf("[SFTPManager Upload()]> Failed to upload %v, %v", file, err))
+	}
+
+	return nil
+}
+
+func (s *SFTPManager) upload(file string, key string, metadata map[string]string, stateFile string) error {
+	client, err := s.connect()
+
+	if err != nil {
+		return err
+	}
+
+	local, err := os.Open(file)
+
+	if err != nil {
+		return err
+	}
+
+	defer local.Close()
+
+	stat, err := local.Stat()
+
+	if err != nil {
+		return err
+	}
+
+	target := s.path(key)
+	err = client.MkdirAll(path.Dir(target))
+
+	if err != nil {
+		return err
+	}
+
+	offset := int64(0)
+	state, err := LoadTransferState(stateFile)
+
+	if err == nil && state.Bucket == s.name && state.Key == key && state.Size == stat.Size() && state.ModTime == stat.ModTime().UnixNano() {
+		if remote, err := client.Stat(target + ".part"); err == nil && remote.Size() <= stat.Size() {
+			offset = remote.Size()
+			log.Printf("Resuming upload of %v at %v of %v", key, formatBytes(offset), formatBytes(stat.Size()))
+		}
+	} else {
+		state = &TransferState{Bucket: s.name, Key: key, Size: stat.Size(), ModTime: stat.ModTime().UnixNano()}
+		err = state.Save(stateFile)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE
+
+	if offset == 0 {
+		flags |= os.O_TRUNC
+	}
+
+	remote, err := client.OpenFile(target+".part", flags)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = remote.Seek(offset, io.SeekStart)
+
+	if err == nil {
+		_, err = local.Seek(offset, io.SeekStart)
+	}
+
+	if err != nil {
+		remote.Close()
+		return err
+	}
+
+	log.Printf("Uploading %v to %v", key, s.name)
+
+	counter := &ProgressCounter{}
+	task := Progress.Start("upload", key, stat.Size()-offset, counter.Bytes)
+
+	_, err = io.Copy(remote, counter.Reader(&throttledReader{reader: local, limiter: UploadLimiter}))
+
+	if closeErr := remote.Close(); err == nil {
+		err = closeErr
+	}
+
+	task.Finish(err)
+
+	if err != nil {
+		return err
+	}
+
+	uploaded, err := client.Stat(target + ".part")
+
+	if err != nil {
+		return err
+	}
+
+	if uploaded.Size() != stat.Size() {
+		return errors.New(fmt.Sprintf("size mismatch after upload, expected %d bytes, got %d", stat.Size(), uploaded.Size()))
+	}
+
+	//the metadata has to be in place before the file becomes visible under its final name
+	payload, err := json.Marshal(metadata)
+
+	if err == nil {
+		err = s.writeFile(client, target+".meta", payload)
+	}
+
+	if err == nil {
+		err = s.rename(client, target+".part", target)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(stateFile)
+}
+
+func (s *SFTPManager) writeFile(client *sftp.Client, name string, data []byte) error {
+	f, err := client.OpenFile(name+".part", os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return s.rename(client, name+".part", name)
+}
+
+// rename replaces the target atomically when the server supports the posix-rename extension
+func (s *SFTPManager) rename(client *sftp.Client, from string, to string) error {
+	if _, ok := client.HasExtension("posix-rename@openssh.com"); ok {
+		return client.PosixRename(from, to)
+	}
+
+	client.Remove(to)
+
+	return client.Rename(from, to)
+}
+
+// DownloadFile downloads into <file>.part, an interrupted download of the same remote file
+// continues at the size of the .part file. The file is verified against the size and the
+// SHA-256 recorded at upload time before it replaces the target.
+func (s *SFTPManager) DownloadFile(key string, file string) error {
+	err := s.reset(s.download(key, file, file+".download-state"))
+
+	if err != nil {
+		return errors.New(fmt.Sprintf("[SFTPManager Download()]> Failed to download %v, %v", key, err))
+	}
+
+	return nil
+}
+
+func (s *SFTPManager) download(key string, file string, stateFile string) error {
+	client, err := s.connect()
+
+	if err != nil {
+		return err
+	}
+
+	remote, err := client.Open(s.path(key))
+
+	if err != nil {
+		return err
+	}
+
+	defer remote.Close()
+
+	stat, err := remote.Stat()
+
+	if err != nil {
+		return err
+	}
+
+	offset := int64(0)
+	version := strconv.FormatInt(stat.ModTime().UnixNano(), 10)
+	state, err := LoadTransferState(stateFile)
+
+	if err == nil && state.Bucket == s.name && state.Key == key && state.ETag == version && state.Size == stat.Size() {
+		if local, err := os.Stat(file + ".part"); err == nil && local.Size() <= stat.Size() {
+			offset = local.Size()
+			log.Printf("Resuming download of %v at %v of %v", key, formatBytes(offset), formatBytes(stat.Size()))
+		}
+	} else {
+		state = &TransferState{Bucket: s.name, Key: key, ETag: version, Size: stat.Size()}
+		err = state.Save(stateFile)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	local, err := os.OpenFile(file+".part", os.O_WRONLY|os.O_CREATE, 0640)
+
+	if err != nil {
+		return err
+	}
+
+	err = local.Truncate(offset)
+
+	if err == nil {
+		_, err = local.Seek(offset, io.SeekStart)
+	}
+
+	if err == nil {
+		_, err = remote.Seek(offset, io.SeekStart)
+	}
+
+	if err != nil {
+		local.Close()
+		return err
+	}
+
+	log.Printf("Downloading %v from %v", key, s.name)
+
+	counter := &ProgressCounter{}
+	task := Progress.Start("download", key, stat.Size()-offset, counter.Bytes)
+
+	_, err = io.Copy(counter.Writer(local), &throttledReader{reader: remote, limiter: DownloadLimiter})
+
+	if closeErr := local.Close(); err == nil {
+		err = closeErr
+	}
+
+	task.Finish(err)
+
+	if err != nil {
+		return err
+	}
+
+	err = s.verify(client, key, stat.Size(), file+".part")
+
+	if err != nil {
+		//a corrupt copy must not be resumed on the next run
+		os.Remove(file + ".part")
+		os.Remove(stateFile)
+		return err
+	}
+
+	err = os.Rename(file+".part", file)
+
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(stateFile)
+}
+
+func (s *SFTPManager) verify(client *sftp.Client, key string, size int64, file string) error {
+	stat, err := os.Stat(file)
+
+	if err != nil {
+		return err
+	}
+
+	if stat.Size() != size {
+		return errors.New(fmt.Sprintf("size mismatch, expected %d bytes, got %d", size, stat.Size()))
+	}
+
+	metadata, err := s.readMetadata(client, key)
+
+	if err != nil || len(metadata[Sha256MetadataKey]) == 0 {
+		log.Printf("Skipping SHA-256 check of %v, it has no %v metadata", key, Sha256MetadataKey)
+		return nil
+	}
+
+	checksum, err := FileSha256(file)
+
+	if err != nil {
+		return err
+	}
+
+	if checksum != metadata[Sha256MetadataKey] {
+		return errors.New(fmt.Sprintf("SHA-256 mismatch, expected %v, got %v", metadata[Sha256MetadataKey], checksum))
+	}
+
+	return nil
+}
+
+func (s *SFTPManager) Metadata(key string) (map[string]string, error) {
+	client, err := s.connect()
+
+	if err != nil {
+		return nil, err
+	}
+
+	metadata, err := s.readMetadata(client, key)
+
+	if err != nil && !os.IsNotExist(err) {
+		s.reset(err)
+	}
+
+	return metadata, err
+}
+
+func (s *SFTPManager) readMetadata(client *sftp.Client, key string) (map[string]string, error) {
+	meta, err := client.Open(s.path(key) + ".meta")
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer meta.Close()
+
+	metadata := make(map[string]string)
+
+	return metadata, json.NewDecoder(meta).Decode(&metadata)
+}
+
+func (s *SFTPManager) Open(key string) (io.ReadCloser, error) {
+	client, err := s.connect()
+
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := client.Open(s.path(key))
+
+	return f, s.reset(err)
+}
+
+func (s *SFTPManager) OpenRange(object RemoteObject, offset int64, length int64) (io.ReadCloser, error) {
+	client, err := s.connect()
+
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := client.Open(s.path(object.Key))
+
+	if err != nil {
+		return nil, s.reset(err)
+	}
+
+	return &throttledReadCloser{throttledReader{io.NewSectionReader(f, offset, length), DownloadLimiter}, f}, nil
+}
+
+func (s *SFTPManager) List(prefix string) ([]RemoteObject, error) {
+	client, err := s.connect()
+
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]RemoteObject, 0)
+
+	//only walk the directory holding the prefix, the root may contain other hosts
+	start := path.Join(s.root, path.Dir(prefix+"x"))
+
+	if _, err := client.Stat(start); os.IsNotExist(err) {
+		return results, nil
+	}
+
+	walker := client.Walk(start)
+
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return nil, s.reset(errors.New(fmt.Sprintf("[SFTPManager List()]> Failed to list %v, %v", prefix, err)))
+		}
+
+		stat := walker.Stat()
+		name := walker.Path()
+
+		if !stat.Mode().IsRegular() || strings.HasSuffix(name, ".meta") || strings.HasSuffix(name, ".part") {
+			continue
+		}
+
+		key := strings.TrimPrefix(strings.TrimPrefix(name, s.root), "/")
+
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		results = append(results, RemoteObject{
+			Key:          key,
+			Size:         stat.Size(),
+			LastModified: stat.ModTime(),
+		})
+	}
+
+	return results, nil
+}
+
+func (s *SFTPManager) Delete(object RemoteObject) (bool, error) {
+	client, err := s.connect()
+
+	if err != nil {
+		return false, err
+	}
+
+	err = client.Remove(s.path(object.Key))
+
+	if err != nil {
+		return false, s.reset(errors.New(fmt.Sprintf("[SFTPManager Delete()]> Failed to delete %v, %v", object.Key, err)))
+	}
+
+	client.Remove(s.path(object.Key) + ".meta")
+	log.Printf("Deleted %v from %v", object.Key, s.name)
+
+	return true, nil
+}
+
+func (s *SFTPManager) Prune() error {
+	return PruneBackups(s, s.retentionDays)
+}
@@ -0,0 +1,381 @@
+package Manager
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// startSFTPServer runs an SSH server with the sftp subsystem on a local port, the way sshd
+// serves it, and returns the options of a client that trusts its host key. Closing the
+// listener stops it.
+func startSFTPServer(t *testing.T, dir string) (SFTPOptions, net.Listener) {
+	hostKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientPublicKey, err := ssh.NewPublicKey(&clientKey.PublicKey)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() == "backup" && bytes.Equal(key.Marshal(), clientPublicKey.Marshal()) {
+				return nil, nil
+			}
+
+			return nil, errors.New("unknown key")
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+
+			if err != nil {
+				return
+			}
+
+			go serveSFTP(conn, config)
+		}
+	}()
+
+	der, err := x509.MarshalECPrivateKey(clientKey)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyFile := filepath.Join(dir, "id_ecdsa")
+	knownHostsFile := filepath.Join(dir, "known_hosts")
+
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+
+	if err == nil {
+		line := knownhosts.Line([]string{listener.Addr().String()}, hostSigner.PublicKey())
+		err = ioutil.WriteFile(knownHostsFile, []byte(line+"\n"), 0600)
+	}
+
+	if err != nil {
+		listener.Close()
+		t.Fatal(err)
+	}
+
+	address := listener.Addr().(*net.TCPAddr)
+
+	return SFTPOptions{
+		Host:           address.IP.String(),
+		Port:           address.Port,
+		User:           "backup",
+		PrivateKeyFile: keyFile,
+		KnownHostsFile: knownHostsFile,
+	}, listener
+}
+
+func serveSFTP(conn net.Conn, config *ssh.ServerConfig) {
+	server, channels, requests, err := ssh.NewServerConn(conn, config)
+
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	defer server.Close()
+
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+
+		channel, requests, err := newChannel.Accept()
+
+		if err != nil {
+			continue
+		}
+
+		go func() {
+			for request := range requests {
+				//the payload of a subsystem request is the length prefixed name
+				ok := request.Type == "subsystem" && len(request.Payload) > 4 && string(request.Payload[4:]) == "sftp"
+				request.Reply(ok, nil)
+
+				if !ok {
+					continue
+				}
+
+				go func() {
+					defer channel.Close()
+
+					subsystem, err := sftp.NewServer(channel)
+
+					if err == nil {
+						subsystem.Serve()
+						subsystem.Close()
+					}
+				}()
+			}
+		}()
+	}
+}
+
+// createTestSFTPManager returns a manager storing below root on a test server, the local
+// directory for its files and a function that stops the server and removes both
+func createTestSFTPManager(t *testing.T) (*SFTPManager, string, string, func()) {
+	dir, err := ioutil.TempDir("", "sftp")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := filepath.Join(dir, "remote")
+	local := filepath.Join(dir, "local")
+
+	err = os.Mkdir(local, 0750)
+
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	options, listener := startSFTPServer(t, dir)
+	manager, err := CreateSFTPManager(root, options, 0)
+
+	if err != nil {
+		listener.Close()
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return manager, root, local, func() {
+		manager.reset(errors.New("closed"))
+		listener.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func writeTestFile(t *testing.T, file string, size int) []byte {
+	err := os.MkdirAll(filepath.Dir(file), 0750)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := make([]byte, size)
+
+	for i := range content {
+		content[i] = byte(i * 31)
+	}
+
+	err = ioutil.WriteFile(file, content, 0640)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return content
+}
+
+func TestSFTPUploadListDownload(t *testing.T) {
+	manager, root, local, cleanup := createTestSFTPManager(t)
+	defer cleanup()
+
+	file := filepath.Join(local, "backup.gz.enc")
+	content := writeTestFile(t, file, 300000)
+	checksum, err := FileSha256(file)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := "host/2026-10-01/20261001T000000Z/backup.gz.enc"
+	err = manager.UploadFile(file, key, map[string]string{Sha256MetadataKey: checksum})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(file + ".upload-state"); !os.IsNotExist(err) {
+		t.Error("the upload state was not removed")
+	}
+
+	//other hosts and files below the prefix are not listed
+	writeTestFile(t, filepath.Join(root, "other", "file"), 10)
+
+	objects, err := manager.List("host/")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(objects) != 1 || objects[0].Key != key || objects[0].Size != int64(len(content)) {
+		t.Fatalf("got objects %+v, want only %v with %d bytes", objects, key, len(content))
+	}
+
+	metadata, err := manager.Metadata(key)
+
+	if err != nil || metadata[Sha256MetadataKey] != checksum {
+		t.Errorf("got metadata %v, %v, want the SHA-256 %v", metadata, err, checksum)
+	}
+
+	downloaded := filepath.Join(local, "downloaded")
+	err = manager.DownloadFile(key, downloaded)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(downloaded)
+
+	if err != nil || !bytes.Equal(data, content) {
+		t.Fatalf("the download differs from the upload, %v", err)
+	}
+
+	deleted, err := manager.Delete(objects[0])
+
+	if err != nil || !deleted {
+		t.Fatalf("delete returned %v, %v", deleted, err)
+	}
+
+	objects, err = manager.List("host/")
+
+	if err != nil || len(objects) != 0 {
+		t.Errorf("got objects %+v, %v after delete", objects, err)
+	}
+
+	if _, err := os.Stat(filepath.Join(root, key+".meta")); !os.IsNotExist(err) {
+		t.Error("the metadata was not deleted")
+	}
+}
+
+func TestSFTPUploadResume(t *testing.T) {
+	manager, root, local, cleanup := createTestSFTPManager(t)
+	defer cleanup()
+
+	file := filepath.Join(local, "backup.gz.enc")
+	content := writeTestFile(t, file, 100000)
+	stat, err := os.Stat(file)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := "host/backup.gz.enc"
+	state := &TransferState{Bucket: manager.Name(), Key: key, Size: stat.Size(), ModTime: stat.ModTime().UnixNano()}
+	err = state.Save(file + ".upload-state")
+
+	//an interrupted upload left the first part, with a marker the resume must not overwrite
+	partial := append([]byte{}, content[:40000]...)
+	partial[0] = 'R'
+
+	if err == nil {
+		err = os.MkdirAll(filepath.Join(root, "host"), 0750)
+	}
+
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(root, key+".part"), partial, 0640)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = manager.UploadFile(file, key, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(root, key))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if data[0] != 'R' || !bytes.Equal(data[1:], content[1:]) {
+		t.Error("the upload did not continue at the end of the partial file")
+	}
+}
+
+func TestSFTPDownloadVerifies(t *testing.T) {
+	manager, root, local, cleanup := createTestSFTPManager(t)
+	defer cleanup()
+
+	file := filepath.Join(local, "backup.gz.enc")
+	writeTestFile(t, file, 50000)
+	checksum, err := FileSha256(file)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := "host/backup.gz.enc"
+	err = manager.UploadFile(file, key, map[string]string{Sha256MetadataKey: checksum})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//corrupt the stored copy without changing its size
+	remote, err := os.OpenFile(filepath.Join(root, key), os.O_WRONLY, 0)
+
+	if err == nil {
+		_, err = remote.WriteAt([]byte("corrupt"), 1000)
+		remote.Close()
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	downloaded := filepath.Join(local, "downloaded")
+	err = manager.DownloadFile(key, downloaded)
+
+	if err == nil {
+		t.Fatal("the corrupt download was accepted")
+	}
+
+	for _, name := range []string{downloaded, downloaded + ".part", downloaded + ".download-state"} {
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("%v was left behind after the failed verification", name)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package Manager
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// SetAsideSuffix separates the data directory from the time it was set aside, e.g.
+// /var/lib/mysql.replaced-20261019T120000Z
+const SetAsideSuffix = ".replaced-"
+
+// SetAside is a data directory moved aside by a restore or a rollback
+type SetAside struct {
+	Path string
+	Time time.Time
+}
+
+// CheckDataDirectoryUnused fails when a server seems to use the data directory: a pid file of
+// a running process, a socket that accepts connections or a lock on ibdata1
+func CheckDataDirectoryUnused(directory string) error {
+	files, err := ioutil.ReadDir(directory)
+
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		path := filepath.Join(directory, f.Name())
+
+		if filepath.Ext(f.Name()) == ".pid" && f.Mode().IsRegular() {
+			data, err := ioutil.ReadFile(path)
+
+			if err != nil {
+				return err
+			}
+
+			pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+
+			//EPERM means the process exists but belongs to another user
+			if err == nil && pid > 0 {
+				if err := syscall.Kill(pid, 0); err == nil || err == syscall.EPERM {
+					return errors.New(fmt.Sprintf("process %d of %v is running", pid, path))
+				}
+			}
+		}
+
+		if f.Mode()&os.ModeSocket != 0 {
+			conn, err := net.DialTimeout("unix", path, time.Second)
+
+			if err == nil {
+				conn.Close()
+				return errors.New(fmt.Sprintf("socket %v accepts connections", path))
+			}
+		}
+	}
+
+	return checkIbdataLock(filepath.Join(directory, "ibdata1"))
+}
+
+// checkIbdataLock tests the fcntl lock InnoDB holds on ibdata1 without taking it, then takes a
+// non-blocking flock on the file and releases it right away
+func checkIbdataLock(path string) error {
+	f, err := os.Open(path)
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	lock := syscall.Flock_t{Type: syscall.F_WRLCK, Whence: 0}
+
+	err = syscall.FcntlFlock(f.Fd(), syscall.F_GETLK, &lock)
+
+	if err != nil {
+		return errors.New(fmt.Sprintf("testing the lock on %v failed, %v", path, err))
+	}
+
+	if lock.Type != syscall.F_UNLCK {
+		return errors.New(fmt.Sprintf("%v is locked by process %d", path, lock.Pid))
+	}
+
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+
+	if err != nil {
+		return errors.New(fmt.Sprintf("%v is locked, %v", path, err))
+	}
+
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
+
+// SetAsideDataDirectory renames the data directory to a timestamped sibling and creates it again
+// empty with the same mode and owner. Renaming keeps the old data on the same file system
+// without copying it, which does not work for a mount point.
+func SetAsideDataDirectory(directory string) (string, error) {
+	directory = filepath.Clean(directory)
+
+	stat, err := os.Stat(directory)
+
+	if err != nil {
+		return "", err
+	}
+
+	setAside := directory + SetAsideSuffix + time.Now().UTC().Format(BackupIdFormat)
+
+	err = os.Rename(directory, setAside)
+
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("[SetAside]> Failed to move %v aside, is it a mount point? %v", directory, err))
+	}
+
+	err = os.Mkdir(directory, stat.Mode().Perm())
+
+	if err == nil {
+		if owner, ok := stat.Sys().(*syscall.Stat_t); ok {
+			err = os.Chown(directory, int(owner.Uid), int(owner.Gid))
+		}
+	}
+
+	if err != nil {
+		return setAside, errors.New(fmt.Sprintf("[SetAside]> Failed to create %v again, the old data is in %v, %v", directory, setAside, err))
+	}
+
+	log.Println("Moved", directory, "aside to", setAside)
+
+	return setAside, nil
+}
+
+// ListSetAside returns the set-aside copies of the data directory, newest first
+func ListSetAside(directory string) ([]SetAside, error) {
+	directory = filepath.Clean(directory)
+
+	files, err := ioutil.ReadDir(filepath.Dir(directory))
+
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := filepath.Base(directory) + SetAsideSuffix
+	list := make([]SetAside, 0)
+
+	for _, f := range files {
+		if !f.IsDir() || !strings.HasPrefix(f.Name(), prefix) {
+			continue
+		}
+
+		setAt, err := time.Parse(BackupIdFormat, strings.TrimPrefix(f.Name(), prefix))
+
+		if err != nil {
+			continue
+		}
+
+		list = append(list, SetAside{Path: filepath.Join(filepath.Dir(directory), f.Name()), Time: setAt})
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Time.After(list[j].Time) })
+
+	return list, nil
+}
+
+// RollbackRestore swaps a set-aside data directory back, the newest one unless from names
+// another. The restored data is set aside in turn, so the rollback can be rolled back as well.
+// It returns the directory that was put back and where the replaced data went.
+func RollbackRestore(directory string, from string) (string, string, error) {
+	list, err := ListSetAside(directory)
+
+	if err != nil {
+		return "", "", err
+	}
+
+	if len(list) == 0 {
+		return "", "", errors.New(fmt.Sprintf("[RollbackRestore]> No set-aside copy of %v found", directory))
+	}
+
+	restore := list[0].Path
+
+	if len(from) > 0 {
+		restore = ""
+
+		for _, setAside := range list {
+			if setAside.Path == filepath.Clean(from) || filepath.Base(setAside.Path) == from {
+				restore = setAside.Path
+			}
+		}
+
+		if len(restore) == 0 {
+			return "", "", errors.New(fmt.Sprintf("[RollbackRestore]> %v is not a set-aside copy of %v", from, directory))
+		}
+	}
+
+	err = CheckDataDirectoryUnused(directory)
+
+	if err != nil {
+		return "", "", errors.New(fmt.Sprintf("[RollbackRestore]> %v is in use, stop the server first: %v", directory, err))
+	}
+
+	replaced := filepath.Clean(directory) + SetAsideSuffix + time.Now().UTC().Format(BackupIdFormat)
+
+	//a set aside in the same second would have the same name
+	if replaced == restore {
+		return "", "", errors.New("[RollbackRestore]> The data directory was set aside less than a second ago, try again")
+	}
+
+	err = os.Rename(directory, replaced)
+
+	if err != nil {
+		return "", "", errors.New(fmt.Sprintf("[RollbackRestore]> Failed to move %v aside, %v", directory, err))
+	}
+
+	err = os.Rename(restore, directory)
+
+	if err != nil {
+		//put the restored data back rather than leaving no data directory at all
+		os.Rename(replaced, directory)
+		return "", "", errors.New(fmt.Sprintf("[RollbackRestore]> Failed to move %v back, %v", restore, err))
+	}
+
+	return restore, replaced, nil
+}
+
+// RemoveExpiredSetAside deletes set-aside copies older than days, 0 keeps them
+func RemoveExpiredSetAside(directory string, days int) error {
+	if days <= 0 {
+		return nil
+	}
+
+	list, err := ListSetAside(directory)
+
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().AddDate(0, 0, -days)
+
+	for _, setAside := range list {
+		if setAside.Time.After(cutoff) {
+			continue
+		}
+
+		log.Println("Removing", setAside.Path, "set aside on", setAside.Time.Format(time.RFC3339))
+
+		err = os.RemoveAll(setAside.Path)
+
+		if err != nil {
+			return errors.New(fmt.Sprintf("[SetAside]> Failed to remove %v, %v", setAside.Path, err))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,305 @@
+package Manager
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"strings"
+	"time"
+
+	sha256 "github.com/minio/sha256-simd"
+)
+
+const (
+	StreamChunkSize   = 16 << 20
+	StreamMaxAttempts = 3
+	BackupStreamFile  = "backup.gz.enc"
+)
+
+// RangeReader is implemented by destinations that can read part of an object, a streaming
+// restore uses it to fetch the backup with parallel requests and to read the IV at its end
+type RangeReader interface {
+	OpenRange(object RemoteObject, offset int64, length int64) (io.ReadCloser, error)
+}
+
+// archiveRestorer is implemented by destinations whose objects may have to be restored from an
+// archival storage class before they can be read
+type archiveRestorer interface {
+	waitForArchiveRestore(key string) error
+}
+
+type streamChunk struct {
+	data []byte
+	err  error
+}
+
+// rangeStream reads a range of an object in order while the following chunks are fetched in
+// parallel. At most concurrency chunks are held in memory, nothing is written to disk.
+type rangeStream struct {
+	slots   chan chan streamChunk
+	done    chan struct{}
+	current []byte
+	err     error
+}
+
+func newRangeStream(source RangeReader, object RemoteObject, offset int64, end int64, concurrency int) *rangeStream {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	r := &rangeStream{
+		slots: make(chan chan streamChunk, concurrency-1),
+		done:  make(chan struct{}),
+	}
+
+	go func() {
+		defer close(r.slots)
+
+		for position := offset; position < end; position += StreamChunkSize {
+			length := end - position
+			if length > StreamChunkSize {
+				length = StreamChunkSize
+			}
+
+			slot := make(chan streamChunk, 1)
+
+			select {
+			case r.slots <- slot:
+			case <-r.done:
+				return
+			}
+
+			go func(position int64, length int64) {
+				data, err := fetchChunk(source, object, position, length)
+				slot <- streamChunk{data: data, err: err}
+			}(position, length)
+		}
+	}()
+
+	return r
+}
+
+// fetchChunk reads one chunk, a body that breaks off halfway is requested again
+func fetchChunk(source RangeReader, object RemoteObject, offset int64, length int64) ([]byte, error) {
+	var err error
+
+	for attempt := 0; attempt < StreamMaxAttempts; attempt++ {
+		if attempt > 0 {
+			log.Printf("Reading %v at %d failed, retrying: %v", object.Key, offset, err)
+			time.Sleep(time.Duration(1<<uint(attempt)) * time.Second)
+		}
+
+		var body io.ReadCloser
+		body, err = source.OpenRange(object, offset, length)
+
+		if err != nil {
+			continue
+		}
+
+		data := make([]byte, length)
+		_, err = io.ReadFull(body, data)
+		body.Close()
+
+		if err == nil {
+			return data, nil
+		}
+	}
+
+	return nil, errors.New(fmt.Sprintf("failed to read %d bytes of %v at %d, %v", length, object.Key, offset, err))
+}
+
+func (r *rangeStream) Read(p []byte) (int, error) {
+	for len(r.current) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		slot, ok := <-r.slots
+
+		if !ok {
+			return 0, io.EOF
+		}
+
+		chunk := <-slot
+		r.current, r.err = chunk.data, chunk.err
+	}
+
+	n := copy(p, r.current)
+	r.current = r.current[n:]
+
+	return n, nil
+}
+
+// Close stops fetching ahead, chunks already requested are discarded when they arrive
+func (r *rangeStream) Close() error {
+	select {
+	case <-r.done:
+	default:
+		close(r.done)
+	}
+
+	return nil
+}
+
+// BackupStream decrypts backup.gz.enc while it is read from a destination. The encrypted bytes
+// are hashed on the way so that Verify can compare them with the SHA-256 recorded at upload
+// time and the MD5 of the checksum file once the stream has been consumed.
+type BackupStream struct {
+	key            string
+	size           int64
+	iv             []byte
+	body           *rangeStream
+	reader         io.Reader
+	counter        *ProgressCounter
+	sha256         hash.Hash
+	md5            hash.Hash
+	expectedSha256 string
+	expectedMd5    string
+}
+
+// OpenBackupStream starts reading the encrypted backup of a remote backup. The IV is stored in
+// the last block of the file, so it is fetched first and the rest is decrypted in order.
+func OpenBackupStream(destination Destination, backup *RemoteBackup, keyFile string) (*BackupStream, error) {
+	object, ok := backup.Objects[BackupStreamFile]
+
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("[BackupStream Open()]> Backup %v has no %v", backup.Id, BackupStreamFile))
+	}
+
+	ranges, ok := destination.(RangeReader)
+
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("[BackupStream Open()]> %v does not support streaming, restore without -stream", destination.Name()))
+	}
+
+	if restorer, ok := destination.(archiveRestorer); ok {
+		err := restorer.waitForArchiveRestore(object.Key)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	k, err := ioutil.ReadFile(keyFile)
+
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("[BackupStream Open()]> Failed to read encryption key, %v", err))
+	}
+
+	block, err := aes.NewCipher(k)
+
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("[BackupStream Open()]> Invalid encryption key, %v", err))
+	}
+
+	if object.Size < int64(block.BlockSize()) {
+		return nil, errors.New(fmt.Sprintf("[BackupStream Open()]> %v is too short to be encrypted, %d bytes", object.Key, object.Size))
+	}
+
+	msgLen := object.Size - int64(block.BlockSize())
+
+	iv, err := fetchChunk(ranges, object, msgLen, int64(block.BlockSize()))
+
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("[BackupStream Open()]> Failed to read the IV of %v, %v", object.Key, err))
+	}
+
+	s := &BackupStream{
+		key:     object.Key,
+		size:    object.Size,
+		iv:      iv,
+		counter: &ProgressCounter{},
+		sha256:  sha256.New(),
+		md5:     md5.New(),
+	}
+
+	if reader, ok := destination.(MetadataReader); ok {
+		if metadata, err := reader.Metadata(object.Key); err == nil {
+			s.expectedSha256 = metadata[Sha256MetadataKey]
+		}
+	}
+
+	if checksum, ok := backup.Objects["checksum"]; ok {
+		s.expectedMd5, err = readSmallObject(destination, checksum.Key)
+
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("[BackupStream Open()]> Failed to read %v, %v", checksum.Key, err))
+		}
+	}
+
+	if len(s.expectedSha256) == 0 && len(s.expectedMd5) == 0 {
+		return nil, errors.New(fmt.Sprintf("[BackupStream Open()]> %v has neither %v metadata nor a checksum file, it cannot be verified", object.Key, Sha256MetadataKey))
+	}
+
+	s.body = newRangeStream(ranges, object, 0, msgLen, AwsConcurrencyLevel)
+	s.reader = &cipher.StreamReader{
+		S: cipher.NewCTR(block, iv),
+		R: io.TeeReader(s.counter.Reader(s.body), io.MultiWriter(s.sha256, s.md5)),
+	}
+
+	return s, nil
+}
+
+func readSmallObject(destination Destination, key string) (string, error) {
+	body, err := destination.Open(key)
+
+	if err != nil {
+		return "", err
+	}
+
+	defer body.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(body, 1<<20))
+
+	return strings.TrimSpace(string(data)), err
+}
+
+func (s *BackupStream) Read(p []byte) (int, error) {
+	return s.reader.Read(p)
+}
+
+// Size is the size of the encrypted backup including the IV
+func (s *BackupStream) Size() int64 {
+	return s.size
+}
+
+// Bytes returns how many encrypted bytes have been read so far
+func (s *BackupStream) Bytes() int64 {
+	return s.counter.Bytes()
+}
+
+// Verify compares the hashes of the encrypted backup with the recorded ones, it fails when the
+// stream was not read to the end
+func (s *BackupStream) Verify() error {
+	if read := s.counter.Bytes() + int64(len(s.iv)); read != s.size {
+		return errors.New(fmt.Sprintf("[BackupStream Verify()]> Only %d of %d bytes of %v were read", read, s.size, s.key))
+	}
+
+	s.sha256.Write(s.iv)
+	s.md5.Write(s.iv)
+
+	checksum := hex.EncodeToString(s.sha256.Sum(nil))
+
+	if len(s.expectedSha256) > 0 && checksum != s.expectedSha256 {
+		return errors.New(fmt.Sprintf("[BackupStream Verify()]> SHA-256 mismatch of %v, expected %v, got %v", s.key, s.expectedSha256, checksum))
+	}
+
+	checksum = hex.EncodeToString(s.md5.Sum(nil))
+
+	if len(s.expectedMd5) > 0 && checksum != s.expectedMd5 {
+		return errors.New(fmt.Sprintf("[BackupStream Verify()]> MD5 mismatch of %v, expected %v, got %v", s.key, s.expectedMd5, checksum))
+	}
+
+	return nil
+}
+
+func (s *BackupStream) Close() error {
+	return s.body.Close()
+}
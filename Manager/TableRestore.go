@@ -0,0 +1,595 @@
+package Manager
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// tableNamePattern limits schema and table names to those whose file name equals the name, other
+// names are encoded by the server and the files could not be found
+var tableNamePattern = regexp.MustCompile(`^[A-Za-z0-9_$]+$`)
+
+// TableName is a table given as schema.table
+type TableName struct {
+	Schema string
+	Table  string
+}
+
+func (t TableName) String() string {
+	return t.Schema + "." + t.Table
+}
+
+func (t TableName) quoted() string {
+	return "`" + t.Schema + "`.`" + t.Table + "`"
+}
+
+// ParseTableNames parses a comma separated list of schema.table
+func ParseTableNames(tables string) ([]TableName, error) {
+	names := make([]TableName, 0)
+
+	for _, table := range strings.Split(tables, ",") {
+		table = strings.TrimSpace(table)
+
+		if len(table) == 0 {
+			continue
+		}
+
+		parts := strings.Split(table, ".")
+
+		if len(parts) != 2 || !tableNamePattern.MatchString(parts[0]) || !tableNamePattern.MatchString(parts[1]) {
+			return nil, errors.New(fmt.Sprintf("invalid table ´%v´, expected schema.table with letters, digits, _ and $", table))
+		}
+
+		names = append(names, TableName{Schema: parts[0], Table: parts[1]})
+	}
+
+	return names, nil
+}
+
+// TableRestore restores single tables or databases from a backup chain into a running server
+// with transportable tablespaces. Only the files of those tables are extracted, the prepared
+// backup is exported and every tablespace is discarded and imported over a SQL connection.
+// Tables missing on the server are created with their definition at backup time, read from a
+// temporary server started on the exported backup.
+type TableRestore struct {
+	restore        *RestoreManager
+	tables         []TableName
+	databases      []string
+	targetSchema   string
+	overwrite      bool
+	mariadbdBinary string
+	serverOptions  []string
+	dsn            string
+}
+
+func CreateTableRestore(
+	Restore *RestoreManager,
+	Tables []TableName,
+	Databases []string,
+	TargetSchema string,
+	Overwrite bool,
+	MariadbdBinary string,
+	ServerOptions []string,
+	Host string,
+	Port int,
+	Username string,
+	Password string,
+) (*TableRestore, error) {
+
+	if len(Tables) == 0 && len(Databases) == 0 {
+		return nil, errors.New("at least one table or database is required")
+	}
+
+	for _, database := range append([]string{TargetSchema}, Databases...) {
+		if len(database) > 0 && !tableNamePattern.MatchString(database) {
+			return nil, errors.New(fmt.Sprintf("invalid database ´%v´, only letters, digits, _ and $ are supported", database))
+		}
+	}
+
+	schemas := make(map[string]bool)
+
+	for _, table := range Tables {
+		schemas[table.Schema] = true
+	}
+
+	for _, database := range Databases {
+		schemas[database] = true
+	}
+
+	if len(TargetSchema) > 0 && len(schemas) > 1 {
+		return nil, errors.New("a target schema can only be given when the tables are from one database")
+	}
+
+	config := mysql.NewConfig()
+	config.User = Username
+	config.Passwd = Password
+	config.Net = "tcp"
+	config.Addr = fmt.Sprintf("%v:%d", Host, Port)
+
+	t := &TableRestore{
+		restore:        Restore,
+		tables:         Tables,
+		databases:      Databases,
+		targetSchema:   TargetSchema,
+		overwrite:      Overwrite,
+		mariadbdBinary: MariadbdBinary,
+		serverOptions:  ServerOptions,
+		dsn:            config.FormatDSN(),
+	}
+
+	Restore.Filter(t.include)
+
+	return t, nil
+}
+
+// include accepts the files in the root of the data directory, which --prepare needs, and the
+// files of the requested tables and databases including partitions and incremental deltas
+func (t *TableRestore) include(path string) bool {
+	schema, file := filepath.Split(path)
+
+	if len(schema) == 0 {
+		return true
+	}
+
+	schema = strings.TrimSuffix(schema, "/")
+
+	for _, database := range t.databases {
+		if schema == database {
+			return true
+		}
+	}
+
+	table := strings.SplitN(strings.SplitN(file, ".", 2)[0], "#P#", 2)[0]
+
+	for _, name := range t.tables {
+		if name.Schema == schema && name.Table == table {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Run extracts and exports the tables and imports them one after another, a failed table stops
+// the restore and leaves the tables imported before it in place. Existing tables are only
+// overwritten when that was requested, otherwise nothing is imported.
+func (t *TableRestore) Run() error {
+	db, err := sql.Open("mysql", t.dsn)
+
+	if err != nil {
+		return errors.New(fmt.Sprintf("[TableRestore Run()]> Failed to open database connection, %v", err))
+	}
+
+	defer db.Close()
+
+	//fail before the backup is extracted when the server can not be reached
+	err = db.Ping()
+
+	if err != nil {
+		return errors.New(fmt.Sprintf("[TableRestore Run()]> Failed to connect to the server, %v", err))
+	}
+
+	var dataDirectory string
+
+	err = db.QueryRow("SELECT @@datadir").Scan(&dataDirectory)
+
+	if err != nil {
+		return errors.New(fmt.Sprintf("[TableRestore Run()]> Failed to read the data directory of the server, %v", err))
+	}
+
+	err = t.restore.PrepareChain()
+
+	if err != nil {
+		return err
+	}
+
+	err = t.restore.Export()
+
+	if err != nil {
+		return err
+	}
+
+	tables, err := t.exportedTables()
+
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+
+	if err != nil {
+		return errors.New(fmt.Sprintf("[TableRestore Run()]> Failed to open database connection, %v", err))
+	}
+
+	defer conn.Close()
+
+	missing, err := t.missingTables(ctx, conn, tables)
+
+	if err != nil {
+		return err
+	}
+
+	definitions := make(map[TableName]string)
+
+	if len(missing) > 0 {
+		definitions, err = t.readDefinitions(missing)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	//the imported rows are not checked against other tables
+	_, err = conn.ExecContext(ctx, "SET SESSION foreign_key_checks = 0")
+
+	if err != nil {
+		return err
+	}
+
+	for _, table := range tables {
+		err = t.importTable(ctx, conn, dataDirectory, table, definitions[table])
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// exportedTables lists the requested tables, every table of a requested database that has an
+// exported tablespace, and checks that each requested table was exported
+func (t *TableRestore) exportedTables() ([]TableName, error) {
+	directory := t.restore.ExportDirectory()
+	tables := make([]TableName, 0)
+
+	for _, table := range t.tables {
+		files, err := tablespaceFiles(filepath.Join(directory, table.Schema), table.Table)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !hasExtension(files, ".cfg") {
+			return nil, errors.New(fmt.Sprintf("[TableRestore Run()]> %v was not exported, it is missing in the backup or not an InnoDB table", table))
+		}
+
+		tables = append(tables, table)
+	}
+
+	for _, database := range t.databases {
+		files, err := ioutil.ReadDir(filepath.Join(directory, database))
+
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("[TableRestore Run()]> Database %v is missing in the backup, %v", database, err))
+		}
+
+		for _, f := range files {
+			if filepath.Ext(f.Name()) != ".cfg" {
+				continue
+			}
+
+			table := strings.SplitN(strings.TrimSuffix(f.Name(), ".cfg"), "#P#", 2)[0]
+
+			if !containsTable(tables, database, table) {
+				tables = append(tables, TableName{Schema: database, Table: table})
+			}
+		}
+	}
+
+	if len(tables) == 0 {
+		return nil, errors.New("[TableRestore Run()]> No InnoDB tables were exported")
+	}
+
+	return tables, nil
+}
+
+func containsTable(tables []TableName, schema string, table string) bool {
+	for _, t := range tables {
+		if t.Schema == schema && t.Table == table {
+			return true
+		}
+	}
+
+	return false
+}
+
+func hasExtension(files []string, extension string) bool {
+	for _, f := range files {
+		if filepath.Ext(f) == extension {
+			return true
+		}
+	}
+
+	return false
+}
+
+// tablespaceFiles returns the .ibd and .cfg files of a table in directory, one pair for every
+// partition of a partitioned table
+func tablespaceFiles(directory string, table string) ([]string, error) {
+	files, err := ioutil.ReadDir(directory)
+
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	names := make([]string, 0)
+
+	for _, f := range files {
+		name := f.Name()
+		extension := filepath.Ext(name)
+
+		if extension != ".ibd" && extension != ".cfg" {
+			continue
+		}
+
+		base := strings.TrimSuffix(name, extension)
+
+		if base == table || strings.HasPrefix(base, table+"#P#") {
+			names = append(names, name)
+		}
+	}
+
+	return names, nil
+}
+
+// target is the table source is imported into
+func (t *TableRestore) target(source TableName) TableName {
+	target := source
+
+	if len(t.targetSchema) > 0 {
+		target.Schema = t.targetSchema
+	}
+
+	return target
+}
+
+// missingTables returns the source tables whose target does not exist on the server. An
+// existing target is an error unless overwriting was requested, DISCARD TABLESPACE throws its
+// data away.
+func (t *TableRestore) missingTables(ctx context.Context, conn *sql.Conn, tables []TableName) ([]TableName, error) {
+	missing := make([]TableName, 0)
+	existing := make([]string, 0)
+
+	for _, table := range tables {
+		exists, err := tableExists(ctx, conn, t.target(table))
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !exists {
+			missing = append(missing, table)
+		} else if !t.overwrite {
+			existing = append(existing, t.target(table).String())
+		}
+	}
+
+	if len(existing) > 0 {
+		return nil, errors.New(fmt.Sprintf("[TableRestore Run()]> %v already exist on the server, use -overwrite to replace their data or -target-schema to import them elsewhere", strings.Join(existing, ", ")))
+	}
+
+	return missing, nil
+}
+
+// readDefinitions starts a temporary server on the exported backup and returns the CREATE TABLE
+// statements of the tables as they were at backup time. The server runs with InnoDB read only,
+// so the exported tablespaces stay as they are.
+func (t *TableRestore) readDefinitions(tables []TableName) (map[TableName]string, error) {
+	dataDirectory := t.restore.ExportDirectory()
+	runDirectory, err := createRunDirectory(filepath.Dir(dataDirectory), "definitions")
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer os.RemoveAll(runDirectory)
+
+	//the temporary server runs as mysql
+	err = chownMysql(dataDirectory)
+
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("[TableRestore Run()]> Failed to change the owner of %v, %v", dataDirectory, err))
+	}
+
+	log.Println("Reading the definitions of", len(tables), "tables missing on the server from the backup")
+
+	server, err := startTemporaryServer(t.mariadbdBinary, t.serverOptions, dataDirectory, runDirectory, "restore-tables",
+		//the system tables are not extracted and nobody else can reach the server without networking
+		"--skip-grant-tables",
+		"--innodb-read-only",
+		"--event-scheduler=DISABLED",
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	definitions, err := showCreateTables(server, tables)
+	shutdownErr := server.shutdown()
+
+	if err == nil {
+		err = shutdownErr
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return definitions, nil
+}
+
+func showCreateTables(server *temporaryServer, tables []TableName) (map[TableName]string, error) {
+	config := mysql.NewConfig()
+	config.User = "root"
+	config.Net = "unix"
+	config.Addr = server.socket
+
+	db, err := sql.Open("mysql", config.FormatDSN())
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer db.Close()
+
+	err = server.wait(db.Ping)
+
+	if err != nil {
+		return nil, err
+	}
+
+	definitions := make(map[TableName]string)
+
+	for _, table := range tables {
+		var name, definition string
+
+		err = db.QueryRow("SHOW CREATE TABLE "+table.quoted()).Scan(&name, &definition)
+
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("[TableRestore Run()]> Failed to read the definition of %v from the backup, %v", table, err))
+		}
+
+		definitions[table] = definition
+	}
+
+	return definitions, nil
+}
+
+// chownMysql gives directory and everything below it to the user the temporary server runs as
+func chownMysql(directory string) error {
+	group, err := user.Lookup(temporaryServerUser)
+
+	if err != nil {
+		return err
+	}
+
+	uid, _ := strconv.Atoi(group.Uid)
+	gid, _ := strconv.Atoi(group.Gid)
+
+	return filepath.Walk(directory, func(name string, f os.FileInfo, err error) error {
+		if err == nil {
+			err = os.Chown(name, uid, gid)
+		}
+		return err
+	})
+}
+
+// importTable creates the target table from its definition at backup time when it does not
+// exist yet, discards its tablespace, copies the exported files in and imports them
+func (t *TableRestore) importTable(ctx context.Context, conn *sql.Conn, dataDirectory string, source TableName, definition string) error {
+	target := t.target(source)
+
+	log.Println("Importing", source, "into", target)
+
+	if len(definition) > 0 {
+		err := t.createTable(ctx, conn, target, definition)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := conn.ExecContext(ctx, "ALTER TABLE "+target.quoted()+" DISCARD TABLESPACE")
+
+	if err != nil {
+		return errors.New(fmt.Sprintf("[TableRestore Run()]> Failed to discard the tablespace of %v, %v", target, err))
+	}
+
+	files, err := tablespaceFiles(filepath.Join(t.restore.ExportDirectory(), source.Schema), source.Table)
+
+	if err != nil {
+		return err
+	}
+
+	group, err := user.Lookup("mysql")
+
+	if err != nil {
+		return err
+	}
+
+	uid, _ := strconv.Atoi(group.Uid)
+	gid, _ := strconv.Atoi(group.Gid)
+
+	for _, file := range files {
+		destination := filepath.Join(dataDirectory, target.Schema, file)
+
+		err = copyFile(filepath.Join(t.restore.ExportDirectory(), source.Schema, file), destination, "copy", &RateLimiter{})
+
+		if err == nil {
+			err = os.Chown(destination, uid, gid)
+		}
+
+		if err != nil {
+			return errors.New(fmt.Sprintf("[TableRestore Run()]> Failed to copy %v into %v, %v", file, filepath.Dir(destination), err))
+		}
+	}
+
+	task := Progress.Start("import", target.String(), 0, nil)
+	_, err = conn.ExecContext(ctx, "ALTER TABLE "+target.quoted()+" IMPORT TABLESPACE")
+	task.Finish(err)
+
+	if err != nil {
+		return errors.New(fmt.Sprintf("[TableRestore Run()]> Failed to import the tablespace of %v, %v", target, err))
+	}
+
+	//the .cfg files are only needed during the import
+	for _, file := range files {
+		if filepath.Ext(file) == ".cfg" {
+			os.Remove(filepath.Join(dataDirectory, target.Schema, file))
+		}
+	}
+
+	return nil
+}
+
+// createTable creates the target table with the definition the source table had at backup time,
+// in the schema of the target so that foreign keys refer to the tables restored next to it
+func (t *TableRestore) createTable(ctx context.Context, conn *sql.Conn, target TableName, definition string) error {
+	_, err := conn.ExecContext(ctx, "CREATE DATABASE IF NOT EXISTS `"+target.Schema+"`")
+
+	if err == nil {
+		_, err = conn.ExecContext(ctx, "USE `"+target.Schema+"`")
+	}
+
+	if err != nil {
+		return errors.New(fmt.Sprintf("[TableRestore Run()]> Failed to create database %v, %v", target.Schema, err))
+	}
+
+	//SHOW CREATE TABLE names the table without its schema
+	_, err = conn.ExecContext(ctx, definition)
+
+	if err != nil {
+		return errors.New(fmt.Sprintf("[TableRestore Run()]> Failed to create %v, %v", target, err))
+	}
+
+	return nil
+}
+
+func tableExists(ctx context.Context, conn *sql.Conn, table TableName) (bool, error) {
+	var count int
+
+	err := conn.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM information_schema.TABLES WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ?",
+		table.Schema, table.Table,
+	).Scan(&count)
+
+	if err != nil {
+		return false, errors.New(fmt.Sprintf("[TableRestore Run()]> Failed to look up %v, %v", table, err))
+	}
+
+	return count > 0, nil
+}
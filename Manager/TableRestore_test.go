@@ -0,0 +1,34 @@
+package Manager
+
+import (
+	"testing"
+)
+
+func TestTableRestoreInclude(t *testing.T) {
+	restore := &TableRestore{
+		tables:    []TableName{{Schema: "shop", Table: "orders"}},
+		databases: []string{"crm"},
+	}
+
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{path: "ibdata1", want: true},
+		{path: "xtrabackup_checkpoints", want: true},
+		{path: "shop/orders.ibd", want: true},
+		{path: "shop/orders.frm", want: true},
+		{path: "shop/orders.ibd.delta", want: true},
+		{path: "shop/orders#P#p2026.ibd", want: true},
+		{path: "shop/orders_archive.ibd", want: false},
+		{path: "shop/customers.ibd", want: false},
+		{path: "crm/contacts.ibd", want: true},
+		{path: "mysql/user.MAI", want: false},
+	}
+
+	for _, test := range tests {
+		if got := restore.include(test.path); got != test.want {
+			t.Errorf("%v: got %v, want %v", test.path, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package Manager
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+const TableStatsFile = "tables.json"
+
+// TableStat describes a table at backup time. Rows is the estimate of information_schema,
+// which is exact for MyISAM and Aria but only approximate for InnoDB.
+type TableStat struct {
+	Schema  string `json:"schema"`
+	Table   string `json:"table"`
+	Engine  string `json:"engine"`
+	Columns int    `json:"columns"`
+	Rows    int64  `json:"rows"`
+}
+
+func (t TableStat) String() string {
+	return t.Schema + "." + t.Table
+}
+
+// quoted escapes the names for statements, unlike TableName they are not validated
+func (t TableStat) quoted() string {
+	return "`" + strings.Replace(t.Schema, "`", "``", -1) + "`.`" + strings.Replace(t.Table, "`", "``", -1) + "`"
+}
+
+// TableStats is saved as tables.json next to the manifest and travels with the backup, the
+// restore test compares the restored tables with it
+type TableStats struct {
+	CollectedAt time.Time   `json:"collected_at"`
+	Tables      []TableStat `json:"tables"`
+}
+
+const tableStatsQuery = `
+SELECT t.TABLE_SCHEMA, t.TABLE_NAME, IFNULL(t.ENGINE, ''), IFNULL(t.TABLE_ROWS, 0), COUNT(c.COLUMN_NAME)
+FROM information_schema.TABLES t
+LEFT JOIN information_schema.COLUMNS c ON c.TABLE_SCHEMA = t.TABLE_SCHEMA AND c.TABLE_NAME = t.TABLE_NAME
+WHERE t.TABLE_TYPE = 'BASE TABLE' AND t.TABLE_SCHEMA NOT IN ('mysql', 'information_schema', 'performance_schema', 'sys')
+GROUP BY t.TABLE_SCHEMA, t.TABLE_NAME, t.ENGINE, t.TABLE_ROWS
+ORDER BY t.TABLE_SCHEMA, t.TABLE_NAME`
+
+// CollectTableStats lists the user tables of the server with their engine, column count and
+// estimated row count
+func CollectTableStats(db *sql.DB) (*TableStats, error) {
+	rows, err := db.Query(tableStatsQuery)
+
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("[TableStats]> Failed to read information_schema, %v", err))
+	}
+
+	defer rows.Close()
+
+	stats := &TableStats{CollectedAt: time.Now().UTC(), Tables: make([]TableStat, 0)}
+
+	for rows.Next() {
+		table := TableStat{}
+
+		err = rows.Scan(&table.Schema, &table.Table, &table.Engine, &table.Rows, &table.Columns)
+
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("[TableStats]> Failed to read information_schema, %v", err))
+		}
+
+		stats.Tables = append(stats.Tables, table)
+	}
+
+	return stats, rows.Err()
+}
+
+// collectServerTableStats connects to the server that is backed up
+func collectServerTableStats(host string, port int, username string, password string) (*TableStats, error) {
+	config := mysql.NewConfig()
+	config.User = username
+	config.Passwd = password
+	config.Net = "tcp"
+	config.Addr = fmt.Sprintf("%v:%d", host, port)
+
+	db, err := sql.Open("mysql", config.FormatDSN())
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer db.Close()
+
+	return CollectTableStats(db)
+}
+
+func LoadTableStats(dir string) (*TableStats, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, TableStatsFile))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return parseTableStats(data)
+}
+
+func parseTableStats(data []byte) (*TableStats, error) {
+	stats := &TableStats{}
+	err := json.Unmarshal(data, stats)
+
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("[TableStats]> Failed to parse %v, %v", TableStatsFile, err))
+	}
+
+	return stats, nil
+}
+
+func (s *TableStats) Save(dir string) error {
+	payload, err := json.MarshalIndent(s, "", "\t")
+
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(dir, TableStatsFile), payload, 0640)
+}
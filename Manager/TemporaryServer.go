@@ -0,0 +1,124 @@
+package Manager
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// temporaryServerUser is the user the temporary servers run as
+var temporaryServerUser = "mysql"
+
+// temporaryServer is a mariadbd started on a restored data directory without networking, its
+// socket and pid file are kept in a directory of the run so it never clashes with the server
+// of the host
+type temporaryServer struct {
+	process *Process
+	socket  string
+}
+
+// startTemporaryServer starts mariadbd with the options of the configuration first, so that
+// --defaults-file can be used, followed by the options of the caller
+func startTemporaryServer(binary string, options []string, dataDirectory string, runDirectory string, name string, extra ...string) (*temporaryServer, error) {
+	socket := filepath.Join(runDirectory, name+".sock")
+
+	args := append(append([]string{}, options...),
+		"--datadir="+dataDirectory,
+		"--socket="+socket,
+		"--pid-file="+filepath.Join(runDirectory, name+".pid"),
+		"--skip-networking",
+		"--skip-slave-start",
+		"--skip-log-bin",
+		"--user="+temporaryServerUser,
+	)
+
+	process := NewProcess("mariadbd", binary, append(args, extra...)...)
+	process.SetStdout(os.Stdout)
+
+	err := process.Start()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &temporaryServer{process: process, socket: socket}, nil
+}
+
+// createRunDirectory creates name below parent for the socket and pid file of a temporary server
+// and gives it to the user the server runs as. parent is given to the group of that user, so the
+// server can reach the directory while parent stays closed to everybody else.
+func createRunDirectory(parent string, name string) (string, error) {
+	account, err := user.Lookup(temporaryServerUser)
+
+	if err != nil {
+		return "", err
+	}
+
+	uid, _ := strconv.Atoi(account.Uid)
+	gid, _ := strconv.Atoi(account.Gid)
+	directory := filepath.Join(parent, name)
+
+	err = os.MkdirAll(directory, 0750)
+
+	if err == nil {
+		err = os.Chown(parent, -1, gid)
+	}
+
+	if err == nil {
+		err = os.Chown(directory, uid, gid)
+	}
+
+	if err != nil {
+		os.RemoveAll(directory)
+		return "", errors.New(fmt.Sprintf("[TemporaryServer]> Failed to create the run directory %v, %v", directory, err))
+	}
+
+	return directory, nil
+}
+
+// wait returns once ready succeeds, crash recovery of a large restore can take a while
+func (s *temporaryServer) wait(ready func() error) error {
+	deadline := time.Now().Add(BinlogServerWaitTime)
+
+	for time.Now().Before(deadline) {
+		select {
+		case <-s.process.Exited():
+			return errors.New(fmt.Sprintf("[TemporaryServer]> Server exited before accepting connections, %v", s.process.Wait()))
+		case <-time.After(time.Second):
+		}
+
+		//failed attempts are expected while the server starts
+		if ready() == nil {
+			return nil
+		}
+	}
+
+	return errors.New(fmt.Sprintf("[TemporaryServer]> Server did not accept connections on %v within %v", s.socket, BinlogServerWaitTime))
+}
+
+// shutdown stops the server with SIGTERM and kills it when it does not exit in time
+func (s *temporaryServer) shutdown() error {
+	select {
+	case <-s.process.Exited():
+		return s.process.Wait()
+	default:
+	}
+
+	log.Println("Shutting down the temporary server")
+	s.process.Signal(syscall.SIGTERM)
+
+	select {
+	case <-s.process.Exited():
+		return nil
+	case <-time.After(BinlogServerWaitTime):
+		s.process.Kill()
+		<-s.process.Exited()
+		return errors.New("[TemporaryServer]> Temporary server did not shut down, killed it")
+	}
+}
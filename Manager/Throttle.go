@@ -0,0 +1,191 @@
+package Manager
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// throttled readers and writers never move more than this in one go, so limits stay smooth
+const throttleChunkSize = 64 << 10
+
+// ThrottleWindow overrides the default rate between Start and End (HH:MM, local time).
+// A window may wrap around midnight, e.g. 22:00-06:00.
+type ThrottleWindow struct {
+	Start          string `json:"start"`
+	End            string `json:"end"`
+	BytesPerSecond int64  `json:"bytes_per_second"`
+}
+
+// RateLimit is a bytes/sec limit, 0 means unlimited
+type RateLimit struct {
+	BytesPerSecond int64            `json:"bytes_per_second"`
+	Windows        []ThrottleWindow `json:"windows"`
+}
+
+type ThrottleConfig struct {
+	Upload          RateLimit `json:"upload"`
+	Download        RateLimit `json:"download"`
+	BackupWrite     RateLimit `json:"backup_write"`
+	MariaBackupIOPS int       `json:"mariabackup_iops"`
+}
+
+// limiters shared by every transfer of the process, they can be changed while transfers run
+var (
+	UploadLimiter      = &RateLimiter{}
+	DownloadLimiter    = &RateLimiter{}
+	BackupWriteLimiter = &RateLimiter{}
+)
+
+func ApplyThrottleConfig(config ThrottleConfig) {
+	UploadLimiter.SetLimit(config.Upload)
+	DownloadLimiter.SetLimit(config.Download)
+	BackupWriteLimiter.SetLimit(config.BackupWrite)
+}
+
+// Rate returns the limit in effect at the given time
+func (r RateLimit) Rate(now time.Time) int64 {
+	minutes := now.Hour()*60 + now.Minute()
+
+	for _, window := range r.Windows {
+		start, okStart := parseClock(window.Start)
+		end, okEnd := parseClock(window.End)
+
+		if !okStart || !okEnd {
+			continue
+		}
+
+		if (start <= end && minutes >= start && minutes < end) || (start > end && (minutes >= start || minutes < end)) {
+			return window.BytesPerSecond
+		}
+	}
+
+	return r.BytesPerSecond
+}
+
+func parseClock(clock string) (int, bool) {
+	t, err := time.Parse("15:04", strings.TrimSpace(clock))
+
+	if err != nil {
+		return 0, false
+	}
+
+	return t.Hour()*60 + t.Minute(), true
+}
+
+type RateLimiter struct {
+	mutex sync.Mutex
+	limit RateLimit
+	next  time.Time
+}
+
+func (r *RateLimiter) SetLimit(limit RateLimit) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.limit = limit
+}
+
+// Wait blocks until n more bytes may pass
+func (r *RateLimiter) Wait(n int) {
+	r.mutex.Lock()
+
+	now := time.Now()
+	rate := r.limit.Rate(now)
+
+	if rate <= 0 {
+		r.mutex.Unlock()
+		return
+	}
+
+	if r.next.Before(now) {
+		r.next = now
+	}
+
+	wait := r.next.Sub(now)
+	r.next = r.next.Add(time.Duration(float64(n) / float64(rate) * float64(time.Second)))
+
+	r.mutex.Unlock()
+
+	time.Sleep(wait)
+}
+
+type throttledReader struct {
+	reader  io.Reader
+	limiter *RateLimiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleChunkSize {
+		p = p[:throttleChunkSize]
+	}
+
+	n, err := t.reader.Read(p)
+	t.limiter.Wait(n)
+
+	return n, err
+}
+
+type throttledReadCloser struct {
+	throttledReader
+	closer io.Closer
+}
+
+func (t *throttledReadCloser) Close() error {
+	return t.closer.Close()
+}
+
+type throttledWriter struct {
+	writer  io.Writer
+	limiter *RateLimiter
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+
+	for len(p) > 0 {
+		chunk := p
+
+		if len(chunk) > throttleChunkSize {
+			chunk = chunk[:throttleChunkSize]
+		}
+
+		t.limiter.Wait(len(chunk))
+		n, err := t.writer.Write(chunk)
+		written += n
+
+		if err != nil {
+			return written, err
+		}
+
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+// throttledTransport limits request bodies with the upload limiter and response bodies with
+// the download limiter. Throttling on the wire keeps the SDK's own checksum reads unthrottled.
+type throttledTransport struct {
+	base http.RoundTripper
+}
+
+func (t *throttledTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil && req.Body != http.NoBody {
+		throttled := *req
+		throttled.Body = &throttledReadCloser{throttledReader{req.Body, UploadLimiter}, req.Body}
+		req = &throttled
+	}
+
+	resp, err := t.base.RoundTrip(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	resp.Body = &throttledReadCloser{throttledReader{resp.Body, DownloadLimiter}, resp.Body}
+
+	return resp, nil
+}
@@ -0,0 +1,77 @@
+package Manager
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimitWindows(t *testing.T) {
+	limit := RateLimit{
+		BytesPerSecond: 100,
+		Windows: []ThrottleWindow{
+			{Start: "22:00", End: "06:00", BytesPerSecond: 0},
+			{Start: "09:00", End: "17:30", BytesPerSecond: 10},
+			{Start: "nine", End: "18:00", BytesPerSecond: 1},
+			//an empty window never matches
+			{Start: "12:00", End: "12:00", BytesPerSecond: 2},
+		},
+	}
+
+	tests := []struct {
+		clock string
+		want  int64
+	}{
+		{clock: "21:59", want: 100},
+		{clock: "22:00", want: 0},
+		{clock: "23:59", want: 0},
+		{clock: "00:00", want: 0},
+		{clock: "05:59", want: 0},
+		{clock: "06:00", want: 100},
+		{clock: "08:59", want: 100},
+		{clock: "09:00", want: 10},
+		{clock: "12:00", want: 10},
+		{clock: "17:29", want: 10},
+		{clock: "17:30", want: 100},
+		{clock: "17:45", want: 100},
+	}
+
+	for _, test := range tests {
+		now, err := time.Parse("15:04", test.clock)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := limit.Rate(now)
+
+		if got != test.want {
+			t.Errorf("%v: got %d bytes/s, want %d", test.clock, got, test.want)
+		}
+	}
+}
+
+func TestRateLimiterWait(t *testing.T) {
+	limiter := &RateLimiter{}
+	limiter.SetLimit(RateLimit{BytesPerSecond: 1000})
+
+	started := time.Now()
+
+	//the first call passes at once and books 0.1s, the following ones wait for the booked time
+	for i := 0; i < 3; i++ {
+		limiter.Wait(100)
+	}
+
+	elapsed := time.Since(started)
+
+	if elapsed < 190*time.Millisecond || elapsed > time.Second {
+		t.Errorf("300 bytes at 1000 bytes/s took %v, want about 200ms", elapsed)
+	}
+
+	limiter.SetLimit(RateLimit{})
+	started = time.Now()
+	limiter.Wait(1 << 30)
+
+	if time.Since(started) > 10*time.Millisecond {
+		t.Error("an unlimited limiter waited")
+	}
+}
@@ -1,11 +1,17 @@
 package Manager
 
 import (
+	"errors"
+	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"io"
 	"log"
+	"os"
+	"sync"
 	"sync/atomic"
 )
 
@@ -26,36 +32,218 @@ func (u *UploadProgress) Read(p []byte) (n int, err error) {
 	return num, err
 }
 
-func (u *UploadProgress) Upload(sess *session.Session, key string, bucket string, input io.Reader, size int64) (chan ProgressUpdate, error) {
+// Upload sends the body to S3. Files larger than a single part are uploaded as a multipart upload
+// whose id and finished parts are kept in stateFile, running it again resumes the same upload.
+func (u *UploadProgress) Upload(sess *session.Session, input *s3manager.UploadInput, body io.ReaderAt, size int64, stateFile string) (chan ProgressUpdate, error) {
 	//Reset the value just in case
 	atomic.StoreInt64(&u.bytes, 0)
-	u.reader = input
-	ul := s3manager.NewUploader(sess)
-
-	//set concurrency
-	ul.Concurrency = AwsConcurrencyLevel
+	key := aws.StringValue(input.Key)
 
 	updates := make(chan ProgressUpdate, 32)
 
 	log.Printf("Uploading " + key + " to S3")
-	_, err := ul.Upload(&s3manager.UploadInput{
-		Body:   u,
-		Bucket: aws.String(bucket),
-		Key:    aws.String(key),
-	})
+
+	task := Progress.Start("upload", key, size, u.BytesSent)
+	task.Notify(updates)
+
+	var err error
+
+	if size <= MultipartPartSize {
+		u.reader = io.NewSectionReader(body, 0, size)
+		input.Body = u
+
+		ul := s3manager.NewUploader(sess)
+		//set concurrency
+		ul.Concurrency = AwsConcurrencyLevel
+
+		_, err = ul.Upload(input)
+	} else {
+		err = u.uploadMultipart(s3.New(sess), input, body, size, stateFile)
+	}
+
+	task.Finish(err)
 
 	if err != nil {
-		select {
-		case updates <- ProgressUpdate{
-			Bytes:    size,
-			Total:    u.BytesSent(),
-			Finished: false,
-			Error:    nil,
-		}:
-		default:
-			log.Printf("Failed to upload" + key + " to S3...")
-		}
+		log.Printf("Failed to upload " + key + " to S3...")
+		return updates, err
 	}
 	log.Printf("Upload finished")
 	return updates, nil
 }
+
+func (u *UploadProgress) uploadMultipart(client *s3.S3, input *s3manager.UploadInput, body io.ReaderAt, size int64, stateFile string) error {
+	modTime := int64(0)
+
+	if f, ok := body.(*os.File); ok {
+		if stat, err := f.Stat(); err == nil {
+			modTime = stat.ModTime().UnixNano()
+		}
+	}
+
+	state, err := LoadTransferState(stateFile)
+	resumed := err == nil
+
+	if err == nil && (state.Bucket != aws.StringValue(input.Bucket) || state.Key != aws.StringValue(input.Key) || state.Size != size || state.ModTime != modTime) {
+		log.Printf("Upload state %v belongs to a different file, starting over", stateFile)
+		if abortErr := abortMultipartUpload(client, state); abortErr != nil {
+			log.Printf("Failed to abort multipart upload %v: %v", state.UploadId, abortErr)
+		}
+		err = errors.New("stale upload state")
+		resumed = false
+	}
+
+	if err != nil {
+		state, err = createMultipartUpload(client, input, size, modTime)
+
+		if err != nil {
+			return err
+		}
+
+		err = state.Save(stateFile)
+
+		if err != nil {
+			return err
+		}
+	} else {
+		log.Printf("Resuming upload %v, %d of %d parts already uploaded", state.UploadId, len(state.Parts), state.PartCount())
+	}
+
+	for _, part := range state.Parts {
+		_, length := state.PartRange(part.Number)
+		atomic.AddInt64(&u.bytes, length)
+	}
+
+	err = u.uploadParts(client, state, body, stateFile)
+
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchUpload && resumed {
+		log.Printf("Multipart upload %v no longer exists, starting over", state.UploadId)
+		os.Remove(stateFile)
+		atomic.StoreInt64(&u.bytes, 0)
+		return u.uploadMultipart(client, input, body, size, stateFile)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	completed := make([]*s3.CompletedPart, 0, len(state.Parts))
+	for _, part := range state.SortedParts() {
+		completed = append(completed, &s3.CompletedPart{
+			ETag:       aws.String(part.ETag),
+			PartNumber: aws.Int64(part.Number),
+		})
+	}
+
+	_, err = client.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(state.Bucket),
+		Key:             aws.String(state.Key),
+		UploadId:        aws.String(state.UploadId),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: completed},
+	})
+
+	if err != nil {
+		return errors.New(fmt.Sprintf("[UploadProgress Upload()]> Failed to complete multipart upload, %v", err))
+	}
+
+	return os.Remove(stateFile)
+}
+
+func (u *UploadProgress) uploadParts(client *s3.S3, state *TransferState, body io.ReaderAt, stateFile string) error {
+	parts := make(chan int64)
+	mutex := &sync.Mutex{}
+	wg := &sync.WaitGroup{}
+	var uploadErr error
+
+	for i := 0; i < AwsConcurrencyLevel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for number := range parts {
+				offset, length := state.PartRange(number)
+
+				out, err := client.UploadPart(&s3.UploadPartInput{
+					Body:       io.NewSectionReader(body, offset, length),
+					Bucket:     aws.String(state.Bucket),
+					Key:        aws.String(state.Key),
+					PartNumber: aws.Int64(number),
+					UploadId:   aws.String(state.UploadId),
+				})
+
+				mutex.Lock()
+				if err == nil {
+					state.Parts = append(state.Parts, TransferPart{Number: number, ETag: aws.StringValue(out.ETag)})
+					err = state.Save(stateFile)
+					atomic.AddInt64(&u.bytes, length)
+				}
+				if err != nil && uploadErr == nil {
+					uploadErr = err
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+
+	for number := int64(1); number <= state.PartCount(); number++ {
+		mutex.Lock()
+		failed := uploadErr != nil
+		done := state.Done(number)
+		mutex.Unlock()
+
+		if failed {
+			break
+		}
+
+		if !done {
+			parts <- number
+		}
+	}
+
+	close(parts)
+	wg.Wait()
+
+	return uploadErr
+}
+
+func createMultipartUpload(client *s3.S3, input *s3manager.UploadInput, size int64, modTime int64) (*TransferState, error) {
+	out, err := client.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket:                    input.Bucket,
+		Key:                       input.Key,
+		Metadata:                  input.Metadata,
+		ServerSideEncryption:      input.ServerSideEncryption,
+		SSEKMSKeyId:               input.SSEKMSKeyId,
+		StorageClass:              input.StorageClass,
+		Tagging:                   input.Tagging,
+		ObjectLockMode:            input.ObjectLockMode,
+		ObjectLockRetainUntilDate: input.ObjectLockRetainUntilDate,
+		ObjectLockLegalHoldStatus: input.ObjectLockLegalHoldStatus,
+	})
+
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("[UploadProgress Upload()]> Failed to create multipart upload, %v", err))
+	}
+
+	return &TransferState{
+		Bucket:   aws.StringValue(input.Bucket),
+		Key:      aws.StringValue(input.Key),
+		UploadId: aws.StringValue(out.UploadId),
+		Size:     size,
+		ModTime:  modTime,
+		PartSize: partSize(size),
+		Parts:    make([]TransferPart, 0),
+	}, nil
+}
+
+func abortMultipartUpload(client *s3.S3, state *TransferState) error {
+	if len(state.UploadId) == 0 {
+		return nil
+	}
+
+	_, err := client.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(state.Bucket),
+		Key:      aws.String(state.Key),
+		UploadId: aws.String(state.UploadId),
+	})
+
+	return err
+}
@@ -0,0 +1,98 @@
+package Manager
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	xbstreamMagic        = "XBSTCK01"
+	xbstreamPayloadChunk = 'P'
+	xbstreamEOFChunk     = 'E'
+	xbstreamMaxPathLen   = 4096
+)
+
+// filterXbstream copies the chunks of the files that include accepts from the xbstream in src to
+// dst, chunks of all other files are skipped so mbstream never writes them. The chunk format is
+// magic, flags, type, path length and path, followed for payload chunks by length, offset,
+// checksum and the data, all integers little endian.
+func filterXbstream(dst io.Writer, src io.Reader, include func(path string) bool) error {
+	header := make([]byte, len(xbstreamMagic)+1+1+4)
+	payload := make([]byte, 8+8+4)
+
+	for {
+		_, err := io.ReadFull(src, header)
+
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return errors.New(fmt.Sprintf("[Xbstream]> Failed to read chunk header, %v", err))
+		}
+
+		if !bytes.Equal(header[:len(xbstreamMagic)], []byte(xbstreamMagic)) {
+			return errors.New("[Xbstream]> Invalid chunk magic, the backup is not an xbstream")
+		}
+
+		chunkType := header[len(xbstreamMagic)+1]
+		pathLen := binary.LittleEndian.Uint32(header[len(xbstreamMagic)+2:])
+
+		if pathLen == 0 || pathLen > xbstreamMaxPathLen {
+			return errors.New(fmt.Sprintf("[Xbstream]> Invalid path length %d", pathLen))
+		}
+
+		path := make([]byte, pathLen)
+
+		_, err = io.ReadFull(src, path)
+
+		if err != nil {
+			return errors.New(fmt.Sprintf("[Xbstream]> Failed to read chunk path, %v", err))
+		}
+
+		out := ioutil.Discard
+
+		if include(strings.TrimPrefix(string(path), "./")) {
+			out = dst
+		}
+
+		switch chunkType {
+		case xbstreamEOFChunk:
+			_, err = out.Write(append(append([]byte{}, header...), path...))
+
+			if err != nil {
+				return err
+			}
+
+			continue
+		case xbstreamPayloadChunk:
+		default:
+			return errors.New(fmt.Sprintf("[Xbstream]> Unsupported chunk type %q in %v", chunkType, string(path)))
+		}
+
+		_, err = io.ReadFull(src, payload)
+
+		if err != nil {
+			return errors.New(fmt.Sprintf("[Xbstream]> Failed to read chunk of %v, %v", string(path), err))
+		}
+
+		length := binary.LittleEndian.Uint64(payload)
+
+		_, err = out.Write(append(append(append([]byte{}, header...), path...), payload...))
+
+		if err != nil {
+			return err
+		}
+
+		_, err = io.CopyN(out, src, int64(length))
+
+		if err != nil {
+			return errors.New(fmt.Sprintf("[Xbstream]> Failed to copy chunk of %v, %v", string(path), err))
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package Manager
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// xbstreamChunk encodes a payload chunk, or an EOF chunk when data is nil
+func xbstreamChunk(path string, offset uint64, data []byte) []byte {
+	chunk := bytes.NewBuffer([]byte(xbstreamMagic))
+	chunk.WriteByte(0)
+
+	if data == nil {
+		chunk.WriteByte(xbstreamEOFChunk)
+	} else {
+		chunk.WriteByte(xbstreamPayloadChunk)
+	}
+
+	binary.Write(chunk, binary.LittleEndian, uint32(len(path)))
+	chunk.WriteString(path)
+
+	if data != nil {
+		binary.Write(chunk, binary.LittleEndian, uint64(len(data)))
+		binary.Write(chunk, binary.LittleEndian, offset)
+		binary.Write(chunk, binary.LittleEndian, uint32(0))
+		chunk.Write(data)
+	}
+
+	return chunk.Bytes()
+}
+
+func TestFilterXbstream(t *testing.T) {
+	orders := append(xbstreamChunk("shop/orders.ibd", 0, []byte("orders")), xbstreamChunk("shop/orders.ibd", 6, []byte("more"))...)
+	orders = append(orders, xbstreamChunk("shop/orders.ibd", 0, nil)...)
+	customers := append(xbstreamChunk("shop/customers.ibd", 0, []byte("customers")), xbstreamChunk("shop/customers.ibd", 0, nil)...)
+	root := xbstreamChunk("./ibdata1", 0, []byte("system"))
+
+	stream := append(append(append([]byte{}, root...), orders...), customers...)
+
+	tests := []struct {
+		name    string
+		stream  []byte
+		include func(path string) bool
+		want    []byte
+		err     string
+	}{
+		{
+			name:    "everything",
+			stream:  stream,
+			include: func(path string) bool { return true },
+			want:    stream,
+		},
+		{
+			name:    "one table and the root",
+			stream:  stream,
+			include: func(path string) bool { return path == "ibdata1" || strings.HasPrefix(path, "shop/orders.") },
+			want:    append(append([]byte{}, root...), orders...),
+		},
+		{
+			name:    "nothing",
+			stream:  stream,
+			include: func(path string) bool { return false },
+			want:    []byte{},
+		},
+		{
+			name:    "empty stream",
+			stream:  []byte{},
+			include: func(path string) bool { return true },
+			want:    []byte{},
+		},
+		{
+			name:    "not an xbstream",
+			stream:  append([]byte("XBSTCK02"), stream[8:]...),
+			include: func(path string) bool { return true },
+			err:     "Invalid chunk magic",
+		},
+		{
+			name:    "truncated header",
+			stream:  stream[:len(root)+5],
+			include: func(path string) bool { return true },
+			err:     "Failed to read chunk header",
+		},
+		{
+			name:    "truncated data",
+			stream:  stream[:len(root)-2],
+			include: func(path string) bool { return false },
+			err:     "Failed to copy chunk of ./ibdata1",
+		},
+		{
+			name:    "empty path",
+			stream:  xbstreamChunk("", 0, []byte("x")),
+			include: func(path string) bool { return true },
+			err:     "Invalid path length 0",
+		},
+	}
+
+	for _, test := range tests {
+		out := &bytes.Buffer{}
+		err := filterXbstream(out, bytes.NewReader(test.stream), test.include)
+
+		if len(test.err) > 0 {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%v: got %v, want an error containing %q", test.name, err, test.err)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+			continue
+		}
+
+		if !bytes.Equal(out.Bytes(), test.want) {
+			t.Errorf("%v: got %d bytes, want %d", test.name, out.Len(), len(test.want))
+		}
+	}
+}
@@ -4,7 +4,10 @@ go 1.12
 
 require (
 	github.com/aws/aws-sdk-go v1.40.27
+	github.com/go-sql-driver/mysql v1.5.0
 	github.com/klauspost/compress v1.9.8 // indirect
 	github.com/klauspost/pgzip v1.2.1
 	github.com/minio/sha256-simd v1.0.0
+	github.com/pkg/sftp v1.13.4
+	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519
 )
@@ -1,12 +1,18 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/karlmjogila/mariabackup/Manager"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 )
 
 //backup command
@@ -24,8 +30,12 @@ var BackupConfigFile = Backup.String("config-file", "", "configuration file")
 var BackupParallelThreads = Backup.Int("parallel-threads", 0, "parallel threads for mariabackup")
 var BackupGzipThreads = Backup.Int("gzip-threads", 0, "gzip number of threads")
 var BackupGzipBlockSize = Backup.Int("gzip-block", 0, "number of bytes gzip processes per cycle")
-var BackupToS3 = Backup.Bool("backup-to-s3", false, "When true upload to S3")
+var BackupToS3 = Backup.Bool("backup-to-s3", false, "When true replicate the backup to the configured destinations")
 var BackupEncryptionKey = Backup.String("encryption-key", "", "encryption key location")
+var BackupProgress = Backup.String("progress", "", "progress output - bar|log|json|none")
+var BackupThrottle = Backup.Int("throttle", 0, "limit mariabackup to this many I/O operations per second")
+var BackupForce = Backup.Bool("force", false, "only warn when the disk space looks insufficient instead of aborting")
+var BackupRestoreTest = Backup.Bool("restore-test", false, "after the backup, restore the chain into the restore test sandbox and check its tables")
 
 //restore command
 var Restore = flag.NewFlagSet("restore", flag.ExitOnError)
@@ -40,14 +50,113 @@ var RestoreGzipThreads = Restore.Int("gzip-threads", 0, "gzip number of threads"
 var RestoreGzipBlockSize = Restore.Int("gzip-block", 0, "number of bytes gzip processes per cycle")
 var RestoreFromS3 = Restore.Bool("restore-from-s3", false, "When true restore from S3")
 var RestoreDate = Restore.String("restore-date", "", "backup creation date from S3, format YYYY-MM-DD")
+var RestoreAt = Restore.String("at", "", "restore the newest backup chain ending at or before this time, format RFC3339")
+var RestoreLatest = Restore.Bool("latest", false, "restore the newest backup chain from S3")
+var RestoreProgress = Restore.String("progress", "", "progress output - bar|log|json|none")
+var RestoreDownloadDirectory = Restore.String("download-dir", "", "directory where backups from S3 are downloaded to")
 var RestoreEncryptionKey = Restore.String("encryption-key", "", "encryption key location")
+var RestoreDestination = Restore.String("destination", "", "destination to restore from, defaults to the first configured one")
+var RestorePrefix = Restore.String("prefix", "", "with -restore-from-s3, remote prefix to discover the chain in, defaults to <hostname>/")
+var RestoreUpTo = Restore.String("upto", "", "apply the chain only up to this backup id, position (0 is the full backup) or time in RFC3339")
+var RestoreStopDatetime = Restore.String("stop-datetime", "", "replay binlogs up to this time after the restore, format YYYY-MM-DD HH:MM:SS in the server time zone")
+var RestoreStopPosition = Restore.String("stop-position", "", "replay binlogs up to this <binlog file>:<position> or GTID after the restore")
+var RestoreDryRun = Restore.Bool("dry-run", false, "with -stop-datetime or -stop-position, only print the binlog events that would be replayed")
+var RestoreStream = Restore.Bool("stream", false, "with -restore-from-s3, stream the backups into mbstream instead of downloading them first")
+var RestoreForce = Restore.Bool("force", false, "only warn when the disk space looks insufficient instead of aborting")
+var RestoreLowDisk = Restore.Bool("low-disk", false, "extract and apply one backup at a time and stream remote backups, for hosts short on disk space")
+var RestorePipelineDepth = Restore.Int("pipeline-depth", -1, "number of backups extracted ahead while a backup is prepared, 0 disables pipelining")
+var RestorePlanOnly = Restore.Bool("plan", false, "only print what the restore would do and check its keys, binaries and directories")
+var RestoreReplace = Restore.Bool("replace", false, "move a target directory that is not empty aside instead of refusing it, rollback-restore puts it back")
+
+//restore-tables command
+var RestoreTables = flag.NewFlagSet("restore-tables", flag.ExitOnError)
+var RestoreTablesConfigFile = RestoreTables.String("config-file", "", "configuration file")
+var RestoreTablesTables = RestoreTables.String("tables", "", "comma separated tables to restore, format schema.table")
+var RestoreTablesDatabase = RestoreTables.String("database", "", "comma separated databases whose InnoDB tables are restored")
+var RestoreTablesTargetSchema = RestoreTables.String("target-schema", "", "import the tables into this schema instead of their own, it is created when missing")
+var RestoreTablesOverwrite = RestoreTables.Bool("overwrite", false, "replace the data of tables that already exist on the server")
+var RestoreTablesSourceDirectory = RestoreTables.String("source-dir", "", "directory in which the backups are stored")
+var RestoreTablesWorkDirectory = RestoreTables.String("work-dir", "", "directory where the backup is extracted and prepared")
+var RestoreTablesHost = RestoreTables.String("host", "", "database host, the server has to run on this machine")
+var RestoreTablesPort = RestoreTables.Int("port", 0, "database port")
+var RestoreTablesUsername = RestoreTables.String("username", "", "database username")
+var RestoreTablesPassword = RestoreTables.String("password", "", "database password")
+var RestoreTablesUpTo = RestoreTables.String("upto", "", "apply the chain only up to this backup id, position (0 is the full backup) or time in RFC3339")
+var RestoreTablesFromS3 = RestoreTables.Bool("from-s3", false, "stream the backup chain from a destination instead of the source directory")
+var RestoreTablesAt = RestoreTables.String("at", "", "with -from-s3, restore the newest chain ending at or before this time, format RFC3339, defaults to the newest chain")
+var RestoreTablesDestination = RestoreTables.String("destination", "", "destination to restore from, defaults to the first configured one")
+var RestoreTablesPrefix = RestoreTables.String("prefix", "", "with -from-s3, remote prefix to discover the chain in, defaults to <hostname>/")
+var RestoreTablesEncryptionKey = RestoreTables.String("encryption-key", "", "encryption key location")
+var RestoreTablesProgress = RestoreTables.String("progress", "", "progress output - bar|log|json|none")
+
+//restore-test command
+var RestoreTest = flag.NewFlagSet("restore-test", flag.ExitOnError)
+var RestoreTestConfigFile = RestoreTest.String("config-file", "", "configuration file")
+var RestoreTestSourceDirectory = RestoreTest.String("source-dir", "", "directory in which the backups are stored")
+var RestoreTestDirectory = RestoreTest.String("dir", "", "sandbox directory the chain is restored into, it is emptied first")
+var RestoreTestSample = RestoreTest.Int("sample", -1, "number of tables checked and counted, 0 checks all of them")
+var RestoreTestUpTo = RestoreTest.String("upto", "", "apply the chain only up to this backup id, position (0 is the full backup) or time in RFC3339")
+var RestoreTestFromS3 = RestoreTest.Bool("from-s3", false, "stream the backup chain from a destination instead of the source directory")
+var RestoreTestAt = RestoreTest.String("at", "", "with -from-s3, test the newest chain ending at or before this time, format RFC3339, defaults to the newest chain")
+var RestoreTestDestination = RestoreTest.String("destination", "", "destination to restore from, defaults to the first configured one")
+var RestoreTestPrefix = RestoreTest.String("prefix", "", "with -from-s3, remote prefix to discover the chain in, defaults to <hostname>/")
+var RestoreTestEncryptionKey = RestoreTest.String("encryption-key", "", "encryption key location")
+var RestoreTestKeep = RestoreTest.Bool("keep", false, "keep the sandbox for inspection instead of removing it")
+var RestoreTestJson = RestoreTest.Bool("json", false, "print the report as JSON")
+var RestoreTestForce = RestoreTest.Bool("force", false, "only warn when the disk space looks insufficient instead of aborting")
+var RestoreTestProgress = RestoreTest.String("progress", "", "progress output - bar|log|json|none")
+
+//upload command
+var Upload = flag.NewFlagSet("upload", flag.ExitOnError)
+var UploadConfigFile = Upload.String("config-file", "", "configuration file")
+var UploadDirectory = Upload.String("dir", "", "backup directory to upload, defaults to the S3 upload directory")
+var UploadEncryptionKey = Upload.String("encryption-key", "", "encryption key location")
+var UploadProgress = Upload.String("progress", "", "progress output - bar|log|json|none")
+
+//list command
+var List = flag.NewFlagSet("list", flag.ExitOnError)
+var ListConfigFile = List.String("config-file", "", "configuration file")
+var ListPrefix = List.String("prefix", "", "prefix to list, defaults to this host")
+var ListDestination = List.String("destination", "", "destination to list, defaults to all of them")
+
+//audit command
+var Audit = flag.NewFlagSet("audit", flag.ExitOnError)
+var AuditConfigFile = Audit.String("config-file", "", "configuration file")
+var AuditDestination = Audit.String("destination", "", "destination to audit, defaults to all of them")
+var AuditTargetDirectory = Audit.String("target-dir", "", "directory in which the local backups are stored")
+var AuditChecksums = Audit.Bool("checksums", false, "also compare the SHA-256 of local files with the one recorded at upload time")
+var AuditJson = Audit.Bool("json", false, "print the reports as JSON")
+
+//archive-binlogs command
+var ArchiveBinlogs = flag.NewFlagSet("archive-binlogs", flag.ExitOnError)
+var ArchiveBinlogsConfigFile = ArchiveBinlogs.String("config-file", "", "configuration file")
+var ArchiveBinlogsDestination = ArchiveBinlogs.String("destination", "", "destination to archive to, defaults to all of them")
+var ArchiveBinlogsEncryptionKey = ArchiveBinlogs.String("encryption-key", "", "encryption key location, binlogs are only compressed without it")
+var ArchiveBinlogsStartFile = ArchiveBinlogs.String("start-file", "", "binlog file to start with on the first run, defaults to the oldest one of the server")
+var ArchiveBinlogsStagingDirectory = ArchiveBinlogs.String("staging-dir", "", "directory mysqlbinlog writes the binlogs to before they are archived")
+
+//rollback-restore command
+var RollbackRestore = flag.NewFlagSet("rollback-restore", flag.ExitOnError)
+var RollbackRestoreConfigFile = RollbackRestore.String("config-file", "", "configuration file")
+var RollbackRestoreTargetDirectory = RollbackRestore.String("target-dir", "", "directory where the MySQL data is stored")
+var RollbackRestoreFrom = RollbackRestore.String("from", "", "set-aside directory to put back, defaults to the newest one")
+var RollbackRestoreList = RollbackRestore.Bool("list", false, "only list the set-aside directories")
+
+//prune command
+var Prune = flag.NewFlagSet("prune", flag.ExitOnError)
+var PruneConfigFile = Prune.String("config-file", "", "configuration file")
+var PruneDestination = Prune.String("destination", "", "destination to prune, defaults to all of them")
+
+func init() {
+	Restore.BoolVar(RestoreFromS3, "from-s3", false, "alias for -restore-from-s3")
+}
 
 func main() {
 	log.SetFlags(log.Ldate | log.Ltime)
 
 	if len(os.Args) < 2 {
 		log.Println("Invalid number of arguments. Usage: " + os.Args[0] + " <command>")
-		return
+		os.Exit(1)
 	}
 
 	switch os.Args[1] {
@@ -56,7 +165,7 @@ func main() {
 
 		if err != nil {
 			log.Println("Parsing backup command failed:", err)
-			return
+			os.Exit(1)
 		}
 		//do backup
 
@@ -80,61 +189,108 @@ func main() {
 			config.GzipBlockSize,
 			config.GzipThreads,
 			config.ParallelThreads,
+			config.Throttle.MariaBackupIOPS,
 		)
 
 		if err != nil {
 			log.Printf("Failed to initialize backup")
-			return
+			os.Exit(1)
+		}
+
+		var replication *Manager.ReplicationManager
+
+		if *BackupToS3 {
+			replication, err = createReplicationManager(config)
+
+			if err != nil {
+				log.Println("Failed to initialize destinations:", err)
+				os.Exit(1)
+			}
+
+			//a full backup replaces the target directory, copies that failed last time have to be retried first
+			err = replication.RetryPending(config.Backup.TargetDirectory)
+
+			if err != nil {
+				log.Println("Retrying failed replication:", err)
+			}
+		}
+
+		estimate, err := backup.EstimateDisk()
+
+		if err == nil && *BackupToS3 {
+			//the encrypted copy is written next to backup.gz
+			estimate[0].Needed *= 2
+		}
+
+		if !checkDiskSpace(estimate, err, *BackupForce) {
+			os.Exit(1)
 		}
 
+		monitor := Manager.WatchDiskSpace(estimate.Directories(), config.Disk, *BackupForce)
 		err = backup.Backup()
+		monitor.Stop()
 
 		if err != nil {
 			log.Println("Backup has failed:", err)
-			return
+			os.Exit(1)
 		}
 
 		log.Printf("Backup successfully finished")
 
 		if *BackupToS3 {
+			err = uploadBackup(replication, backup.BackupPath(), *BackupEncryptionKey)
 
-			encrypt := Manager.Encrypt{}
+			if err != nil {
+				log.Println("Replication has failed:", err)
+				os.Exit(1)
+			}
+		}
 
-			err1 := encrypt.Encrypt(
-				filepath.Join(config.S3.UploadDirectory, "backup.gz"),
-				filepath.Join(config.S3.UploadDirectory, "backup.gz.enc"),
-				*BackupEncryptionKey,
-				1024,
-				config.S3.UploadDirectory,
-			)
+		if *BackupRestoreTest || config.RestoreTest.AfterBackup {
+			//the chain just written, not the one the restore section points to
+			config.Restore.SourceDirectory = config.Backup.TargetDirectory
 
-			if err1 != nil {
-				return
+			if code := runRestoreTest(config, nil, nil, "", "", false, false, *BackupForce); code != 0 {
+				os.Exit(code)
 			}
+		}
 
-			if err != nil {
-				log.Println("Failed to initialize encryption")
+	case "upload":
+		err := Upload.Parse(os.Args[2:])
+		if err != nil {
+			log.Println("Parsing upload command failed:", err)
+			os.Exit(1)
+		}
 
-			}
+		config := loadConfig()
 
-			upload, err := Manager.CreateS3Manager(
-				config.S3.AccessKey,
-				config.S3.Region,
-				config.S3.Bucket,
-				config.S3.Secret,
-			)
+		directory := config.S3.UploadDirectory
 
-			if err != nil {
-				fmt.Println(err)
-			}
-			upload.Upload(config.S3.UploadDirectory)
+		if len(*UploadDirectory) > 0 {
+			directory = *UploadDirectory
+		}
+
+		replication, err := createReplicationManager(config)
+
+		if err != nil {
+			log.Println("Failed to initialize destinations:", err)
+			os.Exit(1)
+		}
+
+		err = uploadBackup(replication, directory, *UploadEncryptionKey)
+
+		if err != nil {
+			log.Println("Replication has failed:", err)
+			os.Exit(1)
 		}
 
+		log.Printf("Upload successfully finished")
+
 	case "restore":
 		err := Restore.Parse(os.Args[2:])
 		if err != nil {
 			log.Println("Parsing restore command failed:", err)
-			return
+			os.Exit(1)
 		}
 		//do restore
 
@@ -143,40 +299,82 @@ func main() {
 		log.Println("Restore source directory:", config.Restore.SourceDirectory)
 		log.Println("Restore target directory:", config.Restore.TargetDirectory)
 
-		if *RestoreFromS3 {
-			err := Restore.Parse(os.Args[4:])
+		var target *Manager.RecoveryTarget
+
+		if len(*RestoreStopDatetime) > 0 || len(*RestoreStopPosition) > 0 {
+			target, err = Manager.ParseRecoveryTarget(*RestoreStopDatetime, *RestoreStopPosition)
+
 			if err != nil {
-				log.Println("Parsing restore command failed:", err)
-				return
+				log.Println("Invalid recovery target:", err)
+				os.Exit(1)
 			}
-			download, err := Manager.CreateS3Manager(
-				config.S3.AccessKey,
-				config.S3.Region,
-				config.S3.Bucket,
-				config.S3.Secret,
-			)
+		} else if *RestoreDryRun {
+			log.Println("-dry-run requires -stop-datetime or -stop-position")
+			os.Exit(1)
+		}
+
+		var streamFrom Manager.Destination
+		var streamChain Manager.RemoteChain
+		var downloadDirectory string
+
+		if *RestoreFromS3 {
+			at, err := restorePointInTime()
 
 			if err != nil {
-				fmt.Println(err)
-			}
-			download.Download(config.S3.UploadDirectory, *RestoreDate)
-
-			decrypt := Manager.Decrypt{}
-
-			err1 := decrypt.Decrypt(
-				filepath.Join(config.S3.UploadDirectory, "backup.gz.enc"),
-				filepath.Join(config.S3.UploadDirectory, "backup.gz"),
-				*RestoreEncryptionKey,
-				1024,
-				config.S3.UploadDirectory,
-				*RestoreDate)
-			if err1 != nil {
-				return
+				log.Println("Invalid restore point:", err)
+				os.Exit(1)
 			}
 
+			download, chain, err := findRemoteChain(config, *RestoreDestination, *RestorePrefix, at, *RestoreUpTo)
+
 			if err != nil {
-				log.Println("Failed to initialize decryption")
+				log.Println("Restore from S3 has failed:", err)
+				os.Exit(1)
+			}
+
+			log.Println("Restoring backup chain ending at or before", at.Format(time.RFC3339))
 
+			//downloaded copies would need as much space as the restore itself
+			stream := *RestoreStream || config.Restore.Stream || *RestoreDryRun || config.Restore.LowDisk
+
+			if !stream {
+				downloadDirectory = config.Restore.DownloadDirectory
+			}
+
+			//the plan reads the chain from the destination without downloading it
+			if stream || *RestorePlanOnly {
+				streamFrom = download
+				streamChain = chain
+			} else {
+				positionFile := filepath.Join(config.Restore.DownloadDirectory, "mariabackup.pos")
+				err = Manager.DownloadChain(download, chain, config.Restore.DownloadDirectory, positionFile)
+
+				if err != nil {
+					log.Println("Download from", download.Name(), "has failed:", err)
+					os.Exit(1)
+				}
+
+				for i := range chain {
+					backupDirectory := filepath.Join(config.Restore.DownloadDirectory, Manager.BackupSubDirectory(i))
+
+					decrypt := Manager.Decrypt{}
+
+					err = decrypt.Decrypt(
+						filepath.Join(backupDirectory, "backup.gz.enc"),
+						filepath.Join(backupDirectory, "backup.gz"),
+						*RestoreEncryptionKey,
+						1024,
+						backupDirectory,
+						chain[i].Id)
+
+					if err != nil {
+						log.Println("Decryption has failed:", err)
+						os.Exit(1)
+					}
+				}
+
+				config.Restore.SourceDirectory = config.Restore.DownloadDirectory
+				config.PositionFile = positionFile
 			}
 		}
 
@@ -193,141 +391,1133 @@ func main() {
 
 		if err != nil {
 			log.Printf("Failed to initialize restore")
-			return
+			os.Exit(1)
 		}
 
-		err = restore.Restore()
+		if streamFrom != nil {
+			restore.StreamFrom(streamFrom, streamChain, *RestoreEncryptionKey)
+		}
+
+		restore.Pipeline(config.Restore.PipelineDepth)
+		restore.History(config.Restore.HistoryFile)
+
+		if config.Restore.LowDisk {
+			restore.LowDisk()
+		}
+
+		if *RestoreReplace {
+			restore.Replace()
+		}
+
+		members, err := restore.Plan(*RestoreUpTo)
 
 		if err != nil {
-			log.Println("Restore has failed:", err)
+			log.Println("Invalid backup chain:", err)
+			os.Exit(1)
+		}
+
+		if *RestorePlanOnly {
+			history, err := Manager.LoadRestoreHistory(config.Restore.HistoryFile)
+
+			if err != nil {
+				log.Println("Failed to read the restore history, the duration is not estimated:", err)
+			}
+
+			plan, err := restore.DescribePlan(downloadDirectory, history)
+
+			if err != nil {
+				log.Println("Planning the restore has failed:", err)
+				os.Exit(1)
+			}
+
+			if target != nil {
+				plan.Step("replay the archived binlogs with %v into a %v started on %v up to %v%v",
+					config.Binlog.MysqlBinlogBinary, config.Binlog.MariadbdBinary, config.Restore.TargetDirectory, *RestoreStopDatetime, *RestoreStopPosition)
+
+				_, err = createPointInTimeRecovery(config, *RestorePrefix)
+				plan.Check("binlog archive", err)
+
+				for _, binary := range []string{config.Binlog.MysqlBinlogBinary, config.Binlog.MysqlBinary, config.Binlog.MariadbdBinary} {
+					plan.Check("point-in-time recovery binary "+binary, Manager.CheckBinary(binary))
+				}
+			}
+
+			plan.Print(os.Stdout)
+
+			if plan.Failed() > 0 {
+				os.Exit(1)
+			}
+
 			return
 		}
 
-		log.Printf("Restore successfully finished")
+		log.Println("Applying", len(members), "backups:")
+		for i, backup := range members {
+			log.Println("  ", i, backup)
+		}
 
-	default:
-		fmt.Printf("%q is not valid command\n", os.Args[1])
-		return
-	}
-}
+		estimate, err := restore.EstimateDisk()
 
-func loadConfig() *Manager.Config {
-	config := Manager.CreateNewConfig()
+		if !*RestoreDryRun && !checkDiskSpace(estimate, err, *RestoreForce) {
+			os.Exit(1)
+		}
 
-	configFile := "config.json" //default
+		var recovery *Manager.PointInTimeRecovery
 
-	//determine the config file based on the command
+		if target != nil {
+			recovery, err = createPointInTimeRecovery(config, *RestorePrefix)
 
-	if Backup.Parsed() {
-		if len(*BackupConfigFile) > 0 {
-			configFile = *BackupConfigFile
+			if err != nil {
+				log.Println("Failed to initialize point-in-time recovery:", err)
+				os.Exit(1)
+			}
 		}
-	}
 
-	if Restore.Parsed() {
-		if len(*RestoreConfigFile) > 0 {
-			configFile = *RestoreConfigFile
+		if *RestoreDryRun {
+			start, err := restore.BinlogPosition()
+
+			if err == nil {
+				err = recovery.DryRun(start, target)
+			}
+
+			if err != nil {
+				log.Println("Dry run has failed:", err)
+				os.Exit(1)
+			}
+
+			return
 		}
-	}
 
-	if config.CheckIfExists(configFile) != nil {
-		err := config.Save(configFile) //try to create config file
+		monitor := Manager.WatchDiskSpace(estimate.Directories(), config.Disk, *RestoreForce)
+		err = restore.Restore()
+		monitor.Stop()
+
 		if err != nil {
-			log.Fatalln("Failed to create config file", err)
+			log.Println("Restore has failed:", err)
+			os.Exit(1)
 		}
-	}
-	err := config.Load(configFile)
 
-	if err != nil {
-		log.Fatalln("Failed to read config file: ", err)
-	}
+		if setAside := restore.SetAsidePath(); len(setAside) > 0 {
+			log.Printf("The previous data directory is kept in %v for %d days, rollback-restore puts it back", setAside, config.Restore.SetAsideDays)
+		}
 
-	if Backup.Parsed() {
+		if recovery != nil {
+			start, err := restore.BinlogPosition()
 
-		if len(*BackupHost) > 0 {
-			config.Backup.Host = *BackupHost
+			if err == nil {
+				err = recovery.Replay(config.Restore.TargetDirectory, start, target)
+			}
+
+			if err != nil {
+				log.Println("Point-in-time recovery has failed, the data is restored up to the backup:", err)
+				os.Exit(1)
+			}
 		}
 
-		if *BackupPort > 0 {
-			config.Backup.Port = *BackupPort
+		//only once the restored data is in place, a failed restore may still need an older copy
+		err = Manager.RemoveExpiredSetAside(config.Restore.TargetDirectory, config.Restore.SetAsideDays)
+
+		if err != nil {
+			log.Println("Removing expired set-aside data directories has failed:", err)
 		}
 
-		if len(*BackupUsername) > 0 {
-			config.Backup.Username = *BackupUsername
+		log.Printf("Restore successfully finished")
+
+	case "restore-tables":
+		err := RestoreTables.Parse(os.Args[2:])
+		if err != nil {
+			log.Println("Parsing restore-tables command failed:", err)
+			os.Exit(1)
 		}
 
-		if len(*BackupPassword) > 0 {
-			config.Backup.Password = *BackupPassword
+		config := loadConfig()
+
+		tables, err := Manager.ParseTableNames(*RestoreTablesTables)
+
+		if err != nil {
+			log.Println("Invalid -tables:", err)
+			os.Exit(1)
 		}
 
-		if len(*BackupMode) > 0 {
-			config.Backup.Mode = *BackupMode
+		databases := make([]string, 0)
+
+		for _, database := range strings.Split(*RestoreTablesDatabase, ",") {
+			if database = strings.TrimSpace(database); len(database) > 0 {
+				databases = append(databases, database)
+			}
 		}
 
-		if len(*BackupTargetDirectory) > 0 {
-			config.Backup.TargetDirectory = *BackupTargetDirectory
+		restore, err := Manager.CreateRestoreManager(
+			config.Restore.SourceDirectory,
+			config.Restore.TargetDirectory,
+			config.Restore.WorkDirectory,
+			config.MariaBackupBinary,
+			config.PositionFile,
+			config.MbStreamBinary,
+			config.GzipBlockSize,
+			config.GzipThreads,
+		)
+
+		if err != nil {
+			log.Printf("Failed to initialize restore")
+			os.Exit(1)
 		}
 
-		if len(*BackupDataDirectory) > 0 {
-			config.Backup.DataDirectory = *BackupDataDirectory
+		if *RestoreTablesFromS3 {
+			at := time.Now()
+
+			if len(*RestoreTablesAt) > 0 {
+				at, err = time.Parse(time.RFC3339, *RestoreTablesAt)
+
+				if err != nil {
+					log.Println("Invalid -at:", err)
+					os.Exit(1)
+				}
+			}
+
+			download, chain, err := findRemoteChain(config, *RestoreTablesDestination, *RestoreTablesPrefix, at, *RestoreTablesUpTo)
+
+			if err != nil {
+				log.Println("Restore from S3 has failed:", err)
+				os.Exit(1)
+			}
+
+			restore.StreamFrom(download, chain, *RestoreTablesEncryptionKey)
 		}
 
-		if len(*BackupMariaBackupBinary) > 0 {
-			config.MariaBackupBinary = *BackupMariaBackupBinary
+		restore.Pipeline(config.Restore.PipelineDepth)
+
+		members, err := restore.Plan(*RestoreTablesUpTo)
+
+		if err != nil {
+			log.Println("Invalid backup chain:", err)
+			os.Exit(1)
 		}
 
-		if len(*BackupPositionFile) > 0 {
-			config.PositionFile = *BackupPositionFile
+		log.Println("Applying", len(members), "backups:")
+		for i, backup := range members {
+			log.Println("  ", i, backup)
 		}
 
-		if *BackupParallelThreads > 0 {
-			config.ParallelThreads = *BackupParallelThreads
+		tableRestore, err := Manager.CreateTableRestore(
+			restore,
+			tables,
+			databases,
+			*RestoreTablesTargetSchema,
+			*RestoreTablesOverwrite,
+			config.Binlog.MariadbdBinary,
+			config.Binlog.ServerOptions,
+			config.Backup.Host,
+			config.Backup.Port,
+			config.Backup.Username,
+			config.Backup.Password,
+		)
+
+		if err != nil {
+			log.Println("Failed to initialize table restore:", err)
+			os.Exit(1)
 		}
 
-		if *BackupGzipThreads > 0 {
-			config.GzipThreads = *BackupGzipThreads
+		err = tableRestore.Run()
+
+		if err != nil {
+			log.Println("Table restore has failed:", err)
+			os.Exit(1)
 		}
 
-		if *BackupGzipBlockSize > 0 {
-			config.GzipBlockSize = *BackupGzipBlockSize
+		log.Printf("Table restore successfully finished")
+
+	case "restore-test":
+		err := RestoreTest.Parse(os.Args[2:])
+		if err != nil {
+			log.Println("Parsing restore-test command failed:", err)
+			os.Exit(2)
 		}
 
-	}
+		config := loadConfig()
 
-	if Restore.Parsed() {
+		var download Manager.Destination
+		var chain Manager.RemoteChain
 
-		if len(*RestoreSourceDirectory) > 0 {
-			config.Restore.SourceDirectory = *RestoreSourceDirectory
+		if *RestoreTestFromS3 {
+			at := time.Now()
+
+			if len(*RestoreTestAt) > 0 {
+				at, err = time.Parse(time.RFC3339, *RestoreTestAt)
+
+				if err != nil {
+					log.Println("Invalid -at:", err)
+					os.Exit(2)
+				}
+			}
+
+			download, chain, err = findRemoteChain(config, *RestoreTestDestination, *RestoreTestPrefix, at, *RestoreTestUpTo)
+
+			if err != nil {
+				log.Println("Restore test from S3 has failed:", err)
+				os.Exit(2)
+			}
 		}
 
-		if len(*RestoreTargetDirectory) > 0 {
-			config.Restore.TargetDirectory = *RestoreTargetDirectory
+		os.Exit(runRestoreTest(config, download, chain, *RestoreTestEncryptionKey, *RestoreTestUpTo, *RestoreTestKeep, *RestoreTestJson, *RestoreTestForce))
+
+	case "list":
+		err := List.Parse(os.Args[2:])
+		if err != nil {
+			log.Println("Parsing list command failed:", err)
+			os.Exit(1)
 		}
 
-		if len(*RestoreWorkDirectory) > 0 {
-			config.Restore.WorkDirectory = *RestoreWorkDirectory
+		config := loadConfig()
+
+		destinations, err := filterDestinations(config, *ListDestination)
+
+		if err != nil {
+			log.Println("Failed to initialize destinations:", err)
+			os.Exit(1)
 		}
 
-		if len(*RestoreMariaBackupBinary) > 0 {
-			config.MariaBackupBinary = *RestoreMariaBackupBinary
+		prefix := *ListPrefix
+
+		if len(prefix) == 0 {
+			prefix = Manager.GenerateHostPrefix()
 		}
 
-		if len(*RestorePositionFile) > 0 {
-			config.PositionFile = *RestorePositionFile
+		failed := false
+
+		for _, destination := range destinations {
+			objects, err := destination.List(prefix)
+
+			if err != nil {
+				log.Println("Listing", destination.Name(), "has failed:", err)
+				failed = true
+				continue
+			}
+
+			fmt.Println(destination.Name())
+
+			for _, object := range objects {
+				if inspector, ok := destination.(Manager.LockInspector); ok {
+					err = inspector.LockStatus(&object)
+
+					if err != nil {
+						log.Println("Reading lock status of", object.Key, "has failed:", err)
+					}
+				}
+
+				fmt.Printf("  %-60s %12d  %s  %s\n", object.Key, object.Size, object.LastModified.Format("2006-01-02 15:04:05"), object.LockStatus())
+			}
 		}
 
-		if len(*RestoreMbStreamBinary) > 0 {
-			config.MbStreamBinary = *RestoreMbStreamBinary
+		if failed {
+			os.Exit(1)
 		}
 
-		if *RestoreGzipThreads > 0 {
-			config.GzipThreads = *RestoreGzipThreads
+	case "audit":
+		err := Audit.Parse(os.Args[2:])
+		if err != nil {
+			log.Println("Parsing audit command failed:", err)
+			os.Exit(2)
 		}
 
-		if *RestoreGzipBlockSize > 0 {
-			config.GzipBlockSize = *RestoreGzipBlockSize
+		config := loadConfig()
+
+		destinations, err := filterDestinations(config, *AuditDestination)
+
+		if err != nil {
+			log.Println("Failed to initialize destinations:", err)
+			os.Exit(2)
 		}
-	}
 
-	return config
+		problems := 0
+		failed := false
+
+		for _, destination := range destinations {
+			report, err := Manager.Audit(destination, config.Backup.TargetDirectory, *AuditChecksums)
+
+			if err != nil {
+				log.Println("Audit of", destination.Name(), "has failed:", err)
+				failed = true
+				continue
+			}
+
+			problems += len(report.Problems)
+
+			if *AuditJson {
+				payload, _ := json.Marshal(report)
+				fmt.Println(string(payload))
+				continue
+			}
+
+			fmt.Printf("%v: %d objects, %d backups, %d chains, %d problems\n", report.Destination, report.Objects, report.Backups, report.Chains, len(report.Problems))
+
+			for _, problem := range report.Problems {
+				fmt.Printf("  %-17s %v: %v\n", problem.Kind, problem.Key, problem.Detail)
+			}
+		}
+
+		//monitoring alerts on the exit code
+		if failed {
+			os.Exit(2)
+		}
+
+		if problems > 0 {
+			os.Exit(1)
+		}
+
+	case "archive-binlogs":
+		err := ArchiveBinlogs.Parse(os.Args[2:])
+		if err != nil {
+			log.Println("Parsing archive-binlogs command failed:", err)
+			os.Exit(1)
+		}
+
+		config := loadConfig()
+
+		destinations, err := filterDestinations(config, *ArchiveBinlogsDestination)
+
+		if err != nil {
+			log.Println("Failed to initialize destinations:", err)
+			os.Exit(1)
+		}
+
+		archiver, err := Manager.CreateBinlogArchiver(
+			destinations,
+			config.Binlog.MysqlBinlogBinary,
+			config.Binlog.MysqlBinary,
+			config.Backup.Host,
+			config.Backup.Port,
+			config.Backup.Username,
+			config.Backup.Password,
+			config.Binlog.StagingDirectory,
+			Manager.GenerateHostPrefix(),
+			*ArchiveBinlogsEncryptionKey,
+			config.GzipBlockSize,
+			config.GzipThreads,
+		)
+
+		if err != nil {
+			log.Println("Failed to initialize binlog archiving:", err)
+			os.Exit(1)
+		}
+
+		err = archiver.Run(*ArchiveBinlogsStartFile)
+
+		if err != nil {
+			log.Println("Binlog archiving has failed:", err)
+			os.Exit(1)
+		}
+
+	case "rollback-restore":
+		err := RollbackRestore.Parse(os.Args[2:])
+		if err != nil {
+			log.Println("Parsing rollback-restore command failed:", err)
+			os.Exit(2)
+		}
+
+		config := loadConfig()
+
+		if *RollbackRestoreList {
+			list, err := Manager.ListSetAside(config.Restore.TargetDirectory)
+
+			if err != nil {
+				log.Println("Listing set-aside data directories has failed:", err)
+				os.Exit(2)
+			}
+
+			for _, setAside := range list {
+				fmt.Printf("%v  set aside %v\n", setAside.Path, setAside.Time.Format(time.RFC3339))
+			}
+
+			return
+		}
+
+		restored, replaced, err := Manager.RollbackRestore(config.Restore.TargetDirectory, *RollbackRestoreFrom)
+
+		if err != nil {
+			log.Println("Rollback has failed:", err)
+			os.Exit(1)
+		}
+
+		log.Println("Moved", restored, "back to", config.Restore.TargetDirectory)
+		log.Println("The replaced data directory is kept in", replaced+", rollback-restore -from puts it back")
+
+		err = Manager.RemoveExpiredSetAside(config.Restore.TargetDirectory, config.Restore.SetAsideDays)
+
+		if err != nil {
+			log.Println("Removing expired set-aside data directories has failed:", err)
+		}
+
+	case "prune":
+		err := Prune.Parse(os.Args[2:])
+		if err != nil {
+			log.Println("Parsing prune command failed:", err)
+			os.Exit(1)
+		}
+
+		config := loadConfig()
+
+		destinations, err := filterDestinations(config, *PruneDestination)
+
+		if err != nil {
+			log.Println("Failed to initialize destinations:", err)
+			os.Exit(1)
+		}
+
+		failed := false
+
+		for _, destination := range destinations {
+			err = destination.Prune()
+
+			if err != nil {
+				log.Println("Prune of", destination.Name(), "has failed:", err)
+				failed = true
+			}
+		}
+
+		err = Manager.RemoveExpiredSetAside(config.Restore.TargetDirectory, config.Restore.SetAsideDays)
+
+		if err != nil {
+			log.Println("Removing expired set-aside data directories has failed:", err)
+			failed = true
+		}
+
+		if failed {
+			os.Exit(1)
+		}
+
+		log.Printf("Prune successfully finished")
+
+	default:
+		fmt.Printf("%q is not valid command\n", os.Args[1])
+		os.Exit(1)
+	}
+}
+
+// configFileName returns the configuration file of the parsed command
+func configFileName() string {
+	configFile := "config.json" //default
+
+	//determine the config file based on the command
+
+	if Backup.Parsed() {
+		if len(*BackupConfigFile) > 0 {
+			configFile = *BackupConfigFile
+		}
+	}
+
+	if Restore.Parsed() {
+		if len(*RestoreConfigFile) > 0 {
+			configFile = *RestoreConfigFile
+		}
+	}
+
+	if RestoreTables.Parsed() {
+		if len(*RestoreTablesConfigFile) > 0 {
+			configFile = *RestoreTablesConfigFile
+		}
+	}
+
+	if RestoreTest.Parsed() {
+		if len(*RestoreTestConfigFile) > 0 {
+			configFile = *RestoreTestConfigFile
+		}
+	}
+
+	if Upload.Parsed() {
+		if len(*UploadConfigFile) > 0 {
+			configFile = *UploadConfigFile
+		}
+	}
+
+	if List.Parsed() {
+		if len(*ListConfigFile) > 0 {
+			configFile = *ListConfigFile
+		}
+	}
+
+	if RollbackRestore.Parsed() {
+		if len(*RollbackRestoreConfigFile) > 0 {
+			configFile = *RollbackRestoreConfigFile
+		}
+	}
+
+	if Prune.Parsed() {
+		if len(*PruneConfigFile) > 0 {
+			configFile = *PruneConfigFile
+		}
+	}
+
+	if Audit.Parsed() {
+		if len(*AuditConfigFile) > 0 {
+			configFile = *AuditConfigFile
+		}
+	}
+
+	if ArchiveBinlogs.Parsed() {
+		if len(*ArchiveBinlogsConfigFile) > 0 {
+			configFile = *ArchiveBinlogsConfigFile
+		}
+	}
+
+	return configFile
+}
+
+func loadConfig() *Manager.Config {
+	config := Manager.CreateNewConfig()
+
+	configFile := configFileName()
+
+	if config.CheckIfExists(configFile) != nil {
+		err := config.Save(configFile) //try to create config file
+		if err != nil {
+			log.Fatalln("Failed to create config file", err)
+		}
+	}
+	err := config.Load(configFile)
+
+	if err != nil {
+		log.Fatalln("Failed to read config file: ", err)
+	}
+
+	if Backup.Parsed() {
+
+		if len(*BackupHost) > 0 {
+			config.Backup.Host = *BackupHost
+		}
+
+		if *BackupPort > 0 {
+			config.Backup.Port = *BackupPort
+		}
+
+		if len(*BackupUsername) > 0 {
+			config.Backup.Username = *BackupUsername
+		}
+
+		if len(*BackupPassword) > 0 {
+			config.Backup.Password = *BackupPassword
+		}
+
+		if len(*BackupMode) > 0 {
+			config.Backup.Mode = *BackupMode
+		}
+
+		if len(*BackupTargetDirectory) > 0 {
+			config.Backup.TargetDirectory = *BackupTargetDirectory
+		}
+
+		if len(*BackupDataDirectory) > 0 {
+			config.Backup.DataDirectory = *BackupDataDirectory
+		}
+
+		if len(*BackupMariaBackupBinary) > 0 {
+			config.MariaBackupBinary = *BackupMariaBackupBinary
+		}
+
+		if len(*BackupPositionFile) > 0 {
+			config.PositionFile = *BackupPositionFile
+		}
+
+		if *BackupParallelThreads > 0 {
+			config.ParallelThreads = *BackupParallelThreads
+		}
+
+		if *BackupGzipThreads > 0 {
+			config.GzipThreads = *BackupGzipThreads
+		}
+
+		if *BackupGzipBlockSize > 0 {
+			config.GzipBlockSize = *BackupGzipBlockSize
+		}
+
+		if *BackupThrottle > 0 {
+			config.Throttle.MariaBackupIOPS = *BackupThrottle
+		}
+
+		if len(*BackupProgress) > 0 {
+			config.Progress.Format = *BackupProgress
+		}
+
+	}
+
+	if Restore.Parsed() {
+
+		if len(*RestoreSourceDirectory) > 0 {
+			config.Restore.SourceDirectory = *RestoreSourceDirectory
+		}
+
+		if len(*RestoreTargetDirectory) > 0 {
+			config.Restore.TargetDirectory = *RestoreTargetDirectory
+		}
+
+		if len(*RestoreWorkDirectory) > 0 {
+			config.Restore.WorkDirectory = *RestoreWorkDirectory
+		}
+
+		if len(*RestoreProgress) > 0 {
+			config.Progress.Format = *RestoreProgress
+		}
+
+		if len(*RestoreDownloadDirectory) > 0 {
+			config.Restore.DownloadDirectory = *RestoreDownloadDirectory
+		}
+
+		if len(*RestoreMariaBackupBinary) > 0 {
+			config.MariaBackupBinary = *RestoreMariaBackupBinary
+		}
+
+		if len(*RestorePositionFile) > 0 {
+			config.PositionFile = *RestorePositionFile
+		}
+
+		if len(*RestoreMbStreamBinary) > 0 {
+			config.MbStreamBinary = *RestoreMbStreamBinary
+		}
+
+		if *RestoreGzipThreads > 0 {
+			config.GzipThreads = *RestoreGzipThreads
+		}
+
+		if *RestoreGzipBlockSize > 0 {
+			config.GzipBlockSize = *RestoreGzipBlockSize
+		}
+
+		if *RestorePipelineDepth >= 0 {
+			config.Restore.PipelineDepth = *RestorePipelineDepth
+		}
+
+		if *RestoreLowDisk {
+			config.Restore.LowDisk = true
+		}
+	}
+
+	if RestoreTables.Parsed() {
+
+		if len(*RestoreTablesSourceDirectory) > 0 {
+			config.Restore.SourceDirectory = *RestoreTablesSourceDirectory
+		}
+
+		if len(*RestoreTablesWorkDirectory) > 0 {
+			config.Restore.WorkDirectory = *RestoreTablesWorkDirectory
+		}
+
+		if len(*RestoreTablesHost) > 0 {
+			config.Backup.Host = *RestoreTablesHost
+		}
+
+		if *RestoreTablesPort > 0 {
+			config.Backup.Port = *RestoreTablesPort
+		}
+
+		if len(*RestoreTablesUsername) > 0 {
+			config.Backup.Username = *RestoreTablesUsername
+		}
+
+		if len(*RestoreTablesPassword) > 0 {
+			config.Backup.Password = *RestoreTablesPassword
+		}
+
+		if len(*RestoreTablesProgress) > 0 {
+			config.Progress.Format = *RestoreTablesProgress
+		}
+	}
+
+	if RestoreTest.Parsed() {
+
+		if len(*RestoreTestSourceDirectory) > 0 {
+			config.Restore.SourceDirectory = *RestoreTestSourceDirectory
+		}
+
+		if len(*RestoreTestDirectory) > 0 {
+			config.RestoreTest.Directory = *RestoreTestDirectory
+		}
+
+		if *RestoreTestSample >= 0 {
+			config.RestoreTest.Sample = *RestoreTestSample
+		}
+
+		if len(*RestoreTestProgress) > 0 {
+			config.Progress.Format = *RestoreTestProgress
+		}
+	}
+
+	if RollbackRestore.Parsed() {
+		if len(*RollbackRestoreTargetDirectory) > 0 {
+			config.Restore.TargetDirectory = *RollbackRestoreTargetDirectory
+		}
+	}
+
+	if Audit.Parsed() {
+		if len(*AuditTargetDirectory) > 0 {
+			config.Backup.TargetDirectory = *AuditTargetDirectory
+		}
+	}
+
+	if ArchiveBinlogs.Parsed() {
+		if len(*ArchiveBinlogsStagingDirectory) > 0 {
+			config.Binlog.StagingDirectory = *ArchiveBinlogsStagingDirectory
+		}
+	}
+
+	if Upload.Parsed() {
+		if len(*UploadProgress) > 0 {
+			config.Progress.Format = *UploadProgress
+		}
+	}
+
+	err = config.CheckDirectories()
+
+	if err != nil {
+		log.Fatalln("Invalid configuration:", err)
+	}
+
+	err = Manager.Progress.Configure(config.Progress)
+
+	if err != nil {
+		log.Fatalln("Invalid progress configuration:", err)
+	}
+
+	//a restore plan runs no processes and must not write anything
+	if *RestorePlanOnly {
+		config.Process.LogDirectory = ""
+	}
+
+	err = Manager.Processes.Configure(config.Process, os.Args[1])
+
+	if err != nil {
+		log.Fatalln("Invalid process configuration:", err)
+	}
+
+	Manager.ApplyThrottleConfig(config.Throttle)
+	go reloadThrottleOnSignal(configFile)
+
+	//archive-binlogs stops mysqlbinlog itself and archives what was staged
+	if !ArchiveBinlogs.Parsed() {
+		go abortOnSignal()
+	}
+
+	return config
+}
+
+// abortOnSignal terminates the process groups of the running child processes on SIGINT or
+// SIGTERM, they run in their own groups and would otherwise outlive the wrapper
+func abortOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	received := <-signals
+	Manager.Processes.LogAbort("received " + received.String())
+	Manager.Processes.Abort()
+
+	if logFile := Manager.Processes.LogFile(); len(logFile) > 0 {
+		log.Println("Output of the child processes was logged to", logFile)
+	}
+
+	os.Exit(1)
+}
+
+// reloadThrottleOnSignal re-reads the throttle section of the config file on SIGHUP, so
+// bandwidth limits can be changed while a long transfer is running
+func reloadThrottleOnSignal(configFile string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	for range signals {
+		config := Manager.CreateNewConfig()
+		err := config.Load(configFile)
+
+		if err != nil {
+			log.Println("Failed to reload throttle settings:", err)
+			continue
+		}
+
+		Manager.ApplyThrottleConfig(config.Throttle)
+		log.Println("Throttle settings reloaded from", configFile)
+	}
+}
+
+// uploadBackup encrypts the backup unless that was already done by an earlier, interrupted run
+// and replicates it, destinations that already hold a copy are skipped
+func uploadBackup(replication *Manager.ReplicationManager, directory string, encryptionKey string) error {
+	if _, err := os.Stat(filepath.Join(directory, "backup.gz")); err == nil {
+		encrypt := Manager.Encrypt{}
+
+		err = encrypt.Encrypt(
+			filepath.Join(directory, "backup.gz"),
+			filepath.Join(directory, "backup.gz.enc"),
+			encryptionKey,
+			1024,
+			directory,
+		)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := replication.Replicate(directory)
+
+	return err
+}
+
+// runRestoreTest restores the local chain, or the remote one when a destination is given, into
+// the sandbox and checks it. It returns the exit code: 0 when the tables are fine, 1 when
+// problems were found and 2 when the test could not be run.
+func runRestoreTest(config *Manager.Config, destination Manager.Destination, chain Manager.RemoteChain, encryptionKey string, upto string, keep bool, asJson bool, force bool) int {
+	sandbox := filepath.Clean(config.RestoreTest.Directory)
+
+	//the sandbox is emptied before the restore
+	for _, directory := range []string{config.Backup.DataDirectory, config.Restore.TargetDirectory, config.Restore.SourceDirectory} {
+		if sandbox == filepath.Clean(directory) || strings.HasPrefix(filepath.Clean(directory)+"/", sandbox+"/") {
+			log.Println("The restore test directory", sandbox, "must not contain", directory)
+			return 2
+		}
+	}
+
+	dataDirectory, workDirectory := Manager.RestoreTestDirectories(sandbox)
+
+	restore, err := Manager.CreateRestoreManager(
+		config.Restore.SourceDirectory,
+		dataDirectory,
+		workDirectory,
+		config.MariaBackupBinary,
+		config.PositionFile,
+		config.MbStreamBinary,
+		config.GzipBlockSize,
+		config.GzipThreads,
+	)
+
+	if err != nil {
+		log.Printf("Failed to initialize restore")
+		return 2
+	}
+
+	if destination != nil {
+		restore.StreamFrom(destination, chain, encryptionKey)
+	}
+
+	restore.Pipeline(config.Restore.PipelineDepth)
+	restore.History(config.Restore.HistoryFile)
+
+	if config.Restore.LowDisk {
+		restore.LowDisk()
+	}
+
+	members, err := restore.Plan(upto)
+
+	if err != nil {
+		log.Println("Invalid backup chain:", err)
+		return 2
+	}
+
+	log.Println("Testing", len(members), "backups in", sandbox+":")
+	for i, backup := range members {
+		log.Println("  ", i, backup)
+	}
+
+	estimate, err := restore.EstimateDisk()
+
+	if !checkDiskSpace(estimate, err, force) {
+		return 2
+	}
+
+	test, err := Manager.CreateRestoreTest(restore, config.RestoreTest, config.Binlog.MariadbdBinary, keep)
+
+	if err != nil {
+		log.Println("Failed to initialize restore test:", err)
+		return 2
+	}
+
+	monitor := Manager.WatchDiskSpace(estimate.Directories(), config.Disk, force)
+	report, err := test.Run()
+	monitor.Stop()
+
+	if err != nil {
+		log.Println("Restore test has failed:", err)
+		return 2
+	}
+
+	if asJson {
+		payload, _ := json.Marshal(report)
+		fmt.Println(string(payload))
+	} else {
+		fmt.Printf("%v: %d backups restored, %d tables, %d checked, %d rows counted, %d problems\n", report.Backup, report.Backups, report.Tables, report.Checked, report.Rows, len(report.Problems))
+
+		if !report.Compared {
+			fmt.Println("  no table statistics were recorded at backup time, the tables were only checked")
+		}
+
+		for _, problem := range report.Problems {
+			fmt.Printf("  %-17s %v: %v\n", problem.Kind, problem.Table, problem.Detail)
+		}
+	}
+
+	if len(report.Problems) > 0 {
+		return 1
+	}
+
+	return 0
+}
+
+// checkDiskSpace logs the estimated disk usage and reports whether the run may start, with
+// force a shortage or a failed estimate is only a warning
+func checkDiskSpace(estimate Manager.DiskEstimate, err error, force bool) bool {
+	if err != nil {
+		log.Println("Estimating disk space has failed:", err)
+		return force
+	}
+
+	if estimate.Fits() {
+		log.Println("Disk space:", estimate)
+		return true
+	}
+
+	if force {
+		log.Println("Warning: disk space may not suffice, continuing because of -force:", estimate)
+		return true
+	}
+
+	log.Println("Not enough disk space, use -force to start anyway:", estimate)
+
+	return false
+}
+
+// restorePointInTime converts the -latest, -at and -restore-date flags into the time the
+// restored backup chain has to end at or before
+func restorePointInTime() (time.Time, error) {
+	given := 0
+
+	for _, set := range []bool{*RestoreLatest, len(*RestoreAt) > 0, len(*RestoreDate) > 0} {
+		if set {
+			given++
+		}
+	}
+
+	if given == 0 && len(*RestoreStopDatetime) > 0 {
+		//the newest chain before the stop time, the binlogs cover the rest
+		return time.ParseInLocation(Manager.StopDatetimeFormat, *RestoreStopDatetime, time.Local)
+	}
+
+	if given != 1 {
+		return time.Time{}, errors.New("exactly one of -latest, -at or -restore-date is required")
+	}
+
+	if *RestoreLatest {
+		return time.Now(), nil
+	}
+
+	if len(*RestoreAt) > 0 {
+		return time.Parse(time.RFC3339, *RestoreAt)
+	}
+
+	date, err := time.ParseInLocation("2006-01-02", *RestoreDate, time.Local)
+
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return date.AddDate(0, 0, 1).Add(-time.Second), nil
+}
+
+// findRemoteChain selects the destination and the chain ending at or before at in the prefix,
+// which defaults to this host, applied up to upto
+func findRemoteChain(config *Manager.Config, name string, prefix string, at time.Time, upto string) (Manager.Destination, Manager.RemoteChain, error) {
+	destination, err := selectDestination(config, name)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(prefix) == 0 {
+		prefix = Manager.GenerateHostPrefix()
+	}
+
+	backups, err := Manager.ReadCatalogPrefix(destination, strings.TrimSuffix(prefix, "/")+"/")
+
+	if err != nil {
+		return nil, nil, errors.New(fmt.Sprintf("listing backups in %v has failed, %v", destination.Name(), err))
+	}
+
+	chain, err := Manager.FindChain(Manager.BuildChains(backups), at)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	chain, err = Manager.ChainUpTo(chain, upto)
+
+	return destination, chain, err
+}
+
+func createReplicationManager(config *Manager.Config) (*Manager.ReplicationManager, error) {
+	destinations, err := Manager.CreateDestinations(config.DestinationConfigs())
+
+	if err != nil {
+		return nil, err
+	}
+
+	return Manager.CreateReplicationManager(destinations, config.MinSuccessfulDestinations)
+}
+
+// filterDestinations returns the destination with the given name or all of them when the name is empty
+func filterDestinations(config *Manager.Config, name string) ([]Manager.Destination, error) {
+	configs := make([]Manager.DestinationConfig, 0)
+
+	for _, destination := range config.DestinationConfigs() {
+		if len(name) == 0 || destination.Name == name {
+			configs = append(configs, destination)
+		}
+	}
+
+	if len(configs) == 0 && len(name) > 0 {
+		return nil, errors.New("no destination is configured with the name: " + name)
+	}
+
+	if len(configs) == 0 {
+		return nil, errors.New("no destinations are configured")
+	}
+
+	return Manager.CreateDestinations(configs)
+}
+
+// createPointInTimeRecovery replays binlogs from the binlog directory or, without one, from the
+// archive below prefix of the configured binlog destination, which defaults to this host
+func createPointInTimeRecovery(config *Manager.Config, prefix string) (*Manager.PointInTimeRecovery, error) {
+	var destination Manager.Destination
+
+	if len(config.Binlog.Directory) == 0 {
+		var err error
+		destination, err = selectDestination(config, config.Binlog.Destination)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	archive, err := Manager.CreateBinlogArchive(destination, config.Binlog.Directory, prefix, *RestoreEncryptionKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return Manager.CreatePointInTimeRecovery(
+		archive,
+		config.Binlog.MysqlBinlogBinary,
+		config.Binlog.MysqlBinary,
+		config.Binlog.MariadbdBinary,
+		config.Binlog.ServerOptions,
+		config.Binlog.ClientOptions,
+		config.Restore.WorkDirectory,
+	)
+}
+
+// selectDestination returns the destination with the given name or the first one when the name is empty
+func selectDestination(config *Manager.Config, name string) (Manager.Destination, error) {
+	destinations, err := filterDestinations(config, name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return destinations[0], nil
 }